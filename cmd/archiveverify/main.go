@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/archiveverify"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveverify checks the revisions archived by the monitor against the
+// given dumps of the wiki, writing a JSON line to the report for each
+// revision missing from the archive, archived but absent from the dumps, or
+// archived with the wrong content, then one for the summary.
+func main() {
+	var (
+		archive  string
+		index    string
+		workers  int
+		out      string
+		wiki     string
+		bots     bool
+		progress time.Duration
+	)
+
+	flag.StringVar(&archive, "archive", "archive", "The folder revisions were archived to")
+	flag.StringVar(&index, "index", "", "The index of a multistream .bz2 dump, to read its streams in parallel")
+	flag.IntVar(&workers, "workers", 0, "How many streams of a multistream dump to read at once (0 for one per CPU)")
+	flag.StringVar(&wiki, "wiki", "en", "The wiki the dumps were taken from")
+	flag.BoolVar(&bots, "bots", false, "Look up which unarchived revisions were made by bots, rather than counting them all as missing")
+	flag.StringVar(&out, "out", "", "The file to write the report to (empty for stdout)")
+	flag.DurationVar(&progress, "progress", 10*time.Second, "How often to report progress (0 to never)")
+	flag.Parse()
+
+	logger := logrus.New()
+	if flag.NArg() == 0 {
+		logger.Fatal("No dumps given to verify the archive against")
+	}
+	if index != "" && flag.NArg() > 1 {
+		logger.Fatal("An index can only be given for a single dump")
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not create report")
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+	defer buffered.Flush()
+	encoder := json.NewEncoder(buffered)
+
+	archiver := monitor.NewFileArchiver(logger, archive)
+	verifier, err := archiveverify.NewVerifier(archiver, wiki, func(f archiveverify.Finding) {
+		encoder.Encode(f)
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("Could not list archived revisions")
+	}
+	if bots {
+		httpClient := http.Client{
+			Timeout: time.Second * 10,
+		}
+		verifier.SkipBots(users.NewCachedUserFetcher(users.NewUserFetcher(logger, httpClient), 100000, time.Hour))
+	}
+
+	for _, path := range flag.Args() {
+		logger.WithField("dump", path).Info("Verifying archive")
+		if index != "" {
+			err = readParallel(logger, path, index, workers, verifier, progress)
+		} else {
+			err = readSequential(logger, path, verifier, progress)
+		}
+		if err != nil {
+			logger.WithError(err).WithField("dump", path).Fatal("Could not read dump")
+		}
+	}
+
+	summary := verifier.Finish()
+	encoder.Encode(struct {
+		Kind string `json:"kind"`
+		archiveverify.Summary
+	}{"summary", summary})
+
+	logger.WithFields(logrus.Fields{
+		"expected":   summary.Expected,
+		"matched":    summary.Matched,
+		"missing":    summary.Missing,
+		"bots":       summary.Bots,
+		"absent":     summary.Absent,
+		"mismatched": summary.Mismatched,
+		"unverified": summary.Unverified,
+	}).Info("Finished verifying archive")
+}
+
+// report logs progress every interval until stop is closed
+func report(logger *logrus.Logger, meter *dump.Meter, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	go meter.Report(interval, stop, func(p dump.Progress) {
+		fields := logrus.Fields{
+			"pages":       p.Pages,
+			"revisions":   p.Revisions,
+			"revisions/s": int64(p.RevisionsPerSecond()),
+			"MB/s":        fmt.Sprintf("%.1f", p.BytesPerSecond()/1e6),
+		}
+		if p.Total > 0 {
+			fields["percent"] = fmt.Sprintf("%.1f", p.Fraction()*100)
+			fields["remaining"] = p.Remaining().Round(time.Second)
+		}
+		logger.WithFields(fields).Info("Reading dump")
+	})
+}
+
+func readSequential(logger *logrus.Logger, path string, v *archiveverify.Verifier, interval time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	meter := dump.NewMeter(info.Size())
+	file, err := dump.Open(path, meter)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := dump.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	report(logger, meter, interval, stop)
+
+	var page *dump.Page
+	for {
+		rev, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var pages int64
+		if rev.Page != page {
+			page = rev.Page
+			pages = 1
+		}
+		meter.Count(pages, 1)
+		v.Check(rev)
+	}
+}
+
+func readParallel(logger *logrus.Logger, path, index string, workers int, v *archiveverify.Verifier, interval time.Duration) error {
+	indexFile, err := dump.Open(index, nil)
+	if err != nil {
+		return err
+	}
+	offsets, err := dump.Streams(indexFile)
+	indexFile.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	meter := dump.NewMeter(info.Size())
+	stop := make(chan struct{})
+	defer close(stop)
+	report(logger, meter, interval, stop)
+
+	return dump.ReadStreams(f, info.Size(), offsets, dump.StreamOptions{
+		Workers: workers,
+		Meter:   meter,
+	}, v.Check)
+}
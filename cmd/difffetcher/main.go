@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/difffetcher"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/wikidata"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		natsurl   string
+		rate      float64
+		cachesize int
+		cachedir  string
+		minage    time.Duration
+		labels    string
+	)
+
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.Float64Var(&rate, "rate", 10, "The most diffs to fetch per second, shared by recent changes and requests (0 for no limit)")
+	flag.IntVar(&cachesize, "cachesize", diffs.DefaultCacheOptions.Size, "How many fetched diffs to keep in memory")
+	flag.StringVar(&cachedir, "cachedir", "", "A directory to cache fetched diffs in (empty to cache in memory only)")
+	flag.DurationVar(&minage, "minage", diffs.DefaultDelayOptions.MinAge, "How old a recent change must be before its diff is fetched")
+	flag.StringVar(&labels, "labels", "", "The language to resolve the labels of entities in Wikidata diffs in (empty to leave them unresolved)")
+	flag.Parse()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	logger := logrus.New()
+	logger.Info("Starting diff fetcher")
+
+	natsconn, err := nats.Connect(natsurl)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not connect to nats")
+	}
+
+	httpClient := http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	limiter := wiki.NewRateLimiter(wiki.RateInterval(rate))
+	fetcher, err := diffs.NewCachingDiffFetcher(logger, diffs.NewRateLimitedDiffFetcher(diffs.NewDiffFetcher(logger, httpClient), limiter), diffs.CacheOptions{
+		Size: cachesize,
+		Dir:  cachedir,
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("Could not open diff cache")
+	}
+
+	queueOptions := diffs.DefaultQueueOptions
+	queueOptions.Priority = diffs.NewAccountPriority(users.NewCachedUserFetcher(users.NewRateLimitedUserFetcher(users.NewUserFetcher(logger, httpClient), limiter), 100000, time.Hour), diffs.DefaultNewAccountOptions, diffs.PatrolPriority)
+	delayOptions := diffs.DefaultDelayOptions
+	delayOptions.MinAge = minage
+	queuer := diffs.NewDelayedDiffQueuer(logger, diffs.NewPriorityDiffQueuer(logger, fetcher, queueOptions), delayOptions)
+
+	service := difffetcher.NewDiffService(natsconn, fetcher, queuer, logger)
+	if labels != "" {
+		service.ResolveLabels(wikidata.NewCachedLabelLookup(wikidata.NewRateLimitedLabelLookup(wikidata.NewLabelLookup(logger, httpClient, labels), limiter), 100000, 24*time.Hour))
+	}
+	service.Serve()
+
+	done := make(chan struct{})
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-interrupt:
+			log.Println("interrupt")
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/dumpimport"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/sirupsen/logrus"
+)
+
+// dumpimport archives the history in the given XML dumps, which may be
+// compressed, as the monitor would have had it been running
+func main() {
+	var (
+		archive       string
+		wiki          string
+		snapshotevery int
+		progress      time.Duration
+	)
+
+	flag.StringVar(&archive, "archive", "archive", "The folder to archive revisions to")
+	flag.StringVar(&wiki, "wiki", "en", "The wiki the dumps were taken from")
+	flag.IntVar(&snapshotevery, "snapshotevery", dumpimport.DefaultOptions.SnapshotEvery, "Snapshot the full content of every nth revision of a page (0 for only the first)")
+	flag.DurationVar(&progress, "progress", 10*time.Second, "How often to report progress (0 to never)")
+	flag.Parse()
+
+	logger := logrus.New()
+	if flag.NArg() == 0 {
+		logger.Fatal("No dumps given to import")
+	}
+
+	err := os.MkdirAll(archive, 0755)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not create archive")
+	}
+
+	// Every revision archived is logged at info level
+	archiveLogger := logrus.New()
+	archiveLogger.SetLevel(logrus.WarnLevel)
+	archiver := monitor.NewFileArchiver(archiveLogger, archive)
+
+	importer := dumpimport.NewImporter(archiver, wiki, dumpimport.Options{
+		SnapshotEvery: snapshotevery,
+	})
+	for _, path := range flag.Args() {
+		logger.WithField("dump", path).Info("Importing dump")
+		err := importDump(logger, path, importer, progress)
+		if err != nil {
+			logger.WithError(err).WithField("dump", path).Fatal("Could not import dump")
+		}
+	}
+
+	stats := importer.Stats()
+	logger.WithFields(logrus.Fields{
+		"pages":     stats.Pages,
+		"revisions": stats.Revisions,
+		"archived":  stats.Archived,
+		"snapshots": stats.Snapshots,
+		"skipped":   stats.Skipped,
+	}).Info("Finished importing")
+}
+
+func importDump(logger *logrus.Logger, path string, importer *dumpimport.Importer, interval time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	meter := dump.NewMeter(info.Size())
+	file, err := dump.Open(path, meter)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := dump.NewReader(file)
+	if err != nil {
+		return err
+	}
+	logger.WithField("wiki", reader.SiteInfo().DBName).Info("Reading dump")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if interval > 0 {
+		go meter.Report(interval, stop, func(p dump.Progress) {
+			logger.WithFields(logrus.Fields{
+				"pages":       p.Pages,
+				"revisions":   p.Revisions,
+				"revisions/s": int64(p.RevisionsPerSecond()),
+				"percent":     fmt.Sprintf("%.1f", p.Fraction()*100),
+				"remaining":   p.Remaining().Round(time.Second),
+			}).Info("Importing dump")
+		})
+	}
+
+	var page *dump.Page
+	for {
+		rev, err := reader.Next()
+		if err == io.EOF {
+			return importer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		var pages int64
+		if rev.Page != page {
+			page = rev.Page
+			pages = 1
+		}
+		meter.Count(pages, 1)
+
+		err = importer.Add(rev)
+		if err != nil {
+			return err
+		}
+	}
+}
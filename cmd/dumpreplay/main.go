@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/dumpreplay"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorsse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventnormalizer"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// dumpreplay publishes the revisions of the given XML dumps to nats as recent
+// changes, in the order they were made
+func main() {
+	var (
+		natsurl string
+		format  string
+		subj    string
+		speed   float64
+		since   string
+		until   string
+	)
+
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.StringVar(&format, "format", "sse", "The format to publish recent changes in: sse, as forwarded from EventStreams, or normalized")
+	flag.StringVar(&subj, "subj", "", "The nats subject to publish to (defaults to the subject of the format)")
+	flag.Float64Var(&speed, "speed", 1, "How many times faster than real time to replay (0 for as fast as possible)")
+	flag.StringVar(&since, "since", "", "The RFC3339 time to replay revisions from (empty for the first)")
+	flag.StringVar(&until, "until", "", "The RFC3339 time to replay revisions until (empty for the last)")
+	flag.Parse()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	logger := logrus.New()
+	logger.Info("Starting dump replay")
+
+	if flag.NArg() == 0 {
+		logger.Fatal("No dumps given to replay")
+	}
+
+	switch format {
+	case "sse":
+		if subj == "" {
+			subj = monitorsse.DefaultForwardSubj
+		}
+	case "normalized":
+		if subj == "" {
+			subj = rceventnormalizer.DefaultNormalizedSubj
+		}
+	default:
+		logger.WithField("format", format).Fatal("Unknown format")
+	}
+
+	o := dumpreplay.Options{}
+	var err error
+	if since != "" {
+		o.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not parse since")
+		}
+	}
+	if until != "" {
+		o.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not parse until")
+		}
+	}
+
+	collector := dumpreplay.NewCollector(o)
+	for _, path := range flag.Args() {
+		logger.WithField("dump", path).Info("Reading dump")
+		err := read(path, collector)
+		if err != nil {
+			logger.WithError(err).WithField("dump", path).Fatal("Could not read dump")
+		}
+	}
+	events := collector.Events()
+
+	natsconn, err := nats.Connect(natsurl)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not connect to nats")
+	}
+	defer natsconn.Close()
+
+	logger.WithFields(logrus.Fields{
+		"events": len(events),
+		"subj":   subj,
+		"speed":  speed,
+	}).Info("Replaying dump")
+
+	published := 0
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- dumpreplay.Replay(events, speed, stop, func(rc sse.RecentChange) error {
+			var data []byte
+			var err error
+			if format == "normalized" {
+				normalized := rc.Normalize()
+				normalized.Source = recentchanges.SourceDump
+				data, err = json.Marshal(normalized)
+			} else {
+				data, err = json.Marshal(rc)
+			}
+			if err != nil {
+				return err
+			}
+
+			published++
+			return natsconn.Publish(subj, data)
+		})
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			logger.WithError(err).Error("Could not replay dump")
+		}
+	case <-interrupt:
+		close(stop)
+		<-done
+		logger.Info("interrupt")
+	}
+
+	err = natsconn.Flush()
+	if err != nil {
+		logger.WithError(err).Error("Could not flush nats")
+	}
+	logger.WithField("published", published).Info("Finished replaying dump")
+}
+
+func read(path string, collector *dumpreplay.Collector) error {
+	file, err := dump.Open(path, nil)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := dump.NewReader(file)
+	if err != nil {
+		return err
+	}
+	return collector.Read(reader)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"log"
 	"net/http"
@@ -14,10 +15,41 @@ import (
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	var (
+		deadline  time.Duration
+		overflow  string
+		queuedir  string
+		cachesize int
+		cachedir  string
+
+		minage      time.Duration
+		retrydelay  time.Duration
+		maxretries  int
+		metricsaddr string
+
+		snapshotevery int
+		snapshotnew   bool
+		userrate      float64
+	)
+
+	flag.DurationVar(&deadline, "deadline", 0, "How long a diff may wait to be fetched before it is dropped (0 waits forever)")
+	flag.StringVar(&overflow, "overflow", "block", "What to do when the diff queue is full: block, dropnewest or droplowest")
+	flag.StringVar(&queuedir, "queuedir", "", "A directory to persist queued diffs in across restarts (empty to keep them in memory)")
+	flag.IntVar(&cachesize, "cachesize", diffs.DefaultCacheOptions.Size, "How many fetched diffs to keep in memory")
+	flag.StringVar(&cachedir, "cachedir", "", "A directory to cache fetched diffs in, shared with other processes (empty to cache in memory only)")
+	flag.DurationVar(&minage, "minage", diffs.DefaultDelayOptions.MinAge, "How old a recent change must be before its diff is fetched")
+	flag.DurationVar(&retrydelay, "retrydelay", diffs.DefaultDelayOptions.RetryDelay, "How long to wait before re-fetching a revision the API does not know about yet")
+	flag.IntVar(&maxretries, "maxretries", diffs.DefaultDelayOptions.MaxRetries, "How many times to re-fetch a revision the API does not know about yet")
+	flag.StringVar(&metricsaddr, "metricsaddr", "", "The address to serve expvar metrics on (empty to disable)")
+	flag.IntVar(&snapshotevery, "snapshotevery", 0, "Archive the full content of every Nth revision of each page (0 to disable)")
+	flag.BoolVar(&snapshotnew, "snapshotnew", false, "Archive the full content of new pages")
+	flag.Float64Var(&userrate, "userrate", 10, "The most account lookups to make per second when ranking diffs (0 for no limit)")
 	flag.Parse()
 	log.SetFlags(0)
 
@@ -27,13 +59,54 @@ func main() {
 	logger := logrus.New()
 	logger.Info("Starting monitor")
 
+	if metricsaddr != "" {
+		go func() {
+			err := http.ListenAndServe(metricsaddr, expvar.Handler())
+			if err != nil {
+				logger.WithError(err).Error("Could not serve metrics")
+			}
+		}()
+	}
+
 	httpClient := http.Client{
 		Timeout: time.Second * 10,
 	}
 
 	diffParser := diffs.NewDiffParser(logger)
-	diffFetcher := diffs.NewDiffFetcher(logger, httpClient)
-	diffQueuer := diffs.NewDiffQueuer(logger, diffFetcher)
+	diffFetcher, err := diffs.NewCachingDiffFetcher(logger, diffs.NewDiffFetcher(logger, httpClient), diffs.CacheOptions{
+		Size: cachesize,
+		Dir:  cachedir,
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("Could not open diff cache")
+	}
+	queueOptions := diffs.DefaultQueueOptions
+	queueOptions.Priority = diffs.NewAccountPriority(users.NewCachedUserFetcher(users.NewRateLimitedUserFetcher(users.NewUserFetcher(logger, httpClient), wiki.NewRateLimiter(wiki.RateInterval(userrate))), 100000, time.Hour), diffs.DefaultNewAccountOptions, diffs.PatrolPriority)
+	queueOptions.Deadline = deadline
+	switch overflow {
+	case "block":
+		queueOptions.Overflow = diffs.OverflowBlock
+	case "dropnewest":
+		queueOptions.Overflow = diffs.OverflowDropNewest
+	case "droplowest":
+		queueOptions.Overflow = diffs.OverflowDropLowest
+	default:
+		logger.WithField("overflow", overflow).Fatal("Unknown overflow policy")
+	}
+	diffQueuer := diffs.NewPriorityDiffQueuer(logger, diffFetcher, queueOptions)
+	diffQueuer = diffs.NewDelayedDiffQueuer(logger, diffQueuer, diffs.DelayOptions{
+		MinAge:     minage,
+		RetryDelay: retrydelay,
+		MaxRetries: maxretries,
+	})
+	if queuedir != "" {
+		persistentQueuer, err := diffs.NewPersistentDiffQueuer(logger, diffQueuer, queuedir)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not open diff queue")
+		}
+		defer persistentQueuer.Close()
+		diffQueuer = persistentQueuer
+	}
 
 	client := wiki.NewSSEClient()
 	streamListener := sse.NewListener(client, logger)
@@ -41,6 +114,12 @@ func main() {
 	archiver := monitor.NewFileArchiver(logger, "archive")
 
 	m := monitor.NewMonitor(streamListener, diffQueuer, diffParser, archiver, logger)
+	if snapshotevery > 0 || snapshotnew {
+		m.EnableSnapshots(revisions.NewRevisionFetcher(logger, httpClient), monitor.SnapshotOptions{
+			Every:    snapshotevery,
+			NewPages: snapshotnew,
+		})
+	}
 	m.Start(recentchanges.ListenOptions{
 		Hidebots: true,
 		Wikis:    []string{"en"},
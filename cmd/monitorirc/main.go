@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"net"
 	"strings"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorirc"
@@ -20,6 +22,12 @@ func main() {
 		name     string
 		hidebots bool
 		wikis    string
+
+		addr        string
+		useTLS      bool
+		saslUser    string
+		saslPass    string
+		maxChannels int
 	)
 
 	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
@@ -29,16 +37,35 @@ func main() {
 	flag.StringVar(&name, "name", "Full Name", "the irc full name")
 	flag.BoolVar(&hidebots, "hidebots", true, "Whether to hide / ignore bot edits")
 	flag.StringVar(&wikis, "wikis", "en", "A comma-delimited list of wikis to listen to")
+	flag.StringVar(&addr, "addr", irc.DefaultAddr, "the irc server address")
+	flag.BoolVar(&useTLS, "tls", false, "Whether to connect to the irc server using tls")
+	flag.StringVar(&saslUser, "sasluser", "", "the account to authenticate as using sasl plain (empty to disable)")
+	flag.StringVar(&saslPass, "saslpass", "", "the sasl plain password")
+	flag.IntVar(&maxChannels, "maxchannels", 0, "the maximum number of channels per connection (0 for no limit)")
 	flag.Parse()
 
 	logger := logrus.New()
 	logger.Info("Starting wikimedia irc monitor")
 
+	var tlsConfig *tls.Config
+	if useTLS {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not parse irc server address")
+		}
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
 	client := irc.NewListener(irc.Options{
-		Nick: nick,
-		Pass: pass,
-		User: user,
-		Name: name,
+		Nick:        nick,
+		Pass:        pass,
+		User:        user,
+		Name:        name,
+		Addr:        addr,
+		TLS:         tlsConfig,
+		SASLUser:    saslUser,
+		SASLPass:    saslPass,
+		MaxChannels: maxChannels,
 	}, logger)
 
 	natsconn, err := nats.Connect(natsurl)
@@ -52,5 +79,8 @@ func main() {
 	}
 
 	forward := monitorirc.NewForwarder(client, natsconn, logger)
-	forward.Forward(lo, monitorirc.DefaultForwardSubj)
+	err = forward.Forward(lo, monitorirc.DefaultForwardSubj)
+	if err != nil {
+		logger.WithError(err).Fatal("Stopped listening")
+	}
 }
@@ -8,7 +8,9 @@ import (
 	"strings"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorsse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
 	nats "github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 )
@@ -41,7 +43,8 @@ func main() {
 		Wikis:    strings.Split(wikis, ","),
 	}
 
-	forward := monitorsse.NewForwarder(natsconn, logger)
+	listener := sse.NewListener(wiki.NewSSEClient(), logger)
+	forward := monitorsse.NewForwarder(listener, natsconn, logger)
 	forward.Forward(lo, monitorsse.DefaultForwardSubj)
 
 	done := make(chan struct{})
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorudp"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/udp"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		natsurl  string
+		addr     string
+		hidebots bool
+		wikis    string
+		names    string
+	)
+
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.StringVar(&addr, "addr", udp.DefaultAddr, "the address to receive $wgRCFeeds datagrams on")
+	flag.BoolVar(&hidebots, "hidebots", true, "Whether to hide / ignore bot edits")
+	flag.StringVar(&wikis, "wikis", "", "A comma-delimited list of wikis to listen to (empty for all)")
+	flag.StringVar(&names, "names", "", "A comma-delimited list of host=name pairs naming the wikis of hosts (others are named after the first label of their host)")
+	flag.Parse()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	logger := logrus.New()
+	logger.Info("Starting mediawiki udp monitor")
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not listen for datagrams")
+	}
+	defer conn.Close()
+
+	natsconn, err := nats.Connect(natsurl)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not connect to nats")
+	}
+
+	lo := recentchanges.ListenOptions{
+		Hidebots: hidebots,
+	}
+	if wikis != "" {
+		lo.Wikis = strings.Split(wikis, ",")
+	}
+
+	hostNames := map[string]string{}
+	if names != "" {
+		for _, pair := range strings.Split(names, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || !wiki.ValidWiki(parts[1]) {
+				logger.WithField("names", names).Fatal("Names must be host=name pairs, with names of lowercase letters, digits and dashes")
+			}
+			hostNames[parts[0]] = parts[1]
+		}
+	}
+
+	forward := monitorudp.NewForwarder(udp.NewListener(conn, hostNames, logger), natsconn, logger)
+	forward.Forward(lo, monitorudp.DefaultForwardSubj)
+
+	done := make(chan struct{})
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-interrupt:
+			log.Println("interrupt")
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcbackfill"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		natsurl  string
+		subj     string
+		since    string
+		until    string
+		hidebots bool
+		wikis    string
+		idle     time.Duration
+	)
+
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.StringVar(&subj, "subj", rcbackfill.DefaultBackfillSubj, "the nats subject to publish replayed recent changes to")
+	flag.StringVar(&since, "since", "", "the RFC3339 time to replay the stream from (required)")
+	flag.StringVar(&until, "until", "", "the RFC3339 time to stop replaying at (defaults to now, i.e. until caught up)")
+	flag.BoolVar(&hidebots, "hidebots", true, "Whether to hide / ignore bot edits")
+	flag.StringVar(&wikis, "wikis", "en", "A comma-delimited list of wikis to listen to")
+	flag.DurationVar(&idle, "idle", rcbackfill.DefaultOptions.IdleTimeout, "How long to wait for an event before giving up")
+	flag.Parse()
+
+	logger := logrus.New()
+	logger.Info("Starting wikimedia sse backfill")
+
+	sinceTime, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not parse since")
+	}
+
+	untilTime := time.Now()
+	if until != "" {
+		untilTime, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not parse until")
+		}
+	}
+
+	natsconn, err := nats.Connect(natsurl)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not connect to nats")
+	}
+	defer natsconn.Close()
+
+	lo := recentchanges.ListenOptions{
+		Hidebots: hidebots,
+		Wikis:    strings.Split(wikis, ","),
+	}
+
+	backfiller := rcbackfill.NewBackfiller(wiki.NewSSEClient(), natsconn, logger, rcbackfill.Options{
+		IdleTimeout: idle,
+	})
+	backfillErr := backfiller.Backfill(lo, sinceTime, untilTime, subj)
+
+	// Whatever was replayed before a failure is still published
+	err = natsconn.Flush()
+	if err != nil {
+		logger.WithError(err).Error("Could not flush nats")
+	}
+
+	if backfillErr != nil {
+		logger.WithError(backfillErr).Fatal("Backfill failed")
+	}
+}
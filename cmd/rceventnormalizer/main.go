@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcbackfill"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventnormalizer"
 	nats "github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
@@ -13,10 +14,12 @@ import (
 
 func main() {
 	var (
-		natsurl string
+		natsurl      string
+		backfillsubj string
 	)
 
 	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.StringVar(&backfillsubj, "backfillsubj", rcbackfill.DefaultBackfillSubj, "the nats subject replayed sse data is published to (empty to ignore)")
 	flag.Parse()
 
 	interrupt := make(chan os.Signal, 1)
@@ -32,6 +35,9 @@ func main() {
 
 	normalizer := rceventnormalizer.NewNormalizer(natsconn, logger)
 	normalizer.Normalize()
+	if backfillsubj != "" {
+		normalizer.NormalizeSSE(backfillsubj)
+	}
 
 	done := make(chan struct{})
 
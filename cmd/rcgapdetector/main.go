@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcgapdetector"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		natsurl string
+		rate    float64
+		workers int
+	)
+
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.Float64Var(&rate, "rate", 10, "The most backfill requests to make per second (0 for no limit)")
+	flag.IntVar(&workers, "workers", rcgapdetector.DefaultOptions.Workers, "How many gaps to backfill at once")
+	flag.Parse()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	logger := logrus.New()
+	logger.Info("Starting rc gap detector")
+
+	natsconn, err := nats.Connect(natsurl)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not connect to nats")
+	}
+
+	httpClient := http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	fetcher := revisions.NewRateLimitedRevisionFetcher(revisions.NewRevisionFetcher(logger, httpClient), wiki.NewRateLimiter(wiki.RateInterval(rate)))
+	detector := rcgapdetector.NewGapDetector(natsconn, fetcher, logger, rcgapdetector.Options{
+		Workers: workers,
+	})
+	detector.Detect()
+
+	done := make(chan struct{})
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-interrupt:
+			log.Println("interrupt")
+			return
+		}
+	}
+}
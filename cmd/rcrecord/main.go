@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcrecording"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
+	wikisse "github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	nats "github.com/nats-io/nats.go"
+	"github.com/r3labs/sse"
+	"github.com/sirupsen/logrus"
+)
+
+// rcrecord records raw EventStreams events, IRC lines, or the messages of a
+// nats subject, for rcreplay to play back
+func main() {
+	var (
+		source   string
+		out      string
+		max      int
+		duration time.Duration
+
+		natsurl string
+		subj    string
+
+		addr  string
+		nick  string
+		wikis string
+	)
+	flag.StringVar(&source, "source", rcrecording.SourceSSE, "What to record: sse, irc or nats")
+	flag.StringVar(&out, "out", "", "The file to record to, compressed if it ends in .gz (defaults to a timestamped file)")
+	flag.IntVar(&max, "max", 0, "The number of events to record (0 for no limit)")
+	flag.DurationVar(&duration, "duration", 0, "How long to record for (0 for no limit)")
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.StringVar(&subj, "subj", "", "The nats subject to record (required for nats)")
+	flag.StringVar(&addr, "addr", irc.DefaultAddr, "the irc server address")
+	flag.StringVar(&nick, "nick", "just_here_for_fun", "the irc nick")
+	flag.StringVar(&wikis, "wikis", "en", "A comma-delimited list of wikis to record the irc channels of")
+	flag.Parse()
+	log.SetFlags(0)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	logger := logrus.New()
+
+	if out == "" {
+		out = source + "-" + time.Now().UTC().Format("20060102T150405Z") + ".jsonl.gz"
+	}
+	w, err := rcrecording.Create(out)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not create recording")
+	}
+	defer w.Close()
+
+	logger.WithFields(logrus.Fields{
+		"source": source,
+		"out":    out,
+		"max":    max,
+	}).Info("Starting rcrecord")
+
+	done := make(chan struct{})
+	var once sync.Once
+	var mux sync.Mutex
+	recorded := 0
+	record := func(r rcrecording.Record) {
+		r.Time = time.Now().UTC()
+		err := w.Write(r)
+		if err != nil {
+			logger.WithError(err).Error("Could not write record")
+			return
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		recorded++
+		if max > 0 && recorded >= max {
+			once.Do(func() { close(done) })
+		}
+	}
+
+	switch source {
+	case rcrecording.SourceSSE:
+		client := wiki.NewSSEClient()
+		go client.Subscribe(wikisse.DefaultURL, func(msg *sse.Event) {
+			if len(msg.Data) == 0 {
+				return
+			}
+			record(rcrecording.Record{
+				Source: rcrecording.SourceSSE,
+				ID:     string(msg.ID),
+				Data:   string(msg.Data),
+			})
+		})
+	case rcrecording.SourceIRC:
+		listener := irc.NewListener(irc.Options{
+			Nick: nick,
+			User: nick,
+			Name: nick,
+			Addr: addr,
+			Raw: func(line string) {
+				channel := ""
+				if fields := strings.Fields(line); len(fields) > 2 {
+					channel = fields[2]
+				}
+				record(rcrecording.Record{
+					Source:  rcrecording.SourceIRC,
+					Subject: channel,
+					Data:    line,
+				})
+			},
+		}, logger)
+		go func() {
+			err := listener.Listen(recentchanges.ListenOptions{
+				Wikis: strings.Split(wikis, ","),
+			}, func(irc.RecentChange, error) {})
+			if err != nil {
+				logger.WithError(err).Error("Stopped listening to irc")
+			}
+		}()
+	case rcrecording.SourceNATS:
+		if subj == "" {
+			logger.Fatal("A subject is required to record nats")
+		}
+		natsconn, err := nats.Connect(natsurl)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not connect to nats")
+		}
+		defer natsconn.Close()
+
+		natsconn.Subscribe(subj, func(msg *nats.Msg) {
+			record(rcrecording.Record{
+				Source:  rcrecording.SourceNATS,
+				Subject: msg.Subject,
+				Data:    string(msg.Data),
+			})
+		})
+	default:
+		logger.WithField("source", source).Fatal("Unknown source")
+	}
+
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case <-flush.C:
+			w.Flush()
+		case <-done:
+			logger.WithField("recorded", max).Info("Recorded maximum events")
+			return
+		case <-timeout:
+			mux.Lock()
+			logger.WithField("recorded", recorded).Info("Finished recording")
+			mux.Unlock()
+			return
+		case <-interrupt:
+			log.Println("interrupt")
+			return
+		}
+	}
+}
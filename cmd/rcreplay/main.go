@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorirc"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorsse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcrecording"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	ircv3 "gopkg.in/irc.v3"
+)
+
+// rcreplay plays a recording made by rcrecord into nats, as the forwarders
+// would have published it, or into a local EventStreams or IRC server for
+// the listeners to connect to
+func main() {
+	var (
+		to      string
+		speed   float64
+		natsurl string
+		subj    string
+		addr    string
+		wait    int
+		timeout time.Duration
+	)
+	flag.StringVar(&to, "to", "nats", "Where to play the recording: nats, sse or irc")
+	flag.Float64Var(&speed, "speed", 1, "How many times faster than recorded to play (0 for as fast as possible)")
+	flag.StringVar(&natsurl, "natsurl", nats.DefaultURL, "the url used to connect to nats")
+	flag.StringVar(&subj, "subj", "", "The nats subject to publish to (defaults to the subject of each record)")
+	flag.StringVar(&addr, "addr", "", "The address to serve sse or irc on (defaults to :8080 and :6667)")
+	flag.IntVar(&wait, "wait", 1, "How many clients to wait for before playing to sse or irc")
+	flag.DurationVar(&timeout, "timeout", time.Minute, "How long to wait for clients")
+	flag.Parse()
+	log.SetFlags(0)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	logger := logrus.New()
+	if flag.NArg() != 1 {
+		logger.Fatal("A single recording to replay is required")
+	}
+
+	r, err := rcrecording.Open(flag.Arg(0))
+	if err != nil {
+		logger.WithError(err).Fatal("Could not open recording")
+	}
+	defer r.Close()
+
+	var play func(rcrecording.Record) error
+	switch to {
+	case "nats":
+		natsconn, err := nats.Connect(natsurl)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not connect to nats")
+		}
+		defer natsconn.Close()
+		defer natsconn.Flush()
+		play = natsPlayer(logger, natsconn, subj)
+	case "sse":
+		if addr == "" {
+			addr = ":8080"
+		}
+		server := wikitest.NewStreamServer()
+		defer server.Close()
+		go func() {
+			err := http.ListenAndServe(addr, server)
+			if err != nil {
+				logger.WithError(err).Fatal("Could not serve sse")
+			}
+		}()
+
+		logger.WithField("addr", addr).Info("Waiting for sse clients")
+		if !server.WaitForClients(wait, timeout) {
+			logger.Fatal("Timed out waiting for sse clients")
+		}
+		play = func(record rcrecording.Record) error {
+			if record.Source == rcrecording.SourceSSE {
+				server.Send(wikitest.StreamEvent{ID: record.ID, Data: record.Data})
+			}
+			return nil
+		}
+	case "irc":
+		if addr == "" {
+			addr = ":6667"
+		}
+		server, err := wikitest.NewIRCServer(addr)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not serve irc")
+		}
+		defer server.Close()
+
+		logger.WithField("addr", server.Addr()).Info("Waiting for irc clients")
+		if !server.WaitForJoin("", wait, timeout) {
+			logger.Fatal("Timed out waiting for irc clients")
+		}
+		play = func(record rcrecording.Record) error {
+			if record.Source == rcrecording.SourceIRC {
+				return server.Send(record.Data)
+			}
+			return nil
+		}
+	default:
+		logger.WithField("to", to).Fatal("Unknown destination")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"to":    to,
+		"speed": speed,
+	}).Info("Replaying recording")
+
+	played := 0
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- rcrecording.Play(r, speed, stop, func(record rcrecording.Record) error {
+			played++
+			return play(record)
+		})
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			logger.WithError(err).Error("Could not replay recording")
+		}
+	case <-interrupt:
+		close(stop)
+		<-done
+		log.Println("interrupt")
+	}
+	logger.WithField("played", played).Info("Finished replaying recording")
+}
+
+// natsPlayer publishes records as the forwarders and services they were
+// recorded from did, or to subj if set
+func natsPlayer(logger *logrus.Logger, natsconn *nats.Conn, subj string) func(rcrecording.Record) error {
+	publish := func(defaultSubj string, data []byte) error {
+		if subj != "" {
+			return natsconn.Publish(subj, data)
+		}
+		return natsconn.Publish(defaultSubj, data)
+	}
+
+	return func(record rcrecording.Record) error {
+		switch record.Source {
+		case rcrecording.SourceNATS:
+			return publish(record.Subject, []byte(record.Data))
+		case rcrecording.SourceSSE:
+			rc := sse.RecentChange{}
+			err := json.Unmarshal([]byte(record.Data), &rc)
+			if err != nil {
+				logger.WithError(err).Warn("Skipping invalid sse record")
+				return nil
+			}
+			data, err := json.Marshal(rc)
+			if err != nil {
+				return err
+			}
+			return publish(monitorsse.DefaultForwardSubj, data)
+		case rcrecording.SourceIRC:
+			m, err := ircv3.ParseMessage(record.Data)
+			if err != nil || len(m.Params) == 0 {
+				logger.WithField("line", record.Data).Warn("Skipping invalid irc record")
+				return nil
+			}
+			rc, err := irc.ParseMessage(m.Params[0], m.Trailing())
+			if err != nil {
+				// The forwarder only publishes recent changes
+				return nil
+			}
+			data, err := json.Marshal(rc)
+			if err != nil {
+				return err
+			}
+			return publish(monitorirc.DefaultForwardSubj, data)
+		}
+		return nil
+	}
+}
@@ -1,67 +1,247 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/xml"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"time"
 
-	"github.com/leebradley/wikiedit-monitor-fast/pkg/base36"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revhash"
+	"github.com/sirupsen/logrus"
 )
 
-type Revision struct {
-	ID   int    `xml:"id"`
-	Text Text   `xml:"text"`
-	Sha1 string `xml:"sha1"`
+// checker checks the text of revisions against their sha1
+type checker struct {
+	mux                sync.Mutex
+	good, bad, skipped int
 }
 
-type Text struct {
-	Deleted string `xml:"deleted,attr"`
-	Value   string `xml:",chardata"`
-}
+func (c *checker) check(rev dump.Revision) error {
+	// Deleted text and stub dumps leave nothing to hash
+	if rev.TextDeleted || rev.SHA1 == "" {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		c.skipped++
+		return nil
+	}
 
-type Page struct {
-	Title     string     `xml:"title"`
-	Revisions []Revision `xml:"revision"`
-	// ID string `xml:"revision>id"`
-	// Deleted string `xml:"revision>text>deleted,attr"`
+	// archiveverify compares the hash with revisions from the streams.
+	// Hashing is most of the work, so is done before taking the lock.
+	encoded := revhash.Sum([]byte(rev.Text))
+	good := revhash.Equal(rev.SHA1, encoded)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !good {
+		c.bad++
+		fmt.Printf("BAD  %d %s %s %s\n", rev.ID, rev.Page.Title, rev.SHA1, encoded)
+	} else {
+		c.good++
+		fmt.Printf("GOOD %d %s\n", rev.ID, rev.SHA1)
+	}
+	return nil
 }
 
+// xmldumpreader checks the text of every revision of an XML dump against its
+// sha1. The dump is read from the file given, which may be compressed, or
+// from stdin.
 func main() {
-	decoder := xml.NewDecoder(os.Stdin)
-	fmt.Println("STARTING")
+	var (
+		index    string
+		workers  int
+		page     string
+		progress time.Duration
+	)
+
+	flag.StringVar(&index, "index", "", "The index of a multistream .bz2 dump, to read its streams in parallel")
+	flag.IntVar(&workers, "workers", 0, "How many streams of a multistream dump to read at once (0 for one per CPU)")
+	flag.StringVar(&page, "page", "", "Only check the page with this title, found through the index")
+	flag.DurationVar(&progress, "progress", 10*time.Second, "How often to report progress (0 to never)")
+	flag.Parse()
+
+	logger := logrus.New()
+	c := &checker{}
+
+	var err error
+	switch {
+	case flag.NArg() == 0:
+		err = readSequential(logger, nil, c, progress)
+	case page != "":
+		err = readPage(logger, flag.Arg(0), index, page, c)
+	case index != "":
+		err = readParallel(logger, flag.Arg(0), index, workers, c, progress)
+	default:
+		var info os.FileInfo
+		info, err = os.Stat(flag.Arg(0))
+		if err != nil {
+			logger.WithError(err).Fatal("Could not open dump")
+		}
+
+		meter := dump.NewMeter(info.Size())
+		var file *dump.File
+		file, err = dump.Open(flag.Arg(0), meter)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not open dump")
+		}
+		defer file.Close()
+		err = readSequential(logger, &reading{file, meter}, c, progress)
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("Could not read dump")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"good":    c.good,
+		"bad":     c.bad,
+		"skipped": c.skipped,
+	}).Info("Finished reading dump")
+	if c.bad > 0 {
+		os.Exit(1)
+	}
+}
+
+// reading is a dump being read sequentially
+type reading struct {
+	r     io.Reader
+	meter *dump.Meter
+}
+
+// report logs progress every interval until stop is closed
+func report(logger *logrus.Logger, meter *dump.Meter, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	go meter.Report(interval, stop, func(p dump.Progress) {
+		fields := logrus.Fields{
+			"pages":       p.Pages,
+			"revisions":   p.Revisions,
+			"revisions/s": int64(p.RevisionsPerSecond()),
+			"MB/s":        fmt.Sprintf("%.1f", p.BytesPerSecond()/1e6),
+		}
+		if p.Total > 0 {
+			fields["percent"] = fmt.Sprintf("%.1f", p.Fraction()*100)
+			fields["remaining"] = p.Remaining().Round(time.Second)
+		}
+		logger.WithFields(fields).Info("Reading dump")
+	})
+}
+
+func readSequential(logger *logrus.Logger, in *reading, c *checker, interval time.Duration) error {
+	if in == nil {
+		meter := dump.NewMeter(0)
+		in = &reading{meter.Reader(os.Stdin), meter}
+	}
+
+	reader, err := dump.NewReader(in.r)
+	if err != nil {
+		return err
+	}
+	logger.WithField("wiki", reader.SiteInfo().DBName).Info("Reading dump")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	report(logger, in.meter, interval, stop)
 
+	var page *dump.Page
 	for {
-		// fmt.Println("TOKEN")
-		// Read tokens from the XML document in a stream.
-		t, _ := decoder.Token()
-		if t == nil {
-			break
+		rev, err := reader.Next()
+		if err == io.EOF {
+			return nil
 		}
-		// Inspect the type of the token just read.
-		switch se := t.(type) {
-		case xml.StartElement:
-			// If we just read a StartElement token
-			// ...and its name is "page"
-			if se.Name.Local == "page" {
-				var p Page
-				// decode a whole chunk of following XML into the
-				// variable p which is a Page (se above)
-				decoder.DecodeElement(&p, &se)
-
-				for _, rev := range p.Revisions {
-					hash := sha1.Sum([]byte(rev.Text.Value))
-					encoded := base36.EncodeBytes(hash[:])
-					// TODO: Instead of comparing with Wikimedia's hash
-					// I'll want to compare with my own hash for the stream revision
-					if rev.Sha1 != encoded {
-						fmt.Printf("BAD  %s %s\n", rev.Sha1, encoded)
-					} else {
-						fmt.Printf("GOOD %s\n", rev.Sha1)
-					}
-				}
-				// fmt.Printf("%+v\n", p)
-			}
+		if err != nil {
+			return err
 		}
+
+		var pages int64
+		if rev.Page != page {
+			page = rev.Page
+			pages = 1
+		}
+		in.meter.Count(pages, 1)
+		c.check(rev)
+	}
+}
+
+func readParallel(logger *logrus.Logger, path, index string, workers int, c *checker, interval time.Duration) error {
+	indexFile, err := dump.Open(index, nil)
+	if err != nil {
+		return err
+	}
+	offsets, err := dump.Streams(indexFile)
+	indexFile.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	siteInfo, err := dump.ReadSiteInfo(f, offsets)
+	if err != nil {
+		return err
+	}
+	logger.WithFields(logrus.Fields{
+		"wiki":    siteInfo.DBName,
+		"streams": len(offsets),
+	}).Info("Reading dump")
+
+	meter := dump.NewMeter(info.Size())
+	stop := make(chan struct{})
+	defer close(stop)
+	report(logger, meter, interval, stop)
+
+	return dump.ReadStreams(f, info.Size(), offsets, dump.StreamOptions{
+		Workers: workers,
+		Meter:   meter,
+	}, c.check)
+}
+
+func readPage(logger *logrus.Logger, path, index, title string, c *checker) error {
+	if index == "" {
+		return fmt.Errorf("Finding a page requires the index of the dump")
+	}
+
+	indexFile, err := dump.Open(index, nil)
+	if err != nil {
+		return err
+	}
+	entry, err := dump.LookupTitle(indexFile, title)
+	indexFile.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"page":   entry.PageID,
+		"offset": entry.Offset,
+	}).Info("Reading page")
+
+	revisions, err := dump.ReadPage(f, info.Size(), entry)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revisions {
+		c.check(rev)
 	}
+	return nil
 }
@@ -1,12 +1,12 @@
 module github.com/leebradley/wikiedit-monitor-fast
 
 require (
-	github.com/nats-io/nats-server/v2 v2.0.0 // indirect
+	github.com/nats-io/nats-server/v2 v2.0.0
 	github.com/nats-io/nats.go v1.8.1
 	github.com/r3labs/sse v0.0.0-20190530104643-3c23fe8c6bd2
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/crypto v0.0.0-20190621222207-cc06ce4a13d4 // indirect
-	golang.org/x/net v0.0.0-20190628185345-da137c7871d7 // indirect
+	golang.org/x/net v0.0.0-20190628185345-da137c7871d7
 	golang.org/x/sys v0.0.0-20190626221950-04f50cda93cb // indirect
 	golang.org/x/text v0.3.2 // indirect
 	golang.org/x/tools v0.0.0-20190628222527-fb37f6ba8261 // indirect
@@ -0,0 +1,252 @@
+// Package archiveverify checks the revisions archived from the recent change
+// streams against a dump of the wiki, finding what the streams missed, what
+// was since deleted, and what was archived wrongly
+package archiveverify
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revhash"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+)
+
+// Kind is the kind of a finding
+type Kind string
+
+const (
+	// KindMissing is a revision of the dump which was not archived
+	KindMissing Kind = "missing"
+
+	// KindBot is a revision of the dump which was not archived, but was made
+	// by an account in the bot group, whose edits the monitor hides
+	KindBot Kind = "bot"
+
+	// KindAbsent is an archived revision which is not in the dump, usually
+	// because it was deleted or suppressed since
+	KindAbsent Kind = "absent"
+
+	// KindMismatch is an archived revision whose reconstructed content does
+	// not match the hash in the dump
+	KindMismatch Kind = "mismatch"
+
+	// KindUnverified is an archived revision whose content could not be
+	// reconstructed to compare
+	KindUnverified Kind = "unverified"
+)
+
+// Finding is a revision which differs between the archive and the dump
+type Finding struct {
+	Kind      Kind   `json:"kind"`
+	Revision  int    `json:"revision"`
+	Page      int    `json:"page,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+
+	// Want is the hash in the dump, and Got the hash of the archived content
+	Want string `json:"want,omitempty"`
+	Got  string `json:"got,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Summary counts the revisions checked
+type Summary struct {
+	// Dumped is the number of revisions read from the dump, and Expected the
+	// number of those made while the archive was being recorded, other than
+	// those made by bots
+	Dumped   int `json:"dumped"`
+	Expected int `json:"expected"`
+	Archived int `json:"archived"`
+
+	Matched    int `json:"matched"`
+	Missing    int `json:"missing"`
+	Bots       int `json:"bots"`
+	Absent     int `json:"absent"`
+	Mismatched int `json:"mismatched"`
+	Unverified int `json:"unverified"`
+
+	// Unhashed is the number of archived revisions with no hash in the dump,
+	// such as those with deleted text
+	Unhashed int `json:"unhashed"`
+}
+
+// Verifier checks the revisions of a dump against an archive. Revision IDs
+// increase over time, so only the revisions of the dump between the first and
+// last archived revisions are expected to be archived, and only archived
+// revisions up to the last revision of the dump are expected in the dump.
+type Verifier struct {
+	archiver monitor.Archiver
+	report   func(Finding)
+	bots     users.UserFetcher
+	wiki     string
+
+	mux      sync.Mutex
+	archived map[int]bool // Whether each archived revision was in the dump
+	first    int
+	last     int
+	latest   int // The latest revision of the dump
+	summary  Summary
+}
+
+// NewVerifier creates a Verifier for the revisions of wiki in archiver,
+// passing each finding to report. report is called by one goroutine at a
+// time.
+func NewVerifier(archiver monitor.Archiver, wiki string, report func(Finding)) (*Verifier, error) {
+	revisions, err := archiver.Revisions(wiki)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verifier{
+		archiver: archiver,
+		wiki:     wiki,
+		report:   report,
+		archived: make(map[int]bool, len(revisions)),
+	}
+	for _, revision := range revisions {
+		v.archived[revision] = false
+	}
+	if len(revisions) > 0 {
+		v.first = revisions[0]
+		v.last = revisions[len(revisions)-1]
+	}
+	v.summary.Archived = len(revisions)
+	return v, nil
+}
+
+// SkipBots looks up the authors of the revisions of the dump which were not
+// archived, reporting those made by bots as KindBot rather than KindMissing.
+// Dumps don't record which edits were flagged as bot edits, so every edit of
+// an account in the bot group counts. lookup should be cached.
+func (v *Verifier) SkipBots(lookup users.UserFetcher) {
+	v.bots = lookup
+}
+
+// bot reports whether a revision was made by an account in the bot group
+func (v *Verifier) bot(rev dump.Revision) (bool, error) {
+	name := rev.Contributor.Username
+	if v.bots == nil || name == "" {
+		return false, nil
+	}
+
+	found, err := v.bots.Fetch(v.wiki, []string{name})
+	if err != nil {
+		return false, err
+	}
+	return found[name].IsBot(), nil
+}
+
+func finding(kind Kind, rev dump.Revision) Finding {
+	f := Finding{
+		Kind:     kind,
+		Revision: rev.ID,
+		Page:     rev.Page.ID,
+		Title:    rev.Page.Title,
+	}
+	if !rev.Timestamp.IsZero() {
+		f.Timestamp = rev.Timestamp.Format("2006-01-02T15:04:05Z")
+	}
+	return f
+}
+
+// Check checks a revision of the dump. It is safe to call from several
+// goroutines, such as those of dump.ReadStreams.
+func (v *Verifier) Check(rev dump.Revision) error {
+	v.mux.Lock()
+	v.summary.Dumped++
+	if rev.ID > v.latest {
+		v.latest = rev.ID
+	}
+	if v.summary.Archived == 0 || rev.ID < v.first || rev.ID > v.last {
+		v.mux.Unlock()
+		return nil
+	}
+
+	_, archived := v.archived[rev.ID]
+	if !archived {
+		v.mux.Unlock()
+		return v.missing(rev)
+	}
+	v.summary.Expected++
+	v.archived[rev.ID] = true
+	v.mux.Unlock()
+
+	if rev.SHA1 == "" {
+		v.mux.Lock()
+		v.summary.Unhashed++
+		v.mux.Unlock()
+		return nil
+	}
+
+	// Reconstructing is the slow part, so is done without holding the lock
+	content, err := v.archiver.Reconstruct(v.wiki, rev.ID)
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if err != nil {
+		f := finding(KindUnverified, rev)
+		f.Error = err.Error()
+		v.summary.Unverified++
+		v.report(f)
+		return nil
+	}
+
+	got := revhash.Sum(content)
+	if !revhash.Equal(rev.SHA1, got) {
+		f := finding(KindMismatch, rev)
+		f.Want = rev.SHA1
+		f.Got = got
+		v.summary.Mismatched++
+		v.report(f)
+		return nil
+	}
+	v.summary.Matched++
+	return nil
+}
+
+// missing reports a revision of the dump which was not archived
+func (v *Verifier) missing(rev dump.Revision) error {
+	// Looking up the author is slow, so is done without holding the lock
+	bot, err := v.bot(rev)
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if bot {
+		v.summary.Bots++
+		v.report(finding(KindBot, rev))
+		return nil
+	}
+
+	f := finding(KindMissing, rev)
+	if err != nil {
+		f.Error = err.Error()
+	}
+	v.summary.Expected++
+	v.summary.Missing++
+	v.report(f)
+	return nil
+}
+
+// Finish reports the archived revisions which were not in the dump, and
+// returns the summary. It must be called once the whole dump is checked.
+func (v *Verifier) Finish() Summary {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	absent := []int{}
+	for revision, seen := range v.archived {
+		if !seen && revision <= v.latest {
+			absent = append(absent, revision)
+		}
+	}
+	sort.Ints(absent)
+
+	for _, revision := range absent {
+		v.summary.Absent++
+		v.report(Finding{Kind: KindAbsent, Revision: revision})
+	}
+	return v.summary
+}
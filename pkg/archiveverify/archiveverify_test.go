@@ -0,0 +1,232 @@
+package archiveverify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revhash"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func archiveDiff(t *testing.T, archiver monitor.Archiver, from, to int, fromText, toText string) {
+	table := `<tr><td colspan="2" class="diff-lineno">Line 1:</td><td colspan="2" class="diff-lineno">Line 1:</td></tr>` +
+		`<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>` + fromText + `</div></td><td class="diff-marker">+</td><td class="diff-addedline"><div>` + toText + `</div></td></tr>`
+	data, err := json.Marshal(diffs.CompareResult{Compare: diffs.Compare{FromRevID: from, ToRevID: to, Body: table}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archiver.Archive("en", to, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func revisionXML(id int, text, sha1 string) string {
+	return fmt.Sprintf(`<revision><id>%d</id><timestamp>2020-01-01T00:00:%02dZ</timestamp><text>%s</text><sha1>%s</sha1></revision>`, id, id, text, sha1)
+}
+
+func TestVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+
+	// Matches, from a snapshot
+	archiveDiff(t, archiver, 9, 10, "page 9", "page 10")
+	archiver.Snapshot("en", 10, []byte("page 10"))
+	// Matches, reconstructed from the diff
+	archiveDiff(t, archiver, 10, 11, "page 10", "page 11")
+	// Archived with the wrong content
+	archiveDiff(t, archiver, 11, 12, "page 11", "page 12")
+	archiver.Snapshot("en", 12, []byte("page twelve"))
+	// Reconstructed from 13, which was not archived
+	archiveDiff(t, archiver, 13, 14, "page 13", "page 14")
+	// Deleted since
+	archiveDiff(t, archiver, 14, 15, "page 14", "page 15")
+	// Text deleted from the dump
+	archiveDiff(t, archiver, 15, 16, "page 15", "page 16")
+	// Made after the dump
+	archiveDiff(t, archiver, 16, 20, "page 16", "page 20")
+
+	revisions := []string{
+		// Made before the archive was recorded
+		revisionXML(5, "page 5", revhash.Sum([]byte("page 5"))),
+	}
+	for _, id := range []int{10, 11, 12, 13, 14} {
+		text := fmt.Sprintf("page %d", id)
+		revisions = append(revisions, revisionXML(id, text, revhash.Sum([]byte(text))))
+	}
+	revisions = append(revisions, revisionXML(16, "", ""))
+	in := "<mediawiki><page><title>Example</title><ns>0</ns><id>1</id>" + strings.Join(revisions, "") + "</page></mediawiki>"
+
+	findings := []Finding{}
+	v, err := NewVerifier(archiver, "en", func(f Finding) {
+		findings = append(findings, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := dump.NewReader(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		revision, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Check(revision)
+	}
+	summary := v.Finish()
+
+	if len(findings) != 4 {
+		t.Fatalf("got findings %+v, want 4", findings)
+	}
+
+	mismatch := findings[0]
+	wantMismatch := Finding{
+		Kind:      KindMismatch,
+		Revision:  12,
+		Page:      1,
+		Title:     "Example",
+		Timestamp: "2020-01-01T00:00:12Z",
+		Want:      revhash.Sum([]byte("page 12")),
+		Got:       revhash.Sum([]byte("page twelve")),
+	}
+	if mismatch != wantMismatch {
+		t.Errorf("got %+v, want %+v", mismatch, wantMismatch)
+	}
+
+	if findings[1].Kind != KindMissing || findings[1].Revision != 13 {
+		t.Errorf("got %+v, want 13 missing", findings[1])
+	}
+	if findings[2].Kind != KindUnverified || findings[2].Revision != 14 || findings[2].Error == "" {
+		t.Errorf("got %+v, want 14 unverified", findings[2])
+	}
+	if findings[3] != (Finding{Kind: KindAbsent, Revision: 15}) {
+		t.Errorf("got %+v, want 15 absent", findings[3])
+	}
+
+	wantSummary := Summary{
+		Dumped:     7,
+		Expected:   6,
+		Archived:   7,
+		Matched:    2,
+		Missing:    1,
+		Absent:     1,
+		Mismatched: 1,
+		Unverified: 1,
+		Unhashed:   1,
+	}
+	if !reflect.DeepEqual(summary, wantSummary) {
+		t.Errorf("got summary %+v, want %+v", summary, wantSummary)
+	}
+}
+
+func TestVerifierBots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	archiveDiff(t, archiver, 9, 10, "page 9", "page 10")
+	archiveDiff(t, archiver, 12, 13, "page 12", "page 13")
+
+	api := wikitest.NewAPIServer(wikitest.APIDataset{
+		"en": {
+			SiteName: "Wikipedia",
+			Lang:     "en",
+			Users: []wikitest.APIUser{
+				{ID: 1, Name: "Example", EditCount: 10, Registration: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+				{ID: 2, Name: "ExampleBot", EditCount: 1000, Groups: []string{"bot"}},
+			},
+		},
+	}, wikitest.DefaultAPIOptions)
+
+	contributed := func(id int, contributor string) string {
+		return fmt.Sprintf(`<revision><id>%d</id><timestamp>2020-01-01T00:00:%02dZ</timestamp><contributor>%s</contributor><text /><sha1 /></revision>`, id, id, contributor)
+	}
+	in := "<mediawiki><page><title>Example</title><ns>0</ns><id>1</id>" +
+		contributed(10, "<username>Example</username><id>1</id>") +
+		contributed(11, "<username>ExampleBot</username><id>2</id>") +
+		contributed(12, "<ip>127.0.0.1</ip>") +
+		contributed(13, "<username>Example</username><id>1</id>") +
+		"</page></mediawiki>"
+
+	findings := []Finding{}
+	v, err := NewVerifier(archiver, "en", func(f Finding) {
+		findings = append(findings, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SkipBots(users.NewCachedUserFetcher(users.NewUserFetcher(logger, api.Client()), 10, time.Hour))
+
+	reader, err := dump.NewReader(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		revision, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Check(revision)
+	}
+	summary := v.Finish()
+
+	kinds := []Kind{}
+	for _, f := range findings {
+		kinds = append(kinds, f.Kind)
+	}
+	if want := []Kind{KindBot, KindMissing}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("got findings %+v, want %v", findings, want)
+	}
+	if findings[0].Revision != 11 || findings[1].Revision != 12 {
+		t.Errorf("got findings %+v, want 11 by a bot and 12 missing", findings)
+	}
+
+	wantSummary := Summary{
+		Dumped:   4,
+		Expected: 3,
+		Archived: 2,
+		Missing:  1,
+		Bots:     1,
+		Unhashed: 2,
+	}
+	if !reflect.DeepEqual(summary, wantSummary) {
+		t.Errorf("got summary %+v, want %+v", summary, wantSummary)
+	}
+
+	// Only the bot was looked up, as the IP isn't an account
+	if requests := len(api.Requests()); requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+}
@@ -4,11 +4,14 @@
 package base36
 
 import (
-	"math"
+	"errors"
 	"math/big"
 	"strings"
 )
 
+// ErrInvalid is returned when decoding a string which is not base36
+var ErrInvalid = errors.New("Invalid base36 string")
+
 var (
 	base36 = []byte{
 		'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
@@ -48,14 +51,30 @@ func Encode(value uint64) string {
 // Decode decodes a base36-encoded string.
 func Decode(s string) uint64 {
 	res := uint64(0)
-	l := len(s) - 1
-	for idx := range s {
-		c := s[l-idx]
-		res += uint64(index[c]) * uint64(math.Pow(36, float64(idx)))
+	for i := 0; i < len(s); i++ {
+		res = res*36 + uint64(index[s[i]])
 	}
 	return res
 }
 
+// DecodeStrict decodes a base36-encoded string, returning ErrInvalid if it
+// is empty, has characters outside the alphabet, or overflows a uint64.
+func DecodeStrict(s string) (uint64, error) {
+	if s == "" {
+		return 0, ErrInvalid
+	}
+
+	res := uint64(0)
+	for i := 0; i < len(s); i++ {
+		digit, ok := index[s[i]]
+		if !ok || res > (^uint64(0)-uint64(digit))/36 {
+			return 0, ErrInvalid
+		}
+		res = res*36 + uint64(digit)
+	}
+	return res, nil
+}
+
 var bigRadix = big.NewInt(36)
 var bigZero = big.NewInt(0)
 
@@ -93,6 +112,38 @@ func EncodeBytes(b []byte) string {
 	return string(EncodeBytesAsBytes(b))
 }
 
+// EncodeNumber encodes a byte slice as a big-endian number, left padded with
+// zeros to width, as PHP's Wikimedia\base_convert does. Unlike EncodeBytes,
+// leading zero bytes are not given a digit of their own.
+func EncodeNumber(b []byte, width int) string {
+	encoded := new(big.Int).SetBytes(b).Text(36)
+	if len(encoded) < width {
+		encoded = strings.Repeat("0", width-len(encoded)) + encoded
+	}
+	return encoded
+}
+
+// DecodeNumber decodes a base36 string to a big-endian number, without
+// leading zero bytes, returning ErrInvalid if it is empty or has characters
+// outside the alphabet.
+func DecodeNumber(s string) ([]byte, error) {
+	if s == "" {
+		return nil, ErrInvalid
+	}
+
+	x := new(big.Int)
+	digit := new(big.Int)
+	for i := 0; i < len(s); i++ {
+		value, ok := index[s[i]]
+		if !ok {
+			return nil, ErrInvalid
+		}
+		x.Mul(x, bigRadix)
+		x.Add(x, digit.SetInt64(int64(value)))
+	}
+	return x.Bytes(), nil
+}
+
 // DecodeToBytes decodes a base36 string to a byte slice, using alphabet.
 func DecodeToBytes(b string) []byte {
 	alphabet := string(base36)
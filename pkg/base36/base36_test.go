@@ -0,0 +1,37 @@
+package base36_test
+
+import (
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/base36"
+)
+
+func TestDecode(t *testing.T) {
+	// 36^12 is beyond the precision of a float64 mantissa
+	tests := map[string]uint64{
+		"0":             0,
+		"z":             35,
+		"10":            36,
+		"1000000000001": 4738381338321616897,
+		"3w5e11264sgsf": 18446744073709551615,
+	}
+
+	for s, want := range tests {
+		if got := base36.Decode(s); got != want {
+			t.Errorf("got %d, want %d for %q", got, want, s)
+		}
+
+		got, err := base36.DecodeStrict(s)
+		if err != nil || got != want {
+			t.Errorf("got %d, %v, want %d for %q", got, err, want, s)
+		}
+	}
+}
+
+func TestDecodeStrictInvalid(t *testing.T) {
+	for _, s := range []string{"", "12-3", "3w5e11264sgsg"} {
+		if _, err := base36.DecodeStrict(s); err != base36.ErrInvalid {
+			t.Errorf("got %v, want ErrInvalid for %q", err, s)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package batchcache caches the results of looking up keys in batches, such
+// as labels of entities or accounts by name, which the API returns many at a
+// time
+package batchcache
+
+import (
+	"sync"
+	"time"
+)
+
+// LookupFunc looks up keys, returning the values of those it found
+type LookupFunc func(keys []string) (map[string]interface{}, error)
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Cache remembers the values looked up for keys, and the keys which had none,
+// for up to a TTL. When the cache fills, expired keys are dropped, and if it
+// is still full it is emptied.
+type Cache struct {
+	size    int
+	ttl     time.Duration
+	mux     sync.Mutex
+	entries map[string]entry
+}
+
+// New creates a Cache of up to size keys, each kept for ttl
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]entry),
+	}
+}
+
+// Lookup returns the values of keys, looking up those which are not cached,
+// once each, with lookup. Keys without a value are left out.
+func (c *Cache) Lookup(keys []string, lookup LookupFunc) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(keys))
+	missing := []string{}
+	seen := make(map[string]bool, len(keys))
+
+	now := time.Now()
+	c.mux.Lock()
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		e, ok := c.entries[key]
+		if !ok || now.After(e.expires) {
+			missing = append(missing, key)
+		} else if e.value != nil {
+			values[key] = e.value
+		}
+	}
+	c.mux.Unlock()
+
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	found, err := lookup(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.entries)+len(missing) > c.size {
+		c.prune(now)
+	}
+	if len(c.entries)+len(missing) > c.size {
+		c.entries = make(map[string]entry)
+	}
+
+	expires := now.Add(c.ttl)
+	for _, key := range missing {
+		value := found[key]
+		if value != nil {
+			values[key] = value
+		}
+		c.entries[key] = entry{value: value, expires: expires}
+	}
+	return values, nil
+}
+
+// prune drops the expired keys
+func (c *Cache) prune(now time.Time) {
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package batchcache_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/batchcache"
+)
+
+// counter looks up keys, finding all but "none", and records each batch
+type counter struct {
+	batches [][]string
+}
+
+func (c *counter) lookup(keys []string) (map[string]interface{}, error) {
+	c.batches = append(c.batches, keys)
+	values := map[string]interface{}{}
+	for _, key := range keys {
+		if key == "fail" {
+			return nil, errors.New("lookup failed")
+		}
+		if key != "none" {
+			values[key] = "value of " + key
+		}
+	}
+	return values, nil
+}
+
+func TestCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		ttl     time.Duration
+		wait    time.Duration
+		lookups [][]string
+		want    map[string]interface{}
+		batches [][]string
+		err     bool
+	}{
+		{
+			name:    "cached",
+			size:    10,
+			ttl:     time.Hour,
+			lookups: [][]string{{"a", "a", "none"}, {"a", "none", "b"}},
+			want:    map[string]interface{}{"a": "value of a", "b": "value of b"},
+			batches: [][]string{{"a", "none"}, {"b"}},
+		},
+		{
+			name:    "expired",
+			size:    10,
+			ttl:     10 * time.Millisecond,
+			wait:    20 * time.Millisecond,
+			lookups: [][]string{{"a", "none"}, {"a", "none"}},
+			want:    map[string]interface{}{"a": "value of a"},
+			batches: [][]string{{"a", "none"}, {"a", "none"}},
+		},
+		{
+			name:    "full",
+			size:    2,
+			ttl:     time.Hour,
+			lookups: [][]string{{"a", "b"}, {"c"}, {"a"}},
+			want:    map[string]interface{}{"a": "value of a"},
+			batches: [][]string{{"a", "b"}, {"c"}, {"a"}},
+		},
+		{
+			name:    "expired dropped when full",
+			size:    2,
+			ttl:     10 * time.Millisecond,
+			wait:    20 * time.Millisecond,
+			lookups: [][]string{{"a"}, {"b", "c"}, {"b"}},
+			want:    map[string]interface{}{"b": "value of b"},
+			batches: [][]string{{"a"}, {"b", "c"}},
+		},
+		{
+			name:    "failed",
+			size:    10,
+			ttl:     time.Hour,
+			lookups: [][]string{{"fail"}},
+			batches: [][]string{{"fail"}},
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := batchcache.New(tt.size, tt.ttl)
+			c := &counter{}
+
+			var got map[string]interface{}
+			var err error
+			for i, keys := range tt.lookups {
+				if i == 1 {
+					time.Sleep(tt.wait)
+				}
+				got, err = cache.Lookup(keys, c.lookup)
+			}
+
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %t", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(c.batches, tt.batches) {
+				t.Errorf("got batches %v, want %v", c.batches, tt.batches)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package difffetcher
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventdeduplicator"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/wikidata"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDiffSubjPrefix prefixes the nats bus subjects diffs are published
+// to, which are followed by the wiki, as in "diffs.en"
+const DefaultDiffSubjPrefix = "diffs"
+
+// DefaultRequestSubj is the nats bus subject diffs can be requested on
+const DefaultRequestSubj = "difffetcher.request"
+
+// Diff is a parsed diff, published with the recent change it belongs to
+type Diff struct {
+	Event   recentchanges.NormalizedRecentChange `json:"event"`
+	Compare diffs.Compare                        `json:"compare"`
+
+	// Entity holds the changes of Wikidata entity diffs
+	Entity []wikidata.Change `json:"entity,omitempty"`
+}
+
+// Request asks for the diff of a revision
+type Request struct {
+	Wiki     string `json:"wiki"`
+	Revision int    `json:"revision"`
+}
+
+// Reply answers a Request with either the diff or the reason it could not be
+// fetched
+type Reply struct {
+	Compare *diffs.Compare `json:"compare,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// wikidataWiki is the normalized name of Wikidata
+const wikidataWiki = "wikidata"
+
+// labelWorkers is how many entity diffs have their labels resolved at once,
+// and labelsPending how many may wait to be
+const (
+	labelWorkers  = 2
+	labelsPending = 1000
+)
+
+// DiffSubj returns the subject diffs of a wiki are published to
+func DiffSubj(wiki string) string {
+	return DefaultDiffSubjPrefix + "." + wiki
+}
+
+type DiffService struct {
+	logger   *logrus.Logger
+	natsconn *nats.Conn
+	fetcher  diffs.DiffFetcher
+	queuer   diffs.DiffQueuer
+	parser   diffs.DiffParser
+
+	labels     wikidata.LabelLookup
+	unlabelled chan Diff
+}
+
+// NewDiffService creates a service fetching diffs of recent changes with
+// queuer, and diffs requested over nats directly with fetcher. Both should
+// share the same underlying fetcher, so they share its rate limit.
+func NewDiffService(natsconn *nats.Conn, fetcher diffs.DiffFetcher, queuer diffs.DiffQueuer, logger *logrus.Logger) *DiffService {
+	return &DiffService{
+		logger:   logger,
+		natsconn: natsconn,
+		fetcher:  fetcher,
+		queuer:   queuer,
+		parser:   diffs.NewDiffParser(logger),
+	}
+}
+
+// ResolveLabels sets the labels of entities referred to by Wikidata entity
+// diffs using lookup, which should share the rate limit of the fetcher.
+// Labels are resolved once the diff is fetched, so lookups don't hold up
+// fetching other diffs.
+func (d *DiffService) ResolveLabels(lookup wikidata.LabelLookup) {
+	d.labels = lookup
+	d.unlabelled = make(chan Diff, labelsPending)
+	for i := 0; i < labelWorkers; i++ {
+		go d.resolveLabels()
+	}
+}
+
+// Serve fetches the diff of every deduplicated recent change, publishing it
+// to the subject of its wiki, and answers requests for diffs
+func (d *DiffService) Serve() {
+	d.natsconn.Subscribe(rceventdeduplicator.DefaultDeduplicatedSubj, func(msg *nats.Msg) {
+		rc := recentchanges.NormalizedRecentChange{}
+		err := json.Unmarshal(msg.Data, &rc)
+		if err != nil {
+			d.logger.WithError(err).Error("Could not unmarshal")
+			return
+		}
+
+		if !wiki.ValidWiki(rc.Wiki) {
+			d.logger.WithField("wiki", rc.Wiki).Warn("Ignoring recent change of an invalid wiki")
+			return
+		}
+
+		d.queuer.Queue(rc, d.publish(rc))
+	})
+
+	d.natsconn.Subscribe(DefaultRequestSubj, func(msg *nats.Msg) {
+		// Fetching may wait on the rate limit, so must not hold up the
+		// subscription
+		go d.reply(msg)
+	})
+}
+
+func (d *DiffService) publish(rc recentchanges.NormalizedRecentChange) diffs.HandleFetchResponse {
+	return func(body []byte, err error) error {
+		if err != nil {
+			return err
+		}
+
+		compare, err := d.parser.Parse(body)
+		if err != nil {
+			return err
+		}
+
+		diff := Diff{Event: rc, Compare: compare}
+		if rc.Wiki == wikidataWiki {
+			diff.Entity = d.parseEntity(rc, compare)
+		}
+
+		if len(diff.Entity) > 0 && d.labels != nil {
+			select {
+			case d.unlabelled <- diff:
+				return nil
+			default:
+				d.logger.WithField("revision", rc.Revision.New).Warn("Too many diffs waiting for labels, publishing without them")
+			}
+		}
+		return d.send(diff)
+	}
+}
+
+// send publishes a diff to the subject of its wiki
+func (d *DiffService) send(diff Diff) error {
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	d.logger.WithFields(logrus.Fields{
+		"wiki":     diff.Event.Wiki,
+		"revision": diff.Event.Revision.New,
+	}).Info("Publishing diff")
+	return d.natsconn.Publish(DiffSubj(diff.Event.Wiki), data)
+}
+
+// resolveLabels publishes entity diffs once their labels are resolved.
+// Failing to resolve them does not stop the diff being published.
+func (d *DiffService) resolveLabels() {
+	for diff := range d.unlabelled {
+		err := wikidata.Resolve(diff.Entity, d.labels)
+		if err != nil {
+			d.logger.WithError(err).WithField("revision", diff.Event.Revision.New).Warn("Could not resolve labels")
+		}
+
+		err = d.send(diff)
+		if err != nil {
+			d.logger.WithError(err).WithField("revision", diff.Event.Revision.New).Error("Could not publish diff")
+		}
+	}
+}
+
+// parseEntity parses the changes of an entity diff. Failing to parse them
+// does not stop the diff being published.
+func (d *DiffService) parseEntity(rc recentchanges.NormalizedRecentChange, compare diffs.Compare) []wikidata.Change {
+	changes, err := wikidata.Parse(compare.Body)
+	if err != nil {
+		d.logger.WithError(err).WithField("revision", rc.Revision.New).Warn("Could not parse entity diff")
+		return nil
+	}
+	return changes
+}
+
+func (d *DiffService) fetch(data []byte) (diffs.Compare, error) {
+	request := Request{}
+	err := json.Unmarshal(data, &request)
+	if err != nil {
+		return diffs.Compare{}, err
+	}
+
+	if request.Wiki == "" || request.Revision <= 0 {
+		return diffs.Compare{}, fmt.Errorf("Request needs a wiki and revision: %s", string(data))
+	}
+
+	// The wiki is placed in the URL fetched, so anyone on the bus could
+	// otherwise choose the host
+	if !wiki.ValidWiki(request.Wiki) {
+		return diffs.Compare{}, fmt.Errorf("Invalid wiki %q", request.Wiki)
+	}
+
+	body, err := d.fetcher.Fetch(request.Wiki, request.Revision)
+	if err != nil {
+		return diffs.Compare{}, err
+	}
+	return d.parser.Parse(body)
+}
+
+func (d *DiffService) reply(msg *nats.Msg) {
+	reply := Reply{}
+	compare, err := d.fetch(msg.Data)
+	if err != nil {
+		d.logger.WithError(err).WithField("request", string(msg.Data)).Warn("Could not fetch requested diff")
+		reply.Error = err.Error()
+	} else {
+		reply.Compare = &compare
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		d.logger.WithError(err).Error("Could not marshal")
+		return
+	}
+
+	err = msg.Respond(data)
+	if err != nil {
+		d.logger.WithError(err).Error("Could not reply")
+	}
+}
@@ -0,0 +1,304 @@
+package difffetcher_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/difffetcher"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventdeduplicator"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func at(minutes int) time.Time {
+	return time.Date(2019, 7, 1, 0, minutes, 0, 0, time.UTC)
+}
+
+var testDataset = wikitest.APIDataset{
+	"en": {
+		SiteName: "Wikipedia",
+		Lang:     "en",
+		Pages: []wikitest.APIPage{
+			{ID: 1, Title: "Main Page", Revisions: []wikitest.APIRevision{
+				{ID: 100, Timestamp: at(0), User: "Alice", UserID: 1, Text: "Welcome"},
+				{ID: 101, Timestamp: at(1), User: "Bob", UserID: 2, Text: "Welcome to Wikipedia"},
+			}},
+		},
+	},
+}
+
+// startService serves diffs from the fake API over an embedded nats server,
+// returning a connection to it
+func startService(t *testing.T) (*nats.Conn, *wikitest.APIServer, func()) {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		s.Shutdown()
+		t.Fatal("Nats server did not start")
+	}
+
+	url := "nats://" + s.Addr().String()
+	serviceConn, err := nats.Connect(url)
+	if err != nil {
+		s.Shutdown()
+		t.Fatal(err)
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		serviceConn.Close()
+		s.Shutdown()
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	api := wikitest.NewAPIServer(testDataset, wikitest.DefaultAPIOptions)
+	fetcher := diffs.NewDiffFetcher(logger, api.Client())
+	difffetcher.NewDiffService(serviceConn, fetcher, diffs.NewDiffQueuer(logger, fetcher), logger).Serve()
+	serviceConn.Flush()
+
+	return conn, api, func() {
+		conn.Close()
+		serviceConn.Close()
+		s.Shutdown()
+	}
+}
+
+func TestDiffServiceRequest(t *testing.T) {
+	conn, api, stop := startService(t)
+	defer stop()
+
+	type want struct {
+		revision int
+		err      string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{
+			name:    "diff",
+			request: `{"wiki":"en","revision":101}`,
+			want:    want{revision: 101},
+		},
+		{
+			name:    "missing revision",
+			request: `{"wiki":"en","revision":999}`,
+			want:    want{err: "nosuchrevid"},
+		},
+		{
+			name:    "no wiki",
+			request: `{"revision":101}`,
+			want:    want{err: "Request needs a wiki and revision"},
+		},
+		{
+			name:    "other host",
+			request: `{"wiki":"attacker.example/x#","revision":101}`,
+			want:    want{err: "Invalid wiki"},
+		},
+		{
+			name:    "path",
+			request: `{"wiki":"../../x","revision":101}`,
+			want:    want{err: "Invalid wiki"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := conn.Request(difffetcher.DefaultRequestSubj, []byte(tt.request), 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reply := difffetcher.Reply{}
+			err = json.Unmarshal(msg.Data, &reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want.err != "" {
+				if !strings.Contains(reply.Error, tt.want.err) || reply.Compare != nil {
+					t.Errorf("got reply %+v, want error %q", reply, tt.want.err)
+				}
+				return
+			}
+			if reply.Error != "" || reply.Compare == nil || reply.Compare.ToRevID != tt.want.revision {
+				t.Errorf("got reply %+v, want a diff to revision %d", reply, tt.want.revision)
+			}
+		})
+	}
+
+	for _, request := range api.Requests() {
+		if !strings.HasPrefix(request, "https://en.wikipedia.org/") {
+			t.Errorf("got a request to %s", request)
+		}
+	}
+}
+
+func TestDiffServicePublish(t *testing.T) {
+	conn, api, stop := startService(t)
+	defer stop()
+
+	published := make(chan *nats.Msg, 10)
+	_, err := conn.ChanSubscribe(difffetcher.DefaultDiffSubjPrefix+".>", published)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rc := range []recentchanges.NormalizedRecentChange{
+		{ID: 1, Type: "edit", Wiki: "attacker.example/x#", Revision: recentchanges.Revision{New: 101, Old: 100}},
+		{ID: 2, Type: "edit", Wiki: "en", Revision: recentchanges.Revision{New: 101, Old: 100}},
+	} {
+		data, _ := json.Marshal(rc)
+		err = conn.Publish(rceventdeduplicator.DefaultDeduplicatedSubj, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case msg := <-published:
+		if msg.Subject != difffetcher.DiffSubj("en") {
+			t.Errorf("got a diff on %s, want %s", msg.Subject, difffetcher.DiffSubj("en"))
+		}
+
+		diff := difffetcher.Diff{}
+		err = json.Unmarshal(msg.Data, &diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff.Event.ID != 2 || diff.Compare.ToRevID != 101 || diff.Compare.FromRevID != 100 || diff.Compare.Body == "" {
+			t.Errorf("got diff %+v", diff)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No diff was published")
+	}
+
+	select {
+	case msg := <-published:
+		t.Errorf("got another diff on %s", msg.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if requests := len(api.Requests()); requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+}
+
+// claimDiff is an entity diff changing a claim from Q5 to Q144
+const claimDiff = `<tr><td colspan="2" class="diff-lineno">Property / <a title="Property:P31" href="/wiki/Property:P31">instance of</a></td><td colspan="2" class="diff-lineno">Property / <a title="Property:P31" href="/wiki/Property:P31">instance of</a></td></tr>` +
+	`<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div><del class="diffchange diffchange-inline"><span><a title="Q5" href="/wiki/Q5">human</a></span></del></div></td><td class="diff-marker">+</td><td class="diff-addedline"><div><ins class="diffchange diffchange-inline"><span><a title="Q144" href="/wiki/Q144">dog</a></span></ins></div></td></tr>`
+
+// immediateQueuer fetches entity diffs at once, recording when each callback
+// returns
+type immediateQueuer struct {
+	handled chan int
+}
+
+func (q immediateQueuer) Queue(rc recentchanges.NormalizedRecentChange, cb diffs.HandleFetchResponse) {
+	data, _ := json.Marshal(diffs.CompareResult{Compare: diffs.Compare{FromRevID: rc.Revision.Old, ToRevID: rc.Revision.New, Body: claimDiff}})
+	cb(data, nil)
+	q.handled <- rc.Revision.New
+}
+
+// gatedLabels labels entities once the gate is opened
+type gatedLabels struct {
+	gate chan struct{}
+}
+
+func (l gatedLabels) Labels(ids []string) (map[string]string, error) {
+	<-l.gate
+	labels := map[string]string{}
+	for _, id := range ids {
+		labels[id] = "label of " + id
+	}
+	return labels, nil
+}
+
+func TestDiffServiceLabels(t *testing.T) {
+	s, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Nats server did not start")
+	}
+
+	conn, err := nats.Connect("nats://" + s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	published := make(chan *nats.Msg, 10)
+	_, err = conn.ChanSubscribe(difffetcher.DiffSubj("wikidata"), published)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	queuer := immediateQueuer{handled: make(chan int, 10)}
+	labels := gatedLabels{gate: make(chan struct{})}
+	service := difffetcher.NewDiffService(conn, nil, queuer, logger)
+	service.ResolveLabels(labels)
+	service.Serve()
+
+	for revision := 1; revision <= 3; revision++ {
+		data, _ := json.Marshal(recentchanges.NormalizedRecentChange{ID: revision, Type: "edit", Wiki: "wikidata", Revision: recentchanges.Revision{New: revision + 1, Old: revision}})
+		err = conn.Publish(rceventdeduplicator.DefaultDeduplicatedSubj, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every diff is fetched while the labels are still being looked up
+	for i := 0; i < 3; i++ {
+		select {
+		case <-queuer.handled:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d diffs handled, want 3", i)
+		}
+	}
+	if len(published) != 0 {
+		t.Errorf("got %d diffs published before their labels were resolved", len(published))
+	}
+
+	close(labels.gate)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-published:
+			diff := difffetcher.Diff{}
+			err = json.Unmarshal(msg.Data, &diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diff.Entity) != 1 || diff.Entity[0].Labels["Q144"] != "label of Q144" {
+				t.Errorf("got changes %+v, want Q144 labelled", diff.Entity)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d diffs published, want 3", i)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package dumpimport seeds the archive with the history of a wiki from an XML
+// dump, diffing consecutive revisions locally in the form the monitor
+// archives from the Action API
+package dumpimport
+
+import (
+	"encoding/json"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/engine"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+)
+
+// timestampFormat is the format of timestamps in the Action API
+const timestampFormat = "2006-01-02T15:04:05Z"
+
+// Options configures an Importer
+type Options struct {
+	// SnapshotEvery snapshots the content of every nth revision of a page,
+	// bounding the diffs applied to reconstruct a revision. The first
+	// revision of a page, and any after a revision with deleted text, are
+	// always snapshotted.
+	SnapshotEvery int
+}
+
+// DefaultOptions snapshots every 100th revision of a page
+var DefaultOptions = Options{
+	SnapshotEvery: 100,
+}
+
+// Stats counts what an Importer read and archived
+type Stats struct {
+	Pages     int
+	Revisions int
+	Archived  int
+	Snapshots int
+
+	// Skipped is the number of revisions already archived, whether by the
+	// monitor or an earlier import
+	Skipped int
+}
+
+// pending is a revision waiting for the next revision of its page, which is
+// the next revision of its compare
+type pending struct {
+	revision int
+	compare  diffs.Compare
+	snapshot []byte
+}
+
+// Importer archives the revisions of a dump, which must be added in the
+// order of the dump. Revisions already archived are left as they are, so
+// importing the same dump twice archives nothing more.
+type Importer struct {
+	archiver monitor.Archiver
+	wiki     string
+	options  Options
+	stats    Stats
+
+	page    *dump.Page
+	prev    *dump.Revision
+	n       int // The revisions of the page read so far
+	pending *pending
+}
+
+// NewImporter creates an Importer archiving the dump of wiki to archiver
+func NewImporter(archiver monitor.Archiver, wiki string, o Options) *Importer {
+	return &Importer{
+		archiver: archiver,
+		wiki:     wiki,
+		options:  o,
+	}
+}
+
+// Add adds the next revision of the dump
+func (i *Importer) Add(rev dump.Revision) error {
+	i.stats.Revisions++
+
+	if rev.Page != i.page {
+		err := i.Flush()
+		if err != nil {
+			return err
+		}
+		i.stats.Pages++
+		i.page = rev.Page
+		i.prev = nil
+		i.n = 0
+	} else if i.pending != nil {
+		i.pending.compare.Next = rev.ID
+		err := i.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	prev := i.prev
+	i.prev = &rev
+	i.n++
+
+	archived, err := i.archiver.Archived(i.wiki, rev.ID)
+	if err != nil {
+		return err
+	}
+	if archived {
+		i.stats.Skipped++
+		return nil
+	}
+
+	i.pending = i.compare(prev, rev)
+	return nil
+}
+
+// compare builds the compare of a revision with the one before it, as
+// action=compare with torelative=prev would return it
+func (i *Importer) compare(prev *dump.Revision, rev dump.Revision) *pending {
+	p := &pending{revision: rev.ID}
+	c := &p.compare
+
+	c.ToID = rev.Page.ID
+	c.ToRevID = rev.ID
+	c.ToNS = rev.Page.NS
+	c.ToTitle = rev.Page.Title
+	c.ToSize = rev.TextBytes
+	c.ToTimestamp = rev.Timestamp.Format(timestampFormat)
+	c.ToUser = user(rev.Contributor)
+	c.ToUserID = rev.Contributor.ID
+	c.ToComment = rev.Comment
+	c.ToTextHidden = diffs.Flag(rev.TextDeleted)
+	c.ToUserHidden = diffs.Flag(rev.Contributor.Deleted)
+	c.ToCommentHidden = diffs.Flag(rev.CommentDeleted)
+
+	from := ""
+	if prev != nil {
+		c.FromID = prev.Page.ID
+		c.FromRevID = prev.ID
+		c.FromNS = prev.Page.NS
+		c.FromTitle = prev.Page.Title
+		c.FromSize = prev.TextBytes
+		c.FromTimestamp = prev.Timestamp.Format(timestampFormat)
+		c.FromUser = user(prev.Contributor)
+		c.FromUserID = prev.Contributor.ID
+		c.FromComment = prev.Comment
+		c.FromTextHidden = diffs.Flag(prev.TextDeleted)
+		c.FromUserHidden = diffs.Flag(prev.Contributor.Deleted)
+		c.FromCommentHidden = diffs.Flag(prev.CommentDeleted)
+		c.Prev = prev.ID
+		from = prev.Text
+	}
+
+	// Hidden text leaves nothing to diff, so the revision after it is
+	// snapshotted to reconstruct from instead
+	if rev.TextDeleted {
+		return p
+	}
+	if prev == nil || prev.TextDeleted || (i.options.SnapshotEvery > 0 && i.n%i.options.SnapshotEvery == 0) {
+		p.snapshot = []byte(rev.Text)
+	}
+	if prev != nil && prev.TextDeleted {
+		return p
+	}
+
+	body := engine.Render(engine.Diff(from, rev.Text, engine.DefaultOptions))
+	c.Slots = map[string]string{diffs.MainSlot: body}
+	c.DiffSize = len(body)
+	return p
+}
+
+// user returns the name shown for a contributor, which for anonymous
+// contributors is their IP
+func user(c dump.Contributor) string {
+	if c.Username != "" {
+		return c.Username
+	}
+	return c.IP
+}
+
+// Flush archives the last revision added. It must be called once the whole
+// dump is added.
+func (i *Importer) Flush() error {
+	p := i.pending
+	if p == nil {
+		return nil
+	}
+	i.pending = nil
+
+	// The snapshot is written first, so a revision is never archived
+	// without the snapshot it is reconstructed from
+	if p.snapshot != nil {
+		err := i.archiver.Snapshot(i.wiki, p.revision, p.snapshot)
+		if err != nil {
+			return err
+		}
+		i.stats.Snapshots++
+	}
+
+	data, err := json.Marshal(diffs.CompareResult{Compare: p.compare})
+	if err != nil {
+		return err
+	}
+	err = i.archiver.Archive(i.wiki, p.revision, data)
+	if err != nil {
+		return err
+	}
+	i.stats.Archived++
+	return nil
+}
+
+// Stats returns what has been read and archived so far
+func (i *Importer) Stats() Stats {
+	return i.stats
+}
@@ -0,0 +1,185 @@
+package dumpimport
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+const history = `<mediawiki>
+<page><title>Example</title><ns>0</ns><id>1</id>
+<revision><id>10</id><timestamp>2020-01-01T00:00:00Z</timestamp><contributor><username>Alice</username><id>7</id></contributor><comment>create</comment><text bytes="23">Intro.
+The cat sat.
+End.</text></revision>
+<revision><id>12</id><parentid>10</parentid><timestamp>2020-01-02T00:00:00Z</timestamp><contributor><ip>127.0.0.1</ip></contributor><text bytes="23">Intro.
+The cat lay.
+End.</text></revision>
+<revision><id>15</id><parentid>12</parentid><timestamp>2020-01-03T00:00:00Z</timestamp><contributor deleted="deleted" /><comment deleted="deleted" /><text bytes="7" deleted="deleted" /></revision>
+<revision><id>16</id><parentid>15</parentid><timestamp>2020-01-04T00:00:00Z</timestamp><contributor><username>Alice</username><id>7</id></contributor><text bytes="27">Intro.
+The cat lay down.
+End.</text></revision>
+<revision><id>20</id><parentid>16</parentid><timestamp>2020-01-05T00:00:00Z</timestamp><contributor><username>Bob</username><id>8</id></contributor><text bytes="27">Intro.
+The dog lay down.
+Fin.</text></revision>
+</page>
+<page><title>Talk:Example</title><ns>1</ns><id>2</id>
+<revision><id>11</id><timestamp>2020-01-01T12:00:00Z</timestamp><contributor><username>Bob</username><id>8</id></contributor><text bytes="3">Hi!</text></revision>
+</page>
+</mediawiki>`
+
+var texts = map[int]string{
+	10: "Intro.\nThe cat sat.\nEnd.",
+	11: "Hi!",
+	12: "Intro.\nThe cat lay.\nEnd.",
+	16: "Intro.\nThe cat lay down.\nEnd.",
+	20: "Intro.\nThe dog lay down.\nFin.",
+}
+
+func importHistory(t *testing.T, archiver monitor.Archiver, o Options) Stats {
+	reader, err := dump.NewReader(strings.NewReader(history))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importer := NewImporter(archiver, "en", o)
+	for {
+		rev, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = importer.Add(rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = importer.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return importer.Stats()
+}
+
+func readCompare(t *testing.T, dir string, revision string) diffs.Compare {
+	logger, _ := test.NewNullLogger()
+	data, err := ioutil.ReadFile(dir + "/en/" + revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare, err := diffs.NewDiffParser(logger).Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compare
+}
+
+func TestImporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+
+	// Archived by the monitor already, and left as it is
+	archiver.Archive("en", 20, []byte(`{"compare":{"fromrevid":16,"torevid":20}}`))
+
+	got := importHistory(t, archiver, Options{SnapshotEvery: 3})
+	want := Stats{Pages: 2, Revisions: 6, Archived: 5, Snapshots: 3, Skipped: 1}
+	if got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+
+	for revision, text := range texts {
+		if revision == 20 {
+			continue
+		}
+		content, err := archiver.Reconstruct("en", revision)
+		if err != nil {
+			t.Fatalf("Reconstruct(%d) returned error %v", revision, err)
+		}
+		if string(content) != text {
+			t.Errorf("Reconstruct(%d) = %q, want %q", revision, content, text)
+		}
+	}
+
+	compare := readCompare(t, dir, "12")
+	wantCompare := diffs.Compare{
+		FromID:        1,
+		FromRevID:     10,
+		FromTitle:     "Example",
+		FromSize:      23,
+		FromTimestamp: "2020-01-01T00:00:00Z",
+		FromUser:      "Alice",
+		FromUserID:    7,
+		FromComment:   "create",
+		ToID:          1,
+		ToRevID:       12,
+		ToTitle:       "Example",
+		ToSize:        23,
+		ToTimestamp:   "2020-01-02T00:00:00Z",
+		ToUser:        "127.0.0.1",
+		Prev:          10,
+		Next:          15,
+	}
+	body := compare.Body
+	compare.Slots, compare.Body, compare.DiffSize = nil, "", 0
+	if !reflect.DeepEqual(compare, wantCompare) {
+		t.Errorf("got compare %+v, want %+v", compare, wantCompare)
+	}
+	if !strings.Contains(body, `The cat <del class="diffchange diffchange-inline">sat</del>.`) {
+		t.Errorf("got body %s", body)
+	}
+
+	hidden := readCompare(t, dir, "15")
+	if !hidden.ToTextHidden || !hidden.ToUserHidden || !hidden.ToCommentHidden || hidden.Body != "" {
+		t.Errorf("got compare %+v, want hidden text, user and comment", hidden)
+	}
+	after := readCompare(t, dir, "16")
+	if !after.FromTextHidden || after.Body != "" {
+		t.Errorf("got compare %+v, want hidden from text", after)
+	}
+}
+
+func TestImporterIdempotent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	importHistory(t, archiver, DefaultOptions)
+
+	files, err := ioutil.ReadDir(dir + "/en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := importHistory(t, archiver, DefaultOptions)
+	want := Stats{Pages: 2, Revisions: 6, Skipped: 6}
+	if got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+
+	again, err := ioutil.ReadDir(dir + "/en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(files) {
+		t.Errorf("got %d files after importing again, want %d", len(again), len(files))
+	}
+}
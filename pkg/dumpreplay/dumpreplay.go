@@ -0,0 +1,180 @@
+// Package dumpreplay turns the revisions of XML dumps into the recent changes
+// the streams would have carried, and replays them in order of time
+package dumpreplay
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+)
+
+// Topic is the EventStreams topic of recent changes
+const Topic = "mediawiki.recentchange"
+
+// Options configures which revisions are collected
+type Options struct {
+	// Since and Until limit the revisions to those made in between. Either
+	// is ignored when zero.
+	Since time.Time
+	Until time.Time
+}
+
+// Collector collects the revisions of dumps as recent changes. Only the
+// metadata of a revision is kept, but every revision in the window is held
+// in memory to be sorted, so long histories should be replayed in windows.
+type Collector struct {
+	options Options
+	events  []sse.RecentChange
+}
+
+// NewCollector creates a Collector
+func NewCollector(o Options) *Collector {
+	return &Collector{options: o, events: []sse.RecentChange{}}
+}
+
+// Read collects the revisions of a dump
+func (c *Collector) Read(reader *dump.Reader) error {
+	site := reader.SiteInfo()
+
+	var prev *dump.Revision
+	for {
+		rev, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if prev != nil && prev.Page != rev.Page {
+			prev = nil
+		}
+		if c.inWindow(rev.Timestamp) {
+			c.events = append(c.events, RecentChange(site, rev, prev))
+		}
+		prev = &rev
+	}
+}
+
+func (c *Collector) inWindow(t time.Time) bool {
+	if !c.options.Since.IsZero() && t.Before(c.options.Since) {
+		return false
+	}
+	if !c.options.Until.IsZero() && t.After(c.options.Until) {
+		return false
+	}
+	return true
+}
+
+// Events returns the recent changes collected, ordered by time. Revisions
+// made in the same second are ordered by ID, as they were saved.
+func (c *Collector) Events() []sse.RecentChange {
+	sort.SliceStable(c.events, func(i, j int) bool {
+		a, b := c.events[i], c.events[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		return *a.Revision.New < *b.Revision.New
+	})
+	return c.events
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// RecentChange returns the recent change of a revision, as EventStreams
+// would have sent it. prev is the revision before it on the page, if any.
+// Details dumps do not hold, such as the recent change ID and whether the
+// user is a bot, are left empty.
+func RecentChange(site dump.SiteInfo, rev dump.Revision, prev *dump.Revision) sse.RecentChange {
+	rc := sse.RecentChange{}
+
+	server := ""
+	if base, err := url.Parse(site.Base); err == nil && base.Host != "" {
+		server = base.Scheme + "://" + base.Host
+		rc.ServerName = base.Host
+		rc.Meta.Domain = base.Host
+		rc.Meta.URI = server + "/wiki/" + url.PathEscape(rev.Page.Title)
+	}
+
+	rc.Meta.Topic = Topic
+	rc.Meta.ID = fmt.Sprintf("00000000-0000-4000-8000-%012x", rev.ID)
+	rc.Meta.Dt = rev.Timestamp.UTC().Format(time.RFC3339)
+
+	rc.Type = "edit"
+	if prev == nil && rev.ParentID == 0 {
+		rc.Type = "new"
+	}
+	rc.Title = rev.Page.Title
+	rc.Namespace = rev.Page.NS
+	rc.Comment = rev.Comment
+	rc.Timestamp = int(rev.Timestamp.Unix())
+	rc.User = rev.Contributor.Username
+	if rc.User == "" {
+		rc.User = rev.Contributor.IP
+	}
+	rc.ServerURL = server
+	rc.ServerScriptPath = "/w"
+	rc.Wiki = site.DBName
+	rc.Minor = rev.Minor
+
+	rc.Length.New = intPtr(rev.TextBytes)
+	rc.Revision.New = intPtr(rev.ID)
+	if prev != nil {
+		rc.Length.Old = intPtr(prev.TextBytes)
+	}
+	if rev.ParentID != 0 {
+		rc.Revision.Old = intPtr(rev.ParentID)
+	} else if prev != nil {
+		rc.Revision.Old = intPtr(prev.ID)
+	}
+	return rc
+}
+
+// Replay calls publish with each event at the pace it was made, sped up by
+// speed. A speed of 0 or less publishes as fast as possible. Replaying stops
+// early when stop is closed, or publish fails.
+func Replay(events []sse.RecentChange, speed float64, stop <-chan struct{}, publish func(sse.RecentChange) error) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	first := events[0].Timestamp
+	for _, rc := range events {
+		if speed > 0 {
+			wait := time.Until(start.Add(delay(first, rc.Timestamp, speed)))
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		err := publish(rc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delay returns when an event made at timestamp is replayed, after the first
+// event made at first
+func delay(first, timestamp int, speed float64) time.Duration {
+	return time.Duration(float64(time.Duration(timestamp-first)*time.Second) / speed)
+}
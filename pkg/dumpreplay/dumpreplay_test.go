@@ -0,0 +1,150 @@
+package dumpreplay
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/dump"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+)
+
+const history = `<mediawiki>
+<siteinfo><dbname>enwiki</dbname><base>https://en.wikipedia.org/wiki/Main_Page</base></siteinfo>
+<page><title>Example page</title><ns>0</ns><id>1</id>
+<revision><id>10</id><timestamp>2020-01-01T00:00:00Z</timestamp><contributor><username>Alice</username><id>7</id></contributor><comment>create</comment><text bytes="20">x</text></revision>
+<revision><id>12</id><parentid>10</parentid><timestamp>2020-01-01T00:00:10Z</timestamp><contributor><ip>127.0.0.1</ip></contributor><minor /><text bytes="25">x</text></revision>
+</page>
+<page><title>Talk:Example page</title><ns>1</ns><id>2</id>
+<revision><id>11</id><timestamp>2020-01-01T00:00:05Z</timestamp><contributor><username>Bob</username><id>8</id></contributor><text bytes="3">x</text></revision>
+<revision><id>13</id><parentid>11</parentid><timestamp>2020-01-01T00:00:10Z</timestamp><contributor><username>Bob</username><id>8</id></contributor><text bytes="1">x</text></revision>
+</page>
+</mediawiki>`
+
+func collect(t *testing.T, o Options) []sse.RecentChange {
+	reader, err := dump.NewReader(strings.NewReader(history))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCollector(o)
+	err = c.Read(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Events()
+}
+
+func revisionIDs(events []sse.RecentChange) []int {
+	ids := []int{}
+	for _, rc := range events {
+		ids = append(ids, *rc.Revision.New)
+	}
+	return ids
+}
+
+func TestCollector(t *testing.T) {
+	events := collect(t, Options{})
+
+	got := revisionIDs(events)
+	want := []int{10, 11, 12, 13}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got revisions %v, want %v", got, want)
+	}
+
+	rc := events[2]
+	if rc.Meta.Domain != "en.wikipedia.org" || rc.Meta.URI != "https://en.wikipedia.org/wiki/Example%20page" || rc.Meta.Dt != "2020-01-01T00:00:10Z" {
+		t.Errorf("got meta %+v", rc.Meta)
+	}
+	if rc.ServerURL != "https://en.wikipedia.org" || rc.Wiki != "enwiki" || rc.Type != "edit" {
+		t.Errorf("got %+v", rc)
+	}
+
+	normalized := rc.Normalize()
+	wantNormalized := recentchanges.NormalizedRecentChange{
+		ID:         -1,
+		Type:       "edit",
+		Title:      "Example page",
+		Timestamp:  1577836810,
+		User:       "127.0.0.1",
+		Wiki:       "en",
+		Minor:      true,
+		Revision:   recentchanges.Revision{New: 12, Old: 10},
+		Changesize: 5,
+		Source:     recentchanges.SourceSSE,
+	}
+	if normalized != wantNormalized {
+		t.Errorf("got %+v, want %+v", normalized, wantNormalized)
+	}
+
+	created := events[0].Normalize()
+	if created.Type != "new" || created.Revision.Old != -1 || created.Changesize != 20 {
+		t.Errorf("got %+v, want a new page", created)
+	}
+}
+
+func TestCollectorWindow(t *testing.T) {
+	events := collect(t, Options{
+		Since: time.Date(2020, 1, 1, 0, 0, 5, 0, time.UTC),
+		Until: time.Date(2020, 1, 1, 0, 0, 9, 0, time.UTC),
+	})
+
+	got := revisionIDs(events)
+	want := []int{11}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got revisions %v, want %v", got, want)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	events := collect(t, Options{})
+
+	got := []int{}
+	err := Replay(events, 0, nil, func(rc sse.RecentChange) error {
+		got = append(got, *rc.Revision.New)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int{10, 11, 12, 13}) {
+		t.Errorf("got revisions %v", got)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	published := 0
+	err = Replay(events, 1, stop, func(rc sse.RecentChange) error {
+		published++
+		return nil
+	})
+	if err != nil || published != 0 {
+		t.Errorf("got %d published and error %v after stopping, want 0", published, err)
+	}
+
+	fail := errors.New("fail")
+	err = Replay(events, 0, nil, func(rc sse.RecentChange) error { return fail })
+	if err != fail {
+		t.Errorf("got error %v, want %v", err, fail)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		speed float64
+		want  time.Duration
+	}{
+		{1, 10 * time.Second},
+		{10, time.Second},
+		{0.5, 20 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := delay(100, 110, tt.speed); got != tt.want {
+			t.Errorf("delay at speed %v = %v, want %v", tt.speed, got, tt.want)
+		}
+	}
+}
@@ -1,21 +1,47 @@
 package monitor
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/engine"
 	"github.com/sirupsen/logrus"
 )
 
-// Archiver archives the given revision to a folder
+// maxChain is the most diffs applied to a snapshot to reconstruct a revision
+const maxChain = 10000
+
+// Archiver archives the given revision to a folder. Revision IDs are only
+// unique within a wiki, so each wiki is archived separately.
 type Archiver interface {
-	Archive(revision int, diff []byte)
+	Archive(wiki string, revision int, diff []byte) error
+
+	// Snapshot archives the full content of a revision
+	Snapshot(wiki string, revision int, content []byte) error
+
+	// Reconstruct returns the content of a revision, applying the archived
+	// diffs since the nearest earlier snapshot
+	Reconstruct(wiki string, revision int) ([]byte, error)
+
+	// Revisions returns every revision of a wiki with an archived diff, in
+	// order
+	Revisions(wiki string) ([]int, error)
+
+	// Archived reports whether the diff of a revision is archived
+	Archived(wiki string, revision int) (bool, error)
 }
 
 // fileArchive is an implementation of Archiver
 type fileArchive struct {
 	folder string
 	logger *logrus.Logger
+	parser diffs.DiffParser
 }
 
 // NewFileArchiver creates a new instance of an Archiver
@@ -23,18 +49,194 @@ func NewFileArchiver(logger *logrus.Logger, folder string) Archiver {
 	return fileArchive{
 		folder: folder,
 		logger: logger,
+		parser: diffs.NewDiffParser(logger),
+	}
+}
+
+// wikiFolder returns the folder the revisions of a wiki are archived to
+func (a fileArchive) wikiFolder(wikiName string) (string, error) {
+	if !wiki.ValidWiki(wikiName) {
+		return "", fmt.Errorf("Invalid wiki %q", wikiName)
+	}
+	return filepath.Join(a.folder, wikiName), nil
+}
+
+func (a fileArchive) diffPath(wikiName string, revision int) (string, error) {
+	folder, err := a.wikiFolder(wikiName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, strconv.Itoa(revision)), nil
+}
+
+func (a fileArchive) snapshotPath(wikiName string, revision int) (string, error) {
+	path, err := a.diffPath(wikiName, revision)
+	if err != nil {
+		return "", err
 	}
+	return path + ".wikitext", nil
 }
 
-// Archives archives the given revision to a folder
-func (a fileArchive) Archive(revision int, diff []byte) {
-	path := a.folder + "/" + strconv.Itoa(revision)
+// Archives archives the given revision to the folder of its wiki
+func (a fileArchive) Archive(wikiName string, revision int, diff []byte) error {
+	path, err := a.diffPath(wikiName, revision)
+	if err != nil {
+		return err
+	}
+	return a.write(path, diff)
+}
+
+// Snapshot archives the content of the given revision beside its diff
+func (a fileArchive) Snapshot(wikiName string, revision int, content []byte) error {
+	path, err := a.snapshotPath(wikiName, revision)
+	if err != nil {
+		return err
+	}
+	return a.write(path, content)
+}
+
+func (a fileArchive) write(path string, data []byte) error {
 	a.logger.WithFields(logrus.Fields{
 		"file": path,
 	}).Info("Archiving revision")
 
-	err := ioutil.WriteFile(path, diff, 0644)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = writeFile(path, data)
+	}
 	if err != nil {
 		a.logger.WithError(err).Error("Could not write file")
 	}
+	return err
+}
+
+// writeFile renames the data into place, so a revision is never archived
+// partially written
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".archive")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Archived checks for the diff of the revision
+func (a fileArchive) Archived(wikiName string, revision int) (bool, error) {
+	path, err := a.diffPath(wikiName, revision)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Reconstruct follows the archived diffs back from the revision to a
+// snapshot, then applies them in order
+func (a fileArchive) Reconstruct(wikiName string, revision int) ([]byte, error) {
+	chain := []diffs.Compare{}
+	for current := revision; ; {
+		diffPath, err := a.diffPath(wikiName, current)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := ioutil.ReadFile(diffPath + ".wikitext")
+		if err == nil {
+			return a.apply(content, chain)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(diffPath)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Revision %d has no archived snapshot or diff to reconstruct %d from", current, revision)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		compare, err := a.parser.Parse(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// The diff of hidden text is empty rather than unchanged
+		if compare.FromTextHidden || compare.ToTextHidden {
+			return nil, fmt.Errorf("Revision %d has hidden text, so %d cannot be reconstructed", compare.ToRevID, revision)
+		}
+
+		if compare.FromRevID == 0 || len(chain) >= maxChain {
+			return nil, fmt.Errorf("No archived snapshot of an earlier revision to reconstruct %d from", revision)
+		}
+		chain = append(chain, compare)
+		current = compare.FromRevID
+	}
+}
+
+// Revisions lists the archived diffs of a wiki, skipping snapshots and other
+// files. A wiki with nothing archived has no revisions.
+func (a fileArchive) Revisions(wikiName string) ([]int, error) {
+	folder, err := a.wikiFolder(wikiName)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []int{}
+	for _, file := range files {
+		revision, err := strconv.Atoi(file.Name())
+		if err != nil || file.IsDir() {
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Ints(revisions)
+	return revisions, nil
+}
+
+// apply applies a chain of diffs, newest first, to the content of the
+// revision before the oldest
+func (a fileArchive) apply(content []byte, chain []diffs.Compare) ([]byte, error) {
+	text := string(content)
+	for i := len(chain) - 1; i >= 0; i-- {
+		body := chain[i].Body
+		if chain[i].Slots != nil {
+			// Diffs which only changed other slots leave the main slot as is
+			body = chain[i].Slots[diffs.MainSlot]
+		}
+
+		rows, err := diffs.ParseTable(body)
+		if err != nil {
+			return nil, err
+		}
+
+		text, err = engine.Apply(text, rows)
+		if err != nil {
+			return nil, fmt.Errorf("Could not apply the diff of revision %d: %v", chain[i].ToRevID, err)
+		}
+	}
+	return []byte(text), nil
 }
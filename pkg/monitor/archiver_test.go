@@ -0,0 +1,170 @@
+package monitor_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// compareTable renders a compare table of a single changed line
+func compareTable(line int, from, to string) string {
+	return `<tr><td colspan="2" class="diff-lineno">Line ` + strconv.Itoa(line) + `:</td><td colspan="2" class="diff-lineno">Line ` + strconv.Itoa(line) + `:</td></tr>` +
+		`<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>` + from + `</div></td><td class="diff-marker">+</td><td class="diff-addedline"><div>` + to + `</div></td></tr>`
+}
+
+func archiveDiff(t *testing.T, archiver monitor.Archiver, from, to int, slots map[string]string) {
+	data, err := json.Marshal(diffs.CompareResult{Compare: diffs.Compare{FromRevID: from, ToRevID: to, Slots: slots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archiver.Archive("en", to, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	archiver.Snapshot("en", 1, []byte("Title\nThe cat sat.\nEnd"))
+	archiveDiff(t, archiver, 1, 2, map[string]string{"main": compareTable(2, "The cat sat.", "The cat lay.")})
+	archiveDiff(t, archiver, 2, 3, map[string]string{"mediainfo": compareTable(1, "a", "b")})
+	archiveDiff(t, archiver, 3, 4, map[string]string{"main": compareTable(3, "End", "Fin")})
+
+	content, err := archiver.Reconstruct("en", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Title\nThe cat lay.\nFin"
+	if string(content) != want {
+		t.Errorf("got %q, want %q", string(content), want)
+	}
+
+	_, err = archiver.Reconstruct("en", 5)
+	if err == nil {
+		t.Error("got no error reconstructing an unarchived revision")
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	archiveDiff(t, archiver, 9, 10, nil)
+	archiveDiff(t, archiver, 1, 2, nil)
+	archiver.Snapshot("en", 2, []byte("content"))
+	archiver.Snapshot("en", 5, []byte("content"))
+
+	got, err := archiver.Revisions("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != 2 || got[1] != 10 {
+		t.Errorf("got %v, want [2 10]", got)
+	}
+}
+
+func TestArchived(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	archiveDiff(t, archiver, 1, 2, nil)
+	archiver.Snapshot("en", 3, []byte("content"))
+
+	for revision, want := range map[int]bool{1: false, 2: true, 3: false} {
+		got, err := archiver.Archived("en", revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Archived(%d) = %v, want %v", revision, got, want)
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "en"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got %d files, want only the diff and snapshot", len(files))
+	}
+}
+
+func TestReconstructHidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	archiver.Snapshot("en", 1, []byte("Visible"))
+	archiver.Archive("en", 2, []byte(`{"compare":{"fromrevid":1,"torevid":2,"totexthidden":true}}`))
+
+	_, err = archiver.Reconstruct("en", 2)
+	if err == nil {
+		t.Error("got no error reconstructing a revision with hidden text")
+	}
+}
+
+func TestArchiveWikis(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	archiver := monitor.NewFileArchiver(logger, dir)
+	archiver.Snapshot("en", 1, []byte("English"))
+	archiver.Snapshot("de", 1, []byte("Deutsch"))
+
+	for wiki, want := range map[string]string{"en": "English", "de": "Deutsch"} {
+		content, err := archiver.Reconstruct(wiki, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("Reconstruct(%q, 1) = %q, want %q", wiki, content, want)
+		}
+	}
+
+	got, err := archiver.Revisions("fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %v, want no revisions of a wiki with nothing archived", got)
+	}
+
+	err = archiver.Archive("../en", 2, []byte("{}"))
+	if err == nil {
+		t.Error("got no error archiving to an invalid wiki")
+	}
+}
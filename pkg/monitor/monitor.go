@@ -3,6 +3,7 @@ package monitor
 import (
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
 	"github.com/sirupsen/logrus"
@@ -17,6 +18,7 @@ type Monitor struct {
 	diffQueuer diffs.DiffQueuer
 	diffParser diffs.DiffParser
 	archiver   Archiver
+	snapshots  *snapshotter
 }
 
 // NewMonitor creates a handler for recent changes
@@ -30,7 +32,17 @@ func NewMonitor(stream sse.Listener, diffQueuer diffs.DiffQueuer, diffParser dif
 	}
 }
 
+// EnableSnapshots archives the full content of revisions chosen by the
+// options, fetched with fetcher in the background
+func (m *Monitor) EnableSnapshots(fetcher revisions.RevisionFetcher, o SnapshotOptions) {
+	m.snapshots = newSnapshotter(m.logger, fetcher, m.archiver, o)
+}
+
 func (m Monitor) Start(o recentchanges.ListenOptions) {
+	if replayer, ok := m.diffQueuer.(diffs.Replayer); ok {
+		replayer.Replay(m.responseHandler)
+	}
+
 	m.stream.Listen(o, m.handleRecentChange)
 }
 
@@ -50,16 +62,24 @@ func (m Monitor) handleRecentChange(rc sse.RecentChange, err error) {
 		return
 	}
 
-	new := *rc.Revision.New
-	m.diffQueuer.Queue(new, func(queryResult []byte, err error) {
-		m.handleFetchResponse(new, queryResult, err)
-	})
+	normalized := rc.Normalize()
+	m.diffQueuer.Queue(normalized, m.responseHandler(normalized))
 }
 
-func (m Monitor) handleFetchResponse(revision int, queryResult []byte, err error) {
+func (m Monitor) responseHandler(rc recentchanges.NormalizedRecentChange) diffs.HandleFetchResponse {
+	return func(queryResult []byte, err error) error {
+		err = m.handleFetchResponse(rc.Wiki, rc.Revision.New, queryResult, err)
+		if err == nil && m.snapshots != nil && m.snapshots.due(rc) {
+			m.snapshots.queue(rc)
+		}
+		return err
+	}
+}
+
+func (m Monitor) handleFetchResponse(wiki string, revision int, queryResult []byte, err error) error {
 	if err != nil {
 		m.logger.WithError(err).Error("Received diffQueuer error")
-		return
+		return err
 	}
 
 	_, err = m.diffParser.Parse(queryResult)
@@ -69,5 +89,5 @@ func (m Monitor) handleFetchResponse(revision int, queryResult []byte, err error
 		}).Error("Encountered parsing error")
 	}
 
-	m.archiver.Archive(revision, queryResult)
+	return m.archiver.Archive(wiki, revision, queryResult)
 }
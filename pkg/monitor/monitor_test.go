@@ -0,0 +1,180 @@
+package monitor_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitor"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeListener delivers the changes given, pausing before those at the
+// indexes of pauses
+type fakeListener struct {
+	changes []string
+	pauses  map[int]time.Duration
+}
+
+func (l fakeListener) Listen(lo recentchanges.ListenOptions, handler sse.Handler) {
+	for i, change := range l.changes {
+		time.Sleep(l.pauses[i])
+		rc := sse.RecentChange{}
+		err := json.Unmarshal([]byte(change), &rc)
+		handler(rc, err)
+	}
+}
+
+// immediateQueuer fetches an empty diff of each change at once, recording
+// when the callback returns
+type immediateQueuer struct {
+	handled chan int
+}
+
+func (q immediateQueuer) Queue(rc recentchanges.NormalizedRecentChange, cb diffs.HandleFetchResponse) {
+	data, _ := json.Marshal(diffs.CompareResult{Compare: diffs.Compare{FromRevID: rc.Revision.Old, ToRevID: rc.Revision.New, Slots: map[string]string{"main": ""}}})
+	cb(data, nil)
+	q.handled <- rc.Revision.New
+}
+
+// gatedContent fetches content once the gate is opened, failing for the
+// revisions given
+type gatedContent struct {
+	revisions.RevisionFetcher
+	gate  chan struct{}
+	fails map[int]bool
+}
+
+func (f gatedContent) FetchContent(wiki string, revID int) (string, error) {
+	<-f.gate
+	if f.fails[revID] {
+		return "", errors.New("nosuchrevid")
+	}
+	return "Content", nil
+}
+
+// failingSnapshots fails to archive snapshots of the revisions given
+type failingSnapshots struct {
+	monitor.Archiver
+	fails map[int]bool
+}
+
+func (a failingSnapshots) Snapshot(wiki string, revision int, content []byte) error {
+	if a.fails[revision] {
+		return errors.New("disk full")
+	}
+	return a.Archiver.Snapshot(wiki, revision, content)
+}
+
+func TestMonitorSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, hook := test.NewNullLogger()
+	archiver := failingSnapshots{monitor.NewFileArchiver(logger, dir), map[int]bool{12: true}}
+	fetcher := gatedContent{gate: make(chan struct{}), fails: map[int]bool{11: true}}
+	queuer := immediateQueuer{handled: make(chan int, 10)}
+
+	m := monitor.NewMonitor(fakeListener{changes: []string{
+		`{"type":"new","wiki":"enwiki","title":"A","id":1,"revision":{"new":10}}`,
+		`{"type":"new","wiki":"enwiki","title":"B","id":2,"revision":{"new":11}}`,
+		`{"type":"new","wiki":"enwiki","title":"C","id":3,"revision":{"new":12}}`,
+		`{"type":"edit","wiki":"enwiki","title":"A","id":4,"revision":{"old":10,"new":13}}`,
+	}}, queuer, diffs.NewDiffParser(logger), archiver, logger)
+	m.EnableSnapshots(fetcher, monitor.SnapshotOptions{NewPages: true})
+
+	// Every diff is handled while the snapshots are still being fetched
+	m.Start(recentchanges.ListenOptions{})
+	for _, want := range []int{10, 11, 12, 13} {
+		if got := <-queuer.handled; got != want {
+			t.Fatalf("got revision %d handled, want %d", got, want)
+		}
+	}
+
+	close(fetcher.gate)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		content, err := archiver.Reconstruct("en", 10)
+		warnings := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level <= logrus.WarnLevel {
+				warnings++
+			}
+		}
+		if err == nil && string(content) == "Content" && warnings == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got content %q, error %v and %d warnings", content, err, warnings)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	failed := map[interface{}]string{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= logrus.WarnLevel {
+			failed[entry.Data["revision"]] = entry.Message
+		}
+	}
+	if len(failed) != 2 || failed[11] == "" || failed[12] == "" {
+		t.Errorf("got failures %v, want revisions 11 and 12", failed)
+	}
+}
+
+func TestMonitorSnapshotsPrunePages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	fetcher := gatedContent{gate: make(chan struct{})}
+	close(fetcher.gate)
+	queuer := immediateQueuer{handled: make(chan int, 10)}
+
+	// A is forgotten while it goes unedited, so 13 starts counting afresh
+	m := monitor.NewMonitor(fakeListener{changes: []string{
+		`{"type":"edit","wiki":"enwiki","title":"A","id":1,"revision":{"old":9,"new":10}}`,
+		`{"type":"edit","wiki":"enwiki","title":"A","id":2,"revision":{"old":10,"new":11}}`,
+		`{"type":"edit","wiki":"enwiki","title":"A","id":3,"revision":{"old":11,"new":12}}`,
+		`{"type":"edit","wiki":"enwiki","title":"A","id":4,"revision":{"old":12,"new":13}}`,
+	}, pauses: map[int]time.Duration{3: 100 * time.Millisecond}}, queuer, diffs.NewDiffParser(logger), monitor.NewFileArchiver(logger, dir), logger)
+	m.EnableSnapshots(fetcher, monitor.SnapshotOptions{Every: 2, PageTTL: 50 * time.Millisecond})
+
+	m.Start(recentchanges.ListenOptions{})
+	for range []int{10, 11, 12, 13} {
+		<-queuer.handled
+	}
+
+	want := map[int]bool{10: true, 11: false, 12: true, 13: true}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := map[int]bool{}
+		for revision := range want {
+			_, err := os.Stat(filepath.Join(dir, "en", strconv.Itoa(revision)+".wikitext"))
+			got[revision] = err == nil
+		}
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got snapshots %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
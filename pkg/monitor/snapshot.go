@@ -0,0 +1,158 @@
+package monitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	"github.com/sirupsen/logrus"
+)
+
+// SnapshotOptions configures which revisions have their full content
+// archived alongside their diff.
+//
+// Snapshotting pages which are later deleted is out of scope. Their content
+// is no longer public once the deletion arrives, so they only have snapshots
+// taken by Every or NewPages beforehand.
+type SnapshotOptions struct {
+	// Every snapshots every Nth revision seen of each page, starting with the
+	// first. Zero disables.
+	Every int
+
+	// NewPages snapshots the first revision of new pages. Most deleted pages
+	// are new pages.
+	NewPages bool
+
+	// PageTTL is how long the revisions seen of a page are counted after
+	// its latest edit. A page edited again after longer is counted afresh,
+	// so its next revision is snapshotted.
+	PageTTL time.Duration
+
+	// Workers is how many snapshots are fetched at once, and Pending how many
+	// may wait to be. Snapshots are dropped while Pending are waiting.
+	Workers int
+	Pending int
+}
+
+// DefaultSnapshotOptions snapshots nothing, fetching up to 2 snapshots at once
+// and counting the revisions of a page for a day after its latest edit
+var DefaultSnapshotOptions = SnapshotOptions{
+	PageTTL: 24 * time.Hour,
+	Workers: 2,
+	Pending: 1000,
+}
+
+// snapshotter decides which revisions to snapshot, fetching and archiving
+// their content in the background
+type snapshotter struct {
+	logger   *logrus.Logger
+	fetcher  revisions.RevisionFetcher
+	archiver Archiver
+	options  SnapshotOptions
+	pending  chan recentchanges.NormalizedRecentChange
+	mux      sync.Mutex
+	seen     map[string]seenPage
+	pruned   time.Time
+}
+
+// seenPage counts the revisions seen of a page
+type seenPage struct {
+	count int
+	last  time.Time
+}
+
+func newSnapshotter(logger *logrus.Logger, fetcher revisions.RevisionFetcher, archiver Archiver, o SnapshotOptions) *snapshotter {
+	if o.Workers <= 0 {
+		o.Workers = DefaultSnapshotOptions.Workers
+	}
+	if o.Pending <= 0 {
+		o.Pending = DefaultSnapshotOptions.Pending
+	}
+	if o.PageTTL <= 0 {
+		o.PageTTL = DefaultSnapshotOptions.PageTTL
+	}
+
+	s := &snapshotter{
+		logger:   logger,
+		fetcher:  fetcher,
+		archiver: archiver,
+		options:  o,
+		pending:  make(chan recentchanges.NormalizedRecentChange, o.Pending),
+		seen:     make(map[string]seenPage),
+		pruned:   time.Now(),
+	}
+	for i := 0; i < o.Workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// queue snapshots the revision in the background, unless too many snapshots
+// are waiting already
+func (s *snapshotter) queue(rc recentchanges.NormalizedRecentChange) {
+	select {
+	case s.pending <- rc:
+	default:
+		s.logger.WithField("revision", rc.Revision.New).Warn("Too many snapshots pending, dropping snapshot")
+	}
+}
+
+func (s *snapshotter) work() {
+	for rc := range s.pending {
+		s.snapshot(rc)
+	}
+}
+
+// snapshot archives the content of the revision. The diff is archived
+// already, so failing to is only logged.
+func (s *snapshotter) snapshot(rc recentchanges.NormalizedRecentChange) {
+	content, err := s.fetcher.FetchContent(rc.Wiki, rc.Revision.New)
+	if err != nil {
+		s.logger.WithError(err).WithField("revision", rc.Revision.New).Warn("Could not fetch revision content")
+		return
+	}
+
+	err = s.archiver.Snapshot(rc.Wiki, rc.Revision.New, []byte(content))
+	if err != nil {
+		s.logger.WithError(err).WithField("revision", rc.Revision.New).Error("Could not archive snapshot")
+	}
+}
+
+// due counts the revision against its page, reporting whether to snapshot it
+func (s *snapshotter) due(rc recentchanges.NormalizedRecentChange) bool {
+	if s.options.NewPages && rc.Type == "new" {
+		return true
+	}
+
+	if s.options.Every <= 0 {
+		return false
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.pruned) >= s.options.PageTTL {
+		s.prune(now.Add(-s.options.PageTTL))
+		s.pruned = now
+	}
+
+	page := rc.Wiki + ":" + rc.Title
+	seen := s.seen[page]
+	s.seen[page] = seenPage{count: seen.count + 1, last: now}
+	return seen.count%s.options.Every == 0
+}
+
+// prune forgets pages which have not been edited since before, so only the
+// pages edited within PageTTL are kept. It must be called holding the lock.
+func (s *snapshotter) prune(before time.Time) {
+	pruned := 0
+	for page, seen := range s.seen {
+		if seen.last.Before(before) {
+			delete(s.seen, page)
+			pruned++
+		}
+	}
+	s.logger.WithField("pages", pruned).Debug("Discarding old pages")
+}
@@ -13,7 +13,7 @@ import (
 
 // Forwarder forwards wikimedia data
 type Forwarder interface {
-	Forward(lo recentchanges.ListenOptions, subj string)
+	Forward(lo recentchanges.ListenOptions, subj string) error
 }
 
 type monitorIrcForwarder struct {
@@ -34,8 +34,9 @@ func NewForwarder(listener irc.Listener, natsconn *nats.Conn, logger *logrus.Log
 	}
 }
 
-func (f *monitorIrcForwarder) Forward(lo recentchanges.ListenOptions, subj string) {
-	f.listener.Listen(lo, func(rc irc.RecentChange, err error) {
+// Forward publishes recent changes to subj until the listener gives up
+func (f *monitorIrcForwarder) Forward(lo recentchanges.ListenOptions, subj string) error {
+	return f.listener.Listen(lo, func(rc irc.RecentChange, err error) {
 		if err != nil {
 			f.logger.WithError(err).Error("Encountered error in stream")
 			return
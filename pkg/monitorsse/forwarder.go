@@ -3,7 +3,6 @@ package monitorsse
 import (
 	"encoding/json"
 
-	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
 	nats "github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 
@@ -26,11 +25,10 @@ type monitorSseForwarder struct {
 const DefaultForwardSubj = "recentchange.sse"
 
 // NewForwarder creates a new service for forwarding wikimedia sse data to nats
-func NewForwarder(natsconn *nats.Conn, logger *logrus.Logger) Forwarder {
-	sseclient := wiki.NewSSEClient()
+func NewForwarder(listener sse.Listener, natsconn *nats.Conn, logger *logrus.Logger) Forwarder {
 	return &monitorSseForwarder{
 		natsconn: natsconn,
-		listener: sse.NewListener(sseclient, logger),
+		listener: listener,
 		logger:   logger,
 	}
 }
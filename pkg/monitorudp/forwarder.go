@@ -0,0 +1,57 @@
+package monitorudp
+
+import (
+	"encoding/json"
+	"fmt"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/udp"
+)
+
+// Forwarder forwards MediaWiki udp feed data
+type Forwarder interface {
+	Forward(lo recentchanges.ListenOptions, subj string)
+}
+
+type monitorUDPForwarder struct {
+	natsconn *nats.Conn
+	listener udp.Listener
+	logger   *logrus.Logger
+}
+
+// DefaultForwardSubj is the default nats bus subject for incoming udp data
+const DefaultForwardSubj = "recentchange.udp"
+
+// NewForwarder creates a new service for forwarding MediaWiki udp data to nats
+func NewForwarder(listener udp.Listener, natsconn *nats.Conn, logger *logrus.Logger) Forwarder {
+	return &monitorUDPForwarder{
+		natsconn: natsconn,
+		listener: listener,
+		logger:   logger,
+	}
+}
+
+func (f *monitorUDPForwarder) Forward(lo recentchanges.ListenOptions, subj string) {
+	f.listener.Listen(lo, func(rc udp.RecentChange, err error) {
+		if err != nil {
+			f.logger.WithError(err).Error("Encountered error in feed")
+			return
+		}
+
+		data, err := json.Marshal(rc)
+		if err != nil {
+			f.logger.WithFields(logrus.Fields{
+				"rc": rc,
+			}).WithError(err).Error("Could not marshal")
+			return
+		}
+
+		f.logger.WithFields(logrus.Fields{
+			"rc": fmt.Sprintf("%+v", rc),
+		}).Info("Publishing recent change")
+		f.natsconn.Publish(subj, data)
+	})
+}
@@ -0,0 +1,359 @@
+// Package pipelinetest runs the recent change pipeline in process, for end to
+// end tests: an embedded nats server, the SSE and IRC forwarders listening to
+// fake streams, the normalizer, the deduplicator, and the diff service
+// fetching from a fake Action API.
+//
+// The monitor is not covered. It listens to EventStreams itself rather than
+// to nats, and archives to disk, so it is tested on its own in package
+// monitor.
+package pipelinetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/difffetcher"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorirc"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorsse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventdeduplicator"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventnormalizer"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// startTimeout is how long the pipeline may take to start
+const startTimeout = 5 * time.Second
+
+// Options configures a Pipeline
+type Options struct {
+	// Wikis and Hidebots are what the forwarders listen to
+	Wikis    []string
+	Hidebots bool
+
+	// Dataset and API configure the Action API diffs are fetched from
+	Dataset wikitest.APIDataset
+	API     wikitest.APIOptions
+
+	// Logger logs every stage. Nothing is logged when it is nil.
+	Logger *logrus.Logger
+}
+
+// Pipeline is a running pipeline. Events sent to Stream or IRC flow through
+// every stage, and can be watched on any subject.
+type Pipeline struct {
+	Stream *wikitest.StreamServer
+	IRC    *wikitest.IRCServer
+	API    *wikitest.APIServer
+
+	logger *logrus.Logger
+	server *server.Server
+	http   *httptest.Server
+
+	mux   sync.Mutex
+	conns []*nats.Conn
+}
+
+// Start starts a pipeline, returning once every stage is listening
+func Start(o Options) (*Pipeline, error) {
+	logger := o.Logger
+	if logger == nil {
+		logger = logrus.New()
+		logger.Out = ioutil.Discard
+	}
+
+	natsServer, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(startTimeout) {
+		natsServer.Shutdown()
+		return nil, fmt.Errorf("Nats server did not start within %s", startTimeout)
+	}
+
+	p := &Pipeline{
+		Stream: wikitest.NewStreamServer(),
+		API:    wikitest.NewAPIServer(o.Dataset, o.API),
+		logger: logger,
+		server: natsServer,
+	}
+	p.http = httptest.NewServer(p.Stream)
+
+	p.IRC, err = wikitest.NewIRCServer("127.0.0.1:0")
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	err = p.startStages()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	err = p.startForwarders(o)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// startStages starts the stages downstream of the forwarders, each with its
+// own connection as if it were its own process
+func (p *Pipeline) startStages() error {
+	conns := make([]*nats.Conn, 3)
+	for i := range conns {
+		conn, err := p.Connect()
+		if err != nil {
+			return err
+		}
+		conns[i] = conn
+	}
+
+	rceventnormalizer.NewNormalizer(conns[0], p.logger).Normalize()
+	rceventdeduplicator.NewDeduplicator(conns[1], p.logger).Deduplicate()
+
+	fetcher := diffs.NewDiffFetcher(p.logger, p.API.Client())
+	queuer := diffs.NewDiffQueuer(p.logger, fetcher)
+	difffetcher.NewDiffService(conns[2], fetcher, queuer, p.logger).Serve()
+
+	// Subscriptions must reach the server before anything is published
+	for _, conn := range conns {
+		err := conn.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startForwarders connects the forwarders to the fake streams, waiting until
+// they are listening
+func (p *Pipeline) startForwarders(o Options) error {
+	lo := recentchanges.ListenOptions{
+		Hidebots: o.Hidebots,
+		Wikis:    o.Wikis,
+	}
+
+	sseConn, err := p.Connect()
+	if err != nil {
+		return err
+	}
+	client, err := wikitest.NewSSEClient(p.http.URL)
+	if err != nil {
+		return err
+	}
+	monitorsse.NewForwarder(sse.NewListener(client, p.logger), sseConn, p.logger).Forward(lo, monitorsse.DefaultForwardSubj)
+
+	ircConn, err := p.Connect()
+	if err != nil {
+		return err
+	}
+
+	// The IRC forwarder gives up once it can't reconnect, which it can't
+	// once the pipeline is closed
+	listener := irc.NewListener(irc.Options{
+		Nick:           "pipelinetest",
+		User:           "pipelinetest",
+		Addr:           p.IRC.Addr(),
+		ReconnectDelay: 10 * time.Millisecond,
+		MaxAttempts:    1,
+	}, p.logger)
+	go monitorirc.NewForwarder(listener, ircConn, p.logger).Forward(lo, monitorirc.DefaultForwardSubj)
+
+	if !p.Stream.WaitForClients(1, startTimeout) {
+		return fmt.Errorf("SSE forwarder did not connect within %s", startTimeout)
+	}
+	for _, wiki := range o.Wikis {
+		channel := "#" + wiki + ".wikipedia"
+		if !p.IRC.WaitForJoin(channel, 1, startTimeout) {
+			return fmt.Errorf("IRC forwarder did not join %s within %s", channel, startTimeout)
+		}
+	}
+	return nil
+}
+
+// URL returns the URL of the nats server
+func (p *Pipeline) URL() string {
+	return "nats://" + p.server.Addr().String()
+}
+
+// Connect connects to the nats server. The connection is closed with the
+// pipeline.
+func (p *Pipeline) Connect() (*nats.Conn, error) {
+	conn, err := nats.Connect(p.URL())
+	if err != nil {
+		return nil, err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.conns = append(p.conns, conn)
+	return conn, nil
+}
+
+// Close stops every stage and server
+func (p *Pipeline) Close() {
+	p.mux.Lock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	p.mux.Unlock()
+
+	if p.IRC != nil {
+		p.IRC.Close()
+	}
+	if p.http != nil {
+		p.Stream.Close()
+		p.http.Close()
+	}
+	p.server.Shutdown()
+}
+
+// Match reports whether a message is the one looked for
+type Match func(data []byte) bool
+
+// Revision matches normalized recent changes of a revision, as published to
+// recentchanges.normalized and recentchanges.dedup, and its diff, as
+// published to diffs.<wiki>
+func Revision(wiki string, revision int) Match {
+	return func(data []byte) bool {
+		message := struct {
+			recentchanges.NormalizedRecentChange
+			Event *recentchanges.NormalizedRecentChange `json:"event"`
+		}{}
+		err := json.Unmarshal(data, &message)
+		if err != nil {
+			return false
+		}
+
+		rc := message.NormalizedRecentChange
+		if message.Event != nil {
+			rc = *message.Event
+		}
+		return rc.Wiki == wiki && rc.Revision.New == revision
+	}
+}
+
+// Watcher collects the messages published to a subject
+type Watcher struct {
+	subj string
+
+	mux      sync.Mutex
+	messages [][]byte
+	arrived  chan struct{}
+}
+
+// Watch collects the messages published to a subject from now on
+func (p *Pipeline) Watch(subj string) (*Watcher, error) {
+	conn, err := p.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		subj:    subj,
+		arrived: make(chan struct{}, 1),
+	}
+	_, err = conn.Subscribe(subj, func(msg *nats.Msg) {
+		w.mux.Lock()
+		w.messages = append(w.messages, msg.Data)
+		w.mux.Unlock()
+
+		select {
+		case w.arrived <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, conn.Flush()
+}
+
+// Messages returns the messages collected so far, in the order they arrived
+func (w *Watcher) Messages() [][]byte {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return append([][]byte(nil), w.messages...)
+}
+
+// Count returns the number of messages collected so far which match
+func (w *Watcher) Count(match Match) int {
+	count := 0
+	for _, data := range w.Messages() {
+		if match(data) {
+			count++
+		}
+	}
+	return count
+}
+
+// Arrives waits for a matching message, failing unless one arrives within the
+// timeout
+func (w *Watcher) Arrives(match Match, within time.Duration) error {
+	deadline := time.After(within)
+	for w.Count(match) == 0 {
+		select {
+		case <-w.arrived:
+		case <-deadline:
+			return fmt.Errorf("No matching message arrived on %s within %s", w.subj, within)
+		}
+	}
+	return nil
+}
+
+// ArrivesOnce waits out the timeout, failing unless exactly one matching
+// message arrives within it. It fails as soon as a second one arrives.
+func (w *Watcher) ArrivesOnce(match Match, within time.Duration) error {
+	count := w.wait(match, within, 1)
+	if count != 1 {
+		return fmt.Errorf("Matching message arrived on %s %d times within %s, want once", w.subj, count, within)
+	}
+	return nil
+}
+
+// Never waits out the timeout, failing if a matching message arrives within
+// it
+func (w *Watcher) Never(match Match, within time.Duration) error {
+	count := w.wait(match, within, 0)
+	if count != 0 {
+		return fmt.Errorf("Matching message arrived on %s %d times within %s, want never", w.subj, count, within)
+	}
+	return nil
+}
+
+// wait counts matching messages until the timeout, or until there are more
+// than max
+func (w *Watcher) wait(match Match, within time.Duration, max int) int {
+	deadline := time.After(within)
+	for {
+		count := w.Count(match)
+		if count > max {
+			return count
+		}
+
+		select {
+		case <-w.arrived:
+		case <-deadline:
+			return w.Count(match)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package pipelinetest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/difffetcher"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+)
+
+// within is how long a change may take to flow through the pipeline, and
+// settle how long to wait for duplicates once it has
+const (
+	within = 2 * time.Second
+	settle = 200 * time.Millisecond
+)
+
+// arrivesOnce waits for a matching message, failing unless no other arrives
+// soon after
+func arrivesOnce(w *Watcher, match Match) error {
+	err := w.Arrives(match, within)
+	if err != nil {
+		return err
+	}
+	return w.ArrivesOnce(match, settle)
+}
+
+func startPipeline(t *testing.T) *Pipeline {
+	t.Helper()
+	dataset, err := wikitest.LoadAPIDataset("testdata/api.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Start(Options{
+		Wikis:    []string{"en", "de"},
+		Hidebots: true,
+		Dataset:  dataset,
+		API:      wikitest.DefaultAPIOptions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func watch(t *testing.T, p *Pipeline, subj string) *Watcher {
+	t.Helper()
+	w, err := p.Watch(subj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestPipeline(t *testing.T) {
+	p := startPipeline(t)
+	defer p.Close()
+
+	normalized := watch(t, p, "recentchanges.normalized")
+	dedup := watch(t, p, "recentchanges.dedup")
+	diffs := map[string]*Watcher{
+		"en": watch(t, p, difffetcher.DiffSubj("en")),
+		"de": watch(t, p, difffetcher.DiffSubj("de")),
+	}
+
+	records, err := wikitest.ReadRecording("testdata/recording.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stream.SendRecords(records)
+	err = p.IRC.SendRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		wiki     string
+		revision int
+	}{
+		{"en", 101},
+		{"en", 200},
+		{"de", 501},
+	}
+
+	for _, tt := range tests {
+		match := Revision(tt.wiki, tt.revision)
+
+		err := arrivesOnce(dedup, match)
+		if err != nil {
+			t.Errorf("%s:%d: %s", tt.wiki, tt.revision, err)
+		}
+
+		// Both sources are normalized, and only the first is kept
+		if count := normalized.Count(match); count != 2 {
+			t.Errorf("%s:%d: got %d normalized changes, want 2", tt.wiki, tt.revision, count)
+		}
+
+		err = arrivesOnce(diffs[tt.wiki], match)
+		if err != nil {
+			t.Errorf("%s:%d: %s", tt.wiki, tt.revision, err)
+			continue
+		}
+		for _, data := range diffs[tt.wiki].Messages() {
+			if !match(data) {
+				continue
+			}
+			diff := difffetcher.Diff{}
+			err := json.Unmarshal(data, &diff)
+			if err != nil {
+				t.Errorf("%s:%d: %s", tt.wiki, tt.revision, err)
+			} else if diff.Compare.ToRevID != tt.revision {
+				t.Errorf("%s:%d: got a diff to revision %d", tt.wiki, tt.revision, diff.Compare.ToRevID)
+			}
+		}
+	}
+
+	// Bot edits are hidden by both forwarders
+	err = normalized.Never(Revision("en", 201), settle)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPipelineReconnect(t *testing.T) {
+	p := startPipeline(t)
+	defer p.Close()
+
+	dedup := watch(t, p, "recentchanges.dedup")
+
+	records, err := wikitest.ReadRecording("testdata/recording.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stream.SendRecords(records[:2])
+	err = dedup.Arrives(Revision("en", 101), within)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The forwarder resumes after the last event it saw, and the events sent
+	// while it was away are deduplicated against those it already forwarded
+	p.Stream.Disconnect()
+	p.Stream.SendRecords(records)
+	for _, revision := range []int{101, 200} {
+		err = arrivesOnce(dedup, Revision("en", revision))
+		if err != nil {
+			t.Errorf("en:%d: %s", revision, err)
+		}
+	}
+}
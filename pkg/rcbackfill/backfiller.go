@@ -0,0 +1,223 @@
+package rcbackfill
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	wikisse "github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	nats "github.com/nats-io/nats.go"
+	"github.com/r3labs/sse"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBackfillSubj is the default nats bus subject for replayed sse data.
+// It is kept separate from the live subject so that replays do not disturb it.
+const DefaultBackfillSubj = "recentchange.sse.backfill"
+
+// progressInterval is how many replayed events pass between progress reports
+const progressInterval = 1000
+
+// Backfiller replays the recentchange stream from a point in time
+type Backfiller interface {
+	Backfill(lo recentchanges.ListenOptions, since time.Time, until time.Time, subj string) error
+}
+
+// Options configures a Backfiller
+type Options struct {
+	// IdleTimeout is how long to wait for an event before giving up. Canary
+	// events keep even a quiet stream flowing, and count towards reaching
+	// until.
+	IdleTimeout time.Duration
+}
+
+// DefaultOptions gives up once the stream has been quiet for five minutes
+var DefaultOptions = Options{
+	IdleTimeout: 5 * time.Minute,
+}
+
+type sseBackfiller struct {
+	client   wiki.SSEClient
+	natsconn *nats.Conn
+	logger   *logrus.Logger
+	options  Options
+}
+
+// NewBackfiller creates a new service for replaying wikimedia sse data to nats
+func NewBackfiller(client wiki.SSEClient, natsconn *nats.Conn, logger *logrus.Logger, o Options) Backfiller {
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = DefaultOptions.IdleTimeout
+	}
+
+	return &sseBackfiller{
+		client:   client,
+		natsconn: natsconn,
+		logger:   logger,
+		options:  o,
+	}
+}
+
+// backfill is the state of a single Backfill
+type backfill struct {
+	lo    recentchanges.ListenOptions
+	until time.Time
+	subj  string
+
+	// caughtUp is closed once an event at or after until arrives, and
+	// stopped once Backfill returns. The subscription can't be cancelled,
+	// so later events are ignored.
+	caughtUp chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+
+	// active is signalled by every event
+	active chan struct{}
+
+	mux       sync.Mutex
+	replayed  int
+	published int
+}
+
+// Backfill publishes the recent changes made between since and until to
+// subj, returning once the stream reaches until. It fails if the stream fails
+// or ends first, or goes quiet for longer than the idle timeout.
+func (b *sseBackfiller) Backfill(lo recentchanges.ListenOptions, since time.Time, until time.Time, subj string) error {
+	url := wikisse.SinceURL(since)
+	b.logger.WithFields(logrus.Fields{
+		"url":   url,
+		"until": until,
+	}).Info("Backfilling")
+
+	run := &backfill{
+		lo:       lo,
+		until:    until,
+		subj:     subj,
+		caughtUp: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		active:   make(chan struct{}, 1),
+	}
+	defer close(run.stopped)
+
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- b.client.Subscribe(url, func(event *sse.Event) {
+			b.handle(run, event)
+		})
+	}()
+
+	idle := time.NewTimer(b.options.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-run.caughtUp:
+			run.mux.Lock()
+			defer run.mux.Unlock()
+			b.logger.WithFields(logrus.Fields{
+				"replayed":  run.replayed,
+				"published": run.published,
+			}).Info("Backfill complete")
+			return nil
+
+		case err := <-subscribed:
+			if err != nil {
+				return fmt.Errorf("Could not subscribe to %s: %s", url, err)
+			}
+			return fmt.Errorf("Stream ended before reaching %s", until)
+
+		case <-run.active:
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(b.options.IdleTimeout)
+
+		case <-idle.C:
+			return fmt.Errorf("No events arrived for %s before reaching %s", b.options.IdleTimeout, until)
+		}
+	}
+}
+
+func (b *sseBackfiller) handle(run *backfill, event *sse.Event) {
+	select {
+	case <-run.caughtUp:
+		return
+	case <-run.stopped:
+		return
+	default:
+	}
+
+	if len(event.Data) == 0 {
+		return
+	}
+
+	select {
+	case run.active <- struct{}{}:
+	default:
+	}
+
+	rc := wikisse.RecentChange{}
+	err := json.Unmarshal(event.Data, &rc)
+	if err != nil {
+		b.logger.WithError(err).WithFields(logrus.Fields{
+			"data": string(event.Data),
+		}).Error("There was an error decoding")
+		return
+	}
+
+	timestamp := time.Unix(int64(rc.Timestamp), 0)
+	if !timestamp.Before(run.until) {
+		run.once.Do(func() {
+			b.logger.WithField("timestamp", timestamp).Info("Caught up")
+			close(run.caughtUp)
+		})
+		return
+	}
+
+	if rc.Meta.Domain == wikisse.CanaryDomain {
+		return
+	}
+
+	run.mux.Lock()
+	defer run.mux.Unlock()
+	run.replayed++
+	if run.replayed%progressInterval == 0 {
+		b.logger.WithFields(logrus.Fields{
+			"replayed":  run.replayed,
+			"published": run.published,
+			"timestamp": timestamp,
+		}).Info("Backfill progress")
+	}
+
+	if rc.Bot && run.lo.Hidebots {
+		return
+	}
+
+	if !listening(run.lo.Wikis, rc.Wiki) {
+		return
+	}
+
+	data, err := json.Marshal(rc)
+	if err != nil {
+		b.logger.WithFields(logrus.Fields{
+			"rc": rc,
+		}).WithError(err).Error("Could not marshal")
+		return
+	}
+
+	b.natsconn.Publish(run.subj, data)
+	run.published++
+}
+
+func listening(wikis []string, wiki string) bool {
+	for _, w := range wikis {
+		if wiki == (w + "wiki") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package rcbackfill_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcbackfill"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	wikisse "github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+	"github.com/r3labs/sse"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+var since = time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+
+// change creates an event for a change made minutes after since
+func change(id int, wiki string, bot bool, minutes int) wikitest.StreamEvent {
+	data, _ := json.Marshal(map[string]interface{}{
+		"meta":      map[string]string{"domain": strings.TrimSuffix(wiki, "wiki") + ".wikipedia.org"},
+		"id":        id,
+		"type":      "edit",
+		"title":     "Example",
+		"timestamp": since.Add(time.Duration(minutes) * time.Minute).Unix(),
+		"user":      "Example",
+		"bot":       bot,
+		"wiki":      wiki,
+		"revision":  map[string]int{"new": id, "old": id - 1},
+	})
+	return wikitest.StreamEvent{ID: strconv.Itoa(id), Data: string(data)}
+}
+
+// connect starts an embedded nats server, connecting to it
+func connect(t *testing.T) (*nats.Conn, func()) {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		s.Shutdown()
+		t.Fatal("Nats server did not start")
+	}
+
+	conn, err := nats.Connect("nats://" + s.Addr().String())
+	if err != nil {
+		s.Shutdown()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Shutdown()
+	}
+}
+
+// failingClient fails to subscribe
+type failingClient struct{}
+
+func (failingClient) Subscribe(url string, handler func(msg *sse.Event)) error {
+	return errors.New("connection refused")
+}
+
+func TestBackfill(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []wikitest.StreamEvent
+		close  bool
+		client wiki.SSEClient
+		want   []int
+		err    string
+	}{
+		{
+			name: "caught up",
+			events: []wikitest.StreamEvent{
+				change(1, "enwiki", false, 1),
+				change(2, "enwiki", true, 2),
+				change(3, "frwiki", false, 3),
+				wikitest.CanaryEvent("canary", since.Add(4*time.Minute)),
+				change(5, "enwiki", false, 5),
+				change(6, "enwiki", false, 10),
+				change(7, "enwiki", false, 11),
+			},
+			want: []int{1, 5},
+		},
+		{
+			name: "canary reaches until",
+			events: []wikitest.StreamEvent{
+				change(1, "enwiki", false, 1),
+				wikitest.CanaryEvent("canary", since.Add(10*time.Minute)),
+			},
+			want: []int{1},
+		},
+		{
+			name: "stream ends",
+			events: []wikitest.StreamEvent{
+				change(1, "enwiki", false, 1),
+			},
+			close: true,
+			want:  []int{1},
+			err:   "Stream ended",
+		},
+		{
+			name: "quiet",
+			events: []wikitest.StreamEvent{
+				change(1, "enwiki", false, 1),
+			},
+			want: []int{1},
+			err:  "No events arrived",
+		},
+		{
+			name:   "subscribe fails",
+			client: failingClient{},
+			want:   []int{},
+			err:    "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, stop := connect(t)
+			defer stop()
+
+			published := make(chan *nats.Msg, 10)
+			_, err := conn.ChanSubscribe(rcbackfill.DefaultBackfillSubj, published)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stream := wikitest.NewStreamServer()
+			httpServer := httptest.NewServer(stream)
+			defer httpServer.Close()
+			defer stream.Close()
+
+			client := tt.client
+			if client == nil {
+				client, err = wikitest.NewSSEClient(httpServer.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				events, closeStream := tt.events, tt.close
+				go func() {
+					if !stream.WaitForClients(1, 5*time.Second) {
+						return
+					}
+					for _, e := range events {
+						stream.Send(e)
+					}
+					if closeStream {
+						stream.Close()
+					}
+				}()
+			}
+
+			logger, _ := test.NewNullLogger()
+			backfiller := rcbackfill.NewBackfiller(client, conn, logger, rcbackfill.Options{
+				IdleTimeout: 200 * time.Millisecond,
+			})
+			lo := recentchanges.ListenOptions{Hidebots: true, Wikis: []string{"en"}}
+			err = backfiller.Backfill(lo, since, since.Add(10*time.Minute), rcbackfill.DefaultBackfillSubj)
+			if tt.err == "" && err != nil {
+				t.Errorf("got error %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+
+			err = conn.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for len(published) > 0 {
+				rc := wikisse.RecentChange{}
+				err := json.Unmarshal((<-published).Data, &rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, *rc.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got changes %v published, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -6,8 +6,10 @@ import (
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorirc"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorsse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/monitorudp"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/udp"
 	nats "github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 )
@@ -27,29 +29,38 @@ func NewNormalizer(natsconn *nats.Conn, logger *logrus.Logger) *RcEventNormalize
 }
 
 func (n *RcEventNormalizer) Normalize() {
-	n.natsconn.Subscribe(monitorsse.DefaultForwardSubj, func(msg *nats.Msg) {
+	n.NormalizeSSE(monitorsse.DefaultForwardSubj)
+
+	n.natsconn.Subscribe(monitorirc.DefaultForwardSubj, func(msg *nats.Msg) {
 		n.logger.WithFields(logrus.Fields{
 			"data": string(msg.Data),
-		}).Debug("Received sse data")
+		}).Debug("Received irc data")
 
-		rc := sse.RecentChange{}
+		rc := irc.RecentChange{}
 		err := json.Unmarshal(msg.Data, &rc)
 		if err != nil {
 			n.logger.WithError(err).Error("Could not unmarshal")
 			return
 		}
 
-		switch rc.Type {
+		normalized, err := rc.Normalize()
+		if err != nil {
+			n.logger.WithFields(logrus.Fields{
+				"data": fmt.Sprintf("%+v", rc),
+			}).WithError(err).Error("Could not normalize irc data")
+			return
+		}
+
+		switch normalized.Type {
 		case "new":
 		case "edit":
 		default:
 			return
 		}
 
-		normalized := rc.Normalize()
 		n.logger.WithFields(logrus.Fields{
 			"msg": fmt.Sprintf("%+v", normalized),
-		}).Info("Normalized sse data")
+		}).Info("Normalized irc data")
 
 		data, err := json.Marshal(normalized)
 		if err != nil {
@@ -60,12 +71,12 @@ func (n *RcEventNormalizer) Normalize() {
 		n.natsconn.Publish(DefaultNormalizedSubj, data)
 	})
 
-	n.natsconn.Subscribe(monitorirc.DefaultForwardSubj, func(msg *nats.Msg) {
+	n.natsconn.Subscribe(monitorudp.DefaultForwardSubj, func(msg *nats.Msg) {
 		n.logger.WithFields(logrus.Fields{
 			"data": string(msg.Data),
-		}).Debug("Received irc data")
+		}).Debug("Received udp data")
 
-		rc := irc.RecentChange{}
+		rc := udp.RecentChange{}
 		err := json.Unmarshal(msg.Data, &rc)
 		if err != nil {
 			n.logger.WithError(err).Error("Could not unmarshal")
@@ -76,13 +87,57 @@ func (n *RcEventNormalizer) Normalize() {
 		if err != nil {
 			n.logger.WithFields(logrus.Fields{
 				"data": fmt.Sprintf("%+v", rc),
-			}).WithError(err).Error("Could not normalize irc data")
+			}).WithError(err).Error("Could not normalize udp data")
+			return
+		}
+
+		switch normalized.Type {
+		case "new":
+		case "edit":
+		default:
 			return
 		}
 
 		n.logger.WithFields(logrus.Fields{
 			"msg": fmt.Sprintf("%+v", normalized),
-		}).Info("Normalized irc data")
+		}).Info("Normalized udp data")
+
+		data, err := json.Marshal(normalized)
+		if err != nil {
+			n.logger.WithError(err).Error("Could not marshal")
+			return
+		}
+
+		n.natsconn.Publish(DefaultNormalizedSubj, data)
+	})
+}
+
+// NormalizeSSE normalizes sse data published to subj, such as data replayed
+// by rcbackfill
+func (n *RcEventNormalizer) NormalizeSSE(subj string) {
+	n.natsconn.Subscribe(subj, func(msg *nats.Msg) {
+		n.logger.WithFields(logrus.Fields{
+			"data": string(msg.Data),
+		}).Debug("Received sse data")
+
+		rc := sse.RecentChange{}
+		err := json.Unmarshal(msg.Data, &rc)
+		if err != nil {
+			n.logger.WithError(err).Error("Could not unmarshal")
+			return
+		}
+
+		switch rc.Type {
+		case "new":
+		case "edit":
+		default:
+			return
+		}
+
+		normalized := rc.Normalize()
+		n.logger.WithFields(logrus.Fields{
+			"msg": fmt.Sprintf("%+v", normalized),
+		}).Info("Normalized sse data")
 
 		data, err := json.Marshal(normalized)
 		if err != nil {
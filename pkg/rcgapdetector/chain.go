@@ -0,0 +1,86 @@
+package rcgapdetector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+)
+
+// Gap is a break in a page's revision chain. The revisions after From up to
+// and including To were never seen.
+type Gap struct {
+	Wiki  string
+	Title string
+	From  int // The latest revision seen
+	To    int // The unseen parent of the revision that revealed the gap
+}
+
+type pageRevision struct {
+	revision int
+	seen     time.Time
+}
+
+// ChainTracker tracks the latest known revision of each page
+type ChainTracker struct {
+	mux    sync.Mutex
+	latest map[string]pageRevision
+}
+
+// NewChainTracker creates an empty ChainTracker
+func NewChainTracker() *ChainTracker {
+	return &ChainTracker{
+		latest: make(map[string]pageRevision),
+	}
+}
+
+// Observe records the revision of a recent change, and reports whether its
+// parent revision reveals a gap since the previous revision of the page
+func (t *ChainTracker) Observe(rc recentchanges.NormalizedRecentChange) (Gap, bool) {
+	new := rc.Revision.New
+	if new <= 0 {
+		return Gap{}, false
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	key := rc.Wiki + ":" + rc.Title
+	last, seen := t.latest[key]
+	if seen && new <= last.revision {
+		// Late or duplicate event
+		return Gap{}, false
+	}
+
+	t.latest[key] = pageRevision{
+		revision: new,
+		seen:     time.Now(),
+	}
+
+	old := rc.Revision.Old
+	if !seen || rc.Type == "new" || old <= 0 || old <= last.revision {
+		return Gap{}, false
+	}
+
+	return Gap{
+		Wiki:  rc.Wiki,
+		Title: rc.Title,
+		From:  last.revision,
+		To:    old,
+	}, true
+}
+
+// Prune forgets pages which have not been edited since before
+func (t *ChainTracker) Prune(before time.Time) int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	pruned := 0
+	for key, last := range t.latest {
+		if last.seen.Before(before) {
+			delete(t.latest, key)
+			pruned++
+		}
+	}
+	return pruned
+}
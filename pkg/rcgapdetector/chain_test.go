@@ -0,0 +1,98 @@
+package rcgapdetector_test
+
+import (
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcgapdetector"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+)
+
+func edit(title string, old int, new int) recentchanges.NormalizedRecentChange {
+	return recentchanges.NormalizedRecentChange{
+		ID:    -1,
+		Type:  "edit",
+		Title: title,
+		Wiki:  "en",
+		Revision: recentchanges.Revision{
+			New: new,
+			Old: old,
+		},
+	}
+}
+
+type wantTracker struct {
+	gap   rcgapdetector.Gap
+	found bool
+}
+
+var trackerTests = []struct {
+	name string
+	in   []recentchanges.NormalizedRecentChange
+	want wantTracker
+}{
+	{
+		name: "first edit",
+		in: []recentchanges.NormalizedRecentChange{
+			edit("Foo", 10, 11),
+		},
+	},
+	{
+		name: "continuous",
+		in: []recentchanges.NormalizedRecentChange{
+			edit("Foo", 10, 11),
+			edit("Foo", 11, 15),
+		},
+	},
+	{
+		name: "gap",
+		in: []recentchanges.NormalizedRecentChange{
+			edit("Foo", 10, 11),
+			edit("Foo", 14, 15),
+		},
+		want: wantTracker{
+			gap: rcgapdetector.Gap{
+				Wiki:  "en",
+				Title: "Foo",
+				From:  11,
+				To:    14,
+			},
+			found: true,
+		},
+	},
+	{
+		name: "late event",
+		in: []recentchanges.NormalizedRecentChange{
+			edit("Foo", 14, 15),
+			edit("Foo", 10, 11),
+		},
+	},
+	{
+		name: "separate pages",
+		in: []recentchanges.NormalizedRecentChange{
+			edit("Foo", 10, 11),
+			edit("Bar", 14, 15),
+		},
+	},
+}
+
+func TestChainTracker(t *testing.T) {
+	for _, tt := range trackerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := rcgapdetector.NewChainTracker()
+
+			var gap rcgapdetector.Gap
+			var found bool
+			for _, rc := range tt.in {
+				gap, found = tracker.Observe(rc)
+			}
+
+			if found != tt.want.found {
+				t.Errorf("got %v, want %v", found, tt.want.found)
+			}
+
+			if gap != tt.want.gap {
+				t.Errorf("got %+v, want %+v", gap, tt.want.gap)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package rcgapdetector
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventdeduplicator"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventnormalizer"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultGapSubj is the nats bus subject gaps are reported to
+const DefaultGapSubj = "recentchanges.gaps"
+
+// pageTTL is how long a page is tracked after its latest edit
+const pageTTL = time.Hour
+
+// Options configures how gaps are backfilled
+type Options struct {
+	// Workers is how many gaps are backfilled at once, and Pending how many
+	// may wait to be. Gaps found while Pending are waiting are only reported.
+	Workers int
+	Pending int
+}
+
+// DefaultOptions backfills up to 4 gaps at once
+var DefaultOptions = Options{
+	Workers: 4,
+	Pending: 1000,
+}
+
+type RcGapDetector struct {
+	logger   *logrus.Logger
+	natsconn *nats.Conn
+	fetcher  revisions.RevisionFetcher
+	tracker  *ChainTracker
+	options  Options
+	pending  chan Gap
+}
+
+// NewGapDetector creates a detector backfilling gaps with fetcher, which
+// should be rate limited, as an outage of the stream leaves a gap in every
+// page edited during it
+func NewGapDetector(natsconn *nats.Conn, fetcher revisions.RevisionFetcher, logger *logrus.Logger, o Options) *RcGapDetector {
+	if o.Workers <= 0 {
+		o.Workers = DefaultOptions.Workers
+	}
+	if o.Pending <= 0 {
+		o.Pending = DefaultOptions.Pending
+	}
+
+	return &RcGapDetector{
+		logger:   logger,
+		natsconn: natsconn,
+		fetcher:  fetcher,
+		tracker:  NewChainTracker(),
+		options:  o,
+		pending:  make(chan Gap, o.Pending),
+	}
+}
+
+// Detect watches deduplicated recent changes for breaks in revision chains.
+// Missing revisions are fetched from the API and republished as normalized
+// recent changes flagged as backfilled, so they pass through deduplication
+// like any other event.
+func (d *RcGapDetector) Detect() {
+	for i := 0; i < d.options.Workers; i++ {
+		go func() {
+			for gap := range d.pending {
+				d.backfill(gap)
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			time.Sleep(pageTTL)
+			pruned := d.tracker.Prune(time.Now().Add(-pageTTL))
+			d.logger.WithField("pages", pruned).Info("Discarding old pages")
+		}
+	}()
+
+	d.natsconn.Subscribe(rceventdeduplicator.DefaultDeduplicatedSubj, func(msg *nats.Msg) {
+		rc := recentchanges.NormalizedRecentChange{}
+		err := json.Unmarshal(msg.Data, &rc)
+		if err != nil {
+			d.logger.WithError(err).Error("Could not unmarshal")
+			return
+		}
+
+		gap, found := d.tracker.Observe(rc)
+		if !found {
+			return
+		}
+
+		d.logger.WithFields(logrus.Fields{
+			"gap": fmt.Sprintf("%+v", gap),
+		}).Warn("Detected revision gap")
+
+		data, err := json.Marshal(gap)
+		if err != nil {
+			d.logger.WithError(err).Error("Could not marshal")
+			return
+		}
+		d.natsconn.Publish(DefaultGapSubj, data)
+
+		select {
+		case d.pending <- gap:
+		default:
+			d.logger.WithFields(logrus.Fields{
+				"gap": fmt.Sprintf("%+v", gap),
+			}).Warn("Too many gaps pending, not backfilling gap")
+		}
+	})
+}
+
+func (d *RcGapDetector) backfill(gap Gap) {
+	revs, err := d.fetcher.FetchBetween(gap.Wiki, gap.Title, gap.From, gap.To)
+	if err != nil {
+		d.logger.WithError(err).WithFields(logrus.Fields{
+			"gap": fmt.Sprintf("%+v", gap),
+		}).Error("Could not fetch missing revisions")
+		return
+	}
+
+	for _, rev := range revs {
+		if rev.RevID == gap.From {
+			continue
+		}
+
+		rc := recentchanges.NormalizedRecentChange{
+			ID:      -1,
+			Type:    "edit",
+			Title:   gap.Title,
+			Comment: rev.Comment,
+			User:    rev.User,
+			Wiki:    gap.Wiki,
+			Minor:   rev.Minor,
+			Revision: recentchanges.Revision{
+				New: rev.RevID,
+				Old: rev.ParentID,
+			},
+			Source:     recentchanges.SourceAPI,
+			Backfilled: true,
+		}
+
+		data, err := json.Marshal(rc)
+		if err != nil {
+			d.logger.WithError(err).Error("Could not marshal")
+			continue
+		}
+
+		d.logger.WithFields(logrus.Fields{
+			"msg": fmt.Sprintf("%+v", rc),
+		}).Info("Backfilled revision")
+		d.natsconn.Publish(rceventnormalizer.DefaultNormalizedSubj, data)
+	}
+}
@@ -0,0 +1,131 @@
+package rcgapdetector_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventdeduplicator"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rceventnormalizer"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcgapdetector"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// gatedRevisions returns the revision closing each gap once the gate is
+// opened, recording how many fetches ran at once
+type gatedRevisions struct {
+	revisions.RevisionFetcher
+	gate chan struct{}
+
+	mux        sync.Mutex
+	running    int
+	maxRunning int
+	fetched    int
+}
+
+func (f *gatedRevisions) FetchBetween(wiki string, title string, startID int, endID int) ([]revisions.Revision, error) {
+	f.mux.Lock()
+	f.running++
+	if f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+	f.mux.Unlock()
+
+	<-f.gate
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.running--
+	f.fetched++
+	return []revisions.Revision{
+		{RevID: startID},
+		{RevID: endID, ParentID: startID},
+	}, nil
+}
+
+func TestGapDetectorBackfill(t *testing.T) {
+	s, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Nats server did not start")
+	}
+
+	conn, err := nats.Connect("nats://" + s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	gaps := make(chan *nats.Msg, 20)
+	backfilled := make(chan *nats.Msg, 20)
+	_, err = conn.ChanSubscribe(rcgapdetector.DefaultGapSubj, gaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ChanSubscribe(rceventnormalizer.DefaultNormalizedSubj, backfilled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	fetcher := &gatedRevisions{gate: make(chan struct{})}
+	rcgapdetector.NewGapDetector(conn, fetcher, logger, rcgapdetector.Options{
+		Workers: 2,
+		Pending: 3,
+	}).Detect()
+
+	// Ten pages each have a gap, but only 2 are backfilled at once, and 3
+	// more wait
+	for page := 0; page < 10; page++ {
+		title := fmt.Sprintf("Page %d", page)
+		for _, rc := range []interface{}{edit(title, 1, 2), edit(title, 5, 6)} {
+			data, _ := json.Marshal(rc)
+			conn.Publish(rceventdeduplicator.DefaultDeduplicatedSubj, data)
+		}
+	}
+	conn.Flush()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-gaps:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d gaps reported, want 10", i)
+		}
+	}
+	// Each gap is queued just after it is reported
+	time.Sleep(50 * time.Millisecond)
+	close(fetcher.gate)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-backfilled:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d revisions backfilled, want 5", i)
+		}
+	}
+	select {
+	case <-backfilled:
+		t.Error("got more than 5 revisions backfilled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	fetcher.mux.Lock()
+	defer fetcher.mux.Unlock()
+	if fetcher.maxRunning != 2 || fetcher.fetched != 5 {
+		t.Errorf("got %d fetches, %d at once, want 5, 2 at once", fetcher.fetched, fetcher.maxRunning)
+	}
+}
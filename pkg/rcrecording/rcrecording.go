@@ -0,0 +1,200 @@
+// Package rcrecording records raw recent change streams, such as EventStreams
+// events, IRC lines or nats messages, to JSON lines files, and plays them back
+// with their original timing
+package rcrecording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SourceSSE records the data of EventStreams events
+	SourceSSE = "sse"
+
+	// SourceIRC records lines from IRC channels
+	SourceIRC = "irc"
+
+	// SourceNATS records messages from a nats subject
+	SourceNATS = "nats"
+)
+
+// Record is a single recorded event
+type Record struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+
+	// Subject is the nats subject or IRC channel the event came from
+	Subject string `json:"subject,omitempty"`
+
+	// ID is the ID of an EventStreams event, used to resume the stream
+	ID string `json:"id,omitempty"`
+
+	// Data is the event as received, such as the JSON of an EventStreams
+	// event or a whole IRC line
+	Data string `json:"data"`
+}
+
+// Writer writes records as JSON lines. It is safe for concurrent use.
+type Writer struct {
+	mux     sync.Mutex
+	file    io.Closer
+	gzip    *gzip.Writer
+	buf     *bufio.Writer
+	encoder *json.Encoder
+}
+
+// Create creates a recording, compressed with gzip if the path ends in .gz
+func Create(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{file: file}
+	var out io.Writer = file
+	if strings.HasSuffix(path, ".gz") {
+		w.gzip = gzip.NewWriter(file)
+		out = w.gzip
+	}
+	w.buf = bufio.NewWriter(out)
+	w.encoder = json.NewEncoder(w.buf)
+	return w, nil
+}
+
+// Write appends a record
+func (w *Writer) Write(r Record) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.encoder.Encode(r)
+}
+
+// Flush writes buffered records through to the file. Compressed recordings
+// are only readable up to the last flush until closed.
+func (w *Writer) Flush() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	err := w.buf.Flush()
+	if err == nil && w.gzip != nil {
+		err = w.gzip.Flush()
+	}
+	return err
+}
+
+// Close flushes and closes the recording
+func (w *Writer) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	err := w.buf.Flush()
+	if w.gzip != nil {
+		if gzipErr := w.gzip.Close(); err == nil {
+			err = gzipErr
+		}
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reader reads the records of a recording in order
+type Reader struct {
+	file    io.Closer
+	decoder *json.Decoder
+}
+
+// Open opens a recording, decompressing it if the path ends in .gz
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var in io.Reader = bufio.NewReader(file)
+	if strings.HasSuffix(path, ".gz") {
+		in, err = gzip.NewReader(in)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &Reader{file: file, decoder: json.NewDecoder(in)}, nil
+}
+
+// NewReader reads records from an uncompressed recording
+func NewReader(r io.Reader) *Reader {
+	return &Reader{decoder: json.NewDecoder(r)}
+}
+
+// Next reads the next record, returning io.EOF at the end of the recording
+func (r *Reader) Next() (Record, error) {
+	record := Record{}
+	err := r.decoder.Decode(&record)
+	return record, err
+}
+
+// Close closes the recording
+func (r *Reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// Play calls handle with each record at the time it was recorded, relative to
+// the first, sped up by speed. A speed of 0 or less plays as fast as
+// possible. Playing stops early when stop is closed, or handle fails.
+func Play(r *Reader, speed float64, stop <-chan struct{}, handle func(Record) error) error {
+	var start time.Time
+	var first time.Time
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if start.IsZero() {
+			start = time.Now()
+			first = record.Time
+		}
+
+		if speed > 0 {
+			wait := time.Until(start.Add(delay(first, record.Time, speed)))
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		err = handle(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// delay returns when a record made at t is played, after the first record
+// made at first
+func delay(first, t time.Time, speed float64) time.Duration {
+	return time.Duration(float64(t.Sub(first)) / speed)
+}
@@ -0,0 +1,122 @@
+package rcrecording
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRecords = []Record{
+	{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Source: SourceSSE, ID: `[{"topic":"eqiad.mediawiki.recentchange","offset":1}]`, Data: `{"title":"A"}`},
+	{Time: time.Date(2020, 1, 1, 0, 0, 0, 500000000, time.UTC), Source: SourceIRC, Subject: "#en.wikipedia", Data: ":rc-pmtpa!~rc-pmtpa@localhost PRIVMSG #en.wikipedia :\x0314[[\x0307A\x0314]]"},
+	{Time: time.Date(2020, 1, 1, 0, 0, 2, 0, time.UTC), Source: SourceNATS, Subject: "recentchanges.dedup", Data: `{"id":1}`},
+}
+
+func writeRecording(t *testing.T, path string) {
+	w, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range testRecords {
+		err = w.Write(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"recording.jsonl", "recording.jsonl.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			writeRecording(t, path)
+
+			r, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			got := []Record{}
+			err = Play(r, 0, nil, func(record Record) error {
+				got = append(got, record)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, testRecords) {
+				t.Errorf("got %+v, want %+v", got, testRecords)
+			}
+		})
+	}
+}
+
+func TestPlayTiming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	writeRecording(t, path)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The recording spans 2s, played in 20ms
+	start := time.Now()
+	offsets := []time.Duration{}
+	err = Play(r, 100, nil, func(record Record) error {
+		offsets = append(offsets, time.Since(start))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offsets[1] < 5*time.Millisecond || offsets[2] < 20*time.Millisecond {
+		t.Errorf("got records at %v, want 0s, 5ms and 20ms", offsets)
+	}
+}
+
+func TestPlayStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	writeRecording(t, path)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stop := make(chan struct{})
+	played := 0
+	err = Play(r, 1, stop, func(record Record) error {
+		played++
+		close(stop)
+		return nil
+	})
+	if err != nil || played != 1 {
+		t.Errorf("got %d played and error %v, want 1", played, err)
+	}
+
+	fail := errors.New("fail")
+	err = Play(r, 0, nil, func(Record) error { return fail })
+	if err != fail {
+		t.Errorf("got error %v, want %v", err, fail)
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := NewReader(strings.NewReader("{\"time\":")).Next()
+	if err == nil || err == io.EOF {
+		t.Errorf("got error %v for a truncated record", err)
+	}
+}
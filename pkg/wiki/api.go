@@ -0,0 +1,52 @@
+package wiki
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validWiki matches normalized wiki names, which are used in hosts, paths and
+// nats subjects
+var validWiki = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// projectHosts are the hosts of wikis which are not language wikipedias
+var projectHosts = map[string]string{
+	"commons":  "commons.wikimedia.org",
+	"meta":     "meta.wikimedia.org",
+	"species":  "species.wikimedia.org",
+	"wikidata": "www.wikidata.org",
+}
+
+// ValidWiki reports whether a wiki name is normalized, so it can't escape the
+// host, path or subject it is placed in. Names from the nats bus must be
+// checked before being fetched.
+func ValidWiki(wiki string) bool {
+	return validWiki.MatchString(wiki)
+}
+
+// APIURL returns the Action API endpoint of a normalized wiki name, such as
+// "en" for the English Wikipedia
+func APIURL(wiki string) string {
+	host, ok := projectHosts[wiki]
+	if !ok {
+		host = wiki + ".wikipedia.org"
+	}
+	return fmt.Sprintf("https://%s/w/api.php", host)
+}
+
+// HostWiki returns the normalized wiki name of a host, the inverse of APIURL,
+// or "" if the host is not a wiki
+func HostWiki(host string) string {
+	for wiki, projectHost := range projectHosts {
+		if host == projectHost {
+			return wiki
+		}
+	}
+
+	wiki := strings.TrimSuffix(host, ".wikipedia.org")
+	if wiki == host || wiki == "" || strings.Contains(wiki, ".") {
+		return ""
+	}
+	return wiki
+}
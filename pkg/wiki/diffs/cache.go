@@ -0,0 +1,199 @@
+package diffs
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheStats counts diffs served from memory ("hits"), from disk
+// ("diskhits"), fetched from the inner DiffFetcher ("misses"), and requests
+// which waited on an identical fetch already in flight ("coalesced")
+var cacheStats = expvar.NewMap("diffs.cache")
+
+// CacheOptions configures a CachingDiffFetch
+type CacheOptions struct {
+	// Size is the number of diffs kept in memory
+	Size int
+
+	// Dir is where diffs are also kept on disk, outliving the memory cache
+	// and restarts. Nothing is written to disk when empty.
+	Dir string
+}
+
+// DefaultCacheOptions keeps the most recent diffs in memory only
+var DefaultCacheOptions = CacheOptions{
+	Size: 1000,
+}
+
+type cacheKey struct {
+	wiki     string
+	revision int
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	body []byte
+}
+
+// flight is a fetch shared by every request for the same revision
+type flight struct {
+	wg   sync.WaitGroup
+	body []byte
+	err  error
+}
+
+// CachingDiffFetch is a DiffFetcher which keeps the diffs fetched by an inner
+// DiffFetcher in a least recently used cache, and shares a single fetch
+// between concurrent requests for the same revision. Bodies are shared between
+// callers and must not be modified.
+type CachingDiffFetch struct {
+	logger   *logrus.Logger
+	inner    DiffFetcher
+	options  CacheOptions
+	mux      sync.Mutex
+	lru      *list.List
+	entries  map[cacheKey]*list.Element
+	inflight map[cacheKey]*flight
+}
+
+// NewCachingDiffFetcher creates a DiffFetcher caching diffs fetched by inner
+func NewCachingDiffFetcher(logger *logrus.Logger, inner DiffFetcher, o CacheOptions) (*CachingDiffFetch, error) {
+	if o.Dir != "" {
+		err := os.MkdirAll(o.Dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &CachingDiffFetch{
+		logger:   logger,
+		inner:    inner,
+		options:  o,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+		inflight: make(map[cacheKey]*flight),
+	}, nil
+}
+
+// Fetch returns the cached diff of the revision, fetching it if necessary
+func (c *CachingDiffFetch) Fetch(wikiName string, revision int) ([]byte, error) {
+	// The wiki is part of the path diffs are stored at
+	if !wiki.ValidWiki(wikiName) {
+		return nil, fmt.Errorf("Invalid wiki %q", wikiName)
+	}
+	key := cacheKey{wikiName, revision}
+
+	c.mux.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		c.mux.Unlock()
+		cacheStats.Add("hits", 1)
+		return element.Value.(*cacheEntry).body, nil
+	}
+
+	if f, ok := c.inflight[key]; ok {
+		c.mux.Unlock()
+		cacheStats.Add("coalesced", 1)
+		f.wg.Wait()
+		return f.body, f.err
+	}
+
+	f := &flight{}
+	f.wg.Add(1)
+	c.inflight[key] = f
+	c.mux.Unlock()
+
+	f.body, f.err = c.fetch(key)
+
+	c.mux.Lock()
+	delete(c.inflight, key)
+	if f.err == nil && ParseAPIError(f.body) == nil {
+		c.add(key, f.body)
+	}
+	c.mux.Unlock()
+	f.wg.Done()
+
+	return f.body, f.err
+}
+
+// fetch reads the diff from disk, or fetches it from the inner DiffFetcher
+func (c *CachingDiffFetch) fetch(key cacheKey) ([]byte, error) {
+	if c.options.Dir != "" {
+		body, err := ioutil.ReadFile(c.path(key))
+		if err == nil {
+			cacheStats.Add("diskhits", 1)
+			return body, nil
+		}
+		if !os.IsNotExist(err) {
+			c.logger.WithError(err).WithField("revision", key.revision).Warn("Could not read cached diff")
+		}
+	}
+
+	cacheStats.Add("misses", 1)
+	body, err := c.inner.Fetch(key.wiki, key.revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors such as missing revisions may be transient, so are not stored
+	if c.options.Dir != "" && ParseAPIError(body) == nil {
+		err := c.store(key, body)
+		if err != nil {
+			c.logger.WithError(err).WithField("revision", key.revision).Warn("Could not cache diff")
+		}
+	}
+	return body, nil
+}
+
+// add adds a diff to the memory cache, evicting the least recently used diffs
+// beyond Size. c.mux must be held.
+func (c *CachingDiffFetch) add(key cacheKey, body []byte) {
+	if c.options.Size <= 0 {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, body})
+	for c.lru.Len() > c.options.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *CachingDiffFetch) path(key cacheKey) string {
+	return filepath.Join(c.options.Dir, key.wiki, strconv.Itoa(key.revision)+".json")
+}
+
+// store writes a diff to disk, renaming it into place so readers never see a
+// partial diff
+func (c *CachingDiffFetch) store(key cacheKey, body []byte) error {
+	path := c.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".diff")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
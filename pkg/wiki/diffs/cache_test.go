@@ -0,0 +1,168 @@
+package diffs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// countingFetcher counts fetches, optionally blocking them until the gate is
+// opened
+type countingFetcher struct {
+	mux     sync.Mutex
+	fetches map[string]int
+	gate    chan struct{}
+	body    string
+}
+
+func newCountingFetcher(body string) *countingFetcher {
+	return &countingFetcher{
+		fetches: make(map[string]int),
+		body:    body,
+	}
+}
+
+func (f *countingFetcher) Fetch(wiki string, revision int) ([]byte, error) {
+	f.mux.Lock()
+	f.fetches[wiki+":"+strconv.Itoa(revision)]++
+	f.mux.Unlock()
+
+	if f.gate != nil {
+		<-f.gate
+	}
+	return []byte(f.body), nil
+}
+
+func (f *countingFetcher) count(wiki string, revision int) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.fetches[wiki+":"+strconv.Itoa(revision)]
+}
+
+func newCache(t *testing.T, inner diffs.DiffFetcher, o diffs.CacheOptions) *diffs.CachingDiffFetch {
+	logger, _ := test.NewNullLogger()
+	cache, err := diffs.NewCachingDiffFetcher(logger, inner, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestCachingDiffFetcher(t *testing.T) {
+	inner := newCountingFetcher("{}")
+	cache := newCache(t, inner, diffs.CacheOptions{Size: 2})
+
+	cache.Fetch("en", 1)
+	cache.Fetch("en", 1)
+	cache.Fetch("de", 1)
+	if inner.count("en", 1) != 1 || inner.count("de", 1) != 1 {
+		t.Errorf("got %v fetches, want 1 per wiki", inner.fetches)
+	}
+
+	// Revision 1 of en is the least recently used
+	cache.Fetch("de", 1)
+	cache.Fetch("en", 2)
+	cache.Fetch("de", 1)
+	cache.Fetch("en", 1)
+	if inner.count("en", 1) != 2 || inner.count("de", 1) != 1 {
+		t.Errorf("got %v fetches, want en:1 evicted", inner.fetches)
+	}
+}
+
+func TestCachingDiffFetcherCoalesces(t *testing.T) {
+	inner := newCountingFetcher("{}")
+	inner.gate = make(chan struct{})
+	cache := newCache(t, inner, diffs.DefaultCacheOptions)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := cache.Fetch("en", 1)
+			if err != nil || string(body) != "{}" {
+				t.Errorf("got %q, %v, want {}", string(body), err)
+			}
+		}()
+	}
+
+	// Wait for the first request to reach the fetcher
+	for inner.count("en", 1) == 0 {
+		runtime.Gosched()
+	}
+	close(inner.gate)
+	wg.Wait()
+
+	if inner.count("en", 1) != 1 {
+		t.Errorf("got %d fetches, want 1", inner.count("en", 1))
+	}
+}
+
+func TestCachingDiffFetcherDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diffcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := newCountingFetcher("{}")
+	newCache(t, inner, diffs.CacheOptions{Dir: dir}).Fetch("en", 1)
+
+	// A new cache has an empty memory tier
+	body, err := newCache(t, inner, diffs.CacheOptions{Dir: dir}).Fetch("en", 1)
+	if err != nil || string(body) != "{}" {
+		t.Errorf("got %q, %v, want {}", string(body), err)
+	}
+
+	if inner.count("en", 1) != 1 {
+		t.Errorf("got %d fetches, want 1", inner.count("en", 1))
+	}
+}
+
+func TestCachingDiffFetcherSkipsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diffcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := newCountingFetcher(noSuchRevID)
+	cache := newCache(t, inner, diffs.CacheOptions{Size: 10, Dir: dir})
+	cache.Fetch("en", 2)
+	cache.Fetch("en", 2)
+
+	if inner.count("en", 2) != 2 {
+		t.Errorf("got %d fetches, want 2", inner.count("en", 2))
+	}
+}
+
+func TestCachingDiffFetcherInvalidWiki(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diffcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := newCountingFetcher("{}")
+	cache := newCache(t, inner, diffs.CacheOptions{Size: 10, Dir: filepath.Join(dir, "a", "b")})
+	for _, wiki := range []string{"../../x", "attacker.example/x#", ""} {
+		_, err := cache.Fetch(wiki, 1)
+		if err == nil {
+			t.Errorf("got no error for wiki %q", wiki)
+		}
+		if inner.count(wiki, 1) != 0 {
+			t.Errorf("got %d fetches of wiki %q, want 0", inner.count(wiki, 1), wiki)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "x")); !os.IsNotExist(err) {
+		t.Errorf("got a diff written outside the cache")
+	}
+}
@@ -0,0 +1,234 @@
+package diffs
+
+import (
+	"container/heap"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/sirupsen/logrus"
+)
+
+// replicaLag counts, per wiki, revisions re-attempted because the API did not
+// know about them yet ("<wiki>.retried"), revisions found on a re-attempt
+// ("<wiki>.recovered"), and revisions still missing once out of attempts
+// ("<wiki>.missing")
+var replicaLag = expvar.NewMap("diffs.replicalag")
+
+// DelayOptions configures a DelayedDiffQueue
+type DelayOptions struct {
+	// MinAge is how old a recent change must be before its diff is fetched
+	MinAge time.Duration
+
+	// RetryDelay is how long to wait before re-attempting a missing revision.
+	// Each attempt waits RetryDelay longer than the previous.
+	RetryDelay time.Duration
+
+	// MaxRetries is how many times a missing revision is re-attempted
+	MaxRetries int
+
+	// MaxPending is how many recent changes can wait to age before Queue
+	// blocks. Retries are not held back, so a few more may wait.
+	MaxPending int
+}
+
+// DefaultDelayOptions gives replicas a few seconds to catch up
+var DefaultDelayOptions = DelayOptions{
+	MinAge:     2 * time.Second,
+	RetryDelay: 5 * time.Second,
+	MaxRetries: 3,
+	MaxPending: 10000,
+}
+
+// delayedRequest is a recent change waiting to be queued
+type delayedRequest struct {
+	rc      recentchanges.NormalizedRecentChange
+	cb      HandleFetchResponse
+	attempt int
+	due     time.Time
+}
+
+// delayHeap orders delayed requests by when they are due
+type delayHeap []*delayedRequest
+
+func (h delayHeap) Len() int            { return len(h) }
+func (h delayHeap) Less(i, j int) bool  { return h[i].due.Before(h[j].due) }
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(*delayedRequest)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// DelayedDiffQueue is a DiffQueuer which waits for recent changes to age
+// before queueing them with an inner DiffQueuer, and re-queues revisions the
+// API reports as missing while they are newer than the last revision fetched
+// from that wiki, as the API replica has likely not seen them yet. Waiting
+// requests are queued in order by a single goroutine, so an inner queue which
+// blocks when full holds back Queue too.
+type DelayedDiffQueue struct {
+	logger   *logrus.Logger
+	inner    DiffQueuer
+	options  DelayOptions
+	mux      sync.Mutex
+	lastGood map[string]int
+
+	pendingMux *sync.Mutex
+	notFull    *sync.Cond
+	pending    *delayHeap
+	wake       chan struct{}
+}
+
+// NewDelayedDiffQueuer creates a DiffQueuer delaying requests to inner
+func NewDelayedDiffQueuer(logger *logrus.Logger, inner DiffQueuer, o DelayOptions) *DelayedDiffQueue {
+	if o.MaxPending <= 0 {
+		o.MaxPending = DefaultDelayOptions.MaxPending
+	}
+
+	pendingMux := &sync.Mutex{}
+	d := &DelayedDiffQueue{
+		logger:     logger,
+		inner:      inner,
+		options:    o,
+		lastGood:   make(map[string]int),
+		pendingMux: pendingMux,
+		notFull:    sync.NewCond(pendingMux),
+		pending:    &delayHeap{},
+		wake:       make(chan struct{}, 1),
+	}
+	go d.run()
+	return d
+}
+
+// Queue queues the recent change once it is at least MinAge old, blocking
+// while MaxPending changes are waiting
+func (d *DelayedDiffQueue) Queue(rc recentchanges.NormalizedRecentChange, cb HandleFetchResponse) {
+	wait := d.options.MinAge
+	if rc.Timestamp > 0 {
+		wait -= time.Since(time.Unix(int64(rc.Timestamp), 0))
+	}
+
+	if wait <= 0 {
+		d.queue(rc, cb, 0)
+		return
+	}
+
+	d.pendingMux.Lock()
+	for d.pending.Len() >= d.options.MaxPending {
+		d.notFull.Wait()
+	}
+	d.delay(&delayedRequest{rc: rc, cb: cb, due: time.Now().Add(wait)})
+	d.pendingMux.Unlock()
+}
+
+// delay adds a request to those waiting. d.pendingMux must be held.
+func (d *DelayedDiffQueue) delay(request *delayedRequest) {
+	heap.Push(d.pending, request)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run queues waiting requests with the inner queue as they fall due
+func (d *DelayedDiffQueue) run() {
+	timer := time.NewTimer(0)
+	for {
+		d.pendingMux.Lock()
+		var request *delayedRequest
+		var wait time.Duration
+		if d.pending.Len() > 0 {
+			wait = time.Until((*d.pending)[0].due)
+			if wait <= 0 {
+				request = heap.Pop(d.pending).(*delayedRequest)
+				d.notFull.Signal()
+			}
+		}
+		empty := d.pending.Len() == 0
+		d.pendingMux.Unlock()
+
+		if request != nil {
+			d.queue(request.rc, request.cb, request.attempt)
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if empty {
+			<-d.wake
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *DelayedDiffQueue) queue(rc recentchanges.NormalizedRecentChange, cb HandleFetchResponse, attempt int) {
+	d.inner.Queue(rc, func(body []byte, err error) error {
+		if err != nil {
+			return cb(body, err)
+		}
+
+		revision := rc.Revision.New
+		apiErr := ParseAPIError(body)
+		if apiErr == nil {
+			d.markGood(rc.Wiki, revision)
+			if attempt > 0 {
+				replicaLag.Add(rc.Wiki+".recovered", 1)
+			}
+			return cb(body, nil)
+		}
+
+		if apiErr.Code != ErrCodeNoSuchRevID {
+			return cb(body, apiErr)
+		}
+
+		if attempt < d.options.MaxRetries && revision > d.last(rc.Wiki) {
+			replicaLag.Add(rc.Wiki+".retried", 1)
+			delay := d.options.RetryDelay * time.Duration(attempt+1)
+			d.logger.WithFields(logrus.Fields{
+				"wiki":     rc.Wiki,
+				"revision": revision,
+				"attempt":  attempt + 1,
+				"delay":    delay.String(),
+			}).Warn("Revision not found yet, retrying")
+
+			// Retries skip the MaxPending limit, as they are queued by the
+			// inner queue's worker, which must not block on itself
+			d.pendingMux.Lock()
+			d.delay(&delayedRequest{rc: rc, cb: cb, attempt: attempt + 1, due: time.Now().Add(delay)})
+			d.pendingMux.Unlock()
+			return nil
+		}
+
+		replicaLag.Add(rc.Wiki+".missing", 1)
+		return cb(body, apiErr)
+	})
+}
+
+func (d *DelayedDiffQueue) markGood(wiki string, revision int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if revision > d.lastGood[wiki] {
+		d.lastGood[wiki] = revision
+	}
+}
+
+func (d *DelayedDiffQueue) last(wiki string) int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.lastGood[wiki]
+}
@@ -0,0 +1,222 @@
+package diffs_test
+
+import (
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+const noSuchRevID = `{"error":{"code":"nosuchrevid","info":"There is no revision with ID 2."}}`
+
+// scriptedQueuer responds to each request for a revision with the next body
+type scriptedQueuer struct {
+	mux    sync.Mutex
+	bodies map[int][]string
+}
+
+// newScriptedQueuer creates a scriptedQueuer, copying bodies so fixtures can
+// be reused
+func newScriptedQueuer(bodies map[int][]string) *scriptedQueuer {
+	q := &scriptedQueuer{bodies: make(map[int][]string)}
+	for revision, script := range bodies {
+		q.bodies[revision] = append([]string(nil), script...)
+	}
+	return q
+}
+
+func (q *scriptedQueuer) Queue(rc recentchanges.NormalizedRecentChange, cb diffs.HandleFetchResponse) {
+	q.mux.Lock()
+	bodies := q.bodies[rc.Revision.New]
+	body := bodies[0]
+	if len(bodies) > 1 {
+		q.bodies[rc.Revision.New] = bodies[1:]
+	}
+	q.mux.Unlock()
+	cb([]byte(body), nil)
+}
+
+type inDelayed struct {
+	bodies  map[int][]string
+	changes []recentchanges.NormalizedRecentChange
+}
+
+type wantDelayed struct {
+	bodies []string
+	errs   []bool
+	metric string
+}
+
+var delayedTests = []struct {
+	name string
+	in   inDelayed
+	want wantDelayed
+}{
+	{
+		name: "recovered",
+		in: inDelayed{
+			bodies: map[int][]string{
+				2: {noSuchRevID, noSuchRevID, "{}"},
+			},
+			changes: []recentchanges.NormalizedRecentChange{
+				{Wiki: "recovered", Revision: recentchanges.Revision{New: 2}},
+			},
+		},
+		want: wantDelayed{
+			bodies: []string{"{}"},
+			errs:   []bool{false},
+			metric: "recovered.recovered",
+		},
+	},
+	{
+		name: "out of attempts",
+		in: inDelayed{
+			bodies: map[int][]string{
+				2: {noSuchRevID},
+			},
+			changes: []recentchanges.NormalizedRecentChange{
+				{Wiki: "missing", Revision: recentchanges.Revision{New: 2}},
+			},
+		},
+		want: wantDelayed{
+			bodies: []string{noSuchRevID},
+			errs:   []bool{true},
+			metric: "missing.missing",
+		},
+	},
+	{
+		name: "older than last good",
+		in: inDelayed{
+			bodies: map[int][]string{
+				3: {"{}"},
+				2: {noSuchRevID, "{}"},
+			},
+			changes: []recentchanges.NormalizedRecentChange{
+				{Wiki: "deleted", Revision: recentchanges.Revision{New: 3}},
+				{Wiki: "deleted", Revision: recentchanges.Revision{New: 2}},
+			},
+		},
+		want: wantDelayed{
+			bodies: []string{"{}", noSuchRevID},
+			errs:   []bool{false, true},
+			metric: "deleted.missing",
+		},
+	},
+}
+
+// replicaLag returns a counter of the diffs.replicalag metric, which is shared
+// by every test
+func replicaLag(key string) int64 {
+	metric, ok := expvar.Get("diffs.replicalag").(*expvar.Map).Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return metric.Value()
+}
+
+func TestDelayedDiffQueuer(t *testing.T) {
+	for _, tt := range delayedTests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := replicaLag(tt.want.metric)
+
+			logger, _ := test.NewNullLogger()
+			queuer := diffs.NewDelayedDiffQueuer(logger, newScriptedQueuer(tt.in.bodies), diffs.DelayOptions{
+				RetryDelay: time.Millisecond,
+				MaxRetries: 3,
+			})
+
+			for i, rc := range tt.in.changes {
+				done := make(chan struct{})
+				queuer.Queue(rc, func(body []byte, err error) error {
+					if string(body) != tt.want.bodies[i] {
+						t.Errorf("got %q, want %q", string(body), tt.want.bodies[i])
+					}
+
+					if (err != nil) != tt.want.errs[i] {
+						t.Errorf("got error %v, want error %v", err, tt.want.errs[i])
+					}
+					close(done)
+					return nil
+				})
+				<-done
+			}
+
+			if added := replicaLag(tt.want.metric) - before; added != 1 {
+				t.Errorf("got %d added to %s, want 1", added, tt.want.metric)
+			}
+		})
+	}
+}
+
+func TestDelayedDiffQueuerMinAge(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	queuer := diffs.NewDelayedDiffQueuer(logger, newScriptedQueuer(map[int][]string{1: {"{}"}}), diffs.DelayOptions{
+		MinAge: 50 * time.Millisecond,
+	})
+
+	start := time.Now()
+	done := make(chan struct{})
+	queuer.Queue(recentchanges.NormalizedRecentChange{
+		Timestamp: int(start.Unix()) - 60,
+		Revision:  recentchanges.Revision{New: 1},
+	}, func(body []byte, err error) error {
+		close(done)
+		return nil
+	})
+	<-done
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("old change waited %s", elapsed)
+	}
+
+	done = make(chan struct{})
+	queuer.Queue(recentchanges.NormalizedRecentChange{
+		Revision: recentchanges.Revision{New: 1},
+	}, func(body []byte, err error) error {
+		close(done)
+		return nil
+	})
+	<-done
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("new change waited %s, want at least 50ms", elapsed)
+	}
+}
+
+func TestDelayedDiffQueuerMaxPending(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	queuer := diffs.NewDelayedDiffQueuer(logger, newScriptedQueuer(map[int][]string{1: {"{}"}, 2: {"{}"}}), diffs.DelayOptions{
+		MinAge:     100 * time.Millisecond,
+		MaxPending: 1,
+	})
+
+	handled := make(chan int, 2)
+	queue := func(revision int) {
+		queuer.Queue(recentchanges.NormalizedRecentChange{
+			Revision: recentchanges.Revision{New: revision},
+		}, func(body []byte, err error) error {
+			handled <- revision
+			return nil
+		})
+	}
+
+	start := time.Now()
+	queue(1)
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("first change blocked for %s", elapsed)
+	}
+
+	// The second change waits for the first to be queued
+	queue(2)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("second change blocked for %s, want at least 100ms", elapsed)
+	}
+
+	for _, want := range []int{1, 2} {
+		if revision := <-handled; revision != want {
+			t.Errorf("got revision %d, want %d", revision, want)
+		}
+	}
+}
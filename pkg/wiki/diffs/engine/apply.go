@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+)
+
+// MismatchError is returned when a diff does not apply to a text
+type MismatchError struct {
+	Line   int // The line of the text, from 1
+	Want   string
+	Actual string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("Diff does not apply at line %d: want %q, got %q", e.Line, e.Want, e.Actual)
+}
+
+// sameLine compares lines ignoring the whitespace compare tables do not
+// reliably preserve
+func sameLine(a, b string) bool {
+	normalize := func(s string) string {
+		return strings.TrimSpace(strings.Replace(s, "\u00a0", " ", -1))
+	}
+	return normalize(a) == normalize(b)
+}
+
+// Apply applies the rows of a wikitext diff, such as those of a compare
+// table, to the text on its from side, returning the text on its to side
+func Apply(text string, rows []diffs.Row) (string, error) {
+	lines := splitLines(text)
+	result := []string{}
+	pos := 0
+
+	line := func(want string) error {
+		if pos >= len(lines) {
+			return &MismatchError{pos + 1, want, ""}
+		}
+		if !sameLine(lines[pos], want) {
+			return &MismatchError{pos + 1, want, lines[pos]}
+		}
+		pos++
+		return nil
+	}
+
+	for _, row := range rows {
+		var err error
+		switch row.Kind {
+		case diffs.RowHeader:
+			start, ok := headerLine(row.From.Text)
+			if !ok {
+				return "", fmt.Errorf("Unknown diff header %q", row.From.Text)
+			}
+			if start-1 < pos || start-1 > len(lines) {
+				return "", fmt.Errorf("Diff header %q is out of order", row.From.Text)
+			}
+			result = append(result, lines[pos:start-1]...)
+			pos = start - 1
+		case diffs.RowContext:
+			result = append(result, row.To.Text)
+			err = line(row.From.Text)
+		case diffs.RowDeleted:
+			err = line(row.From.Text)
+		case diffs.RowAdded:
+			result = append(result, row.To.Text)
+		case diffs.RowChanged:
+			result = append(result, row.To.Text)
+			err = line(row.From.Text)
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	result = append(result, lines[pos:]...)
+	return strings.Join(result, "\n"), nil
+}
+
+// headerLine returns the line number of a diff header. MediaWiki words the
+// header in the user language and groups the digits of the number, as in
+// "Line 1,234:", so every digit of the header is read as the number.
+func headerLine(text string) (int, bool) {
+	line, digits := 0, 0
+	for _, r := range text {
+		if r >= '0' && r <= '9' {
+			line = line*10 + int(r-'0')
+			digits++
+		}
+	}
+	return line, digits > 0
+}
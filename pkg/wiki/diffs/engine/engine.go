@@ -0,0 +1,234 @@
+// Package engine computes diffs of wikitext locally, in the same form as the
+// compare tables of the Action API parsed by diffs.ParseTable
+package engine
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+)
+
+// Options configures a diff
+type Options struct {
+	// Context is the number of unchanged lines shown around each change
+	Context int
+
+	// Similarity is how much of a deleted line must survive in an added line
+	// for the two to be shown as one changed line, from 0 to 1
+	Similarity float64
+}
+
+// DefaultOptions matches the diffs shown by MediaWiki
+var DefaultOptions = Options{
+	Context:    2,
+	Similarity: 0.25,
+}
+
+// Diff compares two wikitexts paragraph by paragraph, and changed
+// paragraphs word by word
+func Diff(from, to string, o Options) []diffs.Row {
+	a := splitLines(from)
+	b := splitLines(to)
+	ops := diff(a, b)
+
+	rows := []diffs.Row{}
+	for _, hunk := range hunks(ops, o.Context) {
+		first := ops[hunk.start]
+		rows = append(rows, diffs.Row{
+			Kind: diffs.RowHeader,
+			From: diffs.Line{Text: "Line " + strconv.Itoa(first.a+1) + ":"},
+			To:   diffs.Line{Text: "Line " + strconv.Itoa(first.b+1) + ":"},
+		})
+
+		for i := hunk.start; i < hunk.end; {
+			if ops[i].kind == opEqual {
+				rows = append(rows, diffs.Row{
+					Kind: diffs.RowContext,
+					From: diffs.Line{Text: a[ops[i].a]},
+					To:   diffs.Line{Text: b[ops[i].b]},
+				})
+				i++
+				continue
+			}
+
+			deleted, added := []string{}, []string{}
+			for ; i < hunk.end && ops[i].kind != opEqual; i++ {
+				if ops[i].kind == opDelete {
+					deleted = append(deleted, a[ops[i].a])
+				} else {
+					added = append(added, b[ops[i].b])
+				}
+			}
+			rows = append(rows, changeRows(deleted, added, o.Similarity)...)
+		}
+	}
+	return rows
+}
+
+// splitLines splits wikitext into paragraphs. Empty text has none.
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// hunk is a run of ops shown under one header
+type hunk struct {
+	start int
+	end   int
+}
+
+// hunks groups changes with up to context unchanged ops either side. Groups
+// whose context would touch are merged.
+func hunks(ops []op, context int) []hunk {
+	visible := make([]bool, len(ops))
+	for i, o := range ops {
+		if o.kind == opEqual {
+			continue
+		}
+
+		visible[i] = true
+		for j := i - 1; j >= 0 && j >= i-context && ops[j].kind == opEqual; j-- {
+			visible[j] = true
+		}
+		for j := i + 1; j < len(ops) && j <= i+context && ops[j].kind == opEqual; j++ {
+			visible[j] = true
+		}
+	}
+
+	result := []hunk{}
+	for i := 0; i < len(ops); i++ {
+		if !visible[i] {
+			continue
+		}
+
+		start := i
+		for i < len(ops) && visible[i] {
+			i++
+		}
+		result = append(result, hunk{start, i})
+	}
+	return result
+}
+
+// changeRows pairs deleted and added paragraphs in order. Similar pairs are
+// diffed word by word, and the rest shown as deleted then added.
+func changeRows(deleted, added []string, similarity float64) []diffs.Row {
+	rows := []diffs.Row{}
+	i := 0
+	for ; i < len(deleted) && i < len(added); i++ {
+		from, to, similar := diffWords(deleted[i], added[i], similarity)
+		if similar {
+			rows = append(rows, diffs.Row{Kind: diffs.RowChanged, From: from, To: to})
+			continue
+		}
+
+		rows = append(rows,
+			diffs.Row{Kind: diffs.RowDeleted, From: diffs.Line{Text: deleted[i]}},
+			diffs.Row{Kind: diffs.RowAdded, To: diffs.Line{Text: added[i]}},
+		)
+	}
+
+	for _, text := range deleted[i:] {
+		rows = append(rows, diffs.Row{Kind: diffs.RowDeleted, From: diffs.Line{Text: text}})
+	}
+	for _, text := range added[i:] {
+		rows = append(rows, diffs.Row{Kind: diffs.RowAdded, To: diffs.Line{Text: text}})
+	}
+	return rows
+}
+
+// splitWords splits a paragraph into runs of word characters, runs of
+// whitespace, and single other characters
+func splitWords(text string) []string {
+	words := []string{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		j := i + 1
+		switch {
+		case isWord(runes[i]):
+			for j < len(runes) && isWord(runes[j]) {
+				j++
+			}
+		case unicode.IsSpace(runes[i]):
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+		}
+		words = append(words, string(runes[i:j]))
+		i = j
+	}
+	return words
+}
+
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isSpace(word string) bool {
+	return strings.TrimSpace(word) == ""
+}
+
+// diffWords diffs two paragraphs word by word, reporting whether enough of
+// the deleted paragraph is unchanged for them to be shown as one change
+func diffWords(from, to string, similarity float64) (diffs.Line, diffs.Line, bool) {
+	a := splitWords(from)
+	b := splitWords(to)
+	ops := diff(a, b)
+
+	unchanged := 0
+	for _, o := range ops {
+		if o.kind == opEqual && !isSpace(a[o.a]) {
+			unchanged += len(a[o.a])
+		}
+	}
+
+	longest := len(from)
+	if len(to) > longest {
+		longest = len(to)
+	}
+	if longest == 0 || float64(unchanged)/float64(longest) < similarity {
+		return diffs.Line{}, diffs.Line{}, false
+	}
+
+	fromLine := diffs.Line{Text: from, Changes: changes(ops, a, opDelete, func(o op) int { return o.a })}
+	toLine := diffs.Line{Text: to, Changes: changes(ops, b, opInsert, func(o op) int { return o.b })}
+	return fromLine, toLine, true
+}
+
+// changes joins the runs of words changed on one side. Changes separated only
+// by unchanged whitespace are joined, as MediaWiki does.
+func changes(ops []op, words []string, kind opKind, index func(op) int) []string {
+	result := []string{}
+	var current strings.Builder
+	var pending strings.Builder
+	for _, o := range ops {
+		switch {
+		case o.kind == kind:
+			if current.Len() > 0 {
+				current.WriteString(pending.String())
+			}
+			pending.Reset()
+			current.WriteString(words[index(o)])
+		case o.kind == opEqual && isSpace(words[index(o)]) && current.Len() > 0:
+			pending.WriteString(words[index(o)])
+		case o.kind == opEqual:
+			if current.Len() > 0 {
+				result = append(result, current.String())
+				current.Reset()
+			}
+			pending.Reset()
+		}
+	}
+
+	if current.Len() > 0 {
+		result = append(result, current.String())
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,247 @@
+package engine_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/engine"
+)
+
+type inEngine struct {
+	from string
+	to   string
+}
+
+type wantEngine struct {
+	// table is the compare table MediaWiki renders for the same change
+	table string
+}
+
+var engineTests = []struct {
+	name string
+	in   inEngine
+	want wantEngine
+}{
+	{
+		name: "changed word",
+		in: inEngine{
+			from: "One.\nTwo.\nThe cat sat on the mat.\nThree.\nFour.\nFive.",
+			to:   "One.\nTwo.\nThe cat lay on the rug.\nThree.\nFour.\nFive.",
+		},
+		want: wantEngine{
+			table: `<tr><td colspan="2" class="diff-lineno">Line 1:</td><td colspan="2" class="diff-lineno">Line 1:</td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>One.</div></td><td class="diff-marker"></td><td class="diff-context"><div>One.</div></td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>Two.</div></td><td class="diff-marker"></td><td class="diff-context"><div>Two.</div></td></tr>
+<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>The cat <del class="diffchange diffchange-inline">sat</del> on the <del class="diffchange diffchange-inline">mat</del>.</div></td><td class="diff-marker">+</td><td class="diff-addedline"><div>The cat <ins class="diffchange diffchange-inline">lay</ins> on the <ins class="diffchange diffchange-inline">rug</ins>.</div></td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>Three.</div></td><td class="diff-marker"></td><td class="diff-context"><div>Three.</div></td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>Four.</div></td><td class="diff-marker"></td><td class="diff-context"><div>Four.</div></td></tr>`,
+		},
+	},
+	{
+		name: "adjacent words",
+		in: inEngine{
+			from: "A quick brown fox.",
+			to:   "A slow red fox.",
+		},
+		want: wantEngine{
+			table: `<tr><td colspan="2" class="diff-lineno">Line 1:</td><td colspan="2" class="diff-lineno">Line 1:</td></tr>
+<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>A <del class="diffchange diffchange-inline">quick brown</del> fox.</div></td><td class="diff-marker">+</td><td class="diff-addedline"><div>A <ins class="diffchange diffchange-inline">slow red</ins> fox.</div></td></tr>`,
+		},
+	},
+	{
+		name: "separate hunks",
+		in: inEngine{
+			from: "1\n2\n3\n4\n5\n6\n7\n8\n9",
+			to:   "0\n1\n2\n3\n4\n5\n6\n7\n8",
+		},
+		want: wantEngine{
+			table: `<tr><td colspan="2" class="diff-lineno">Line 1:</td><td colspan="2" class="diff-lineno">Line 1:</td></tr>
+<tr><td colspan="2" class="diff-empty">&#160;</td><td class="diff-marker">+</td><td class="diff-addedline"><div>0</div></td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>1</div></td><td class="diff-marker"></td><td class="diff-context"><div>1</div></td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>2</div></td><td class="diff-marker"></td><td class="diff-context"><div>2</div></td></tr>
+<tr><td colspan="2" class="diff-lineno">Line 7:</td><td colspan="2" class="diff-lineno">Line 8:</td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>7</div></td><td class="diff-marker"></td><td class="diff-context"><div>7</div></td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>8</div></td><td class="diff-marker"></td><td class="diff-context"><div>8</div></td></tr>
+<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>9</div></td><td colspan="2" class="diff-empty">&#160;</td></tr>`,
+		},
+	},
+	{
+		name: "rewritten",
+		in: inEngine{
+			from: "Completely different.",
+			to:   "Nothing alike here!",
+		},
+		want: wantEngine{
+			table: `<tr><td colspan="2" class="diff-lineno">Line 1:</td><td colspan="2" class="diff-lineno">Line 1:</td></tr>
+<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>Completely different.</div></td><td colspan="2" class="diff-empty">&#160;</td></tr>
+<tr><td colspan="2" class="diff-empty">&#160;</td><td class="diff-marker">+</td><td class="diff-addedline"><div>Nothing alike here!</div></td></tr>`,
+		},
+	},
+	{
+		name: "unchanged",
+		in: inEngine{
+			from: "Same.",
+			to:   "Same.",
+		},
+		want: wantEngine{
+			table: ``,
+		},
+	},
+}
+
+func TestDiff(t *testing.T) {
+	for _, tt := range engineTests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := diffs.ParseTable(tt.want.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := engine.Diff(tt.in.from, tt.in.to, engine.DefaultOptions)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// apply rebuilds the to side of a diff shown with unlimited context
+func apply(rows []diffs.Row) string {
+	lines := []string{}
+	for _, row := range rows {
+		if row.Kind != diffs.RowHeader && row.Kind != diffs.RowDeleted {
+			lines = append(lines, row.To.Text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func FuzzDiff(f *testing.F) {
+	for _, tt := range engineTests {
+		f.Add(tt.in.from, tt.in.to)
+	}
+
+	f.Fuzz(func(t *testing.T, from, to string) {
+		o := engine.DefaultOptions
+		o.Context = len(from) + len(to)
+		rows := engine.Diff(from, to, o)
+		if got := apply(rows); len(rows) > 0 && got != strings.TrimSuffix(to, "\n") {
+			t.Errorf("got %q, want %q", got, to)
+		}
+
+		rows = engine.Diff(from, to, engine.DefaultOptions)
+		got, err := engine.Apply(from, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != strings.TrimSuffix(to, "\n") && len(rows) > 0 {
+			t.Errorf("applied %q, want %q", got, to)
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	for _, tt := range engineTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := diffs.ParseTable(tt.want.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := engine.Apply(tt.in.from, rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.in.to {
+				t.Errorf("got %q, want %q", got, tt.in.to)
+			}
+		})
+	}
+}
+
+func TestApplyHeaders(t *testing.T) {
+	lines := make([]string, 1500)
+	for i := range lines {
+		lines[i] = strconv.Itoa(i + 1)
+	}
+	text := strings.Join(lines, "\n")
+
+	tests := []struct {
+		header string
+		line   int
+	}{
+		{"Line 2:", 2},
+		{"Line 1,234:", 1234},
+		{"Zeile 1.234:", 1234},
+		{"1234行目:", 1234},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			from := strconv.Itoa(tt.line)
+			rows := []diffs.Row{
+				{Kind: diffs.RowHeader, From: diffs.Line{Text: tt.header}, To: diffs.Line{Text: tt.header}},
+				{Kind: diffs.RowChanged, From: diffs.Line{Text: from}, To: diffs.Line{Text: "changed"}},
+			}
+
+			got, err := engine.Apply(text, rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := strings.Replace(text, "\n"+from+"\n", "\nchanged\n", 1)
+			if got != want {
+				t.Errorf("did not change only line %d", tt.line)
+			}
+		})
+	}
+
+	_, err := engine.Apply(text, []diffs.Row{{Kind: diffs.RowHeader, From: diffs.Line{Text: "Line:"}}})
+	if err == nil {
+		t.Error("got no error applying a header without a line number")
+	}
+}
+
+func TestApplyMismatch(t *testing.T) {
+	rows := engine.Diff("One.\nTwo.", "One.\nThree.", engine.DefaultOptions)
+	_, err := engine.Apply("Uno.\nTwo.", rows)
+	if _, ok := err.(*engine.MismatchError); !ok {
+		t.Errorf("got %v, want a MismatchError", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	for _, tt := range engineTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := engine.Render(engine.Diff(tt.in.from, tt.in.to, engine.DefaultOptions))
+			if got != tt.want.table {
+				t.Errorf("got %s, want %s", got, tt.want.table)
+			}
+		})
+	}
+}
+
+func TestRenderEscaped(t *testing.T) {
+	from := "<ref>a & b</ref>\n  indented"
+	to := "<ref>a &amp; c</ref>\n  indented"
+
+	rows := engine.Diff(from, to, engine.DefaultOptions)
+	parsed, err := diffs.ParseTable(engine.Render(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, rows) {
+		t.Errorf("got %+v, want %+v", parsed, rows)
+	}
+
+	got, err := engine.Apply(from, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != to {
+		t.Errorf("applied %q, want %q", got, to)
+	}
+}
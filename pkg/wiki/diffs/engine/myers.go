@@ -0,0 +1,163 @@
+package engine
+
+// opKind is how a token differs between two sequences
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// op is a token of either sequence. a is its index in the from sequence for
+// equal and deleted tokens, and b its index in the to sequence for equal and
+// inserted tokens.
+type op struct {
+	kind opKind
+	a    int
+	b    int
+}
+
+// maxEdits bounds the work spent finding the shortest edit script. Beyond
+// it, sequences are treated as entirely replaced.
+const maxEdits = 2000
+
+// window is the part of the furthest reaching paths of one step of the
+// search which the next step reads
+type window struct {
+	lo   int
+	vals []int
+}
+
+func (w window) get(k int) int {
+	return w.vals[k-w.lo]
+}
+
+// diff finds the shortest edit script between two sequences with Myers'
+// algorithm, after trimming their common prefix and suffix
+func diff(a, b []string) []op {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]op, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, op{opEqual, i, i})
+	}
+
+	middle := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	for _, o := range middle {
+		ops = append(ops, op{o.kind, o.a + prefix, o.b + prefix})
+	}
+
+	for i := suffix; i > 0; i-- {
+		ops = append(ops, op{opEqual, len(a) - i, len(b) - i})
+	}
+	return ops
+}
+
+func myers(a, b []string) []op {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := []window{}
+
+	for d := 0; d <= max; d++ {
+		if d > maxEdits {
+			return replace(n, m)
+		}
+
+		lo := -d - 1
+		trace = append(trace, window{lo, append([]int(nil), v[offset+lo:offset+d+2]...)})
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(trace, n, m)
+			}
+		}
+	}
+	return replace(n, m)
+}
+
+// backtrack follows the furthest reaching paths back from the end of both
+// sequences, returning the edit script in order
+func backtrack(trace []window, n, m int) []op {
+	reversed := []op{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		w := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && w.get(k-1) < w.get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := w.get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, op{opEqual, x, y})
+		}
+
+		if x == prevX {
+			y--
+			reversed = append(reversed, op{opInsert, x, y})
+		} else {
+			x--
+			reversed = append(reversed, op{opDelete, x, y})
+		}
+	}
+
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, op{opEqual, x, y})
+	}
+
+	ops := make([]op, len(reversed))
+	for i, o := range reversed {
+		ops[len(reversed)-1-i] = o
+	}
+	return ops
+}
+
+// replace deletes every token of a and inserts every token of b
+func replace(n, m int) []op {
+	ops := make([]op, 0, n+m)
+	for i := 0; i < n; i++ {
+		ops = append(ops, op{opDelete, i, 0})
+	}
+	for i := 0; i < m; i++ {
+		ops = append(ops, op{opInsert, n, i})
+	}
+	return ops
+}
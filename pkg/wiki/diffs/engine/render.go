@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"html"
+	"strings"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+)
+
+// empty stands in for the missing side of an added or deleted row
+const empty = `<td colspan="2" class="diff-empty">&#160;</td>`
+
+// Render renders rows as the compare table action=compare would return for
+// them, which diffs.ParseTable reads back
+func Render(rows []diffs.Row) string {
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var b strings.Builder
+		b.WriteString("<tr>")
+		switch row.Kind {
+		case diffs.RowHeader:
+			b.WriteString(`<td colspan="2" class="diff-lineno">` + html.EscapeString(row.From.Text) + `</td>`)
+			b.WriteString(`<td colspan="2" class="diff-lineno">` + html.EscapeString(row.To.Text) + `</td>`)
+		case diffs.RowContext:
+			b.WriteString(`<td class="diff-marker"></td><td class="diff-context">` + renderLine(row.From, "") + `</td>`)
+			b.WriteString(`<td class="diff-marker"></td><td class="diff-context">` + renderLine(row.To, "") + `</td>`)
+		case diffs.RowDeleted:
+			b.WriteString(`<td class="diff-marker">−</td><td class="diff-deletedline">` + renderLine(row.From, "del") + `</td>`)
+			b.WriteString(empty)
+		case diffs.RowAdded:
+			b.WriteString(empty)
+			b.WriteString(`<td class="diff-marker">+</td><td class="diff-addedline">` + renderLine(row.To, "ins") + `</td>`)
+		case diffs.RowChanged:
+			b.WriteString(`<td class="diff-marker">−</td><td class="diff-deletedline">` + renderLine(row.From, "del") + `</td>`)
+			b.WriteString(`<td class="diff-marker">+</td><td class="diff-addedline">` + renderLine(row.To, "ins") + `</td>`)
+		}
+		b.WriteString("</tr>")
+		lines = append(lines, b.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderLine renders the text of a line, marking its changes with tag. Only
+// the text of a line is kept, so each change is marked where it is next
+// found after the last.
+func renderLine(line diffs.Line, tag string) string {
+	var b strings.Builder
+	b.WriteString("<div>")
+	text := line.Text
+	for _, change := range line.Changes {
+		i := strings.Index(text, change)
+		if change == "" || i < 0 {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[:i]))
+		b.WriteString(`<` + tag + ` class="diffchange diffchange-inline">` + html.EscapeString(change) + `</` + tag + `>`)
+		text = text[i+len(change):]
+	}
+	b.WriteString(html.EscapeString(text))
+	b.WriteString("</div>")
+	return b.String()
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,10 +16,11 @@ type DiffFetch struct {
 }
 
 type DiffFetcher interface {
-	Fetch(revision int) ([]byte, error)
+	// Fetch fetches the diff of a revision against its parent on a wiki
+	Fetch(wiki string, revision int) ([]byte, error)
 }
 
-const baseUrl = "https://en.wikipedia.org/w/api.php?action=compare&format=json&fromrev=%d&torelative=prev"
+const compareQuery = "%s?action=compare&format=json&formatversion=2&fromrev=%d&torelative=prev&slots=*&prop=diff|diffsize|ids|title|user|comment|parsedcomment|size|timestamp|rel&uselang=en"
 
 func NewDiffFetcher(logger *logrus.Logger, client http.Client) DiffFetcher {
 	mc := DiffFetch{
@@ -28,8 +30,8 @@ func NewDiffFetcher(logger *logrus.Logger, client http.Client) DiffFetcher {
 	return mc
 }
 
-func (mc DiffFetch) Fetch(revision int) ([]byte, error) {
-	url := fmt.Sprintf(baseUrl, revision)
+func (mc DiffFetch) Fetch(wikiName string, revision int) ([]byte, error) {
+	url := fmt.Sprintf(compareQuery, wiki.APIURL(wikiName), revision)
 	mc.logger.WithFields(logrus.Fields{
 		"url": url,
 	}).Info("Fetching revision")
@@ -46,6 +48,13 @@ func (mc DiffFetch) Fetch(revision int) ([]byte, error) {
 		mc.logger.WithError(err).Error("Error reading body")
 		return nil, err
 	}
+	// Rate limits and outages are not API errors, and have no JSON body
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Unexpected status %s fetching revision %d from %s", resp.Status, revision, wikiName)
+		mc.logger.WithError(err).Error("Error querying")
+		return nil, err
+	}
+
 	diff := time.Now().Sub(start)
 	mc.logger.WithFields(logrus.Fields{
 		"time":  diff.String(),
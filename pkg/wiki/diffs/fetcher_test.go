@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
 	"github.com/sirupsen/logrus/hooks/test"
 )
 
 type inFetcher struct {
+	wiki     string
 	revision int
 	body     string
 }
@@ -29,15 +33,29 @@ var fetcherTests = []struct {
 	{
 		name: "basic",
 		in: inFetcher{
+			wiki:     "en",
 			revision: 100,
 			body:     "foo",
 		},
 		want: wantFetcher{
-			url:  "https://en.wikipedia.org/w/api.php?action=compare&format=json&fromrev=100&torelative=prev",
+			url:  "https://en.wikipedia.org/w/api.php?action=compare&format=json&formatversion=2&fromrev=100&torelative=prev&slots=*&prop=diff|diffsize|ids|title|user|comment|parsedcomment|size|timestamp|rel&uselang=en",
 			body: "foo",
 			err:  nil,
 		},
 	},
+	{
+		name: "project",
+		in: inFetcher{
+			wiki:     "wikidata",
+			revision: 200,
+			body:     "bar",
+		},
+		want: wantFetcher{
+			url:  "https://www.wikidata.org/w/api.php?action=compare&format=json&formatversion=2&fromrev=200&torelative=prev&slots=*&prop=diff|diffsize|ids|title|user|comment|parsedcomment|size|timestamp|rel&uselang=en",
+			body: "bar",
+			err:  nil,
+		},
+	},
 }
 
 // RoundTripFunc
@@ -75,7 +93,7 @@ func TestDiffFetcher(t *testing.T) {
 
 			logger, _ := test.NewNullLogger()
 			fetcher := diffs.NewDiffFetcher(logger, *client)
-			body, err := fetcher.Fetch(tt.in.revision)
+			body, err := fetcher.Fetch(tt.in.wiki, tt.in.revision)
 			if err != tt.want.err {
 				t.Errorf("got %q, want %q", err, tt.want.err)
 			}
@@ -86,3 +104,191 @@ func TestDiffFetcher(t *testing.T) {
 		})
 	}
 }
+
+type wantCompare struct {
+	from   int
+	to     int
+	prev   int
+	next   int
+	user   string
+	hidden bool
+	change string
+}
+
+var apiFetcherTests = []struct {
+	name     string
+	wiki     string
+	revision int
+	fault    *wikitest.APIFault
+	want     wantCompare
+	code     string
+	err      bool
+}{
+	{
+		name:     "edit",
+		wiki:     "en",
+		revision: 101,
+		want:     wantCompare{from: 100, to: 101, prev: 100, next: 102, user: "Bob", change: "that anyone can edit"},
+	},
+	{
+		name:     "creation",
+		wiki:     "en",
+		revision: 200,
+		want:     wantCompare{to: 200, next: 201, user: "Alice", change: "is a country in South Asia."},
+	},
+	{
+		name:     "hidden",
+		wiki:     "en",
+		revision: 102,
+		want:     wantCompare{from: 101, to: 102, prev: 101, next: 103, hidden: true},
+	},
+	{
+		name:     "other wiki",
+		wiki:     "de",
+		revision: 501,
+		want:     wantCompare{from: 500, to: 501, prev: 500, user: "198.51.100.7", change: "und ein Land"},
+	},
+	{
+		name:     "project",
+		wiki:     "wikidata",
+		revision: 901,
+		want:     wantCompare{from: 900, to: 901, prev: 900, user: "Carol", change: "&#34;de&#34;"},
+	},
+	{
+		name:     "missing revision",
+		wiki:     "en",
+		revision: 999,
+		code:     diffs.ErrCodeNoSuchRevID,
+	},
+	{
+		name:     "unknown wiki",
+		wiki:     "fr",
+		revision: 1,
+		err:      true,
+	},
+	{
+		name:     "outage",
+		wiki:     "en",
+		revision: 101,
+		fault:    &wikitest.APIFault{Status: http.StatusServiceUnavailable},
+		err:      true,
+	},
+	{
+		name:     "api error",
+		wiki:     "de",
+		revision: 501,
+		fault:    &wikitest.APIFault{Wiki: "de", Code: "internal_api_error_DBQueryError", Info: "Database query error."},
+		code:     "internal_api_error_DBQueryError",
+	},
+	{
+		name:     "fault on another wiki",
+		wiki:     "en",
+		revision: 101,
+		fault:    &wikitest.APIFault{Wiki: "de", Status: http.StatusServiceUnavailable},
+		want:     wantCompare{from: 100, to: 101, prev: 100, next: 102, user: "Bob", change: "that anyone can edit"},
+	},
+}
+
+func TestDiffFetcherAPI(t *testing.T) {
+	dataset, err := wikitest.LoadAPIDataset("testdata/api.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range apiFetcherTests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := wikitest.NewAPIServer(dataset, wikitest.DefaultAPIOptions)
+			if tt.fault != nil {
+				api.Fail(*tt.fault)
+			}
+
+			logger, _ := test.NewNullLogger()
+			fetcher := diffs.NewDiffFetcher(logger, api.Client())
+			body, err := fetcher.Fetch(tt.wiki, tt.revision)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+
+			compare, err := diffs.NewDiffParser(logger).Parse(body)
+			if tt.code != "" {
+				apiErr, ok := err.(*diffs.APIError)
+				if !ok || apiErr.Code != tt.code {
+					t.Fatalf("got error %v, want API error %q", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := wantCompare{
+				from:   compare.FromRevID,
+				to:     compare.ToRevID,
+				prev:   compare.Prev,
+				next:   compare.Next,
+				user:   compare.ToUser,
+				hidden: bool(compare.ToTextHidden && compare.ToUserHidden && compare.ToCommentHidden),
+			}
+			if tt.want.change != "" && strings.Contains(compare.Body, tt.want.change) {
+				got.change = tt.want.change
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if tt.want.hidden && compare.Body != "" {
+				t.Errorf("got body %q for hidden text", compare.Body)
+			}
+		})
+	}
+}
+
+func TestDiffFetcherRateLimited(t *testing.T) {
+	dataset, err := wikitest.LoadAPIDataset("testdata/api.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := wikitest.NewAPIServer(dataset, wikitest.APIOptions{RateLimit: 2})
+	logger, _ := test.NewNullLogger()
+	fetcher := diffs.NewDiffFetcher(logger, api.Client())
+
+	// The limit applies to each wiki
+	for _, revision := range []int{100, 101} {
+		if _, err := fetcher.Fetch("en", revision); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fetcher.Fetch("de", 501); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fetcher.Fetch("en", 103)
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("got error %v, want a 429", err)
+	}
+}
+
+func TestDiffFetcherLatency(t *testing.T) {
+	dataset, err := wikitest.LoadAPIDataset("testdata/api.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := wikitest.NewAPIServer(dataset, wikitest.APIOptions{Latency: time.Second})
+	client := api.Client()
+	client.Timeout = 50 * time.Millisecond
+
+	logger, _ := test.NewNullLogger()
+	fetcher := diffs.NewDiffFetcher(logger, client)
+	start := time.Now()
+	_, err = fetcher.Fetch("en", 101)
+	if err == nil {
+		t.Error("got no error, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s, want the client to time out", elapsed)
+	}
+}
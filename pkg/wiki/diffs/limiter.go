@@ -0,0 +1,31 @@
+package diffs
+
+import (
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+)
+
+// RateLimitedDiffFetch is a DiffFetcher which spaces fetches by an inner
+// DiffFetcher with a RateLimiter, which other fetchers may share
+type RateLimitedDiffFetch struct {
+	inner   DiffFetcher
+	limiter *wiki.RateLimiter
+}
+
+// NewRateLimitedDiffFetcher creates a DiffFetcher making fetches with inner
+// as limiter allows. Fetches are not limited when limiter is nil.
+func NewRateLimitedDiffFetcher(inner DiffFetcher, limiter *wiki.RateLimiter) DiffFetcher {
+	if limiter == nil {
+		return inner
+	}
+
+	return RateLimitedDiffFetch{
+		inner:   inner,
+		limiter: limiter,
+	}
+}
+
+// Fetch waits for the next free slot, then fetches the revision
+func (r RateLimitedDiffFetch) Fetch(wiki string, revision int) ([]byte, error) {
+	r.limiter.Wait()
+	return r.inner.Fetch(wiki, revision)
+}
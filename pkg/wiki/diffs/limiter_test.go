@@ -0,0 +1,37 @@
+package diffs_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+)
+
+func TestRateLimitedDiffFetcher(t *testing.T) {
+	inner := newCountingFetcher("{}")
+	fetcher := diffs.NewRateLimitedDiffFetcher(inner, wiki.NewRateLimiter(20*time.Millisecond))
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(revision int) {
+			defer wg.Done()
+			fetcher.Fetch("en", revision)
+		}(i)
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("3 fetches took %s, want at least 60ms", elapsed)
+	}
+}
+
+func TestRateLimitedDiffFetcherUnlimited(t *testing.T) {
+	inner := newCountingFetcher("{}")
+	if diffs.NewRateLimitedDiffFetcher(inner, wiki.NewRateLimiter(0)) != diffs.DiffFetcher(inner) {
+		t.Error("got a rate limited fetcher, want the inner fetcher")
+	}
+}
@@ -3,24 +3,148 @@ package diffs
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 )
 
+// MainSlot is the role of the slot holding the wikitext of a page
+const MainSlot = "main"
+
+// Flag is a boolean the Action API reports as true in formatversion=2
+// responses, or by the presence of a key in formatversion=1 responses, such as
+// "fromuserhidden": ""
+type Flag bool
+
+// UnmarshalJSON sets the flag unless the key is explicitly false or null
+func (f *Flag) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	*f = value != "false" && value != "null"
+	return nil
+}
+
+// Compare is the result of action=compare. Fields a revision has hidden, such
+// as the user of a revision with UserHidden set, are empty unless the
+// requester may view deleted revisions.
 type Compare struct {
-	FromID    int    `json:"fromid"`
-	FromRevID int    `json:"fromrevid"`
-	FromNS    int    `json:"fromns"`
-	FromTitle string `json:"fromtitle"`
-	ToID      int    `json:"toid"`
-	ToRevID   int    `json:"torevid"`
-	ToNS      int    `json:"tons"`
-	ToTitle   string `json:"totitle"`
-	Body      string `json:"*"`
+	FromID            int    `json:"fromid"`
+	FromRevID         int    `json:"fromrevid"`
+	FromNS            int    `json:"fromns"`
+	FromTitle         string `json:"fromtitle"`
+	FromSize          int    `json:"fromsize"`
+	FromTimestamp     string `json:"fromtimestamp"`
+	FromUser          string `json:"fromuser"`
+	FromUserID        int    `json:"fromuserid"`
+	FromComment       string `json:"fromcomment"`
+	FromParsedComment string `json:"fromparsedcomment"`
+	FromTextHidden    Flag   `json:"fromtexthidden,omitempty"`
+	FromUserHidden    Flag   `json:"fromuserhidden,omitempty"`
+	FromCommentHidden Flag   `json:"fromcommenthidden,omitempty"`
+	FromSuppressed    Flag   `json:"fromsuppressed,omitempty"`
+
+	ToID            int    `json:"toid"`
+	ToRevID         int    `json:"torevid"`
+	ToNS            int    `json:"tons"`
+	ToTitle         string `json:"totitle"`
+	ToSize          int    `json:"tosize"`
+	ToTimestamp     string `json:"totimestamp"`
+	ToUser          string `json:"touser"`
+	ToUserID        int    `json:"touserid"`
+	ToComment       string `json:"tocomment"`
+	ToParsedComment string `json:"toparsedcomment"`
+	ToTextHidden    Flag   `json:"totexthidden,omitempty"`
+	ToUserHidden    Flag   `json:"touserhidden,omitempty"`
+	ToCommentHidden Flag   `json:"tocommenthidden,omitempty"`
+	ToSuppressed    Flag   `json:"tosuppressed,omitempty"`
+
+	// Prev and Next are the revisions before and after the to revision, or
+	// zero if there are none
+	Prev int `json:"prev"`
+	Next int `json:"next"`
+
+	DiffSize int `json:"diffsize"`
+
+	// Slots are the diffs of each slot which changed, keyed by role, such as
+	// "main" or "mediainfo" for Commons structured data
+	Slots map[string]string `json:"bodies,omitempty"`
+
+	// Body is the diff of every slot, main first
+	Body string `json:"body"`
+}
+
+// UnmarshalJSON decodes formatversion=2 responses, and the "*" body of
+// formatversion=1 responses archived before slots were requested
+func (c *Compare) UnmarshalJSON(data []byte) error {
+	type compare Compare
+	err := json.Unmarshal(data, (*compare)(c))
+	if err != nil {
+		return err
+	}
+
+	if c.Body == "" && len(c.Slots) > 0 {
+		c.Body = combineSlots(c.Slots)
+	}
+
+	if c.Body == "" {
+		legacy := struct {
+			Body string `json:"*"`
+		}{}
+		err = json.Unmarshal(data, &legacy)
+		c.Body = legacy.Body
+	}
+	return err
+}
+
+// combineSlots joins the diffs of each slot, main first, then by role
+func combineSlots(slots map[string]string) string {
+	roles := make([]string, 0, len(slots))
+	for role := range slots {
+		if role != MainSlot {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	if _, ok := slots[MainSlot]; ok {
+		roles = append([]string{MainSlot}, roles...)
+	}
+
+	body := ""
+	for _, role := range roles {
+		body += slots[role]
+	}
+	return body
 }
 
 type CompareResult struct {
-	Compare Compare `json:"compare"`
+	Compare Compare   `json:"compare"`
+	Error   *APIError `json:"error"`
+}
+
+// APIError is an error reported by the Action API
+type APIError struct {
+	Code string `json:"code"`
+	Info string `json:"info"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error %s: %s", e.Code, e.Info)
+}
+
+// ErrCodeNoSuchRevID is the API error code for a revision which does not
+// exist, or which has not reached the replica serving the request yet
+const ErrCodeNoSuchRevID = "nosuchrevid"
+
+// ParseAPIError returns the API error in a response body, or nil if there
+// is none
+func ParseAPIError(input []byte) *APIError {
+	result := struct {
+		Error *APIError `json:"error"`
+	}{}
+	err := json.Unmarshal(input, &result)
+	if err != nil {
+		return nil
+	}
+	return result.Error
 }
 
 type DiffParser struct {
@@ -39,5 +163,9 @@ func (r DiffParser) Parse(input []byte) (Compare, error) {
 		err := fmt.Errorf("There was an error decoding: %s", data)
 		return Compare{}, err
 	}
+
+	if result.Error != nil {
+		return Compare{}, result.Error
+	}
 	return result.Compare, nil
 }
@@ -1,6 +1,8 @@
 package diffs_test
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
@@ -41,6 +43,165 @@ var parserTests = []struct {
 			err: nil,
 		},
 	},
+	{
+		name: "metadata",
+		in: inParser{
+			data: `{"compare":{"fromid":31530695,"fromrevid":903665607,"fromns":2,"fromtitle":"User:DeltaQuad/UAA/Time","fromsize":1024,"fromtimestamp":"2019-06-28T21:00:02Z","fromuser":"DeltaQuad","fromuserid":1234,"fromcomment":"Updating time","fromparsedcomment":"Updating time","toid":31530695,"torevid":903668373,"tons":2,"totitle":"User:DeltaQuad/UAA/Time","tosize":1030,"totimestamp":"2019-06-28T21:20:02Z","touser":"DeltaQuad","touserid":1234,"tocomment":"[[WP:UAA]]","toparsedcomment":"<a href=\"/wiki/WP:UAA\">WP:UAA</a>","prev":903665607,"next":903670000,"diffsize":512,"*":"test"}}`,
+		},
+		want: wantParser{
+			compare: diffs.Compare{
+				FromID:            31530695,
+				FromRevID:         903665607,
+				FromNS:            2,
+				FromTitle:         "User:DeltaQuad/UAA/Time",
+				FromSize:          1024,
+				FromTimestamp:     "2019-06-28T21:00:02Z",
+				FromUser:          "DeltaQuad",
+				FromUserID:        1234,
+				FromComment:       "Updating time",
+				FromParsedComment: "Updating time",
+				ToID:              31530695,
+				ToRevID:           903668373,
+				ToNS:              2,
+				ToTitle:           "User:DeltaQuad/UAA/Time",
+				ToSize:            1030,
+				ToTimestamp:       "2019-06-28T21:20:02Z",
+				ToUser:            "DeltaQuad",
+				ToUserID:          1234,
+				ToComment:         "[[WP:UAA]]",
+				ToParsedComment:   `<a href="/wiki/WP:UAA">WP:UAA</a>`,
+				Prev:              903665607,
+				Next:              903670000,
+				DiffSize:          512,
+				Body:              "test",
+			},
+			err: nil,
+		},
+	},
+	{
+		name: "deleted user",
+		in: inParser{
+			data: `{"compare":{"fromid":100,"fromrevid":200,"fromns":0,"fromtitle":"Example","fromsize":10,"fromtimestamp":"2019-06-28T21:00:02Z","fromuserhidden":"","fromcomment":"","fromparsedcomment":"","toid":100,"torevid":201,"tons":0,"totitle":"Example","tosize":12,"totimestamp":"2019-06-28T21:20:02Z","touser":"Example","touserid":5,"tocomment":"Reverted","toparsedcomment":"Reverted","prev":200,"diffsize":64,"*":"test"}}`,
+		},
+		want: wantParser{
+			compare: diffs.Compare{
+				FromID:          100,
+				FromRevID:       200,
+				FromTitle:       "Example",
+				FromSize:        10,
+				FromTimestamp:   "2019-06-28T21:00:02Z",
+				FromUserHidden:  true,
+				ToID:            100,
+				ToRevID:         201,
+				ToTitle:         "Example",
+				ToSize:          12,
+				ToTimestamp:     "2019-06-28T21:20:02Z",
+				ToUser:          "Example",
+				ToUserID:        5,
+				ToComment:       "Reverted",
+				ToParsedComment: "Reverted",
+				Prev:            200,
+				DiffSize:        64,
+				Body:            "test",
+			},
+			err: nil,
+		},
+	},
+	{
+		name: "suppressed comment",
+		in: inParser{
+			data: `{"compare":{"fromid":100,"fromrevid":200,"fromns":0,"fromtitle":"Example","fromsize":10,"fromtimestamp":"2019-06-28T21:00:02Z","fromuser":"Example","fromuserid":5,"fromcomment":"Created","fromparsedcomment":"Created","toid":100,"torevid":201,"tons":0,"totitle":"Example","tosize":12,"totimestamp":"2019-06-28T21:20:02Z","touser":"Example","touserid":5,"tocommenthidden":"","tosuppressed":"","prev":200,"diffsize":64,"*":"test"}}`,
+		},
+		want: wantParser{
+			compare: diffs.Compare{
+				FromID:            100,
+				FromRevID:         200,
+				FromTitle:         "Example",
+				FromSize:          10,
+				FromTimestamp:     "2019-06-28T21:00:02Z",
+				FromUser:          "Example",
+				FromUserID:        5,
+				FromComment:       "Created",
+				FromParsedComment: "Created",
+				ToID:              100,
+				ToRevID:           201,
+				ToTitle:           "Example",
+				ToSize:            12,
+				ToTimestamp:       "2019-06-28T21:20:02Z",
+				ToUser:            "Example",
+				ToUserID:          5,
+				ToCommentHidden:   true,
+				ToSuppressed:      true,
+				Prev:              200,
+				DiffSize:          64,
+				Body:              "test",
+			},
+			err: nil,
+		},
+	},
+	{
+		name: "slots",
+		in: inParser{
+			data: `{"compare":{"fromid":1,"fromrevid":10,"fromns":6,"fromtitle":"File:Example.jpg","toid":1,"torevid":11,"tons":6,"totitle":"File:Example.jpg","tosuppressed":false,"prev":10,"bodies":{"mediainfo":"<tr>caption</tr>","main":"<tr>text</tr>"}}}`,
+		},
+		want: wantParser{
+			compare: diffs.Compare{
+				FromID:    1,
+				FromRevID: 10,
+				FromNS:    6,
+				FromTitle: "File:Example.jpg",
+				ToID:      1,
+				ToRevID:   11,
+				ToNS:      6,
+				ToTitle:   "File:Example.jpg",
+				Prev:      10,
+				Slots: map[string]string{
+					"main":      "<tr>text</tr>",
+					"mediainfo": "<tr>caption</tr>",
+				},
+				Body: "<tr>text</tr><tr>caption</tr>",
+			},
+			err: nil,
+		},
+	},
+	{
+		name: "structured data only",
+		in: inParser{
+			data: `{"compare":{"fromid":1,"fromrevid":11,"fromns":6,"fromtitle":"File:Example.jpg","toid":1,"torevid":12,"tons":6,"totitle":"File:Example.jpg","touserhidden":true,"prev":11,"bodies":{"mediainfo":"<tr>depicts</tr>"}}}`,
+		},
+		want: wantParser{
+			compare: diffs.Compare{
+				FromID:       1,
+				FromRevID:    11,
+				FromNS:       6,
+				FromTitle:    "File:Example.jpg",
+				ToID:         1,
+				ToRevID:      12,
+				ToNS:         6,
+				ToTitle:      "File:Example.jpg",
+				ToUserHidden: true,
+				Prev:         11,
+				Slots: map[string]string{
+					"mediainfo": "<tr>depicts</tr>",
+				},
+				Body: "<tr>depicts</tr>",
+			},
+			err: nil,
+		},
+	},
+	{
+		name: "nosuchrevid",
+		in: inParser{
+			data: `{"error":{"code":"nosuchrevid","info":"There is no revision with ID 903668373.","*":"See https://en.wikipedia.org/w/api.php for API usage."},"servedby":"mw1234"}`,
+		},
+		want: wantParser{
+			compare: diffs.Compare{},
+			err: &diffs.APIError{
+				Code: "nosuchrevid",
+				Info: "There is no revision with ID 903668373.",
+			},
+		},
+	},
 }
 
 func TestParser(t *testing.T) {
@@ -49,13 +210,31 @@ func TestParser(t *testing.T) {
 			logger, _ := test.NewNullLogger()
 			parser := diffs.NewDiffParser(logger)
 			compare, err := parser.Parse([]byte(tt.in.data))
-			if err != tt.want.err {
+			if !reflect.DeepEqual(err, tt.want.err) {
 				t.Errorf("got %q, want %q", err, tt.want.err)
 			}
 
-			if compare != tt.want.compare {
+			if !reflect.DeepEqual(compare, tt.want.compare) {
 				t.Errorf("got %v, want %v", compare, tt.want.compare)
 			}
 		})
 	}
 }
+
+func TestFlagRoundTrip(t *testing.T) {
+	want := diffs.Compare{ToUserHidden: true, ToSuppressed: true}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := diffs.Compare{}
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
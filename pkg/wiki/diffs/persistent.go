@@ -0,0 +1,288 @@
+package diffs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/sirupsen/logrus"
+)
+
+// Replayer is implemented by DiffQueuers which persist requests across
+// restarts. Replay queues every request which was never handled, using
+// handler to create its callback.
+type Replayer interface {
+	Replay(handler func(rc recentchanges.NormalizedRecentChange) HandleFetchResponse)
+}
+
+// walFile is the name of the write-ahead log inside the queue directory
+const walFile = "queue.wal"
+
+// compactThreshold is the number of acknowledgements between compactions
+const compactThreshold = 1000
+
+const (
+	opQueue = "queue"
+	opAck   = "ack"
+)
+
+// walRecord is a line of the write-ahead log
+type walRecord struct {
+	Op  string                                `json:"op"`
+	Seq int                                   `json:"seq"`
+	RC  *recentchanges.NormalizedRecentChange `json:"rc,omitempty"`
+}
+
+// PersistentDiffQueue is a DiffQueuer which records requests in a write-ahead
+// log, and acknowledges them once their callback handles them without error,
+// or once they fail for good. Unacknowledged requests are replayed by Replay
+// after a restart.
+type PersistentDiffQueue struct {
+	logger  *logrus.Logger
+	inner   DiffQueuer
+	path    string
+	mux     sync.Mutex
+	file    *os.File
+	pending map[int]recentchanges.NormalizedRecentChange
+	replay  []int
+	nextSeq int
+	acks    int
+}
+
+// NewPersistentDiffQueuer creates a DiffQueuer storing its requests in dir,
+// and scheduling them with inner
+func NewPersistentDiffQueuer(logger *logrus.Logger, inner DiffQueuer, dir string) (*PersistentDiffQueue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &PersistentDiffQueue{
+		logger:  logger,
+		inner:   inner,
+		path:    filepath.Join(dir, walFile),
+		pending: make(map[int]recentchanges.NormalizedRecentChange),
+	}
+
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for seq := range q.pending {
+		q.replay = append(q.replay, seq)
+	}
+	sort.Ints(q.replay)
+
+	// Compacting on startup drops the acknowledged history
+	err = q.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"file":    q.path,
+		"pending": len(q.pending),
+	}).Info("Opened diff queue")
+	return q, nil
+}
+
+// load reads the log, keeping requests which were never acknowledged
+func (q *PersistentDiffQueue) load() error {
+	file, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := walRecord{}
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// A crash may leave a partially written record at the end
+			q.logger.WithError(err).WithField("record", scanner.Text()).Warn("Skipping corrupt record")
+			continue
+		}
+
+		switch record.Op {
+		case opQueue:
+			if record.RC != nil {
+				q.pending[record.Seq] = *record.RC
+			}
+		case opAck:
+			delete(q.pending, record.Seq)
+		}
+
+		if record.Seq >= q.nextSeq {
+			q.nextSeq = record.Seq + 1
+		}
+	}
+	return scanner.Err()
+}
+
+// append writes a record to the log and syncs it to disk. q.mux must be held.
+func (q *PersistentDiffQueue) append(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
+
+// compact rewrites the log with only the pending requests. q.mux must be held
+// once the queue is open.
+func (q *PersistentDiffQueue) compact() error {
+	tmp := q.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	seqs := make([]int, 0, len(q.pending))
+	for seq := range q.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	writer := bufio.NewWriter(file)
+	for _, seq := range seqs {
+		rc := q.pending[seq]
+		data, err := json.Marshal(walRecord{Op: opQueue, Seq: seq, RC: &rc})
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, q.path)
+	if err != nil {
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0644)
+	q.acks = 0
+	return err
+}
+
+func (q *PersistentDiffQueue) ack(seq int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	delete(q.pending, seq)
+	err := q.append(walRecord{Op: opAck, Seq: seq})
+	if err != nil {
+		q.logger.WithError(err).WithField("seq", seq).Error("Could not acknowledge request")
+		return
+	}
+
+	q.acks++
+	if q.acks >= compactThreshold {
+		err := q.compact()
+		if err != nil {
+			q.logger.WithError(err).Error("Could not compact diff queue")
+		}
+	}
+}
+
+// wrap acknowledges the request once cb handles it, or once it can't succeed
+// however often it is replayed
+func (q *PersistentDiffQueue) wrap(seq int, cb HandleFetchResponse) HandleFetchResponse {
+	return func(body []byte, err error) error {
+		handleErr := cb(body, err)
+		if handleErr != nil && !permanent(err) && !permanent(handleErr) {
+			return handleErr
+		}
+
+		q.ack(seq)
+		return handleErr
+	}
+}
+
+// permanent reports whether a request failed for good: it was dropped by the
+// queue, or the API answered with an error, such as a revision which is still
+// missing once out of retries
+func permanent(err error) bool {
+	if err == ErrDeadlineExceeded || err == ErrQueueFull {
+		return true
+	}
+
+	var apiErr *APIError
+	return errors.As(err, &apiErr)
+}
+
+// Queue records the request, then queues it for fetching
+func (q *PersistentDiffQueue) Queue(rc recentchanges.NormalizedRecentChange, cb HandleFetchResponse) {
+	q.mux.Lock()
+	seq := q.nextSeq
+	q.nextSeq++
+	q.pending[seq] = rc
+	err := q.append(walRecord{Op: opQueue, Seq: seq, RC: &rc})
+	q.mux.Unlock()
+
+	if err != nil {
+		q.logger.WithError(err).WithField("revision", rc.Revision.New).Error("Could not persist request")
+	}
+
+	q.inner.Queue(rc, q.wrap(seq, cb))
+}
+
+// Replay queues the requests which were pending when the queue was opened
+func (q *PersistentDiffQueue) Replay(handler func(rc recentchanges.NormalizedRecentChange) HandleFetchResponse) {
+	q.mux.Lock()
+	seqs := q.replay
+	q.replay = nil
+	replayed := make([]recentchanges.NormalizedRecentChange, len(seqs))
+	for i, seq := range seqs {
+		replayed[i] = q.pending[seq]
+	}
+	q.mux.Unlock()
+
+	q.logger.WithField("total", len(seqs)).Info("Replaying queued revisions")
+	go func() {
+		for i, rc := range replayed {
+			q.inner.Queue(rc, q.wrap(seqs[i], handler(rc)))
+		}
+	}()
+}
+
+// Pending returns the number of requests which have not been acknowledged
+func (q *PersistentDiffQueue) Pending() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.pending)
+}
+
+// Close closes the write-ahead log
+func (q *PersistentDiffQueue) Close() error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.file.Close()
+}
@@ -0,0 +1,148 @@
+package diffs_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+type queuedRequest struct {
+	rc recentchanges.NormalizedRecentChange
+	cb diffs.HandleFetchResponse
+}
+
+// recordingQueuer records requests instead of fetching them
+type recordingQueuer struct {
+	requests chan queuedRequest
+}
+
+func newRecordingQueuer() *recordingQueuer {
+	return &recordingQueuer{
+		requests: make(chan queuedRequest, 10),
+	}
+}
+
+func (q *recordingQueuer) Queue(rc recentchanges.NormalizedRecentChange, cb diffs.HandleFetchResponse) {
+	q.requests <- queuedRequest{rc, cb}
+}
+
+func openQueue(t *testing.T, dir string) (*diffs.PersistentDiffQueue, *recordingQueuer) {
+	logger, _ := test.NewNullLogger()
+	inner := newRecordingQueuer()
+	q, err := diffs.NewPersistentDiffQueuer(logger, inner, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, inner
+}
+
+func TestPersistentDiffQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diffqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, inner := openQueue(t, dir)
+	for _, revision := range []int{1, 2, 3} {
+		q.Queue(change(revision, "Example"), func(body []byte, err error) error {
+			return err
+		})
+	}
+
+	// Handle 1, fail to handle 2, and never handle 3
+	(<-inner.requests).cb([]byte{}, nil)
+	(<-inner.requests).cb(nil, errors.New("archive failed"))
+	<-inner.requests
+	q.Close()
+
+	q, inner = openQueue(t, dir)
+	if q.Pending() != 2 {
+		t.Fatalf("got %d pending, want 2", q.Pending())
+	}
+
+	replayed := []int{}
+	q.Replay(func(rc recentchanges.NormalizedRecentChange) diffs.HandleFetchResponse {
+		replayed = append(replayed, rc.Revision.New)
+		return func(body []byte, err error) error {
+			return err
+		}
+	})
+	(<-inner.requests).cb([]byte{}, nil)
+	(<-inner.requests).cb([]byte{}, nil)
+
+	if len(replayed) != 2 || replayed[0] != 2 || replayed[1] != 3 {
+		t.Errorf("got %v, want [2 3]", replayed)
+	}
+
+	if q.Pending() != 0 {
+		t.Errorf("got %d pending, want 0", q.Pending())
+	}
+	q.Close()
+
+	q, _ = openQueue(t, dir)
+	defer q.Close()
+	if q.Pending() != 0 {
+		t.Errorf("got %d pending after reopening, want 0", q.Pending())
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "queue.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != 0 {
+		t.Errorf("got %d bytes after compaction, want 0", info.Size())
+	}
+}
+
+func TestPersistentDiffQueueFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diffqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, _ := test.NewNullLogger()
+	parser := diffs.NewDiffParser(logger)
+
+	q, inner := openQueue(t, dir)
+	for _, revision := range []int{1, 2, 3, 4} {
+		q.Queue(change(revision, "Example"), func(body []byte, err error) error {
+			if err != nil {
+				return err
+			}
+			_, err = parser.Parse(body)
+			return err
+		})
+	}
+
+	// Drop 1, run out of retries for 2, fail to fetch 3, and parse an API
+	// error for 4. Only 3 could succeed if replayed.
+	(<-inner.requests).cb(nil, diffs.ErrDeadlineExceeded)
+	(<-inner.requests).cb([]byte(noSuchRevID), &diffs.APIError{Code: diffs.ErrCodeNoSuchRevID})
+	(<-inner.requests).cb(nil, errors.New("connection reset"))
+	(<-inner.requests).cb([]byte(noSuchRevID), nil)
+	q.Close()
+
+	q, inner = openQueue(t, dir)
+	defer q.Close()
+	if q.Pending() != 1 {
+		t.Fatalf("got %d pending after a restart, want 1", q.Pending())
+	}
+
+	q.Replay(func(rc recentchanges.NormalizedRecentChange) diffs.HandleFetchResponse {
+		return func(body []byte, err error) error {
+			return err
+		}
+	})
+	if request := <-inner.requests; request.rc.Revision.New != 3 {
+		t.Errorf("got revision %d replayed, want 3", request.rc.Revision.New)
+	}
+}
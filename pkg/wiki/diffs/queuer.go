@@ -1,45 +1,336 @@
 package diffs
 
-import "github.com/sirupsen/logrus"
+import (
+	"container/heap"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+	"github.com/sirupsen/logrus"
+)
 
 type DiffQueuer interface {
-	Queue(revision int, cb HandleFetchResponse)
+	Queue(rc recentchanges.NormalizedRecentChange, cb HandleFetchResponse)
+}
+
+// ErrDeadlineExceeded is passed to the callback of a request which waited in
+// the queue for longer than its deadline
+var ErrDeadlineExceeded = errors.New("Diff request exceeded its deadline")
+
+// ErrQueueFull is passed to the callback of a request dropped because the
+// queue was full
+var ErrQueueFull = errors.New("Diff queue is full")
+
+// PriorityFunc ranks a recent change. Higher priorities are fetched first,
+// and equal priorities are fetched in the order they were queued.
+type PriorityFunc func(rc recentchanges.NormalizedRecentChange) int
+
+// OverflowPolicy decides what happens when a request is queued while the
+// queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the caller until there is room in the queue
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest drops the request being queued
+	OverflowDropNewest
+
+	// OverflowDropLowest drops the lowest priority request, which may be the
+	// request being queued
+	OverflowDropLowest
+)
+
+// QueueOptions configures a DiffQueue
+type QueueOptions struct {
+	// Size is the number of requests which can wait in the queue
+	Size int
+
+	// Priority ranks requests. All requests are equal when nil.
+	Priority PriorityFunc
+
+	// Deadline is how long a request may wait before it is dropped. Zero
+	// waits forever.
+	Deadline time.Duration
+
+	Overflow OverflowPolicy
+}
+
+// DefaultQueueOptions fetches diffs first in first out
+var DefaultQueueOptions = QueueOptions{
+	Size:     100,
+	Overflow: OverflowBlock,
 }
 
 type fetchRequest struct {
-	revid int
-	cb    HandleFetchResponse
+	wiki     string
+	revid    int
+	cb       HandleFetchResponse
+	priority int
+	seq      int
+	deadline time.Time
 }
 
-type HandleFetchResponse func([]byte, error)
+// HandleFetchResponse handles a fetched diff, returning an error if it could
+// not be handled. Persistent queues keep requests until they are handled.
+type HandleFetchResponse func([]byte, error) error
+
+// requestHeap orders requests by priority, then by the order they were queued
+type requestHeap []*fetchRequest
+
+func (h requestHeap) Len() int { return len(h) }
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h requestHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *requestHeap) Push(x interface{}) { *h = append(*h, x.(*fetchRequest)) }
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
 
 type DiffQueue struct {
-	logger *logrus.Logger
-	queue  chan fetchRequest
+	logger   *logrus.Logger
+	options  QueueOptions
+	mux      *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    *requestHeap
+	seq      *int
 }
 
+// NewDiffQueuer creates a DiffQueuer which fetches diffs first in first out
 func NewDiffQueuer(logger *logrus.Logger, df DiffFetcher) DiffQueuer {
+	return NewPriorityDiffQueuer(logger, df, DefaultQueueOptions)
+}
+
+// NewPriorityDiffQueuer creates a DiffQueuer which fetches diffs in order of
+// priority, dropping requests according to the options
+func NewPriorityDiffQueuer(logger *logrus.Logger, df DiffFetcher, o QueueOptions) DiffQueuer {
+	mux := &sync.Mutex{}
 	dq := DiffQueue{
-		logger: logger,
-		queue:  make(chan fetchRequest, 100),
+		logger:   logger,
+		options:  o,
+		mux:      mux,
+		notEmpty: sync.NewCond(mux),
+		notFull:  sync.NewCond(mux),
+		queue:    &requestHeap{},
+		seq:      new(int),
 	}
 	go func() {
 		for {
-			queue := <-dq.queue
-			body, err := df.Fetch(queue.revid)
-			queue.cb(body, err)
+			request := dq.next()
+			if !request.deadline.IsZero() && time.Now().After(request.deadline) {
+				dq.drop(request, ErrDeadlineExceeded)
+				continue
+			}
+
+			body, err := df.Fetch(request.wiki, request.revid)
+			err = request.cb(body, err)
+			if err != nil {
+				logger.WithError(err).WithField("revision", request.revid).Warn("Fetched revision was not handled")
+			}
 		}
 	}()
 	return dq
 }
 
-// Queue fetches the revision sequentially
-func (mc DiffQueue) Queue(revision int, cb HandleFetchResponse) {
+// next blocks until a request is queued, and removes the highest priority one
+func (mc DiffQueue) next() *fetchRequest {
+	mc.mux.Lock()
+	defer mc.mux.Unlock()
+
+	for mc.queue.Len() == 0 {
+		mc.notEmpty.Wait()
+	}
+
+	request := heap.Pop(mc.queue).(*fetchRequest)
+	mc.notFull.Signal()
+	return request
+}
+
+func (mc DiffQueue) drop(request *fetchRequest, err error) {
+	mc.logger.WithError(err).WithFields(logrus.Fields{
+		"revision": request.revid,
+		"priority": request.priority,
+	}).Warn("Dropping revision")
+	request.cb(nil, err)
+}
+
+// Queue fetches the revision of the recent change, in order of priority
+func (mc DiffQueue) Queue(rc recentchanges.NormalizedRecentChange, cb HandleFetchResponse) {
+	request := &fetchRequest{
+		wiki:  rc.Wiki,
+		revid: rc.Revision.New,
+		cb:    cb,
+	}
+	if mc.options.Priority != nil {
+		request.priority = mc.options.Priority(rc)
+	}
+
+	mc.mux.Lock()
 	mc.logger.WithFields(logrus.Fields{
-		"total": len(mc.queue),
+		"total":    mc.queue.Len(),
+		"priority": request.priority,
 	}).Info("Queueing revision")
-	mc.queue <- fetchRequest{
-		revid: revision,
-		cb:    cb,
+
+	var dropped *fetchRequest
+	for mc.options.Size > 0 && mc.queue.Len() >= mc.options.Size && dropped == nil {
+		switch mc.options.Overflow {
+		case OverflowDropNewest:
+			dropped = request
+		case OverflowDropLowest:
+			dropped = mc.removeLowest(request)
+		default:
+			mc.notFull.Wait()
+		}
+	}
+
+	if dropped != request {
+		if mc.options.Deadline > 0 {
+			request.deadline = time.Now().Add(mc.options.Deadline)
+		}
+		request.seq = *mc.seq
+		*mc.seq++
+		heap.Push(mc.queue, request)
+		mc.notEmpty.Signal()
+	}
+	mc.mux.Unlock()
+
+	if dropped != nil {
+		mc.drop(dropped, ErrQueueFull)
+	}
+}
+
+// removeLowest removes and returns the lowest priority queued request if it
+// ranks below incoming, otherwise it returns incoming
+func (mc DiffQueue) removeLowest(incoming *fetchRequest) *fetchRequest {
+	queue := *mc.queue
+	lowest := 0
+	for i := range queue {
+		if queue.Less(lowest, i) {
+			lowest = i
+		}
+	}
+
+	if queue[lowest].priority >= incoming.priority {
+		return incoming
+	}
+	return heap.Remove(mc.queue, lowest).(*fetchRequest)
+}
+
+// PatrolPriority ranks edits patrollers are most interested in first:
+// anonymous and temporary users, and large removals of content. New accounts
+// need looking up, so are ranked by wrapping it with NewAccountPriority.
+func PatrolPriority(rc recentchanges.NormalizedRecentChange) int {
+	priority := 0
+	if anonymous(rc.User) {
+		priority += 2
+	}
+
+	if rc.Changesize <= -500 {
+		priority++
+	}
+
+	if rc.Bot {
+		priority--
+	}
+	return priority
+}
+
+// anonymous reports whether a user is an IP address or a temporary account
+func anonymous(user string) bool {
+	return net.ParseIP(user) != nil || strings.HasPrefix(user, "~")
+}
+
+// NewAccountOptions decides which accounts are new, and how long queueing
+// waits to find out
+type NewAccountOptions struct {
+	// Accounts younger than MaxAge, or with fewer than MinEdits edits, are
+	// new
+	MaxAge   time.Duration
+	MinEdits int
+
+	// Timeout is how long queueing waits for an account to be looked up, and
+	// Lookups how many lookups may run at once. Lookups which take longer
+	// finish in the background, so a cached lookup ranks later edits.
+	Timeout time.Duration
+	Lookups int
+}
+
+// DefaultNewAccountOptions treats accounts as new until they would be
+// autoconfirmed on the English Wikipedia
+var DefaultNewAccountOptions = NewAccountOptions{
+	MaxAge:   4 * 24 * time.Hour,
+	MinEdits: 10,
+	Timeout:  50 * time.Millisecond,
+	Lookups:  4,
+}
+
+// NewAccountPriority ranks edits by new accounts as highly as anonymous edits,
+// on top of the ranking of base. Accounts are looked up in the background, so
+// lookup should be cached. Edits whose account can't be looked up within the
+// timeout, or while too many lookups are running, keep the ranking of base.
+func NewAccountPriority(lookup users.UserFetcher, o NewAccountOptions, base PriorityFunc) PriorityFunc {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultNewAccountOptions.Timeout
+	}
+	if o.Lookups <= 0 {
+		o.Lookups = DefaultNewAccountOptions.Lookups
+	}
+	running := make(chan struct{}, o.Lookups)
+
+	return func(rc recentchanges.NormalizedRecentChange) int {
+		priority := base(rc)
+		if rc.User == "" || rc.Bot || anonymous(rc.User) {
+			return priority
+		}
+
+		select {
+		case running <- struct{}{}:
+		default:
+			return priority
+		}
+
+		// Buffered, so the lookup can finish after queueing stops waiting
+		result := make(chan users.User, 1)
+		go func() {
+			defer func() { <-running }()
+			found, err := lookup.Fetch(rc.Wiki, []string{rc.User})
+			if err != nil {
+				close(result)
+				return
+			}
+			result <- found[rc.User]
+		}()
+
+		timeout := time.NewTimer(o.Timeout)
+		defer timeout.Stop()
+		var user users.User
+		select {
+		case user = <-result:
+		case <-timeout.C:
+			return priority
+		}
+
+		if user.Name == "" || user.Missing || user.Invalid || user.IsBot() {
+			return priority
+		}
+
+		age := user.Age(time.Now())
+		if user.EditCount < o.MinEdits || (age > 0 && age < o.MaxAge) {
+			priority += 2
+		}
+		return priority
 	}
 }
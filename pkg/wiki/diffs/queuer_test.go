@@ -0,0 +1,293 @@
+package diffs_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// gatedFetcher blocks fetching the first revision until the gate is opened
+type gatedFetcher struct {
+	started chan struct{}
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func newGatedFetcher() *gatedFetcher {
+	return &gatedFetcher{
+		started: make(chan struct{}),
+		gate:    make(chan struct{}),
+	}
+}
+
+func (f *gatedFetcher) Fetch(wiki string, revision int) ([]byte, error) {
+	f.once.Do(func() {
+		close(f.started)
+		<-f.gate
+	})
+	return []byte{}, nil
+}
+
+type queued struct {
+	revision int
+	err      error
+}
+
+type inQueuer struct {
+	options diffs.QueueOptions
+	wait    time.Duration
+	changes []recentchanges.NormalizedRecentChange
+}
+
+type wantQueuer struct {
+	results []queued
+}
+
+func change(revision int, user string) recentchanges.NormalizedRecentChange {
+	return recentchanges.NormalizedRecentChange{
+		User: user,
+		Revision: recentchanges.Revision{
+			New: revision,
+		},
+	}
+}
+
+var queuerTests = []struct {
+	name string
+	in   inQueuer
+	want wantQueuer
+}{
+	{
+		name: "fifo",
+		in: inQueuer{
+			options: diffs.DefaultQueueOptions,
+			changes: []recentchanges.NormalizedRecentChange{
+				change(2, "Example"),
+				change(3, "127.0.0.1"),
+				change(4, "Example"),
+			},
+		},
+		want: wantQueuer{
+			results: []queued{{1, nil}, {2, nil}, {3, nil}, {4, nil}},
+		},
+	},
+	{
+		name: "priority",
+		in: inQueuer{
+			options: diffs.QueueOptions{
+				Size:     10,
+				Priority: diffs.PatrolPriority,
+			},
+			changes: []recentchanges.NormalizedRecentChange{
+				change(2, "Example"),
+				change(3, "127.0.0.1"),
+				change(4, "~2025-12345"),
+			},
+		},
+		want: wantQueuer{
+			results: []queued{{1, nil}, {3, nil}, {4, nil}, {2, nil}},
+		},
+	},
+	{
+		name: "deadline",
+		in: inQueuer{
+			options: diffs.QueueOptions{
+				Size:     10,
+				Deadline: time.Millisecond,
+			},
+			wait: 10 * time.Millisecond,
+			changes: []recentchanges.NormalizedRecentChange{
+				change(2, "Example"),
+			},
+		},
+		want: wantQueuer{
+			results: []queued{{1, nil}, {2, diffs.ErrDeadlineExceeded}},
+		},
+	},
+	{
+		name: "drop newest",
+		in: inQueuer{
+			options: diffs.QueueOptions{
+				Size:     1,
+				Overflow: diffs.OverflowDropNewest,
+			},
+			changes: []recentchanges.NormalizedRecentChange{
+				change(2, "Example"),
+				change(3, "127.0.0.1"),
+			},
+		},
+		want: wantQueuer{
+			results: []queued{{3, diffs.ErrQueueFull}, {1, nil}, {2, nil}},
+		},
+	},
+	{
+		name: "drop lowest",
+		in: inQueuer{
+			options: diffs.QueueOptions{
+				Size:     1,
+				Priority: diffs.PatrolPriority,
+				Overflow: diffs.OverflowDropLowest,
+			},
+			changes: []recentchanges.NormalizedRecentChange{
+				change(2, "Example"),
+				change(3, "127.0.0.1"),
+				change(4, "Example"),
+			},
+		},
+		want: wantQueuer{
+			results: []queued{{2, diffs.ErrQueueFull}, {4, diffs.ErrQueueFull}, {1, nil}, {3, nil}},
+		},
+	},
+}
+
+func TestDiffQueuer(t *testing.T) {
+	for _, tt := range queuerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := test.NewNullLogger()
+			fetcher := newGatedFetcher()
+			queuer := diffs.NewPriorityDiffQueuer(logger, fetcher, tt.in.options)
+
+			results := make(chan queued, len(tt.want.results))
+			queue := func(rc recentchanges.NormalizedRecentChange) {
+				queuer.Queue(rc, func(body []byte, err error) error {
+					results <- queued{rc.Revision.New, err}
+					return nil
+				})
+			}
+
+			// Hold the worker on the first revision while the rest are queued
+			queue(change(1, "Example"))
+			<-fetcher.started
+			for _, rc := range tt.in.changes {
+				queue(rc)
+			}
+			time.Sleep(tt.in.wait)
+			close(fetcher.gate)
+
+			got := []queued{}
+			for range tt.want.results {
+				got = append(got, <-results)
+			}
+
+			if !reflect.DeepEqual(got, tt.want.results) {
+				t.Errorf("got %v, want %v", got, tt.want.results)
+			}
+		})
+	}
+}
+
+// fakeUsers looks up accounts from a map, counting lookups
+type fakeUsers struct {
+	users   map[string]users.User
+	lookups int
+}
+
+func (f *fakeUsers) Fetch(wiki string, names []string) (map[string]users.User, error) {
+	f.lookups++
+	if wiki != "en" {
+		return nil, errors.New("Unexpected status 404 Not Found")
+	}
+	found := map[string]users.User{}
+	for _, name := range names {
+		user, ok := f.users[name]
+		if !ok {
+			user = users.User{Name: name, Missing: true}
+		}
+		found[name] = user
+	}
+	return found, nil
+}
+
+func TestNewAccountPriority(t *testing.T) {
+	registered := func(ago time.Duration) string {
+		return time.Now().Add(-ago).UTC().Format(time.RFC3339)
+	}
+	lookup := &fakeUsers{users: map[string]users.User{
+		"Established": {Name: "Established", EditCount: 5000, Registration: registered(365 * 24 * time.Hour)},
+		"Unrecorded":  {Name: "Unrecorded", EditCount: 5000},
+		"Newcomer":    {Name: "Newcomer", EditCount: 50, Registration: registered(time.Hour)},
+		"Quiet":       {Name: "Quiet", EditCount: 2, Registration: registered(365 * 24 * time.Hour)},
+		"ExampleBot":  {Name: "ExampleBot", EditCount: 2, Registration: registered(time.Hour), Groups: []string{"*", "user", "bot"}},
+	}}
+	priority := diffs.NewAccountPriority(lookup, diffs.DefaultNewAccountOptions, diffs.PatrolPriority)
+
+	tests := []struct {
+		name    string
+		rc      recentchanges.NormalizedRecentChange
+		want    int
+		lookups int
+	}{
+		{"established", recentchanges.NormalizedRecentChange{Wiki: "en", User: "Established"}, 0, 1},
+		{"unrecorded registration", recentchanges.NormalizedRecentChange{Wiki: "en", User: "Unrecorded"}, 0, 1},
+		{"recently registered", recentchanges.NormalizedRecentChange{Wiki: "en", User: "Newcomer"}, 2, 1},
+		{"few edits", recentchanges.NormalizedRecentChange{Wiki: "en", User: "Quiet", Changesize: -1000}, 3, 1},
+		{"bot group", recentchanges.NormalizedRecentChange{Wiki: "en", User: "ExampleBot"}, 0, 1},
+		{"bot edit", recentchanges.NormalizedRecentChange{Wiki: "en", User: "Quiet", Bot: true}, -1, 0},
+		{"missing", recentchanges.NormalizedRecentChange{Wiki: "en", User: "Nobody"}, 0, 1},
+		{"ip", recentchanges.NormalizedRecentChange{Wiki: "en", User: "127.0.0.1"}, 2, 0},
+		{"temporary", recentchanges.NormalizedRecentChange{Wiki: "en", User: "~2025-12345"}, 2, 0},
+		{"lookup fails", recentchanges.NormalizedRecentChange{Wiki: "xx", User: "Quiet"}, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup.lookups = 0
+			if got := priority(tt.rc); got != tt.want {
+				t.Errorf("got priority %d, want %d", got, tt.want)
+			}
+			if lookup.lookups != tt.lookups {
+				t.Errorf("got %d lookups, want %d", lookup.lookups, tt.lookups)
+			}
+		})
+	}
+}
+
+// blockedUsers looks up accounts once unblocked, counting lookups
+type blockedUsers struct {
+	unblock chan struct{}
+	mux     sync.Mutex
+	lookups int
+}
+
+func (b *blockedUsers) Fetch(wiki string, names []string) (map[string]users.User, error) {
+	b.mux.Lock()
+	b.lookups++
+	b.mux.Unlock()
+	<-b.unblock
+	return map[string]users.User{names[0]: {Name: names[0], EditCount: 1}}, nil
+}
+
+func TestNewAccountPrioritySlowLookup(t *testing.T) {
+	lookup := &blockedUsers{unblock: make(chan struct{})}
+	defer close(lookup.unblock)
+	priority := diffs.NewAccountPriority(lookup, diffs.NewAccountOptions{
+		MaxAge:   time.Hour,
+		MinEdits: 10,
+		Timeout:  10 * time.Millisecond,
+		Lookups:  1,
+	}, diffs.PatrolPriority)
+
+	// The first lookup times out, and the second isn't made while it runs
+	for _, user := range []string{"Slow", "Queued"} {
+		start := time.Now()
+		if got := priority(recentchanges.NormalizedRecentChange{Wiki: "en", User: user}); got != 0 {
+			t.Errorf("%s: got priority %d, want 0", user, got)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: ranking took %s", user, elapsed)
+		}
+	}
+
+	lookup.mux.Lock()
+	defer lookup.mux.Unlock()
+	if lookup.lookups != 1 {
+		t.Errorf("got %d lookups, want 1", lookup.lookups)
+	}
+}
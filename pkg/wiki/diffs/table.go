@@ -0,0 +1,252 @@
+package diffs
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// RowKind is the kind of a row of a compare table
+type RowKind int
+
+const (
+	// RowHeader starts a block of rows, giving its position on each side,
+	// such as "Line 5:" in wikitext diffs or "label / en" in entity diffs
+	RowHeader RowKind = iota
+
+	// RowContext is unchanged on both sides
+	RowContext
+
+	// RowDeleted only exists on the from side
+	RowDeleted
+
+	// RowAdded only exists on the to side
+	RowAdded
+
+	// RowChanged differs between the sides
+	RowChanged
+)
+
+func (k RowKind) String() string {
+	switch k {
+	case RowHeader:
+		return "header"
+	case RowContext:
+		return "context"
+	case RowDeleted:
+		return "deleted"
+	case RowAdded:
+		return "added"
+	case RowChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Line is one side of a row of a compare table
+type Line struct {
+	Text string
+
+	// Changes are the runs of Text which differ from the other side, marked
+	// with <del> or <ins>
+	Changes []string
+
+	// Links are the titles linked from the line, such as "Q5" or
+	// "Property:P31" in entity diffs
+	Links []string
+}
+
+// Row is a row of a compare table. From is empty for added rows, and To is
+// empty for deleted rows.
+type Row struct {
+	Kind RowKind
+	From Line
+	To   Line
+}
+
+// side is the part of a row a cell belongs to
+type side int
+
+const (
+	sideNone side = iota
+	sideFrom
+	sideTo
+)
+
+// tableParser collects rows from the cells of a compare table
+type tableParser struct {
+	rows []Row
+	row  Row
+
+	// cell state, reset by each <td>
+	class   string
+	line    *Line
+	text    strings.Builder
+	change  strings.Builder
+	changes int
+	seen    [3]bool
+}
+
+// ParseTable parses the rows of the HTML table body returned by
+// action=compare
+func ParseTable(body string) ([]Row, error) {
+	p := &tableParser{rows: []Row{}}
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			err := tokenizer.Err()
+			if err == io.EOF {
+				p.endRow()
+				return p.rows, nil
+			}
+			return nil, err
+		case html.StartTagToken, html.SelfClosingTagToken:
+			p.start(tokenizer.Token())
+		case html.EndTagToken:
+			p.end(tokenizer.Token())
+		case html.TextToken:
+			p.addText(string(tokenizer.Text()))
+		}
+	}
+}
+
+func attr(token html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(class string, name string) bool {
+	for _, c := range strings.Fields(class) {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *tableParser) start(token html.Token) {
+	switch token.Data {
+	case "tr":
+		p.endRow()
+	case "td":
+		p.endCell()
+		p.startCell(attr(token, "class"))
+	case "del", "ins":
+		p.changes++
+	case "a":
+		if p.line != nil {
+			if title := attr(token, "title"); title != "" {
+				p.line.Links = append(p.line.Links, title)
+			}
+		}
+	case "br":
+		p.addText("\n")
+	}
+}
+
+func (p *tableParser) end(token html.Token) {
+	switch token.Data {
+	case "td":
+		p.endCell()
+	case "tr":
+		p.endRow()
+	case "del", "ins":
+		if p.changes > 0 {
+			p.changes--
+		}
+		if p.changes == 0 && p.line != nil && p.change.Len() > 0 {
+			p.line.Changes = append(p.line.Changes, p.change.String())
+			p.change.Reset()
+		}
+	case "div":
+		// Each line of a cell is wrapped in a <div>
+		p.addText("\n")
+	}
+}
+
+func (p *tableParser) startCell(class string) {
+	p.class = class
+	var side side
+	switch {
+	case hasClass(class, "diff-lineno"):
+		p.row.Kind = RowHeader
+		side = p.nextSide()
+	case hasClass(class, "diff-deletedline"):
+		side = sideFrom
+	case hasClass(class, "diff-addedline"):
+		side = sideTo
+	case hasClass(class, "diff-context"):
+		p.row.Kind = RowContext
+		side = p.nextSide()
+	default:
+		// Markers, and empty cells standing in for a missing side
+		if hasClass(class, "diff-empty") {
+			p.seen[p.nextSide()] = true
+		}
+		return
+	}
+
+	p.seen[side] = true
+	if side == sideFrom {
+		p.line = &p.row.From
+	} else {
+		p.line = &p.row.To
+	}
+}
+
+// nextSide returns the side of a cell which could be on either side
+func (p *tableParser) nextSide() side {
+	if p.seen[sideFrom] {
+		return sideTo
+	}
+	return sideFrom
+}
+
+func (p *tableParser) addText(text string) {
+	if p.line == nil {
+		return
+	}
+	p.text.WriteString(text)
+	if p.changes > 0 {
+		p.change.WriteString(text)
+	}
+}
+
+func (p *tableParser) endCell() {
+	if p.line != nil {
+		p.line.Text = strings.TrimRight(p.text.String(), "\n")
+		if hasClass(p.class, "diff-deletedline") {
+			p.row.Kind = RowDeleted
+		}
+		if hasClass(p.class, "diff-addedline") {
+			if p.row.Kind == RowDeleted {
+				p.row.Kind = RowChanged
+			} else {
+				p.row.Kind = RowAdded
+			}
+		}
+	}
+	p.line = nil
+	p.class = ""
+	p.text.Reset()
+	p.change.Reset()
+	p.changes = 0
+}
+
+func (p *tableParser) endRow() {
+	p.endCell()
+	if p.seen[sideFrom] || p.seen[sideTo] {
+		if p.row.Kind != RowHeader || p.row.From.Text != "" || p.row.To.Text != "" {
+			p.rows = append(p.rows, p.row)
+		}
+	}
+	p.row = Row{}
+	p.seen = [3]bool{}
+}
@@ -0,0 +1,34 @@
+package diffs_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+)
+
+const wikitextTable = `<tr><td colspan="2" class="diff-lineno" id="mw-diff-left-l5">Line 5:</td>
+<td colspan="2" class="diff-lineno">Line 5:</td></tr>
+<tr><td class="diff-marker"></td><td class="diff-context"><div>Unchanged.</div></td><td class="diff-marker"></td><td class="diff-context"><div>Unchanged.</div></td></tr>
+<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>The cat <del class="diffchange diffchange-inline">sat</del> down.</div></td><td class="diff-marker">+</td><td class="diff-addedline"><div>The cat <ins class="diffchange diffchange-inline">lay</ins> down.</div></td></tr>
+<tr><td colspan="2" class="diff-empty">&#160;</td><td class="diff-marker">+</td><td class="diff-addedline"><div>[[Category:Cats]]</div></td></tr>
+<tr><td class="diff-marker">−</td><td class="diff-deletedline"><div>Goodbye.</div></td><td colspan="2" class="diff-empty">&#160;</td></tr>`
+
+func TestParseTable(t *testing.T) {
+	want := []diffs.Row{
+		{Kind: diffs.RowHeader, From: diffs.Line{Text: "Line 5:"}, To: diffs.Line{Text: "Line 5:"}},
+		{Kind: diffs.RowContext, From: diffs.Line{Text: "Unchanged."}, To: diffs.Line{Text: "Unchanged."}},
+		{Kind: diffs.RowChanged, From: diffs.Line{Text: "The cat sat down.", Changes: []string{"sat"}}, To: diffs.Line{Text: "The cat lay down.", Changes: []string{"lay"}}},
+		{Kind: diffs.RowAdded, To: diffs.Line{Text: "[[Category:Cats]]"}},
+		{Kind: diffs.RowDeleted, From: diffs.Line{Text: "Goodbye."}},
+	}
+
+	got, err := diffs.ParseTable(wikitextTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
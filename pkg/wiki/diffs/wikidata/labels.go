@@ -0,0 +1,221 @@
+package wikidata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/batchcache"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/sirupsen/logrus"
+)
+
+// maxIDs is the most entities wbgetentities accepts in one request
+const maxIDs = 50
+
+// LabelLookup finds the labels of entities
+type LabelLookup interface {
+	// Labels returns the labels of the entities which have one
+	Labels(ids []string) (map[string]string, error)
+}
+
+type entitiesResult struct {
+	Error *struct {
+		Code string `json:"code"`
+		Info string `json:"info"`
+	} `json:"error"`
+	Entities map[string]struct {
+		Labels map[string]struct {
+			Value string `json:"value"`
+		} `json:"labels"`
+	} `json:"entities"`
+}
+
+type apiLabelLookup struct {
+	client   http.Client
+	logger   *logrus.Logger
+	language string
+}
+
+// NewLabelLookup creates a LabelLookup fetching labels in a language from
+// the Wikidata API, falling back to other languages where there is none
+func NewLabelLookup(logger *logrus.Logger, client http.Client, language string) LabelLookup {
+	return apiLabelLookup{
+		client:   client,
+		logger:   logger,
+		language: language,
+	}
+}
+
+func (l apiLabelLookup) Labels(ids []string) (map[string]string, error) {
+	labels := make(map[string]string, len(ids))
+	for start := 0; start < len(ids); start += maxIDs {
+		end := start + maxIDs
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		err := l.fetch(ids[start:end], labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+func (l apiLabelLookup) fetch(ids []string, labels map[string]string) error {
+	query := url.Values{}
+	query.Set("action", "wbgetentities")
+	query.Set("format", "json")
+	query.Set("props", "labels")
+	query.Set("languages", l.language)
+	query.Set("languagefallback", "1")
+	query.Set("ids", strings.Join(ids, "|"))
+
+	url := wiki.APIURL("wikidata") + "?" + query.Encode()
+	l.logger.WithFields(logrus.Fields{
+		"url": url,
+	}).Info("Fetching labels")
+
+	start := time.Now()
+	resp, err := l.client.Get(url)
+	if err != nil {
+		l.logger.WithError(err).Error("Error querying")
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		l.logger.WithError(err).Error("Error reading body")
+		return err
+	}
+
+	result := entitiesResult{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return fmt.Errorf("There was an error decoding: %s", string(body))
+	}
+
+	if result.Error != nil {
+		return fmt.Errorf("API error %s: %s", result.Error.Code, result.Error.Info)
+	}
+
+	for id, entity := range result.Entities {
+		if label, ok := entity.Labels[l.language]; ok {
+			labels[id] = label.Value
+		}
+	}
+
+	l.logger.WithFields(logrus.Fields{
+		"time":  time.Now().Sub(start).String(),
+		"bytes": len(body),
+	}).Info("Labels fetched")
+	return nil
+}
+
+// CachedLabelLookup is a LabelLookup remembering the labels found by an inner
+// LabelLookup, and the entities it found no label for
+type CachedLabelLookup struct {
+	inner LabelLookup
+	cache *batchcache.Cache
+}
+
+// NewCachedLabelLookup creates a LabelLookup caching up to size labels found
+// by inner, each for ttl
+func NewCachedLabelLookup(inner LabelLookup, size int, ttl time.Duration) *CachedLabelLookup {
+	return &CachedLabelLookup{
+		inner: inner,
+		cache: batchcache.New(size, ttl),
+	}
+}
+
+// Labels returns the cached labels, looking up the rest with the inner
+// LabelLookup
+func (c *CachedLabelLookup) Labels(ids []string) (map[string]string, error) {
+	values, err := c.cache.Lookup(ids, func(missing []string) (map[string]interface{}, error) {
+		found, err := c.inner.Labels(missing)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]interface{}, len(found))
+		for id, label := range found {
+			values[id] = label
+		}
+		return values, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string, len(values))
+	for id, label := range values {
+		labels[id] = label.(string)
+	}
+	return labels, nil
+}
+
+// Resolve sets the labels of the entities each change refers to
+func Resolve(changes []Change, lookup LabelLookup) error {
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, change := range changes {
+		for _, id := range change.IDs() {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	labels, err := lookup.Labels(ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range changes {
+		for _, id := range changes[i].IDs() {
+			if label, ok := labels[id]; ok {
+				if changes[i].Labels == nil {
+					changes[i].Labels = make(map[string]string)
+				}
+				changes[i].Labels[id] = label
+			}
+		}
+	}
+	return nil
+}
+
+// rateLimitedLabelLookup is a LabelLookup which spaces lookups by an inner
+// LabelLookup with a RateLimiter
+type rateLimitedLabelLookup struct {
+	inner   LabelLookup
+	limiter *wiki.RateLimiter
+}
+
+// NewRateLimitedLabelLookup creates a LabelLookup making lookups with inner
+// as limiter allows. Lookups are not limited when limiter is nil.
+func NewRateLimitedLabelLookup(inner LabelLookup, limiter *wiki.RateLimiter) LabelLookup {
+	if limiter == nil {
+		return inner
+	}
+
+	return rateLimitedLabelLookup{
+		inner:   inner,
+		limiter: limiter,
+	}
+}
+
+func (r rateLimitedLabelLookup) Labels(ids []string) (map[string]string, error) {
+	r.limiter.Wait()
+	return r.inner.Labels(ids)
+}
@@ -0,0 +1,120 @@
+package wikidata_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/wikidata"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// RoundTripFunc
+type RoundTripFunc func(req *http.Request) *http.Response
+
+// RoundTrip .
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+// countingLookup counts the IDs looked up. Entities in unlabelled have no
+// label.
+type countingLookup struct {
+	lookups    int
+	unlabelled map[string]bool
+}
+
+func (l *countingLookup) Labels(ids []string) (map[string]string, error) {
+	l.lookups += len(ids)
+	labels := map[string]string{}
+	for _, id := range ids {
+		if !l.unlabelled[id] {
+			labels[id] = "label of " + id
+		}
+	}
+	return labels, nil
+}
+
+func TestLabelLookup(t *testing.T) {
+	client := http.Client{
+		Transport: RoundTripFunc(func(req *http.Request) *http.Response {
+			if req.URL.Host != "www.wikidata.org" || req.URL.Query().Get("ids") != "P31|Q5" {
+				t.Errorf("got %s", req.URL)
+			}
+
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"entities":{"P31":{"labels":{"en":{"language":"en","value":"instance of"}}},"Q5":{"labels":{"en":{"language":"en","value":"human"}}}},"success":1}`)),
+				Header:     make(http.Header),
+			}
+		}),
+	}
+
+	logger, _ := test.NewNullLogger()
+	labels, err := wikidata.NewLabelLookup(logger, client, "en").Labels([]string{"P31", "Q5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"P31": "instance of", "Q5": "human"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("got %v, want %v", labels, want)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	inner := &countingLookup{}
+	lookup := wikidata.NewCachedLabelLookup(inner, 10, time.Hour)
+
+	changes := []wikidata.Change{
+		{Section: wikidata.SectionClaim, Kind: wikidata.Changed, Property: "P31", OldIDs: []string{"Q5"}, NewIDs: []string{"Q144"}},
+		{Section: wikidata.SectionQualifier, Kind: wikidata.Added, Property: "P31", Value: "Q144"},
+	}
+
+	for i := 0; i < 2; i++ {
+		err := wikidata.Resolve(changes, lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if inner.lookups != 3 {
+		t.Errorf("got %d lookups, want 3", inner.lookups)
+	}
+
+	want := map[string]string{"P31": "label of P31", "Q144": "label of Q144"}
+	if !reflect.DeepEqual(changes[1].Labels, want) {
+		t.Errorf("got %v, want %v", changes[1].Labels, want)
+	}
+
+	if !strings.HasPrefix(changes[0].Labels["Q5"], "label of") {
+		t.Errorf("got %v, want Q5 resolved", changes[0].Labels)
+	}
+}
+
+func TestCachedLabelLookup(t *testing.T) {
+	inner := &countingLookup{unlabelled: map[string]bool{"Q404": true}}
+	lookup := wikidata.NewCachedLabelLookup(inner, 10, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		labels, err := lookup.Labels([]string{"Q5", "Q5", "Q404"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{"Q5": "label of Q5"}
+		if !reflect.DeepEqual(labels, want) {
+			t.Errorf("got %v, want %v", labels, want)
+		}
+	}
+
+	// Duplicates are looked up once, and entities without a label are
+	// remembered too
+	if inner.lookups != 2 {
+		t.Errorf("got %d lookups, want 2", inner.lookups)
+	}
+}
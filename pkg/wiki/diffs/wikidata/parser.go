@@ -0,0 +1,234 @@
+package wikidata
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+)
+
+// Section is the part of an entity a change belongs to
+type Section string
+
+const (
+	SectionLabel       Section = "label"
+	SectionDescription Section = "description"
+	SectionAlias       Section = "alias"
+	SectionClaim       Section = "claim"
+	SectionQualifier   Section = "qualifier"
+	SectionReference   Section = "reference"
+	SectionRank        Section = "rank"
+	SectionSitelink    Section = "sitelink"
+	SectionBadge       Section = "badge"
+)
+
+// ChangeKind is how a part of an entity changed
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change is a change to a single part of an entity
+type Change struct {
+	Section Section    `json:"section"`
+	Kind    ChangeKind `json:"kind"`
+
+	// Language is the language of a label, description or alias
+	Language string `json:"language,omitempty"`
+
+	// Site is the site of a sitelink or badge, such as "enwiki"
+	Site string `json:"site,omitempty"`
+
+	// Property is the property of a claim, or of the claim a qualifier,
+	// reference or rank belongs to, such as "P31"
+	Property string `json:"property,omitempty"`
+
+	// Value is the value of the claim a qualifier, reference or rank belongs
+	// to, such as "Q5" for an entity or the text of other values
+	Value string `json:"value,omitempty"`
+
+	// Old and New are the text of the part before and after the change.
+	// Old is empty when the part was added, and New when it was removed.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+
+	// OldIDs and NewIDs are the entities referred to by Old and New
+	OldIDs []string `json:"oldids,omitempty"`
+	NewIDs []string `json:"newids,omitempty"`
+
+	// Labels maps the IDs of the change to their labels, once resolved
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// HeaderError describes a block of an entity diff which could not be parsed
+type HeaderError struct {
+	Header string
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("Unknown entity diff header %q", e.Header)
+}
+
+// entityID matches the ID in the title of a link to an entity, such as
+// "Q5", "Property:P31" or "Lexeme:L1"
+var entityID = regexp.MustCompile(`^(?:[A-Za-z]+:)?([PQL][0-9]+)$`)
+
+// entityText matches an entity ID written out in text
+var entityText = regexp.MustCompile(`\b[PQL][0-9]+\b`)
+
+// entityIDs returns the IDs of the entities linked from a line
+func entityIDs(line diffs.Line) []string {
+	var ids []string
+	for _, link := range line.Links {
+		if match := entityID.FindStringSubmatch(link); match != nil {
+			ids = append(ids, match[1])
+		}
+	}
+	return ids
+}
+
+// block is the position in the entity a header row describes
+type block struct {
+	section  Section
+	language string
+	site     string
+	property string
+	value    string
+}
+
+// parseHeader reads the position of a block from its header, such as
+// "label / en", "links / enwiki / name" or "Property / P31: Q5 / qualifier"
+func parseHeader(line diffs.Line) (block, error) {
+	path := strings.Split(line.Text, " / ")
+	if len(path) < 2 {
+		return block{}, &HeaderError{line.Text}
+	}
+
+	switch strings.ToLower(path[0]) {
+	case "label":
+		return block{section: SectionLabel, language: path[1]}, nil
+	case "description":
+		return block{section: SectionDescription, language: path[1]}, nil
+	case "aliases":
+		return block{section: SectionAlias, language: path[1]}, nil
+	case "links":
+		if len(path) > 2 && path[2] == "badges" {
+			return block{section: SectionBadge, site: path[1]}, nil
+		}
+		return block{section: SectionSitelink, site: path[1]}, nil
+	case "property":
+		return parseClaimHeader(line, path)
+	}
+	return block{}, &HeaderError{line.Text}
+}
+
+// parseClaimHeader reads the property, and the value a qualifier, reference
+// or rank belongs to. Entities are usually linked by their label, so IDs are
+// read from the links where possible.
+func parseClaimHeader(line diffs.Line, path []string) (block, error) {
+	b := block{section: SectionClaim}
+	if len(path) > 2 {
+		switch path[2] {
+		case "qualifier":
+			b.section = SectionQualifier
+		case "reference":
+			b.section = SectionReference
+		case "rank":
+			b.section = SectionRank
+		default:
+			return block{}, &HeaderError{line.Text}
+		}
+	}
+
+	ids := entityIDs(line)
+	if len(ids) == 0 {
+		ids = entityText.FindAllString(path[1], -1)
+	}
+	if len(ids) == 0 {
+		return block{}, &HeaderError{line.Text}
+	}
+	b.property = ids[0]
+
+	if b.section != SectionClaim {
+		if len(ids) > 1 {
+			b.value = ids[1]
+		} else if i := strings.Index(path[1], ": "); i >= 0 {
+			b.value = path[1][i+2:]
+		}
+	}
+	return b, nil
+}
+
+// Parse parses the changes of a Wikibase entity diff, such as the body of a
+// compare of two revisions on Wikidata
+func Parse(body string) ([]Change, error) {
+	rows, err := diffs.ParseTable(body)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	current := block{}
+	for _, row := range rows {
+		change := Change{}
+		switch row.Kind {
+		case diffs.RowHeader:
+			// Added blocks only have a header on the to side
+			header := row.To
+			if header.Text == "" {
+				header = row.From
+			}
+
+			current, err = parseHeader(header)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case diffs.RowAdded:
+			change.Kind = Added
+		case diffs.RowDeleted:
+			change.Kind = Removed
+		case diffs.RowChanged:
+			change.Kind = Changed
+		default:
+			continue
+		}
+
+		if current.section == "" {
+			return nil, &HeaderError{}
+		}
+
+		change.Section = current.section
+		change.Language = current.language
+		change.Site = current.site
+		change.Property = current.property
+		change.Value = current.value
+		if row.Kind != diffs.RowAdded {
+			change.Old = row.From.Text
+			change.OldIDs = entityIDs(row.From)
+		}
+		if row.Kind != diffs.RowDeleted {
+			change.New = row.To.Text
+			change.NewIDs = entityIDs(row.To)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// IDs returns every entity a change refers to
+func (c Change) IDs() []string {
+	ids := []string{}
+	if c.Property != "" {
+		ids = append(ids, c.Property)
+	}
+	if entityID.MatchString(c.Value) {
+		ids = append(ids, c.Value)
+	}
+	ids = append(ids, c.OldIDs...)
+	return append(ids, c.NewIDs...)
+}
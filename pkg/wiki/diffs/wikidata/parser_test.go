@@ -0,0 +1,49 @@
+package wikidata_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/wikidata"
+)
+
+func TestParse(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/entity.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []wikidata.Change{
+		{Section: wikidata.SectionLabel, Kind: wikidata.Changed, Language: "en", Old: "Douglas Adams", New: "Dougie"},
+		{Section: wikidata.SectionDescription, Kind: wikidata.Added, Language: "de", New: "britischer Schriftsteller"},
+		{Section: wikidata.SectionAlias, Kind: wikidata.Removed, Language: "en", Old: "DNA"},
+		{Section: wikidata.SectionClaim, Kind: wikidata.Changed, Property: "P31", Old: "human", New: "dog", OldIDs: []string{"Q5"}, NewIDs: []string{"Q144"}},
+		{Section: wikidata.SectionQualifier, Kind: wikidata.Added, Property: "P69", Value: "Q691283", New: "end time: 1974", NewIDs: []string{"P582"}},
+		{Section: wikidata.SectionReference, Kind: wikidata.Added, Property: "P569", Value: "11 March 1952", New: "P248: Q36578"},
+		{Section: wikidata.SectionSitelink, Kind: wikidata.Changed, Site: "enwiki", Old: "Douglas Adams", New: "Dougie"},
+		{Section: wikidata.SectionBadge, Kind: wikidata.Added, Site: "enwiki", New: "featured article", NewIDs: []string{"Q17437796"}},
+	}
+
+	got, err := wikidata.Parse(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d changes, want %d: %+v", len(got), len(want), got)
+	}
+
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestParseUnknownHeader(t *testing.T) {
+	_, err := wikidata.Parse(`<tr><td colspan="2" class="diff-lineno">Line 1:</td><td colspan="2" class="diff-lineno">Line 1:</td></tr>`)
+	if _, ok := err.(*wikidata.HeaderError); !ok {
+		t.Errorf("got %v, want a HeaderError", err)
+	}
+}
@@ -0,0 +1,106 @@
+package dump
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrNo7z is returned when opening a .7z dump without 7z installed
+var ErrNo7z = errors.New("Reading .7z dumps requires 7z, 7za or 7zr")
+
+// File is an opened dump, decompressed while it is read
+type File struct {
+	io.Reader
+
+	// Size is the size of the file on disk
+	Size int64
+
+	file *os.File
+	cmd  *exec.Cmd
+}
+
+// Open opens a dump, decompressing it by its extension: .bz2 (including
+// multistream dumps), .gz or .7z. Anything else is read as plain XML. The
+// compressed bytes read are counted by m, if given, except for .7z dumps,
+// which 7z reads itself.
+func Open(path string, m *Meter) (*File, error) {
+	if strings.HasSuffix(path, ".7z") {
+		return open7z(path, m)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var r io.Reader = bufio.NewReaderSize(file, 1<<20)
+	if m != nil {
+		r = m.Reader(r)
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(r)
+	case strings.HasSuffix(path, ".gz"):
+		r, err = gzip.NewReader(r)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return &File{Reader: r, Size: info.Size(), file: file}, nil
+}
+
+// open7z decompresses a .7z dump with the 7z command, as Go has no decoder
+func open7z(path string, m *Meter) (*File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var bin string
+	for _, name := range []string{"7z", "7za", "7zr"} {
+		bin, err = exec.LookPath(name)
+		if err == nil {
+			break
+		}
+	}
+	if bin == "" {
+		return nil, ErrNo7z
+	}
+
+	cmd := exec.Command(bin, "e", "-so", path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Reader: bufio.NewReaderSize(stdout, 1<<20), Size: info.Size(), cmd: cmd}, nil
+}
+
+// Close closes the dump, stopping 7z if it is still decompressing
+func (f *File) Close() error {
+	if f.cmd != nil {
+		f.cmd.Process.Kill()
+		f.cmd.Wait()
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,74 @@
+package dump
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	history, err := ioutil.ReadFile("testdata/history.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz := filepath.Join(t.TempDir(), "history.xml.gz")
+	f, err := os.Create(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write(history)
+	w.Close()
+	f.Close()
+
+	tests := []struct {
+		path          string
+		wantDB        string
+		wantRevisions int
+	}{
+		{"testdata/history.xml", "enwiki", 3},
+		{gz, "enwiki", 3},
+		// Read straight through, every stream in turn
+		{"testdata/multistream.xml.bz2", "testwiki", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			info, err := os.Stat(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			meter := NewMeter(info.Size())
+			file, err := Open(tt.path, meter)
+			if err != nil {
+				t.Fatalf("Open() returned error %v", err)
+			}
+			defer file.Close()
+
+			reader, err := NewReader(file)
+			if err != nil {
+				t.Fatalf("NewReader() returned error %v", err)
+			}
+			if reader.SiteInfo().DBName != tt.wantDB {
+				t.Errorf("SiteInfo().DBName = %q, want %q", reader.SiteInfo().DBName, tt.wantDB)
+			}
+			if got := len(readAll(t, reader)); got != tt.wantRevisions {
+				t.Errorf("read %d revisions, want %d", got, tt.wantRevisions)
+			}
+			if file.Size != info.Size() || meter.Progress().Bytes != info.Size() {
+				t.Errorf("Size = %d and read %d bytes, want %d", file.Size, meter.Progress().Bytes, info.Size())
+			}
+		})
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	_, err := Open("testdata/missing.xml.bz2", nil)
+	if !os.IsNotExist(err) {
+		t.Errorf("Open() returned error %v, want not exist", err)
+	}
+}
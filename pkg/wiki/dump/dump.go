@@ -0,0 +1,281 @@
+// Package dump reads MediaWiki XML dumps, as produced by Special:Export and
+// dumps.wikimedia.org, one revision at a time
+package dump
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SiteInfo describes the wiki a dump was taken from
+type SiteInfo struct {
+	SiteName   string      `xml:"sitename"`
+	DBName     string      `xml:"dbname"`
+	Base       string      `xml:"base"`
+	Generator  string      `xml:"generator"`
+	Case       string      `xml:"case"`
+	Namespaces []Namespace `xml:"namespaces>namespace"`
+}
+
+// Namespace is a namespace of the wiki. The main namespace has no name.
+type Namespace struct {
+	Key  int    `xml:"key,attr"`
+	Case string `xml:"case,attr"`
+	Name string `xml:",chardata"`
+}
+
+// Page is a page of the dump, without its revisions
+type Page struct {
+	Title string
+	NS    int
+	ID    int
+
+	// Redirect is the title the page redirects to, if it is a redirect
+	Redirect string
+
+	Restrictions string
+}
+
+// Contributor is the author of a revision. Either Username and ID, or IP
+// are set, unless the contributor is deleted.
+type Contributor struct {
+	Username string
+	ID       int
+	IP       string
+	Deleted  bool
+}
+
+// Revision is a revision of a page
+type Revision struct {
+	Page *Page
+
+	ID          int
+	ParentID    int
+	Timestamp   time.Time
+	Contributor Contributor
+	Minor       bool
+
+	Comment        string
+	CommentDeleted bool
+
+	Model  string
+	Format string
+
+	// Text is empty in stub dumps, and when TextDeleted is set
+	Text        string
+	TextBytes   int
+	TextDeleted bool
+
+	// SHA1 is the base36 revision hash of Text, compared with revhash.Equal
+	SHA1 string
+}
+
+// deleted is the value of the deleted attribute of hidden fields
+const deleted = "deleted"
+
+type xmlDeletable struct {
+	Deleted string `xml:"deleted,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type xmlRevision struct {
+	ID          int    `xml:"id"`
+	ParentID    int    `xml:"parentid"`
+	Timestamp   string `xml:"timestamp"`
+	Contributor struct {
+		Deleted  string `xml:"deleted,attr"`
+		Username string `xml:"username"`
+		ID       int    `xml:"id"`
+		IP       string `xml:"ip"`
+	} `xml:"contributor"`
+	Minor   *struct{}    `xml:"minor"`
+	Comment xmlDeletable `xml:"comment"`
+	Model   string       `xml:"model"`
+	Format  string       `xml:"format"`
+	Text    struct {
+		Deleted string `xml:"deleted,attr"`
+		Bytes   int    `xml:"bytes,attr"`
+		Value   string `xml:",chardata"`
+	} `xml:"text"`
+	SHA1 string `xml:"sha1"`
+}
+
+// Error describes where reading a dump failed
+type Error struct {
+	Offset int64 // The offset in the dump, in bytes
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Could not read dump at offset %d: %v", e.Offset, e.Err)
+}
+
+// Reader reads the revisions of a dump in order. Only one revision is held
+// in memory at a time, however many a page has.
+type Reader struct {
+	decoder  *xml.Decoder
+	siteInfo SiteInfo
+	page     *Page
+
+	// pending is the element read while looking for the site info
+	pending *xml.StartElement
+}
+
+// NewReader creates a Reader, reading the site info at the start of the dump
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{decoder: xml.NewDecoder(r)}
+	for {
+		token, err := reader.decoder.Token()
+		if err == io.EOF {
+			return reader, nil
+		}
+		if err != nil {
+			return nil, reader.wrap(err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local == "mediawiki" {
+			continue
+		}
+
+		if start.Name.Local == "siteinfo" {
+			err = reader.decoder.DecodeElement(&reader.siteInfo, &start)
+			if err != nil {
+				return nil, reader.wrap(err)
+			}
+			return reader, nil
+		}
+
+		// Partial dumps may have no site info
+		reader.pending = &start
+		return reader, nil
+	}
+}
+
+// SiteInfo returns the site info of the dump
+func (r *Reader) SiteInfo() SiteInfo {
+	return r.siteInfo
+}
+
+func (r *Reader) wrap(err error) error {
+	return &Error{Offset: r.decoder.InputOffset(), Err: err}
+}
+
+// token returns the element read by NewReader before reading on
+func (r *Reader) token() (xml.Token, error) {
+	if r.pending != nil {
+		start := *r.pending
+		r.pending = nil
+		return start, nil
+	}
+	return r.decoder.Token()
+}
+
+// Next reads the next revision, returning io.EOF once every revision has
+// been read. Pages without revisions are skipped.
+func (r *Reader) Next() (Revision, error) {
+	for {
+		token, err := r.token()
+		if err == io.EOF {
+			if r.page != nil {
+				return Revision{}, r.wrap(io.ErrUnexpectedEOF)
+			}
+			return Revision{}, io.EOF
+		}
+		if err != nil {
+			return Revision{}, r.wrap(err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			revision, ok, err := r.start(t)
+			if err != nil {
+				return Revision{}, r.wrap(err)
+			}
+			if ok {
+				return revision, nil
+			}
+		case xml.EndElement:
+			if t.Name.Local == "page" {
+				r.page = nil
+			}
+		}
+	}
+}
+
+// start handles an element, returning the revision if it is one
+func (r *Reader) start(start xml.StartElement) (Revision, bool, error) {
+	if start.Name.Local == "page" {
+		r.page = &Page{}
+		return Revision{}, false, nil
+	}
+
+	if r.page == nil {
+		// Elements outside of pages, such as the end of the site info
+		return Revision{}, false, r.decoder.Skip()
+	}
+
+	var err error
+	switch start.Name.Local {
+	case "title":
+		err = r.decoder.DecodeElement(&r.page.Title, &start)
+	case "ns":
+		err = r.decoder.DecodeElement(&r.page.NS, &start)
+	case "id":
+		err = r.decoder.DecodeElement(&r.page.ID, &start)
+	case "redirect":
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "title" {
+				r.page.Redirect = attr.Value
+			}
+		}
+		err = r.decoder.Skip()
+	case "restrictions":
+		err = r.decoder.DecodeElement(&r.page.Restrictions, &start)
+	case "revision":
+		return r.revision(start)
+	default:
+		// Uploads and elements of newer schemas
+		err = r.decoder.Skip()
+	}
+	return Revision{}, false, err
+}
+
+func (r *Reader) revision(start xml.StartElement) (Revision, bool, error) {
+	raw := xmlRevision{}
+	err := r.decoder.DecodeElement(&raw, &start)
+	if err != nil {
+		return Revision{}, false, err
+	}
+
+	revision := Revision{
+		Page:     r.page,
+		ID:       raw.ID,
+		ParentID: raw.ParentID,
+		Contributor: Contributor{
+			Username: raw.Contributor.Username,
+			ID:       raw.Contributor.ID,
+			IP:       raw.Contributor.IP,
+			Deleted:  raw.Contributor.Deleted == deleted,
+		},
+		Minor:          raw.Minor != nil,
+		Comment:        raw.Comment.Value,
+		CommentDeleted: raw.Comment.Deleted == deleted,
+		Model:          raw.Model,
+		Format:         raw.Format,
+		Text:           raw.Text.Value,
+		TextBytes:      raw.Text.Bytes,
+		TextDeleted:    raw.Text.Deleted == deleted,
+		SHA1:           raw.SHA1,
+	}
+
+	if raw.Timestamp != "" {
+		revision.Timestamp, err = time.Parse(time.RFC3339, raw.Timestamp)
+		if err != nil {
+			return Revision{}, false, fmt.Errorf("Revision %d has an invalid timestamp: %v", raw.ID, err)
+		}
+	}
+	return revision, true, nil
+}
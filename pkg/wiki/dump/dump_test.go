@@ -0,0 +1,149 @@
+package dump
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, r *Reader) []Revision {
+	revisions := []Revision{}
+	for {
+		revision, err := r.Next()
+		if err == io.EOF {
+			return revisions
+		}
+		if err != nil {
+			t.Fatalf("Next() returned error %v", err)
+		}
+		revisions = append(revisions, revision)
+	}
+}
+
+func TestReader(t *testing.T) {
+	f, err := os.Open("testdata/history.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader() returned error %v", err)
+	}
+
+	wantSiteInfo := SiteInfo{
+		SiteName:  "Wikipedia",
+		DBName:    "enwiki",
+		Base:      "https://en.wikipedia.org/wiki/Main_Page",
+		Generator: "MediaWiki 1.41.0-wmf.7",
+		Case:      "first-letter",
+		Namespaces: []Namespace{
+			{Key: -1, Case: "first-letter", Name: "Special"},
+			{Key: 0, Case: "first-letter"},
+			{Key: 1, Case: "first-letter", Name: "Talk"},
+		},
+	}
+	if !reflect.DeepEqual(r.SiteInfo(), wantSiteInfo) {
+		t.Errorf("SiteInfo() = %+v, want %+v", r.SiteInfo(), wantSiteInfo)
+	}
+
+	redirect := &Page{Title: "AccessibleComputing", NS: 0, ID: 10, Redirect: "Computer accessibility"}
+	talk := &Page{Title: "Talk:Example", NS: 1, ID: 20}
+	want := []Revision{
+		{
+			Page:        redirect,
+			ID:          1002250816,
+			ParentID:    854851586,
+			Timestamp:   time.Date(2021, 1, 23, 15, 15, 1, 0, time.UTC),
+			Contributor: Contributor{Username: "Elli", ID: 20842734},
+			Minor:       true,
+			Comment:     "shel",
+			Model:       "wikitext",
+			Format:      "text/x-wiki",
+			Text:        "#REDIRECT [[Computer accessibility]]",
+			TextBytes:   111,
+			SHA1:        "kmysdltgexdwkv2xsml3j44jb56dxvn",
+		},
+		{
+			Page:        talk,
+			ID:          54,
+			Timestamp:   time.Date(2001, 1, 15, 13, 15, 0, 0, time.UTC),
+			Contributor: Contributor{IP: "127.0.0.1"},
+			Comment:     "first",
+			Model:       "wikitext",
+			Format:      "text/x-wiki",
+			Text:        "revision 54",
+			TextBytes:   11,
+			SHA1:        "039sg7syuee6ji0hacxnhlq1jd4dyhw",
+		},
+		{
+			Page:           talk,
+			ID:             77,
+			ParentID:       54,
+			Timestamp:      time.Date(2001, 1, 16, 9, 0, 0, 0, time.UTC),
+			Contributor:    Contributor{Deleted: true},
+			CommentDeleted: true,
+			Model:          "wikitext",
+			Format:         "text/x-wiki",
+			TextBytes:      11,
+			TextDeleted:    true,
+			SHA1:           "0dvuxo27ua13avbhkwwhi3atnwr5krl",
+		},
+	}
+
+	got := readAll(t, r)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Next() = %+v, want %+v", got, want)
+	}
+	if got[1].Page != got[2].Page {
+		t.Errorf("Revisions of the same page do not share a Page")
+	}
+}
+
+func TestReaderWithoutSiteInfo(t *testing.T) {
+	in := `<mediawiki><page><title>A</title><ns>0</ns><id>1</id><revision><id>2</id></revision></page></mediawiki>`
+	r, err := NewReader(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("NewReader() returned error %v", err)
+	}
+
+	got := readAll(t, r)
+	want := []Revision{{Page: &Page{Title: "A", ID: 1}, ID: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Next() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"truncated", `<mediawiki><page><title>A</title><revision><id>2</id></revision>`},
+		{"malformed", `<mediawiki><page><title>A</title><revision><id>2</revision></page></mediawiki>`},
+		{"bad id", `<mediawiki><page><revision><id>x</id></revision></page></mediawiki>`},
+		{"bad timestamp", `<mediawiki><page><revision><id>2</id><timestamp>yesterday</timestamp></revision></page></mediawiki>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("NewReader() returned error %v", err)
+			}
+
+			for err == nil {
+				_, err = r.Next()
+			}
+			var dumpErr *Error
+			if !errors.As(err, &dumpErr) {
+				t.Errorf("Next() returned %v, want *Error", err)
+			}
+		})
+	}
+}
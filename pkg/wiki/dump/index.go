@@ -0,0 +1,134 @@
+package dump
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNotInIndex is returned when a page is not in a multistream index
+var ErrNotInIndex = errors.New("Page is not in the index")
+
+// IndexEntry is a line of the index of a multistream dump, giving the offset
+// of the bz2 stream holding a page
+type IndexEntry struct {
+	Offset int64
+	PageID int
+	Title  string
+
+	// End is the offset of the next stream, set by LookupTitle and LookupID.
+	// It is 0 when the page is in the last stream.
+	End int64
+}
+
+// IndexReader reads the entries of a multistream index, such as
+// enwiki-latest-pages-articles-multistream-index.txt, in order
+type IndexReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewIndexReader creates an IndexReader reading the decompressed index r
+func NewIndexReader(r io.Reader) *IndexReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	return &IndexReader{scanner: scanner}
+}
+
+// Next reads the next entry, returning io.EOF at the end of the index
+func (r *IndexReader) Next() (IndexEntry, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// Titles may themselves contain colons
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			return IndexEntry{}, fmt.Errorf("Invalid index entry on line %d: %q", r.line, line)
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return IndexEntry{}, fmt.Errorf("Invalid offset on line %d: %v", r.line, err)
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return IndexEntry{}, fmt.Errorf("Invalid page id on line %d: %v", r.line, err)
+		}
+		return IndexEntry{Offset: offset, PageID: id, Title: fields[2]}, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return IndexEntry{}, err
+	}
+	return IndexEntry{}, io.EOF
+}
+
+// LookupTitle finds the entry of a page by its title. The index is read
+// rather than held in memory, as for large wikis it is gigabytes.
+func LookupTitle(r io.Reader, title string) (IndexEntry, error) {
+	return lookup(r, func(e IndexEntry) bool { return e.Title == title })
+}
+
+// LookupID finds the entry of a page by its ID
+func LookupID(r io.Reader, id int) (IndexEntry, error) {
+	return lookup(r, func(e IndexEntry) bool { return e.PageID == id })
+}
+
+func lookup(r io.Reader, match func(IndexEntry) bool) (IndexEntry, error) {
+	index := NewIndexReader(r)
+	for {
+		entry, err := index.Next()
+		if err == io.EOF {
+			return IndexEntry{}, ErrNotInIndex
+		}
+		if err != nil {
+			return IndexEntry{}, err
+		}
+		if match(entry) {
+			err = end(index, &entry)
+			return entry, err
+		}
+	}
+}
+
+// end finds where the stream of an entry ends from the entries after it
+func end(index *IndexReader, entry *IndexEntry) error {
+	for {
+		next, err := index.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if next.Offset != entry.Offset {
+			entry.End = next.Offset
+			return nil
+		}
+	}
+}
+
+// Streams returns the offsets of the streams of a multistream dump listed in
+// its index, in order
+func Streams(r io.Reader) ([]int64, error) {
+	offsets := []int64{}
+	index := NewIndexReader(r)
+	for {
+		entry, err := index.Next()
+		if err == io.EOF {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(offsets) == 0 || offsets[len(offsets)-1] != entry.Offset {
+			offsets = append(offsets, entry.Offset)
+		}
+	}
+}
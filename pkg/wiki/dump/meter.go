@@ -0,0 +1,117 @@
+package dump
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is how far through a dump reading has got
+type Progress struct {
+	// Bytes is the number of compressed bytes read, out of Total
+	Bytes int64
+	Total int64
+
+	Pages     int64
+	Revisions int64
+	Elapsed   time.Duration
+}
+
+// Fraction returns the fraction of the dump read, or 0 if its size is unknown
+func (p Progress) Fraction() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / float64(p.Total)
+}
+
+// BytesPerSecond returns the compressed bytes read per second
+func (p Progress) BytesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// RevisionsPerSecond returns the revisions read per second
+func (p Progress) RevisionsPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Revisions) / p.Elapsed.Seconds()
+}
+
+// Remaining estimates the time left to read the dump, or 0 if unknown
+func (p Progress) Remaining() time.Duration {
+	fraction := p.Fraction()
+	if fraction <= 0 || fraction > 1 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * (1 - fraction) / fraction)
+}
+
+// Meter measures progress through a dump. It is safe for concurrent use.
+type Meter struct {
+	start     time.Time
+	total     int64
+	bytes     int64
+	pages     int64
+	revisions int64
+}
+
+// NewMeter creates a Meter for a dump of total compressed bytes
+func NewMeter(total int64) *Meter {
+	return &Meter{start: time.Now(), total: total}
+}
+
+// AddBytes counts compressed bytes read
+func (m *Meter) AddBytes(n int64) {
+	atomic.AddInt64(&m.bytes, n)
+}
+
+// Count counts pages and revisions read
+func (m *Meter) Count(pages, revisions int64) {
+	atomic.AddInt64(&m.pages, pages)
+	atomic.AddInt64(&m.revisions, revisions)
+}
+
+// Progress returns the progress so far
+func (m *Meter) Progress() Progress {
+	return Progress{
+		Bytes:     atomic.LoadInt64(&m.bytes),
+		Total:     m.total,
+		Pages:     atomic.LoadInt64(&m.pages),
+		Revisions: atomic.LoadInt64(&m.revisions),
+		Elapsed:   time.Since(m.start),
+	}
+}
+
+// Report calls report with the progress every interval until stop is closed
+func (m *Meter) Report(interval time.Duration, stop <-chan struct{}, report func(Progress)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report(m.Progress())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reader counts the bytes read through r
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	return &meterReader{r, m}
+}
+
+type meterReader struct {
+	r io.Reader
+	m *Meter
+}
+
+func (r *meterReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.m.AddBytes(int64(n))
+	return n, err
+}
@@ -0,0 +1,198 @@
+package dump
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+)
+
+// ErrPageNotFound is returned when a page is not in the stream its index
+// entry points to
+var ErrPageNotFound = errors.New("Page is not in its stream")
+
+// footer ends the last stream of a multistream dump
+var footer = []byte("</mediawiki>")
+
+// StreamOptions configures reading a multistream dump in parallel
+type StreamOptions struct {
+	// Workers is the number of streams decompressed and read at once. It
+	// defaults to the number of CPUs.
+	Workers int
+
+	// Meter, if given, measures progress through the dump
+	Meter *Meter
+}
+
+// StreamError describes which stream of a multistream dump could not be read
+type StreamError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("Could not read stream at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// readStream decompresses the bz2 stream between offset and end. Multistream
+// dumps hold around 100 pages of current revisions per stream, so each is
+// small enough to read whole.
+func readStream(r io.ReaderAt, offset, end int64) ([]byte, error) {
+	return ioutil.ReadAll(bzip2.NewReader(io.NewSectionReader(r, offset, end-offset)))
+}
+
+// ReadSiteInfo reads the site info from the first stream of a multistream
+// dump, which holds nothing else
+func ReadSiteInfo(r io.ReaderAt, offsets []int64) (SiteInfo, error) {
+	if len(offsets) == 0 {
+		return SiteInfo{}, nil
+	}
+
+	data, err := readStream(r, 0, offsets[0])
+	if err != nil {
+		return SiteInfo{}, &StreamError{0, err}
+	}
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return SiteInfo{}, &StreamError{0, err}
+	}
+	return reader.SiteInfo(), nil
+}
+
+// ReadPage reads the revisions of a page from a multistream dump of size
+// bytes, using the entry of the page in its index to read only the stream
+// holding it
+func ReadPage(r io.ReaderAt, size int64, entry IndexEntry) ([]Revision, error) {
+	end := entry.End
+	if end == 0 {
+		end = size
+	}
+
+	revisions := []Revision{}
+	err := readPages(r, entry.Offset, end, nil, func(revision Revision) error {
+		if revision.Page.ID == entry.PageID {
+			revisions = append(revisions, revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &StreamError{entry.Offset, err}
+	}
+
+	if len(revisions) == 0 {
+		return nil, ErrPageNotFound
+	}
+	return revisions, nil
+}
+
+// ReadStreams reads every page of a multistream dump of size bytes, reading
+// the streams at offsets across worker goroutines. handle is called from
+// every worker at once, though the revisions of a page are always handled in
+// order by the same worker. Reading stops at the first error.
+func ReadStreams(r io.ReaderAt, size int64, offsets []int64, o StreamOptions, handle func(Revision) error) error {
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if o.Meter != nil && len(offsets) > 0 {
+		o.Meter.AddBytes(offsets[0])
+	}
+
+	jobs := make(chan int)
+	done := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				end := size
+				if i+1 < len(offsets) {
+					end = offsets[i+1]
+				}
+
+				err := readPages(r, offsets[i], end, o.Meter, handle)
+				if err != nil {
+					fail(&StreamError{offsets[i], err})
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range offsets {
+		select {
+		case jobs <- i:
+		case <-done:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// readPages reads the pages of the stream between offset and end
+func readPages(r io.ReaderAt, offset, end int64, m *Meter, handle func(Revision) error) error {
+	data, err := readStream(r, offset, end)
+	if err != nil {
+		return err
+	}
+
+	// The last stream is followed by a stream closing the document, which
+	// the bz2 reader reads on into
+	data = bytes.TrimSuffix(bytes.TrimSpace(data), footer)
+
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	var pages, revisions int64
+	var page *Page
+	for {
+		revision, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if revision.Page != page {
+			page = revision.Page
+			pages++
+		}
+		revisions++
+
+		err = handle(revision)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m != nil {
+		m.AddBytes(end - offset)
+		m.Count(pages, revisions)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package dump
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testIndex = "testdata/multistream-index.txt"
+
+func openMultistream(t *testing.T) (*os.File, int64) {
+	f, err := os.Open("testdata/multistream.xml.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, info.Size()
+}
+
+func indexOffsets(t *testing.T) []int64 {
+	index, err := os.Open(testIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	offsets, err := Streams(index)
+	if err != nil {
+		t.Fatalf("Streams() returned error %v", err)
+	}
+	return offsets
+}
+
+func TestStreams(t *testing.T) {
+	got := indexOffsets(t)
+	want := []int64{231, 521, 833}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Streams() = %v, want %v", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		lookup  func(*os.File) (IndexEntry, error)
+		want    IndexEntry
+		wantErr error
+	}{
+		{
+			name:   "title with colons",
+			lookup: func(f *os.File) (IndexEntry, error) { return LookupTitle(f, "Wikipedia:About: Colons") },
+			want:   IndexEntry{Offset: 521, PageID: 3, Title: "Wikipedia:About: Colons", End: 833},
+		},
+		{
+			name:   "last stream",
+			lookup: func(f *os.File) (IndexEntry, error) { return LookupID(f, 5) },
+			want:   IndexEntry{Offset: 833, PageID: 5, Title: "Epsilon"},
+		},
+		{
+			name:    "missing",
+			lookup:  func(f *os.File) (IndexEntry, error) { return LookupTitle(f, "Zeta") },
+			wantErr: ErrNotInIndex,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(testIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			got, err := tt.lookup(f)
+			if err != tt.wantErr {
+				t.Fatalf("lookup returned error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("lookup = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexReaderInvalid(t *testing.T) {
+	_, err := NewIndexReader(strings.NewReader("12:x:Title\n")).Next()
+	if err == nil {
+		t.Errorf("Next() returned no error for an invalid page id")
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	f, size := openMultistream(t)
+
+	for _, entry := range []IndexEntry{
+		{Offset: 521, PageID: 4, Title: "Delta", End: 833},
+		{Offset: 833, PageID: 5, Title: "Epsilon"},
+	} {
+		revisions, err := ReadPage(f, size, entry)
+		if err != nil {
+			t.Fatalf("ReadPage(%s) returned error %v", entry.Title, err)
+		}
+		if len(revisions) != 1 || revisions[0].Page.Title != entry.Title || revisions[0].ID != entry.PageID*100 {
+			t.Errorf("ReadPage(%s) = %+v", entry.Title, revisions)
+		}
+	}
+
+	_, err := ReadPage(f, size, IndexEntry{Offset: 231, PageID: 4, End: 521})
+	if err != ErrPageNotFound {
+		t.Errorf("ReadPage() returned error %v, want %v", err, ErrPageNotFound)
+	}
+}
+
+func TestReadSiteInfo(t *testing.T) {
+	f, _ := openMultistream(t)
+
+	got, err := ReadSiteInfo(f, indexOffsets(t))
+	if err != nil {
+		t.Fatalf("ReadSiteInfo() returned error %v", err)
+	}
+	if got.DBName != "testwiki" || len(got.Namespaces) != 2 {
+		t.Errorf("ReadSiteInfo() = %+v", got)
+	}
+}
+
+func TestReadStreams(t *testing.T) {
+	f, size := openMultistream(t)
+
+	for _, workers := range []int{1, 2, 8} {
+		mux := sync.Mutex{}
+		titles := []string{}
+		meter := NewMeter(size)
+		err := ReadStreams(f, size, indexOffsets(t), StreamOptions{Workers: workers, Meter: meter}, func(revision Revision) error {
+			mux.Lock()
+			defer mux.Unlock()
+			titles = append(titles, revision.Page.Title)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ReadStreams() returned error %v", err)
+		}
+
+		sort.Strings(titles)
+		want := []string{"Alpha", "Beta", "Delta", "Epsilon", "Wikipedia:About: Colons"}
+		if !reflect.DeepEqual(titles, want) {
+			t.Errorf("ReadStreams() with %d workers read %v, want %v", workers, titles, want)
+		}
+
+		progress := meter.Progress()
+		if progress.Bytes != size || progress.Pages != 5 || progress.Revisions != 5 || progress.Fraction() != 1 {
+			t.Errorf("Progress() = %+v", progress)
+		}
+	}
+}
+
+func TestReadStreamsError(t *testing.T) {
+	f, size := openMultistream(t)
+
+	stop := errors.New("stop")
+	err := ReadStreams(f, size, indexOffsets(t), StreamOptions{Workers: 2}, func(revision Revision) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("ReadStreams() returned error %v, want %v", err, stop)
+	}
+
+	// Offsets which are not the start of a stream
+	err = ReadStreams(f, size, []int64{300}, StreamOptions{}, func(Revision) error { return nil })
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Offset != 300 {
+		t.Errorf("ReadStreams() returned error %v, want *StreamError at 300", err)
+	}
+}
@@ -0,0 +1,40 @@
+package wiki
+
+import (
+	"time"
+)
+
+// RateLimiter spaces requests to the API at least an interval apart, however
+// many goroutines and fetchers share it. A nil RateLimiter doesn't limit.
+type RateLimiter struct {
+	ticker *time.Ticker
+}
+
+// NewRateLimiter creates a RateLimiter allowing one request per interval, or
+// nil if interval is zero
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		ticker: time.NewTicker(interval),
+	}
+}
+
+// RateInterval returns the interval between requests made at most rate times
+// a second, or zero for no limit
+func RateInterval(rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Wait waits for the next free slot
+func (r *RateLimiter) Wait() {
+	if r == nil {
+		return
+	}
+	<-r.ticker.C
+}
@@ -1,13 +1,14 @@
 package irc
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
 	"github.com/sirupsen/logrus"
@@ -18,11 +19,24 @@ import (
 type RecentChange struct {
 	Channel    string
 	Page       string
-	Flags      string
-	URL        string
+	Flags      string // Edit flags: N (new), M (minor), B (bot) and ! (unpatrolled)
+	URL        string // Empty for log events
 	User       string
-	Changesize string
+	Changesize string // e.g. "(+12)". Empty for log events
 	Comment    string
+
+	Unpatrolled bool // Whether the "!" flag is set
+
+	LogType   string // e.g. "delete" for Special:Log/delete. Empty unless a log event
+	LogAction string // e.g. "restore". Empty unless a log event
+}
+
+// HostWiki names a wiki after the first label of its host, as in "en" for
+// en.wikipedia.org
+func HostWiki(host string) string {
+	// Wikidata is served from www.wikidata.org
+	parts := strings.Split(strings.TrimPrefix(host, "www."), ".")
+	return parts[0]
 }
 
 func (rc *RecentChange) Normalize() (recentchanges.NormalizedRecentChange, error) {
@@ -47,8 +61,23 @@ func (rc *RecentChange) Normalize() (recentchanges.NormalizedRecentChange, error
 		old = -1
 	}
 
-	parts := strings.Split(parsedURL.Hostname(), ".")
-	wiki := parts[0]
+	// New pages link to their only revision as "oldid"
+	if new == -1 && strings.Contains(rc.Flags, "N") {
+		new, old = old, -1
+	}
+
+	// Log events have no URL, so fall back to the "#en.wikipedia" channel
+	host := parsedURL.Hostname()
+	if host == "" {
+		host = strings.TrimPrefix(rc.Channel, "#")
+	}
+	wiki := HostWiki(host)
+
+	// The change size is formatted as "(+12)", "(-3)" or "(0)"
+	changesize, err := strconv.Atoi(strings.Trim(rc.Changesize, "()"))
+	if err != nil {
+		changesize = 0
+	}
 
 	bot := strings.Contains(rc.Flags, "B")
 	minor := strings.Contains(rc.Flags, "M")
@@ -62,6 +91,10 @@ func (rc *RecentChange) Normalize() (recentchanges.NormalizedRecentChange, error
 		rcType = "edit"
 	}
 
+	if rc.LogType != "" {
+		rcType = "log"
+	}
+
 	return recentchanges.NormalizedRecentChange{
 		ID:      id,
 		Type:    rcType,
@@ -75,7 +108,8 @@ func (rc *RecentChange) Normalize() (recentchanges.NormalizedRecentChange, error
 			New: new,
 			Old: old,
 		},
-		Source: recentchanges.SourceIRC,
+		Changesize: changesize,
+		Source:     recentchanges.SourceIRC,
 	}, nil
 }
 
@@ -84,7 +118,7 @@ type Handler func(rc RecentChange, err error)
 
 // Listener listens to recent changes
 type Listener interface {
-	Listen(lo recentchanges.ListenOptions, handler Handler)
+	Listen(lo recentchanges.ListenOptions, handler Handler) error
 }
 
 type ircListener struct {
@@ -98,32 +132,158 @@ type Options struct {
 	Pass string
 	User string
 	Name string
+
+	// Addr is the address to connect to. DefaultAddr is used when empty.
+	Addr string
+
+	// TLS connects to Addr using TLS when set
+	TLS *tls.Config
+
+	// SASLUser and SASLPass authenticate using SASL PLAIN when SASLUser is set
+	SASLUser string
+	SASLPass string
+
+	// MaxChannels is the maximum number of channels joined on a single
+	// connection. Channels are spread over as many connections as needed.
+	// Zero joins every channel on one connection.
+	MaxChannels int
+
+	// ReconnectDelay is how long to wait before reconnecting a closed
+	// connection. Each failed attempt in a row waits twice as long, up to
+	// MaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	// MaxAttempts is how many connection attempts in a row may fail before
+	// a connection gives up. Zero reconnects forever.
+	MaxAttempts int
+
+	// Raw, when set, is called with every line received from a channel, as
+	// it was received, before it is parsed
+	Raw func(line string)
 }
 
 // DefaultAddr is the default address to connect to via TCP
 const DefaultAddr = "irc.wikimedia.org:6667"
 
-var stripper = regexp.MustCompile(`\x1f|\x02|\x12|\x0f|\x16|\x03(?:\d{1,2}(?:,\d{1,2})?)?`)
-var parser = regexp.MustCompile(`PRIVMSG (?P<channel>#[A-Za-z.]+) :\[\[(?P<page>.+)\]\] (?P<flags>.+)? (?P<url>https:\/\/[^ ]+) \* (?P<user>.+) \* (?P<changesize>\(.+\)) ?(?P<comment>.+)?`)
+// DefaultReconnectDelay and DefaultMaxReconnectDelay are used when the
+// options leave them unset
+const (
+	DefaultReconnectDelay    = time.Second
+	DefaultMaxReconnectDelay = time.Minute
+)
 
 // NewListener creates a new IRC Listener
 func NewListener(o Options, logger *logrus.Logger) Listener {
+	if o.Addr == "" {
+		o.Addr = DefaultAddr
+	}
+	if o.ReconnectDelay <= 0 {
+		o.ReconnectDelay = DefaultReconnectDelay
+	}
+	if o.MaxReconnectDelay <= 0 {
+		o.MaxReconnectDelay = DefaultMaxReconnectDelay
+	}
+	if o.MaxReconnectDelay < o.ReconnectDelay {
+		o.MaxReconnectDelay = o.ReconnectDelay
+	}
+
 	return &ircListener{
 		options: o,
 		logger:  logger,
 	}
 }
 
-func (l *ircListener) Listen(lo recentchanges.ListenOptions, handler Handler) {
+// Listen joins the channels of the given wikis, spreading them across
+// connections according to Options.MaxChannels. Each connection reconnects
+// on its own when it closes. Listen returns once every connection has given
+// up, with the first error.
+func (l *ircListener) Listen(lo recentchanges.ListenOptions, handler Handler) error {
+	channels := make([]string, 0, len(lo.Wikis))
+	for _, wiki := range lo.Wikis {
+		channels = append(channels, fmt.Sprintf("#%s.wikipedia", wiki))
+	}
+
+	shards := shardChannels(channels, l.options.MaxChannels)
+	errs := make(chan error, len(shards))
+	for i, shard := range shards {
+		go func(i int, shard []string) {
+			err := l.keepListening(lo, shard, handler)
+			l.logger.WithError(err).WithFields(logrus.Fields{
+				"connection": i,
+				"channels":   shard,
+			}).Error("Gave up on connection")
+			errs <- err
+		}(i, shard)
+	}
+
+	var first error
+	for range shards {
+		err := <-errs
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// keepListening listens to channels on one connection, reconnecting with
+// backoff whenever it closes, until MaxAttempts attempts in a row fail or
+// authentication fails
+func (l *ircListener) keepListening(lo recentchanges.ListenOptions, channels []string, handler Handler) error {
+	delay := l.options.ReconnectDelay
+	failures := 0
+	for {
+		registered, err := l.listenShard(lo, channels, handler)
+		if err == nil {
+			err = errors.New("Connection closed")
+		}
+		if errors.Is(err, ErrSASLFailed) {
+			return err
+		}
+
+		// A connection which registered is healthy, however it ended
+		if registered {
+			failures = 0
+			delay = l.options.ReconnectDelay
+		} else {
+			failures++
+		}
+		if l.options.MaxAttempts > 0 && failures >= l.options.MaxAttempts {
+			return fmt.Errorf("Could not connect after %d attempts: %s", failures, err)
+		}
+
+		l.logger.WithError(err).WithFields(logrus.Fields{
+			"channels": channels,
+			"delay":    delay.String(),
+		}).Warn("Connection closed, reconnecting")
+		time.Sleep(delay)
+
+		if !registered {
+			delay *= 2
+			if delay > l.options.MaxReconnectDelay {
+				delay = l.options.MaxReconnectDelay
+			}
+		}
+	}
+}
+
+// listenShard listens to channels on one connection until it closes,
+// reporting whether the server welcomed it
+func (l *ircListener) listenShard(lo recentchanges.ListenOptions, channels []string, handler Handler) (bool, error) {
 	l.logger.WithFields(logrus.Fields{
-		"url": DefaultAddr,
+		"url":      l.options.Addr,
+		"tls":      l.options.TLS != nil,
+		"channels": channels,
 	}).Info("Listening")
-	conn, err := net.Dial("tcp", DefaultAddr)
+
+	conn, err := l.dial()
 	if err != nil {
-		log.Fatalln(err)
+		return false, err
 	}
+	defer conn.Close()
 
-	listenerHandler := newListenerHandler(l, lo, handler)
+	listenerHandler := newListenerHandler(l, lo, channels, conn, handler)
 
 	config := irc.ClientConfig{
 		Nick:    l.options.Nick,
@@ -135,77 +295,110 @@ func (l *ircListener) Listen(lo recentchanges.ListenOptions, handler Handler) {
 
 	// Create the client
 	client := irc.NewClient(conn, config)
+	if l.options.SASLUser != "" {
+		// Registration is held until CAP END, which is sent once SASL completes
+		client.Write("CAP REQ :sasl")
+	}
+
 	err = client.Run()
-	if err != nil {
-		log.Fatalln(err)
+	if listenerHandler.err != nil {
+		return listenerHandler.registered, listenerHandler.err
+	}
+	return listenerHandler.registered, err
+}
+
+func (l *ircListener) dial() (net.Conn, error) {
+	if l.options.TLS != nil {
+		return tls.Dial("tcp", l.options.Addr, l.options.TLS)
 	}
+	return net.Dial("tcp", l.options.Addr)
+}
+
+// shardChannels splits channels into groups of at most max channels
+func shardChannels(channels []string, max int) [][]string {
+	if max <= 0 || len(channels) <= max {
+		return [][]string{channels}
+	}
+
+	shards := [][]string{}
+	for len(channels) > max {
+		shards = append(shards, channels[:max])
+		channels = channels[max:]
+	}
+	return append(shards, channels)
 }
 
 type listenHandler struct {
 	lo       recentchanges.ListenOptions
+	channels []string
+	conn     net.Conn
 	handler  Handler
 	listener *ircListener
+	err      error
+
+	// registered is set once the server welcomes the connection
+	registered bool
 }
 
-func newListenerHandler(listener *ircListener, lo recentchanges.ListenOptions, handler Handler) irc.Handler {
+func newListenerHandler(listener *ircListener, lo recentchanges.ListenOptions, channels []string, conn net.Conn, handler Handler) *listenHandler {
 	return &listenHandler{
 		lo:       lo,
+		channels: channels,
+		conn:     conn,
 		handler:  handler,
 		listener: listener,
 	}
 }
 
+// abort closes the connection, causing the client to return err from Run
+func (l *listenHandler) abort(err error) {
+	l.err = err
+	l.conn.Close()
+}
+
 func (l *listenHandler) Handle(c *irc.Client, m *irc.Message) {
+	if l.handleSASL(c, m) {
+		return
+	}
+
 	// 001 is a welcome event, so we join channels there
 	if m.Command == "001" {
-		for _, wiki := range l.lo.Wikis {
-			l.listener.logger.WithFields(logrus.Fields{
-				"channels": l.lo.Wikis,
-			}).Info("Joining channels")
-			command := fmt.Sprintf("JOIN #%s.wikipedia", wiki)
-			c.Write(command)
+		l.registered = true
+		l.listener.logger.WithFields(logrus.Fields{
+			"channels": l.channels,
+		}).Info("Joining channels")
+		for _, channel := range l.channels {
+			c.Write("JOIN " + channel)
 		}
 		return
 	}
 
-	full := m.String()
-	message := string(stripper.ReplaceAll([]byte(full), []byte{}))
-
 	l.listener.logger.WithFields(logrus.Fields{
 		"command": m.Command,
-		"data":    message,
+		"data":    m.String(),
 	}).Debug("Received data")
 
 	if !c.FromChannel(m) {
 		return
 	}
 
-	matches := findNamedMatches(parser, message)
-	rc := RecentChange{
-		Channel:    matches["channel"],
-		Page:       matches["page"],
-		Flags:      matches["flags"],
-		URL:        matches["url"],
-		User:       matches["user"],
-		Changesize: matches["changesize"],
-		Comment:    matches["comment"],
+	if l.listener.options.Raw != nil {
+		l.listener.options.Raw(m.String())
 	}
 
-	if rc.Page != "" {
-		if l.lo.Hidebots && strings.Contains(rc.Flags, "B") {
-			return
-		}
-
-		l.handler(rc, nil)
+	rc, err := ParseMessage(m.Params[0], m.Trailing())
+	if err == ErrNotRecentChange {
+		return
 	}
-}
 
-func findNamedMatches(regex *regexp.Regexp, str string) map[string]string {
-	match := regex.FindStringSubmatch(str)
+	if err != nil {
+		l.handler(rc, err)
+		return
+	}
 
-	results := map[string]string{}
-	for i, name := range match {
-		results[regex.SubexpNames()[i]] = name
+	if l.lo.Hidebots && strings.Contains(rc.Flags, "B") {
+		return
 	}
-	return results
+
+	l.handler(rc, nil)
 }
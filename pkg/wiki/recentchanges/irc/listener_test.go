@@ -0,0 +1,262 @@
+package irc_test
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// listen starts a listener connected to the server, returning the changes it
+// receives, and a channel receiving the error it stops listening with. It
+// reconnects quickly, and gives up once the server is closed.
+func listen(t *testing.T, s *wikitest.IRCServer, o irc.Options, lo recentchanges.ListenOptions) (chan irc.RecentChange, chan error) {
+	logger, _ := test.NewNullLogger()
+
+	o.Nick = "tester"
+	o.User = "tester"
+	o.Addr = s.Addr()
+	o.ReconnectDelay = 10 * time.Millisecond
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 1
+	}
+	listener := irc.NewListener(o, logger)
+
+	changes := make(chan irc.RecentChange, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Listen(lo, func(rc irc.RecentChange, err error) {
+			if err != nil {
+				t.Errorf("got error %v", err)
+				return
+			}
+			changes <- rc
+		})
+	}()
+	return changes, done
+}
+
+// receive receives n changes, returning their pages
+func receive(t *testing.T, changes chan irc.RecentChange, n int) []string {
+	t.Helper()
+	pages := []string{}
+	for len(pages) < n {
+		select {
+		case rc := <-changes:
+			pages = append(pages, rc.Page)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after receiving %q", pages)
+		}
+	}
+
+	select {
+	case rc := <-changes:
+		t.Errorf("got unexpected change %q", rc.Page)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return pages
+}
+
+func newIRCServer(t *testing.T) *wikitest.IRCServer {
+	s, err := wikitest.NewIRCServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestListenerRecording(t *testing.T) {
+	records, err := wikitest.ReadRecording("testdata/recording.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newIRCServer(t)
+	changes, done := listen(t, s, irc.Options{}, recentchanges.ListenOptions{
+		Hidebots: true,
+		Wikis:    []string{"en", "de"},
+	})
+	defer func() {
+		s.Close()
+		<-done
+	}()
+
+	for _, channel := range []string{"#en.wikipedia", "#de.wikipedia"} {
+		if !s.WaitForJoin(channel, 1, 5*time.Second) {
+			t.Fatalf("listener did not join %s", channel)
+		}
+	}
+
+	err = s.SendRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"Pakistan",
+		"Draft:Kettle Point (band)",
+		"List of [[unusual]] articles",
+		"Main Page",
+		"Special:Log/delete",
+		"Spezial:Log/block",
+	}
+	got := receive(t, changes, len(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestListenerSASL(t *testing.T) {
+	tests := []struct {
+		name string
+		pass string
+		err  string
+	}{
+		{name: "success", pass: "secret"},
+		{name: "failure", pass: "wrong", err: "Sasl authentication failed: ERR_SASLFAIL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newIRCServer(t)
+			s.AddAccount("tester", "secret")
+			changes, done := listen(t, s, irc.Options{
+				SASLUser: "tester",
+				SASLPass: tt.pass,
+			}, recentchanges.ListenOptions{
+				Wikis: []string{"en"},
+			})
+			defer s.Close()
+
+			if tt.err != "" {
+				select {
+				case err := <-done:
+					if !errors.Is(err, irc.ErrSASLFailed) || !strings.HasPrefix(err.Error(), tt.err) {
+						t.Errorf("got error %v, want %q", err, tt.err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("listener did not stop")
+				}
+				return
+			}
+			defer func() {
+				s.Close()
+				<-done
+			}()
+
+			if !s.WaitForJoin("#en.wikipedia", 1, 5*time.Second) {
+				t.Fatal("listener did not join")
+			}
+			if got := s.LoggedIn(); got != 1 {
+				t.Errorf("got %d clients logged in, want 1", got)
+			}
+
+			s.Send(":rc-pmtpa!~rc-pmtpa@special.user PRIVMSG #en.wikipedia :\x0314[[\x0307Pakistan\x0314]]\x034 \x0310 \x0302https://en.wikipedia.org/w/index.php?diff=903668401&oldid=903668090\x03 \x035*\x03 \x030339.57.192.10\x03 \x035*\x03 (-12) \x0310/* History */\x03")
+			got := receive(t, changes, 1)
+			if got[0] != "Pakistan" {
+				t.Errorf("got %q, want %q", got[0], "Pakistan")
+			}
+		})
+	}
+}
+
+func TestListenerShards(t *testing.T) {
+	records, err := wikitest.ReadRecording("testdata/recording.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newIRCServer(t)
+	changes, done := listen(t, s, irc.Options{
+		MaxChannels: 2,
+	}, recentchanges.ListenOptions{
+		Wikis: []string{"en", "de", "zh-min-nan"},
+	})
+	defer func() {
+		s.Close()
+		<-done
+	}()
+
+	for _, channel := range []string{"#en.wikipedia", "#de.wikipedia", "#zh-min-nan.wikipedia"} {
+		if !s.WaitForJoin(channel, 1, 5*time.Second) {
+			t.Fatalf("listener did not join %s", channel)
+		}
+		if joined := s.Joined(channel); joined != 1 {
+			t.Errorf("got %s joined by %d connections, want 1", channel, joined)
+		}
+	}
+	if clients := s.Clients(); clients != 2 {
+		t.Errorf("got %d connections, want 2", clients)
+	}
+
+	err = s.SendRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every change is received once, though connections race each other
+	want := []string{
+		"Draft:Kettle Point (band)",
+		"List of [[unusual]] articles",
+		"Main Page",
+		"Pakistan",
+		"Special:Log/delete",
+		"Spezial:Log/block",
+		"Tâi-oân",
+		"User:DeltaQuad/UAA/Time",
+	}
+	got := receive(t, changes, len(want))
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestListenerReconnect(t *testing.T) {
+	s := newIRCServer(t)
+	changes, done := listen(t, s, irc.Options{
+		MaxChannels: 1,
+		MaxAttempts: 3,
+	}, recentchanges.ListenOptions{
+		Wikis: []string{"en", "de"},
+	})
+
+	for _, channel := range []string{"#en.wikipedia", "#de.wikipedia"} {
+		if !s.WaitForJoin(channel, 1, 5*time.Second) {
+			t.Fatalf("listener did not join %s", channel)
+		}
+	}
+
+	// Only the connection which dropped reconnects
+	s.Disconnect("#en.wikipedia")
+	s.Send(":rc-pmtpa!~rc-pmtpa@special.user PRIVMSG #de.wikipedia :\x0314[[\x0307Berlin\x0314]]\x034 \x0310 \x0302https://de.wikipedia.org/w/index.php?diff=501&oldid=500\x03 \x035*\x03 \x0303Itti\x03 \x035*\x03 (+12) \x0310\x03")
+	if got := receive(t, changes, 1); got[0] != "Berlin" {
+		t.Errorf("got %q, want %q", got[0], "Berlin")
+	}
+
+	if !s.WaitForJoin("#en.wikipedia", 1, 5*time.Second) {
+		t.Fatal("listener did not rejoin #en.wikipedia")
+	}
+	s.Send(":rc-pmtpa!~rc-pmtpa@special.user PRIVMSG #en.wikipedia :\x0314[[\x0307Pakistan\x0314]]\x034 \x0310 \x0302https://en.wikipedia.org/w/index.php?diff=201&oldid=200\x03 \x035*\x03 \x0303Carol\x03 \x035*\x03 (+4) \x0310\x03")
+	if got := receive(t, changes, 1); got[0] != "Pakistan" {
+		t.Errorf("got %q, want %q", got[0], "Pakistan")
+	}
+
+	// Once the server is gone, every connection gives up
+	s.Close()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+			t.Errorf("got error %v, want giving up after 3 attempts", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not give up")
+	}
+}
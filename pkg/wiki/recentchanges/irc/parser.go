@@ -0,0 +1,261 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// mIRC colours used by MediaWiki's IRCColourfulRCFeedFormatter to delimit the
+// fields of a recent change message
+const (
+	colorNone      = -1
+	colorURL       = 2
+	colorUser      = 3
+	colorFlags     = 4
+	colorSeparator = 5
+	colorPage      = 7
+	colorComment   = 10
+	colorBrackets  = 14
+)
+
+const (
+	codeBold      = '\x02'
+	codeColor     = '\x03'
+	codeReset     = '\x0f'
+	codeReverse   = '\x16'
+	codeItalic    = '\x1d'
+	codeUnderline = '\x1f'
+	codeReverse2  = '\x12'
+)
+
+// ErrNotRecentChange is returned when a message is not formatted as a recent change
+var ErrNotRecentChange = errors.New("Message is not a recent change")
+
+// ParseError describes a recent change message which could not be parsed
+type ParseError struct {
+	Field   string // The field being parsed when the error occurred
+	Reason  string
+	Message string // The raw message
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Could not parse %s (%s) in irc message %q", e.Field, e.Reason, e.Message)
+}
+
+// token is a run of text sharing the same foreground colour
+type token struct {
+	color int
+	text  string
+}
+
+// tokenize splits text at every mIRC colour code. Other formatting codes are
+// discarded, and a colour code without digits (or a reset) starts a token with
+// colorNone.
+func tokenize(text string) []token {
+	tokens := []token{}
+	current := token{color: colorNone}
+	var b strings.Builder
+
+	flush := func(color int) {
+		current.text = b.String()
+		tokens = append(tokens, current)
+		b.Reset()
+		current = token{color: color}
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case codeColor:
+			color, n := readColor(text[i+1:])
+			i += n
+			flush(color)
+		case codeReset:
+			flush(colorNone)
+		case codeBold, codeReverse, codeReverse2, codeItalic, codeUnderline:
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	flush(colorNone)
+
+	return tokens
+}
+
+// readColor reads the "fg[,bg]" digits following a colour code, returning the
+// foreground colour and the number of bytes consumed
+func readColor(s string) (int, int) {
+	fg, n := readDigits(s)
+	if n == 0 {
+		return colorNone, 0
+	}
+
+	if n < len(s) && s[n] == ',' {
+		if _, m := readDigits(s[n+1:]); m > 0 {
+			n += m + 1
+		}
+	}
+	return fg, n
+}
+
+// readDigits reads up to two decimal digits
+func readDigits(s string) (int, int) {
+	value, n := 0, 0
+	for n < 2 && n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		value = value*10 + int(s[n]-'0')
+		n++
+	}
+	return value, n
+}
+
+type messageParser struct {
+	tokens  []token
+	pos     int
+	message string
+}
+
+func (p *messageParser) fail(field string, reason string) error {
+	return &ParseError{
+		Field:   field,
+		Reason:  reason,
+		Message: p.message,
+	}
+}
+
+// expect skips uncoloured whitespace and returns the next token, which must
+// have the given colour
+func (p *messageParser) expect(color int, field string) (token, error) {
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		p.pos++
+		if t.color == colorNone && strings.TrimSpace(t.text) == "" {
+			continue
+		}
+
+		if t.color != color {
+			return t, p.fail(field, fmt.Sprintf("expected colour %d, got %d", color, t.color))
+		}
+		return t, nil
+	}
+	return token{}, p.fail(field, "unexpected end of message")
+}
+
+// ParseMessage parses the text of a recent change message sent to the given
+// channel, using the mIRC colours MediaWiki assigns to each field. It returns
+// ErrNotRecentChange for messages which are not recent changes at all, and a
+// *ParseError for recent changes that are malformed.
+func ParseMessage(channel string, text string) (RecentChange, error) {
+	p := &messageParser{
+		tokens:  tokenize(text),
+		message: text,
+	}
+
+	open, err := p.expect(colorBrackets, "page")
+	if err != nil || open.text != "[[" {
+		return RecentChange{}, ErrNotRecentChange
+	}
+
+	var page strings.Builder
+	for {
+		if p.pos >= len(p.tokens) {
+			return RecentChange{}, p.fail("page", "missing closing brackets")
+		}
+
+		t := p.tokens[p.pos]
+		p.pos++
+		if t.color == colorBrackets && t.text == "]]" {
+			break
+		}
+		if t.color != colorPage {
+			return RecentChange{}, p.fail("page", fmt.Sprintf("unexpected colour %d", t.color))
+		}
+		page.WriteString(t.text)
+	}
+
+	if page.Len() == 0 {
+		return RecentChange{}, p.fail("page", "empty title")
+	}
+
+	flags, err := p.expect(colorFlags, "flags")
+	if err != nil {
+		return RecentChange{}, err
+	}
+
+	// The URL is preceded by a single separating space coloured as a comment
+	if _, err := p.expect(colorComment, "url"); err != nil {
+		return RecentChange{}, err
+	}
+
+	url, err := p.expect(colorURL, "url")
+	if err != nil {
+		return RecentChange{}, err
+	}
+
+	if _, err := p.expect(colorSeparator, "user"); err != nil {
+		return RecentChange{}, err
+	}
+
+	user, err := p.expect(colorUser, "user")
+	if err != nil {
+		return RecentChange{}, err
+	}
+
+	if _, err := p.expect(colorSeparator, "changesize"); err != nil {
+		return RecentChange{}, err
+	}
+
+	// The change size is uncoloured, and empty for log events
+	var changesize strings.Builder
+	for p.pos < len(p.tokens) && p.tokens[p.pos].color == colorNone {
+		changesize.WriteString(p.tokens[p.pos].text)
+		p.pos++
+	}
+
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].color != colorComment {
+		return RecentChange{}, p.fail("comment", "missing comment")
+	}
+
+	var comment strings.Builder
+	for _, t := range p.tokens[p.pos:] {
+		comment.WriteString(t.text)
+	}
+
+	rc := RecentChange{
+		Channel:    channel,
+		Page:       page.String(),
+		URL:        url.text,
+		User:       user.text,
+		Changesize: strings.TrimSpace(changesize.String()),
+		Comment:    comment.String(),
+	}
+
+	flagText := strings.TrimSpace(flags.text)
+	if rc.URL == "" {
+		// Log events have no URL, the flags are the log action and the page is
+		// Special:Log/<type>
+		rc.LogAction = flagText
+		if i := strings.LastIndex(rc.Page, "/"); i != -1 {
+			rc.LogType = rc.Page[i+1:]
+		}
+		if rc.LogType == "" {
+			return RecentChange{}, p.fail("page", "log event without a log type")
+		}
+		return rc, nil
+	}
+
+	rc.Flags = flagText
+	rc.Unpatrolled = strings.Contains(flagText, "!")
+	return rc, nil
+}
+
+// FormatMessage formats a recent change as MediaWiki's
+// IRCColourfulRCFeedFormatter would
+func FormatMessage(rc RecentChange) string {
+	flags := rc.Flags
+	if rc.LogType != "" {
+		flags = rc.LogAction
+	}
+
+	return fmt.Sprintf("\x0314[[\x0307%s\x0314]]\x034 %s\x0310 \x0302%s\x03 \x035*\x03 \x0303%s\x03 \x035*\x03 %s \x0310%s\x03",
+		rc.Page, flags, rc.URL, rc.User, rc.Changesize, rc.Comment)
+}
@@ -0,0 +1,322 @@
+package irc_test
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
+)
+
+type inParser struct {
+	channel string
+	message string
+}
+
+type wantParser struct {
+	rc  irc.RecentChange
+	err bool
+}
+
+var parserTests = []struct {
+	name string
+	in   inParser
+	want wantParser
+}{
+	{
+		name: "edit",
+		in: inParser{
+			channel: "#en.wikipedia",
+			message: "\x0314[[\x0307Pakistan\x0314]]\x034 M\x0310 \x0302https://en.wikipedia.org/w/index.php?diff=903668401&oldid=903668090\x03 \x035*\x03 \x030339.57.192.10\x03 \x035*\x03 (-12) \x0310/* History */\x03",
+		},
+		want: wantParser{
+			rc: irc.RecentChange{
+				Channel:    "#en.wikipedia",
+				Page:       "Pakistan",
+				Flags:      "M",
+				URL:        "https://en.wikipedia.org/w/index.php?diff=903668401&oldid=903668090",
+				User:       "39.57.192.10",
+				Changesize: "(-12)",
+				Comment:    "/* History */",
+			},
+		},
+	},
+	{
+		name: "title and comment containing delimiters",
+		in: inParser{
+			channel: "#zh-min-nan.wikipedia",
+			message: "\x0314[[\x0307A]] * B\x0314]]\x034 !N\x0310 \x0302https://zh-min-nan.wikipedia.org/w/index.php?oldid=5&rcid=6\x03 \x035*\x03 \x0303Some * One\x03 \x035*\x03 (\x02+1500\x02) \x0310rv * see [[talk]]\x03",
+		},
+		want: wantParser{
+			rc: irc.RecentChange{
+				Channel:     "#zh-min-nan.wikipedia",
+				Page:        "A]] * B",
+				Flags:       "!N",
+				URL:         "https://zh-min-nan.wikipedia.org/w/index.php?oldid=5&rcid=6",
+				User:        "Some * One",
+				Changesize:  "(+1500)",
+				Comment:     "rv * see [[talk]]",
+				Unpatrolled: true,
+			},
+		},
+	},
+	{
+		name: "empty flags and comment",
+		in: inParser{
+			channel: "#en.wikipedia",
+			message: "\x0314[[\x0307Main Page\x0314]]\x034 \x0310 \x0302https://en.wikipedia.org/w/index.php?diff=2&oldid=1\x03 \x035*\x03 \x0303Example\x03 \x035*\x03 (0) \x0310\x03",
+		},
+		want: wantParser{
+			rc: irc.RecentChange{
+				Channel:    "#en.wikipedia",
+				Page:       "Main Page",
+				URL:        "https://en.wikipedia.org/w/index.php?diff=2&oldid=1",
+				User:       "Example",
+				Changesize: "(0)",
+			},
+		},
+	},
+	{
+		name: "log",
+		in: inParser{
+			channel: "#en.wikipedia",
+			message: "\x0314[[\x0307Special:Log/delete\x0314]]\x034 delete\x0310 \x0302\x03 \x035*\x03 \x0303Fastily\x03 \x035*\x03  \x0310deleted \"[[Foo]]\": G3\x03",
+		},
+		want: wantParser{
+			rc: irc.RecentChange{
+				Channel:   "#en.wikipedia",
+				Page:      "Special:Log/delete",
+				User:      "Fastily",
+				Comment:   "deleted \"[[Foo]]\": G3",
+				LogType:   "delete",
+				LogAction: "delete",
+			},
+		},
+	},
+	{
+		name: "not a recent change",
+		in: inParser{
+			channel: "#en.wikipedia",
+			message: "Welcome to the channel",
+		},
+		want: wantParser{
+			err: true,
+		},
+	},
+	{
+		name: "truncated",
+		in: inParser{
+			channel: "#en.wikipedia",
+			message: "\x0314[[\x0307Main Page\x0314]]\x034 M\x0310 \x0302https://en.wikipedia.org/w/index.php?diff=2&oldid=1\x03 \x035*\x03",
+		},
+		want: wantParser{
+			err: true,
+		},
+	},
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, tt := range parserTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := irc.ParseMessage(tt.in.channel, tt.in.message)
+			if (err != nil) != tt.want.err {
+				t.Fatalf("got error %v, want error %v", err, tt.want.err)
+			}
+
+			if rc != tt.want.rc {
+				t.Errorf("got %+v, want %+v", rc, tt.want.rc)
+			}
+		})
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	_, err := irc.ParseMessage("#en.wikipedia", "Welcome to the channel")
+	if err != irc.ErrNotRecentChange {
+		t.Errorf("got %v, want %v", err, irc.ErrNotRecentChange)
+	}
+
+	_, err = irc.ParseMessage("#en.wikipedia", "\x0314[[\x0307Main Page\x0314]]\x034 M")
+	if _, ok := err.(*irc.ParseError); !ok {
+		t.Errorf("got %T, want *irc.ParseError", err)
+	}
+}
+
+type fixture struct {
+	channel string
+	message string
+}
+
+func readFixtures(t testing.TB) []fixture {
+	file, err := os.Open("testdata/messages.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	fixtures := []fixture{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		fixtures = append(fixtures, fixture{
+			channel: parts[0],
+			message: parts[1],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return fixtures
+}
+
+func TestFixtures(t *testing.T) {
+	for _, f := range readFixtures(t) {
+		rc, err := irc.ParseMessage(f.channel, f.message)
+		if err != nil {
+			t.Errorf("got error %v for %q", err, f.message)
+			continue
+		}
+
+		normalized, err := rc.Normalize()
+		if err != nil {
+			t.Errorf("got error %v normalizing %+v", err, rc)
+			continue
+		}
+
+		if normalized.Wiki == "" || normalized.Type == "" {
+			t.Errorf("got incomplete normalization %+v for %+v", normalized, rc)
+		}
+	}
+}
+
+func TestNormalizeWiki(t *testing.T) {
+	tests := map[string]irc.RecentChange{
+		"en":        {Channel: "#en.wikipedia", URL: "https://en.wikipedia.org/w/index.php?diff=2&oldid=1"},
+		"wikidata":  {Channel: "#wikidata.wikipedia", URL: "https://www.wikidata.org/w/index.php?diff=2&oldid=1"},
+		"commons":   {Channel: "#commons.wikimedia", URL: "https://commons.wikimedia.org/w/index.php?diff=2&oldid=1"},
+		"wikimania": {Channel: "#wikimania.wikimedia", URL: "https://wikimania.wikimedia.org/w/index.php?diff=2&oldid=1"},
+		"de":        {Channel: "#de.wikipedia", Page: "Spezial:Log/block", LogType: "block"},
+	}
+
+	for want, rc := range tests {
+		normalized, err := rc.Normalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if normalized.Wiki != want {
+			t.Errorf("got %q, want %q for %s%s", normalized.Wiki, want, rc.Channel, rc.URL)
+		}
+	}
+}
+
+func TestNormalizeNewPage(t *testing.T) {
+	rc := irc.RecentChange{
+		Channel: "#en.wikipedia",
+		Flags:   "!N",
+		URL:     "https://en.wikipedia.org/w/index.php?oldid=903668412&rcid=1165581904",
+	}
+
+	normalized, err := rc.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Matches the SSE stream, so the deduplicator sees one change
+	want := recentchanges.Revision{New: 903668412, Old: -1}
+	if normalized.Type != "new" || normalized.ID != 1165581904 || normalized.Revision != want {
+		t.Errorf("got %+v, want a new page with revision %+v", normalized, want)
+	}
+}
+
+// roundTrips reports whether a parsed field can be formatted unambiguously. A
+// leading ",<digit>" would be read as a background colour.
+func roundTrips(rc irc.RecentChange) bool {
+	for _, field := range []string{rc.Page, rc.URL, rc.User, rc.Comment} {
+		if strings.HasPrefix(field, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, fixture := range readFixtures(f) {
+		f.Add(fixture.message)
+	}
+
+	f.Fuzz(func(t *testing.T, message string) {
+		rc, err := irc.ParseMessage("#en.wikipedia", message)
+		if err != nil {
+			return
+		}
+
+		if rc.Page == "" {
+			t.Fatalf("parsed %q with an empty page", message)
+		}
+
+		if !roundTrips(rc) {
+			return
+		}
+
+		formatted := irc.FormatMessage(rc)
+		reparsed, err := irc.ParseMessage("#en.wikipedia", formatted)
+		if err != nil {
+			t.Fatalf("could not reparse %q: %v", formatted, err)
+		}
+
+		if reparsed != rc {
+			t.Fatalf("got %+v, want %+v", reparsed, rc)
+		}
+	})
+}
+
+func FuzzFormatMessage(f *testing.F) {
+	f.Add("Main Page", "MB", "https://en.wikipedia.org/w/index.php?diff=2&oldid=1", "Example", "(+1)", "comment * text")
+	f.Add("Special:Log/delete", "delete", "", "Example", "", "deleted [[Foo]]")
+
+	f.Fuzz(func(t *testing.T, page string, flags string, url string, user string, changesize string, comment string) {
+		for _, field := range []string{page, flags, url, user, changesize, comment} {
+			if strings.IndexFunc(field, func(r rune) bool { return r < ' ' }) != -1 || strings.HasPrefix(field, ",") {
+				return
+			}
+		}
+
+		flags = strings.TrimSpace(flags)
+		changesize = strings.TrimSpace(changesize)
+		if page == "" || (url == "" && !strings.Contains(page, "/")) {
+			return
+		}
+
+		rc := irc.RecentChange{
+			Channel:    "#en.wikipedia",
+			Page:       page,
+			URL:        url,
+			User:       user,
+			Changesize: changesize,
+			Comment:    comment,
+		}
+		if url == "" {
+			rc.LogType = page[strings.LastIndex(page, "/")+1:]
+			rc.LogAction = flags
+			if rc.LogType == "" {
+				return
+			}
+		} else {
+			rc.Flags = flags
+			rc.Unpatrolled = strings.Contains(flags, "!")
+		}
+
+		parsed, err := irc.ParseMessage(rc.Channel, irc.FormatMessage(rc))
+		if err != nil {
+			t.Fatalf("could not parse %+v: %v", rc, err)
+		}
+
+		if parsed != rc {
+			t.Fatalf("got %+v, want %+v", parsed, rc)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package irc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/irc.v3"
+)
+
+// ErrSASLFailed is returned when SASL authentication fails. Reconnecting
+// would fail the same way, so the listener gives up.
+var ErrSASLFailed = errors.New("Sasl authentication failed")
+
+// saslFailures are the numerics sent when SASL authentication fails
+var saslFailures = map[string]string{
+	"902": "ERR_NICKLOCKED",
+	"904": "ERR_SASLFAIL",
+	"905": "ERR_SASLTOOLONG",
+	"906": "ERR_SASLABORTED",
+}
+
+// saslPlain encodes the AUTHENTICATE payload for the PLAIN mechanism
+func saslPlain(user string, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + "\x00" + user + "\x00" + pass))
+}
+
+// handleSASL performs SASL PLAIN authentication when it is configured, and
+// reports whether the message was part of the exchange
+func (l *listenHandler) handleSASL(c *irc.Client, m *irc.Message) bool {
+	options := l.listener.options
+	if options.SASLUser == "" {
+		return false
+	}
+
+	switch m.Command {
+	case "CAP":
+		if len(m.Params) < 2 {
+			return true
+		}
+
+		caps := strings.Fields(m.Trailing())
+		switch m.Params[1] {
+		case "ACK":
+			for _, cap := range caps {
+				if cap == "sasl" {
+					c.Write("AUTHENTICATE PLAIN")
+				}
+			}
+		case "NAK":
+			l.abort(fmt.Errorf("%w: server rejected the sasl capability", ErrSASLFailed))
+		}
+		return true
+	case "AUTHENTICATE":
+		if len(m.Params) > 0 && m.Params[0] == "+" {
+			c.Write("AUTHENTICATE " + saslPlain(options.SASLUser, options.SASLPass))
+		}
+		return true
+	case "900":
+		// RPL_LOGGEDIN
+		return true
+	case "903":
+		// RPL_SASLSUCCESS
+		l.listener.logger.WithField("user", options.SASLUser).Info("Authenticated with sasl")
+		c.Write("CAP END")
+		return true
+	}
+
+	if name, ok := saslFailures[m.Command]; ok {
+		l.abort(fmt.Errorf("%w: %s %s", ErrSASLFailed, name, m.Trailing()))
+		return true
+	}
+
+	return false
+}
@@ -17,6 +17,8 @@ type NormalizedRecentChange struct {
 
 	Comment string `json:"comment"` // (rc_comment)
 
+	Timestamp int `json:"timestamp"` // Unix timestamp (derived from rc_timestamp). (0 is unknown)
+
 	User string `json:"user"` // (rc_user_text)
 
 	Bot bool `json:"bot"` // (rc_bot)
@@ -29,7 +31,13 @@ type NormalizedRecentChange struct {
 	// Old and new revision IDs
 	Revision Revision `json:"revision"`
 
-	Source string // "irc" or "sse"
+	Changesize int `json:"changesize"` // (rc_new_len - rc_old_len)
+
+	Source string // "irc", "sse", "udp", "api" or "dump"
+
+	// Backfilled is set on events synthesized from the API to fill a gap in
+	// a page's revision history
+	Backfilled bool `json:"backfilled,omitempty"`
 }
 
 // Revision represents a Wikimedia revision
@@ -44,4 +52,13 @@ const (
 
 	// SourceIRC is the NormalizedRecentChange source for IRC stream
 	SourceIRC = "irc"
+
+	// SourceUDP is the NormalizedRecentChange source for MediaWiki UDP feeds
+	SourceUDP = "udp"
+
+	// SourceAPI is the NormalizedRecentChange source for events recovered from the API
+	SourceAPI = "api"
+
+	// SourceDump is the NormalizedRecentChange source for events replayed from XML dumps
+	SourceDump = "dump"
 )
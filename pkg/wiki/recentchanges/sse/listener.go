@@ -2,7 +2,9 @@ package sse
 
 import (
 	"encoding/json"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
@@ -13,6 +15,15 @@ import (
 // DefaultURL is the default URL to connect to for wikimedia SSE streams
 const DefaultURL = "https://stream.wikimedia.org/v2/stream/recentchange"
 
+// CanaryDomain is the meta.domain of canary events, which EventStreams sends
+// to check the stream is flowing. They are not real changes.
+const CanaryDomain = "canary"
+
+// SinceURL is the URL for replaying the recentchange stream from the given time
+func SinceURL(since time.Time) string {
+	return DefaultURL + "?since=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
+}
+
 // RecentChange represents a recent change on wikimedia via the SSE stream
 type RecentChange struct {
 	Meta struct {
@@ -120,22 +131,34 @@ func (rc *RecentChange) Normalize() recentchanges.NormalizedRecentChange {
 		old = *rc.Revision.Old
 	}
 
-	wiki := strings.Replace(rc.Wiki, "wiki", "", 1)
+	changesize := 0
+	if rc.Length.New != nil {
+		changesize = *rc.Length.New
+		if rc.Length.Old != nil {
+			changesize -= *rc.Length.Old
+		}
+	}
+
+	// Database names end in "wiki", which may also start them, as in
+	// "wikidatawiki"
+	wiki := strings.TrimSuffix(rc.Wiki, "wiki")
 
 	return recentchanges.NormalizedRecentChange{
-		ID:      id,
-		Type:    rc.Type,
-		Title:   rc.Title,
-		Comment: rc.Comment,
-		User:    rc.User,
-		Bot:     rc.Bot,
-		Wiki:    wiki,
-		Minor:   rc.Minor,
+		ID:        id,
+		Type:      rc.Type,
+		Title:     rc.Title,
+		Comment:   rc.Comment,
+		Timestamp: rc.Timestamp,
+		User:      rc.User,
+		Bot:       rc.Bot,
+		Wiki:      wiki,
+		Minor:     rc.Minor,
 		Revision: recentchanges.Revision{
 			New: new,
 			Old: old,
 		},
-		Source: recentchanges.SourceSSE,
+		Changesize: changesize,
+		Source:     recentchanges.SourceSSE,
 	}
 }
 
@@ -167,11 +190,20 @@ func NewListener(client wiki.SSEClient, logger *logrus.Logger) Listener {
 func (sl *sseListener) Listen(lo recentchanges.ListenOptions, handler Handler) {
 	sl.logger.WithField("url", DefaultURL).Info("Subscribing to url")
 	go sl.client.Subscribe(DefaultURL, func(event *sse.Event) {
+		// The client sends an event without data when the connection drops
+		if len(event.Data) == 0 {
+			return
+		}
+
 		rc, err := sl.handleMessage(lo.Wikis, event.Data, handler)
 		if err != nil {
 			handler(rc, err)
 		}
 
+		if rc.Meta.Domain == CanaryDomain {
+			return
+		}
+
 		if rc.Bot && lo.Hidebots {
 			return
 		}
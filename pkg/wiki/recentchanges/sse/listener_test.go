@@ -1,10 +1,13 @@
 package sse_test
 
 import (
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
 	wikisse "github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
 	"github.com/r3labs/sse"
 
 	"github.com/sirupsen/logrus/hooks/test"
@@ -100,3 +103,82 @@ func (client *FakeSSEClient) Subscribe(url string, handler func(msg *sse.Event))
 
 	return client.err
 }
+
+func TestListenerStream(t *testing.T) {
+	records, err := wikitest.ReadRecording("testdata/recentchange.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := wikitest.NewStreamServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer s.Close()
+
+	client, err := wikitest.NewSSEClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	listener := wikisse.NewListener(client, logger)
+
+	in := make(chan listenInput, 10)
+	listener.Listen(recentchanges.ListenOptions{
+		Hidebots: true,
+		Wikis:    []string{"en", "de"},
+	}, func(rc wikisse.RecentChange, err error) {
+		in <- listenInput{rc: rc, err: err}
+	})
+
+	expect := func(titles ...string) {
+		t.Helper()
+		for _, title := range titles {
+			select {
+			case received := <-in:
+				if received.err != nil {
+					t.Fatalf("got error %v, want %q", received.err, title)
+				}
+				if received.rc.Title != title {
+					t.Fatalf("got %q, want %q", received.rc.Title, title)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %q", title)
+			}
+		}
+	}
+
+	if !s.WaitForClients(1, 5*time.Second) {
+		t.Fatal("listener did not connect")
+	}
+	s.SendRecords(records[:2])
+	expect("Pakistan", "Berlin")
+
+	// Changes sent while disconnected are received on reconnecting, and bot,
+	// other wiki and canary events are dropped
+	s.Disconnect()
+	s.SendCanary("canary")
+	s.SendRecords(records[2:])
+	expect("Main Page")
+
+	ids := s.LastEventIDs()
+	if len(ids) != 2 || ids[1] != records[1].ID {
+		t.Errorf("got Last-Event-IDs %q, want resuming from %q", ids, records[1].ID)
+	}
+}
+
+func TestNormalizeWiki(t *testing.T) {
+	tests := map[string]string{
+		"enwiki":        "en",
+		"wikidatawiki":  "wikidata",
+		"commonswiki":   "commons",
+		"wikimaniawiki": "wikimania",
+	}
+
+	for dbname, want := range tests {
+		rc := wikisse.RecentChange{Wiki: dbname}
+		if got := rc.Normalize().Wiki; got != want {
+			t.Errorf("got %q, want %q for %s", got, want, dbname)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/irc"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAddr is the default address to receive MediaWiki $wgRCFeeds datagrams on
+const DefaultAddr = "127.0.0.1:9390"
+
+// maxDatagramSize is the largest datagram MediaWiki will send over UDP
+const maxDatagramSize = 65535
+
+const (
+	// FormatJSON is the format produced by MediaWiki's JSONRCFeedFormatter
+	FormatJSON = "json"
+
+	// FormatIRC is the format produced by MediaWiki's IRCColourfulRCFeedFormatter
+	FormatIRC = "irc"
+)
+
+// RecentChange represents a recent change received from a MediaWiki UDP feed.
+// Depending on Format, either JSON or IRC is set.
+type RecentChange struct {
+	Format string            `json:"format"`
+	JSON   *sse.RecentChange `json:"json,omitempty"`
+	IRC    *irc.RecentChange `json:"irc,omitempty"`
+
+	// Wiki is the name the listener was configured to give the wiki. When
+	// empty, the wiki is named after its host.
+	Wiki string `json:"wiki,omitempty"`
+}
+
+// Host returns the host of the wiki the change was made on, or "" if the
+// datagram doesn't say
+func (rc *RecentChange) Host() string {
+	switch {
+	case rc.JSON != nil:
+		if rc.JSON.ServerName != "" {
+			return rc.JSON.ServerName
+		}
+		parsedURL, err := url.Parse(rc.JSON.ServerURL)
+		if err != nil {
+			return ""
+		}
+		return parsedURL.Hostname()
+	case rc.IRC != nil:
+		parsedURL, err := url.Parse(rc.IRC.URL)
+		if err == nil && parsedURL.Hostname() != "" {
+			return parsedURL.Hostname()
+		}
+		return strings.TrimPrefix(rc.IRC.Channel, "#")
+	}
+	return ""
+}
+
+// Normalize converts the recent change into a NormalizedRecentChange. Both
+// formats name the wiki after its host, as the IRC format has no database
+// name, unless the listener gave it a name.
+func (rc *RecentChange) Normalize() (recentchanges.NormalizedRecentChange, error) {
+	var normalized recentchanges.NormalizedRecentChange
+	switch {
+	case rc.Format == FormatJSON && rc.JSON != nil:
+		normalized = rc.JSON.Normalize()
+	case rc.Format == FormatIRC && rc.IRC != nil:
+		var err error
+		normalized, err = rc.IRC.Normalize()
+		if err != nil {
+			return recentchanges.NormalizedRecentChange{}, err
+		}
+	default:
+		return recentchanges.NormalizedRecentChange{}, fmt.Errorf("Recent change has no %q payload", rc.Format)
+	}
+
+	if rc.Wiki != "" {
+		normalized.Wiki = rc.Wiki
+	} else if host := rc.Host(); host != "" {
+		normalized.Wiki = irc.HostWiki(host)
+	}
+	normalized.Source = recentchanges.SourceUDP
+	return normalized, nil
+}
+
+// Handler handles recent changes coming from a feed
+type Handler func(rc RecentChange, err error)
+
+// Listener listens to recent changes
+type Listener interface {
+	Listen(lo recentchanges.ListenOptions, handler Handler)
+}
+
+type udpListener struct {
+	conn   net.PacketConn
+	names  map[string]string
+	logger *logrus.Logger
+}
+
+// NewListener creates a new listener for datagrams arriving on conn. names
+// maps the hosts of wikis to the names to give them, such as "my" for a
+// wiki served from wiki.example.org. Other wikis are named after the first
+// label of their host.
+func NewListener(conn net.PacketConn, names map[string]string, logger *logrus.Logger) Listener {
+	return &udpListener{
+		conn:   conn,
+		names:  names,
+		logger: logger,
+	}
+}
+
+// Listen to the given wikis, with the given handler. An empty list of wikis
+// listens to every wiki sending to the connection.
+func (ul *udpListener) Listen(lo recentchanges.ListenOptions, handler Handler) {
+	ul.logger.WithField("addr", ul.conn.LocalAddr().String()).Info("Listening")
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := ul.conn.ReadFrom(buf)
+			if err != nil {
+				ul.logger.WithError(err).Error("Stopped reading datagrams")
+				return
+			}
+
+			ul.logger.WithFields(logrus.Fields{
+				"from": addr.String(),
+				"data": string(buf[:n]),
+			}).Debug("Received datagram")
+
+			rc, err := ParseDatagram(buf[:n])
+			if err == irc.ErrNotRecentChange {
+				ul.logger.Debug("Datagram is not a recent change... discarding")
+				continue
+			}
+
+			if err != nil {
+				handler(rc, err)
+				continue
+			}
+
+			if name, ok := ul.names[rc.Host()]; ok {
+				rc.Wiki = name
+			}
+
+			normalized, err := rc.Normalize()
+			if err != nil {
+				handler(rc, err)
+				continue
+			}
+
+			if normalized.Bot && lo.Hidebots {
+				continue
+			}
+
+			if !listening(lo.Wikis, normalized.Wiki) {
+				continue
+			}
+
+			handler(rc, nil)
+		}
+	}()
+}
+
+func listening(wikis []string, wiki string) bool {
+	if len(wikis) == 0 {
+		return true
+	}
+
+	for _, w := range wikis {
+		if w == wiki {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDatagram decodes a single line sent by a MediaWiki UDP feed. JSON lines
+// are decoded as sse.RecentChange, and anything else is parsed as an IRC
+// message, returning irc.ErrNotRecentChange if it is not one. IRC lines may be
+// prefixed with "#channel\t", as configured with the feed's prefix option.
+func ParseDatagram(data []byte) (RecentChange, error) {
+	line := bytes.TrimRight(data, "\r\n")
+
+	if bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte("{")) {
+		rc := sse.RecentChange{}
+		err := json.Unmarshal(line, &rc)
+		if err != nil {
+			return RecentChange{Format: FormatJSON}, err
+		}
+		return RecentChange{Format: FormatJSON, JSON: &rc}, nil
+	}
+
+	text := string(line)
+	channel := ""
+	if strings.HasPrefix(text, "#") {
+		if i := strings.Index(text, "\t"); i != -1 {
+			channel = text[:i]
+			text = text[i+1:]
+		}
+	}
+
+	rc, err := irc.ParseMessage(channel, text)
+	if err != nil {
+		return RecentChange{Format: FormatIRC}, err
+	}
+	return RecentChange{Format: FormatIRC, IRC: &rc}, nil
+}
@@ -0,0 +1,233 @@
+package udp_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/udp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+type inListener struct {
+	data  []string
+	names map[string]string
+	lo    recentchanges.ListenOptions
+}
+
+type wantListener struct {
+	normalized recentchanges.NormalizedRecentChange
+	err        bool
+}
+
+var listenerTests = []struct {
+	name string
+	in   inListener
+	want wantListener
+}{
+	{
+		name: "json",
+		in: inListener{
+			data: []string{
+				`{"id":51,"type":"edit","namespace":0,"title":"Main Page","comment":"typo","timestamp":1561931418,"user":"Admin","bot":false,"minor":true,"length":{"old":20,"new":25},"revision":{"old":100,"new":101},"server_url":"http://docs.localhost","server_name":"docs.localhost","wiki":"docswiki"}`,
+			},
+			lo: recentchanges.ListenOptions{
+				Wikis: []string{"docs"},
+			},
+		},
+		want: wantListener{
+			normalized: recentchanges.NormalizedRecentChange{
+				ID:        -1,
+				Type:      "edit",
+				Title:     "Main Page",
+				Comment:   "typo",
+				Timestamp: 1561931418,
+				User:      "Admin",
+				Wiki:      "docs",
+				Minor:     true,
+				Revision: recentchanges.Revision{
+					New: 101,
+					Old: 100,
+				},
+				Changesize: 5,
+				Source:     recentchanges.SourceUDP,
+			},
+		},
+	},
+	{
+		name: "json named",
+		in: inListener{
+			data: []string{
+				`{"id":52,"type":"edit","namespace":0,"title":"Main Page","comment":"","timestamp":1561931418,"user":"Admin","bot":false,"minor":false,"length":{"old":20,"new":20},"revision":{"old":101,"new":102},"server_url":"http://localhost","server_name":"localhost","wiki":"my_wiki"}`,
+			},
+			names: map[string]string{"localhost": "my"},
+			lo: recentchanges.ListenOptions{
+				Wikis: []string{"my"},
+			},
+		},
+		want: wantListener{
+			normalized: recentchanges.NormalizedRecentChange{
+				ID:        -1,
+				Type:      "edit",
+				Title:     "Main Page",
+				Timestamp: 1561931418,
+				User:      "Admin",
+				Wiki:      "my",
+				Revision: recentchanges.Revision{
+					New: 102,
+					Old: 101,
+				},
+				Source: recentchanges.SourceUDP,
+			},
+		},
+	},
+	{
+		name: "irc named",
+		in: inListener{
+			data: []string{
+				"\x0314[[\x0307Main Page\x0314]]\x034 \x0310 \x0302http://localhost/w/index.php?diff=102&oldid=101\x03 \x035*\x03 \x0303Admin\x03 \x035*\x03 (0) \x0310\x03\n",
+			},
+			names: map[string]string{"localhost": "my"},
+			lo: recentchanges.ListenOptions{
+				Wikis: []string{"my"},
+			},
+		},
+		want: wantListener{
+			normalized: recentchanges.NormalizedRecentChange{
+				ID:    -1,
+				Type:  "edit",
+				Title: "Main Page",
+				User:  "Admin",
+				Wiki:  "my",
+				Revision: recentchanges.Revision{
+					New: 102,
+					Old: 101,
+				},
+				Source: recentchanges.SourceUDP,
+			},
+		},
+	},
+	{
+		name: "irc colourful",
+		in: inListener{
+			data: []string{
+				"\x0314[[\x0307Main Page\x0314]]\x034 M\x0310 \x0302http://docs.localhost/w/index.php?diff=101&oldid=100\x03 \x035*\x03 \x0303Admin\x03 \x035*\x03 (+5) \x0310typo\x03\n",
+			},
+			lo: recentchanges.ListenOptions{
+				Wikis: []string{"docs"},
+			},
+		},
+		want: wantListener{
+			normalized: recentchanges.NormalizedRecentChange{
+				ID:      -1,
+				Type:    "edit",
+				Title:   "Main Page",
+				Comment: "typo",
+				User:    "Admin",
+				Wiki:    "docs",
+				Minor:   true,
+				Revision: recentchanges.Revision{
+					New: 101,
+					Old: 100,
+				},
+				Changesize: 5,
+				Source:     recentchanges.SourceUDP,
+			},
+		},
+	},
+	{
+		name: "irc with channel prefix and hidden bot",
+		in: inListener{
+			data: []string{
+				"#docs.localhost\t\x0314[[\x0307Bot Page\x0314]]\x034 B\x0310 \x0302http://docs.localhost/w/index.php?diff=7&oldid=6\x03 \x035*\x03 \x0303Bot\x03 \x035*\x03 (+1) \x0310\x03",
+				"#docs.localhost\t\x0314[[\x0307New Page\x0314]]\x034 N\x0310 \x0302http://docs.localhost/w/index.php?oldid=8&rcid=9\x03 \x035*\x03 \x0303Someone\x03 \x035*\x03 (+20) \x0310created\x03",
+			},
+			lo: recentchanges.ListenOptions{
+				Hidebots: true,
+			},
+		},
+		want: wantListener{
+			normalized: recentchanges.NormalizedRecentChange{
+				ID:      9,
+				Type:    "new",
+				Title:   "New Page",
+				Comment: "created",
+				User:    "Someone",
+				Wiki:    "docs",
+				Revision: recentchanges.Revision{
+					New: 8,
+					Old: -1,
+				},
+				Changesize: 20,
+				Source:     recentchanges.SourceUDP,
+			},
+		},
+	},
+	{
+		name: "invalid json",
+		in: inListener{
+			data: []string{`{"wiki":`},
+		},
+		want: wantListener{
+			err: true,
+		},
+	},
+}
+
+type listenInput struct {
+	rc  udp.RecentChange
+	err error
+}
+
+func TestListener(t *testing.T) {
+	for _, tt := range listenerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			logger, _ := test.NewNullLogger()
+			listener := udp.NewListener(conn, tt.in.names, logger)
+
+			in := make(chan listenInput, len(tt.in.data))
+			listener.Listen(tt.in.lo, func(rc udp.RecentChange, err error) {
+				in <- listenInput{
+					rc:  rc,
+					err: err,
+				}
+			})
+
+			sender, err := net.Dial("udp", conn.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sender.Close()
+
+			for _, data := range tt.in.data {
+				if _, err := sender.Write([]byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			received := <-in
+
+			if (received.err != nil) != tt.want.err {
+				t.Fatalf("got error %v, want error %v", received.err, tt.want.err)
+			}
+
+			if tt.want.err {
+				return
+			}
+
+			normalized, err := received.rc.Normalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if normalized != tt.want.normalized {
+				t.Errorf("got %+v, want %+v", normalized, tt.want.normalized)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Package revhash computes and compares the SHA-1 hashes MediaWiki stores for
+// revisions, which are base36 encoded and padded with zeros to 31 characters
+package revhash
+
+import (
+	"crypto/sha1"
+	"errors"
+	"hash"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/base36"
+)
+
+// Length is the length of a MediaWiki revision hash
+const Length = 31
+
+// ErrInvalid is returned when decoding a string which is not a revision hash
+var ErrInvalid = errors.New("Invalid revision hash")
+
+// Hasher hashes revision content written to it in pieces
+type Hasher struct {
+	sha1 hash.Hash
+}
+
+// New creates a Hasher
+func New() *Hasher {
+	return &Hasher{sha1: sha1.New()}
+}
+
+// Write adds content to the hash. It never returns an error.
+func (h *Hasher) Write(p []byte) (int, error) {
+	return h.sha1.Write(p)
+}
+
+// Sum returns the revision hash of the content written so far
+func (h *Hasher) Sum() string {
+	var sum [sha1.Size]byte
+	h.sha1.Sum(sum[:0])
+	return Encode(sum)
+}
+
+// Reset discards the content written so far
+func (h *Hasher) Reset() {
+	h.sha1.Reset()
+}
+
+// Sum returns the revision hash of content
+func Sum(content []byte) string {
+	return Encode(sha1.Sum(content))
+}
+
+// Encode encodes a SHA-1 sum as a revision hash
+func Encode(sum [sha1.Size]byte) string {
+	return base36.EncodeNumber(sum[:], Length)
+}
+
+// Decode decodes a revision hash to its SHA-1 sum. Hashes missing their
+// padding are accepted, but not ones too long or too large to be a SHA-1 sum.
+func Decode(s string) ([sha1.Size]byte, error) {
+	var sum [sha1.Size]byte
+	if len(s) > Length {
+		return sum, ErrInvalid
+	}
+
+	b, err := base36.DecodeNumber(s)
+	if err != nil || len(b) > sha1.Size {
+		return sum, ErrInvalid
+	}
+
+	copy(sum[sha1.Size-len(b):], b)
+	return sum, nil
+}
+
+// Equal reports whether two revision hashes are of the same SHA-1 sum,
+// regardless of case and padding. Invalid hashes, including the empty hashes
+// of revisions whose content is hidden, are never equal.
+func Equal(a, b string) bool {
+	sumA, err := Decode(a)
+	if err != nil {
+		return false
+	}
+
+	sumB, err := Decode(b)
+	return err == nil && sumA == sumB
+}
@@ -0,0 +1,111 @@
+package revhash_test
+
+import (
+	"crypto/sha1"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revhash"
+)
+
+// Hashes as stored by MediaWiki in rev_sha1
+var knownHashes = []struct {
+	content string
+	hash    string
+}{
+	{"", "phoiac9h4m842xq45sp7s6u21eteeq1"},
+	{"Hello, world!", "hbbvduyzg9rvcn7s9tgwxvh7c4u19y1"},
+	// A leading zero byte
+	{"revision 54", "039sg7syuee6ji0hacxnhlq1jd4dyhw"},
+	// Padded without a leading zero byte
+	{"revision 77", "0dvuxo27ua13avbhkwwhi3atnwr5krl"},
+}
+
+func TestSum(t *testing.T) {
+	for _, known := range knownHashes {
+		if got := revhash.Sum([]byte(known.content)); got != known.hash {
+			t.Errorf("got %q, want %q for %q", got, known.hash, known.content)
+		}
+
+		hasher := revhash.New()
+		for _, piece := range strings.SplitAfter(known.content, " ") {
+			hasher.Write([]byte(piece))
+		}
+		if got := hasher.Sum(); got != known.hash {
+			t.Errorf("got %q streaming, want %q for %q", got, known.hash, known.content)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, known := range knownHashes {
+		sum, err := revhash.Decode(known.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sum != sha1.Sum([]byte(known.content)) {
+			t.Errorf("got %x for %q", sum, known.hash)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"phoiac9h4m842xq45sp7s6u21etee!1",
+		"0phoiac9h4m842xq45sp7s6u21eteeq1",
+		// 36^31 - 1 overflows 160 bits
+		strings.Repeat("z", 31),
+	}
+	for _, hash := range invalid {
+		if _, err := revhash.Decode(hash); err != revhash.ErrInvalid {
+			t.Errorf("got %v, want ErrInvalid for %q", err, hash)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"0dvuxo27ua13avbhkwwhi3atnwr5krl", "dvuxo27ua13avbhkwwhi3atnwr5krl", true},
+		{"0DVUXO27UA13AVBHKWWHI3ATNWR5KRL", "0dvuxo27ua13avbhkwwhi3atnwr5krl", true},
+		{"phoiac9h4m842xq45sp7s6u21eteeq1", "hbbvduyzg9rvcn7s9tgwxvh7c4u19y1", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := revhash.Equal(tt.a, tt.b); got != tt.want {
+			t.Errorf("got %v, want %v for %q and %q", got, tt.want, tt.a, tt.b)
+		}
+	}
+}
+
+func FuzzSum(f *testing.F) {
+	for _, known := range knownHashes {
+		f.Add([]byte(known.content))
+	}
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		hash := revhash.Sum(content)
+		if len(hash) != revhash.Length {
+			t.Fatalf("got %d characters, want %d", len(hash), revhash.Length)
+		}
+
+		sum := sha1.Sum(content)
+		want := new(big.Int).SetBytes(sum[:]).Text(36)
+		if strings.TrimLeft(hash, "0") != strings.TrimLeft(want, "0") {
+			t.Errorf("got %q, want %q", hash, want)
+		}
+
+		decoded, err := revhash.Decode(hash)
+		if err != nil || decoded != sum {
+			t.Errorf("got %x, %v decoding %q, want %x", decoded, err, hash, sum)
+		}
+
+		if !revhash.Equal(hash, strings.TrimLeft(hash, "0")) {
+			t.Errorf("got %q unequal to itself unpadded", hash)
+		}
+	})
+}
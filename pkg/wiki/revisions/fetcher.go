@@ -0,0 +1,188 @@
+package revisions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/sirupsen/logrus"
+)
+
+// Revision is a revision as returned by prop=revisions
+type Revision struct {
+	RevID     int    `json:"revid"`
+	ParentID  int    `json:"parentid"`
+	User      string `json:"user"`
+	Timestamp string `json:"timestamp"`
+	Comment   string `json:"comment"`
+	Minor     bool   `json:"minor"`
+
+	// Slots holds the content of each slot, when requested
+	Slots map[string]Slot `json:"slots,omitempty"`
+}
+
+// Slot is the content of a slot of a revision
+type Slot struct {
+	ContentModel string `json:"contentmodel"`
+	Content      string `json:"content"`
+
+	// TextHidden is set when the content is hidden by revision deletion
+	TextHidden bool `json:"texthidden,omitempty"`
+}
+
+type revisionsResult struct {
+	Continue map[string]string `json:"continue"`
+	Error    *struct {
+		Code string `json:"code"`
+		Info string `json:"info"`
+	} `json:"error"`
+	Query struct {
+		Pages []struct {
+			Title     string     `json:"title"`
+			Missing   bool       `json:"missing"`
+			Revisions []Revision `json:"revisions"`
+		} `json:"pages"`
+	} `json:"query"`
+}
+
+// RevisionFetcher fetches the revision history of pages
+type RevisionFetcher interface {
+	// FetchBetween fetches the revisions of a page from startID to endID
+	// inclusive, oldest first
+	FetchBetween(wiki string, title string, startID int, endID int) ([]Revision, error)
+
+	// FetchContent fetches the content of the main slot of a revision
+	FetchContent(wiki string, revID int) (string, error)
+}
+
+// mainSlot is the role of the slot holding the wikitext of a page
+const mainSlot = "main"
+
+type revisionFetch struct {
+	client http.Client
+	logger *logrus.Logger
+}
+
+// NewRevisionFetcher creates a RevisionFetcher using the Action API
+func NewRevisionFetcher(logger *logrus.Logger, client http.Client) RevisionFetcher {
+	return revisionFetch{
+		logger: logger,
+		client: client,
+	}
+}
+
+func (rf revisionFetch) FetchBetween(wikiName string, title string, startID int, endID int) ([]Revision, error) {
+	query := url.Values{}
+	query.Set("action", "query")
+	query.Set("format", "json")
+	query.Set("formatversion", "2")
+	query.Set("prop", "revisions")
+	query.Set("titles", title)
+	query.Set("rvprop", "ids|timestamp|user|comment|flags")
+	query.Set("rvdir", "newer")
+	query.Set("rvstartid", strconv.Itoa(startID))
+	query.Set("rvendid", strconv.Itoa(endID))
+	query.Set("rvlimit", "max")
+
+	revisions := []Revision{}
+	for {
+		result, err := rf.fetch(wikiName, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, page := range result.Query.Pages {
+			if page.Missing {
+				return nil, fmt.Errorf("Page %q is missing from %s", title, wikiName)
+			}
+			revisions = append(revisions, page.Revisions...)
+		}
+
+		if len(result.Continue) == 0 {
+			return revisions, nil
+		}
+		for key, value := range result.Continue {
+			query.Set(key, value)
+		}
+	}
+}
+
+func (rf revisionFetch) FetchContent(wikiName string, revID int) (string, error) {
+	query := url.Values{}
+	query.Set("action", "query")
+	query.Set("format", "json")
+	query.Set("formatversion", "2")
+	query.Set("prop", "revisions")
+	query.Set("revids", strconv.Itoa(revID))
+	query.Set("rvprop", "ids|content")
+	query.Set("rvslots", mainSlot)
+
+	result, err := rf.fetch(wikiName, query)
+	if err != nil {
+		return "", err
+	}
+
+	for _, page := range result.Query.Pages {
+		for _, revision := range page.Revisions {
+			slot, ok := revision.Slots[mainSlot]
+			if revision.RevID != revID || !ok {
+				continue
+			}
+			if slot.TextHidden {
+				return "", fmt.Errorf("Revision %d of %s has hidden content", revID, wikiName)
+			}
+			return slot.Content, nil
+		}
+	}
+	return "", fmt.Errorf("Revision %d is missing from %s", revID, wikiName)
+}
+
+func (rf revisionFetch) fetch(wikiName string, query url.Values) (revisionsResult, error) {
+	result := revisionsResult{}
+	if !wiki.ValidWiki(wikiName) {
+		return result, fmt.Errorf("Invalid wiki %q", wikiName)
+	}
+
+	url := wiki.APIURL(wikiName) + "?" + query.Encode()
+	rf.logger.WithFields(logrus.Fields{
+		"url": url,
+	}).Info("Fetching revisions")
+
+	start := time.Now()
+	resp, err := rf.client.Get(url)
+	if err != nil {
+		rf.logger.WithError(err).Error("Error querying")
+		return result, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		rf.logger.WithError(err).Error("Error reading body")
+		return result, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Unexpected status %s fetching revisions from %s", resp.Status, wikiName)
+	}
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return result, fmt.Errorf("There was an error decoding: %s", string(body))
+	}
+
+	if result.Error != nil {
+		return result, fmt.Errorf("API error %s: %s", result.Error.Code, result.Error.Info)
+	}
+
+	rf.logger.WithFields(logrus.Fields{
+		"time":  time.Now().Sub(start).String(),
+		"bytes": len(body),
+	}).Info("Revisions fetched")
+	return result, nil
+}
@@ -0,0 +1,228 @@
+package revisions_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/revisions"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+type inFetcher struct {
+	wiki    string
+	title   string
+	startID int
+	endID   int
+	bodies  []string
+}
+
+type wantFetcher struct {
+	urls      []string
+	revisions []revisions.Revision
+	err       bool
+}
+
+var fetcherTests = []struct {
+	name string
+	in   inFetcher
+	want wantFetcher
+}{
+	{
+		name: "continued",
+		in: inFetcher{
+			wiki:    "en",
+			title:   "Main Page",
+			startID: 100,
+			endID:   102,
+			bodies: []string{
+				`{"continue":{"rvcontinue":"20190701000000|102","continue":"||"},"query":{"pages":[{"pageid":1,"ns":0,"title":"Main Page","revisions":[{"revid":100,"parentid":99,"user":"A","timestamp":"2019-07-01T00:00:00Z","comment":"a"},{"revid":101,"parentid":100,"minor":true,"user":"B","timestamp":"2019-07-01T00:00:01Z","comment":"b"}]}]}}`,
+				`{"batchcomplete":true,"query":{"pages":[{"pageid":1,"ns":0,"title":"Main Page","revisions":[{"revid":102,"parentid":101,"user":"C","timestamp":"2019-07-01T00:00:02Z","comment":"c"}]}]}}`,
+			},
+		},
+		want: wantFetcher{
+			urls: []string{
+				"https://en.wikipedia.org/w/api.php?action=query&format=json&formatversion=2&prop=revisions&rvdir=newer&rvendid=102&rvlimit=max&rvprop=ids%7Ctimestamp%7Cuser%7Ccomment%7Cflags&rvstartid=100&titles=Main+Page",
+				"https://en.wikipedia.org/w/api.php?action=query&continue=%7C%7C&format=json&formatversion=2&prop=revisions&rvcontinue=20190701000000%7C102&rvdir=newer&rvendid=102&rvlimit=max&rvprop=ids%7Ctimestamp%7Cuser%7Ccomment%7Cflags&rvstartid=100&titles=Main+Page",
+			},
+			revisions: []revisions.Revision{
+				{RevID: 100, ParentID: 99, User: "A", Timestamp: "2019-07-01T00:00:00Z", Comment: "a"},
+				{RevID: 101, ParentID: 100, User: "B", Timestamp: "2019-07-01T00:00:01Z", Comment: "b", Minor: true},
+				{RevID: 102, ParentID: 101, User: "C", Timestamp: "2019-07-01T00:00:02Z", Comment: "c"},
+			},
+		},
+	},
+	{
+		name: "api error",
+		in: inFetcher{
+			wiki:    "commons",
+			title:   "File:Foo.jpg",
+			startID: 1,
+			endID:   2,
+			bodies: []string{
+				`{"error":{"code":"badid_rvstartid","info":"No revision was found for parameter \"rvstartid\"."}}`,
+			},
+		},
+		want: wantFetcher{
+			urls: []string{
+				"https://commons.wikimedia.org/w/api.php?action=query&format=json&formatversion=2&prop=revisions&rvdir=newer&rvendid=2&rvlimit=max&rvprop=ids%7Ctimestamp%7Cuser%7Ccomment%7Cflags&rvstartid=1&titles=File%3AFoo.jpg",
+			},
+			err: true,
+		},
+	},
+	{
+		name: "invalid wiki",
+		in: inFetcher{
+			wiki:    "attacker.example/x#",
+			title:   "Main Page",
+			startID: 1,
+			endID:   2,
+			bodies:  []string{`{}`},
+		},
+		want: wantFetcher{
+			err: true,
+		},
+	},
+}
+
+// RoundTripFunc
+type RoundTripFunc func(req *http.Request) *http.Response
+
+// RoundTrip .
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+func TestRevisionFetcher(t *testing.T) {
+	for _, tt := range fetcherTests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			client := http.Client{
+				Transport: RoundTripFunc(func(req *http.Request) *http.Response {
+					url := req.URL.String()
+					if requests >= len(tt.want.urls) || url != tt.want.urls[requests] {
+						t.Errorf("unexpected request %d %q", requests, url)
+					}
+
+					body := tt.in.bodies[requests%len(tt.in.bodies)]
+					requests++
+					return &http.Response{
+						StatusCode: 200,
+						Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+						Header:     make(http.Header),
+					}
+				}),
+			}
+
+			logger, _ := test.NewNullLogger()
+			fetcher := revisions.NewRevisionFetcher(logger, client)
+			revs, err := fetcher.FetchBetween(tt.in.wiki, tt.in.title, tt.in.startID, tt.in.endID)
+			if (err != nil) != tt.want.err {
+				t.Fatalf("got error %v, want error %v", err, tt.want.err)
+			}
+
+			if !tt.want.err && !reflect.DeepEqual(revs, tt.want.revisions) {
+				t.Errorf("got %+v, want %+v", revs, tt.want.revisions)
+			}
+		})
+	}
+}
+
+func respond(body string) *http.Client {
+	return &http.Client{
+		Transport: RoundTripFunc(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+				Header:     make(http.Header),
+			}
+		}),
+	}
+}
+
+func TestFetchContent(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	fetcher := revisions.NewRevisionFetcher(logger, *respond(`{"batchcomplete":true,"query":{"pages":[{"pageid":1,"ns":0,"title":"Main Page","revisions":[{"revid":100,"parentid":99,"slots":{"main":{"contentmodel":"wikitext","contentformat":"text/x-wiki","content":"Hello\nworld"}}}]}]}}`))
+	content, err := fetcher.FetchContent("en", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content != "Hello\nworld" {
+		t.Errorf("got %q, want %q", content, "Hello\nworld")
+	}
+
+	fetcher = revisions.NewRevisionFetcher(logger, *respond(`{"batchcomplete":true,"query":{"badrevids":{"100":{"revid":100,"missing":true}}}}`))
+	_, err = fetcher.FetchContent("en", 100)
+	if err == nil {
+		t.Error("got no error for a missing revision")
+	}
+}
+
+func at(minutes int) time.Time {
+	return time.Date(2019, 7, 1, 0, minutes, 0, 0, time.UTC)
+}
+
+var dataset = wikitest.APIDataset{
+	"en": {
+		Pages: []wikitest.APIPage{
+			{ID: 1, Title: "Main Page", Revisions: []wikitest.APIRevision{
+				{ID: 100, Timestamp: at(0), User: "A", Comment: "a", Text: "a"},
+				{ID: 101, Timestamp: at(1), User: "B", Comment: "b", Text: "b", Minor: true},
+				{ID: 102, Timestamp: at(2), User: "C", Comment: "c", Text: "c", TextHidden: true},
+				{ID: 103, Timestamp: at(3), User: "D", Comment: "d", Text: "d"},
+			}},
+		},
+	},
+}
+
+func TestRevisionFetcherAPI(t *testing.T) {
+	api := wikitest.NewAPIServer(dataset, wikitest.APIOptions{Limit: 2})
+	logger, _ := test.NewNullLogger()
+	fetcher := revisions.NewRevisionFetcher(logger, api.Client())
+
+	revs, err := fetcher.FetchBetween("en", "Main Page", 101, 103)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []revisions.Revision{
+		{RevID: 101, ParentID: 100, User: "B", Timestamp: "2019-07-01T00:01:00Z", Comment: "b", Minor: true},
+		{RevID: 102, ParentID: 101, User: "C", Timestamp: "2019-07-01T00:02:00Z", Comment: "c"},
+		{RevID: 103, ParentID: 102, User: "D", Timestamp: "2019-07-01T00:03:00Z", Comment: "d"},
+	}
+	if !reflect.DeepEqual(revs, want) {
+		t.Errorf("got %+v, want %+v", revs, want)
+	}
+	if requests := len(api.Requests()); requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+
+	_, err = fetcher.FetchBetween("en", "Missing", 1, 2)
+	if err == nil {
+		t.Error("got no error for a missing page")
+	}
+
+	content, err := fetcher.FetchContent("en", 101)
+	if err != nil || content != "b" {
+		t.Errorf("got %q, %v, want %q", content, err, "b")
+	}
+
+	_, err = fetcher.FetchContent("en", 102)
+	if err == nil {
+		t.Error("got no error for hidden content")
+	}
+
+	api.Fail(wikitest.APIFault{Status: http.StatusTooManyRequests, Code: "ratelimited", Info: "Slow down", Times: 1})
+	_, err = fetcher.FetchContent("en", 101)
+	if err == nil {
+		t.Error("got no error when rate limited")
+	}
+	_, err = fetcher.FetchContent("en", 101)
+	if err != nil {
+		t.Errorf("got error %v once the fault passed", err)
+	}
+}
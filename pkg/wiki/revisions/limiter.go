@@ -0,0 +1,36 @@
+package revisions
+
+import (
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+)
+
+// rateLimitedRevisionFetch is a RevisionFetcher which spaces requests by an
+// inner RevisionFetcher with a RateLimiter
+type rateLimitedRevisionFetch struct {
+	inner   RevisionFetcher
+	limiter *wiki.RateLimiter
+}
+
+// NewRateLimitedRevisionFetcher creates a RevisionFetcher making requests
+// with inner as limiter allows. Requests are not limited when limiter is nil.
+// Each FetchBetween counts once, however many pages of revisions it takes.
+func NewRateLimitedRevisionFetcher(inner RevisionFetcher, limiter *wiki.RateLimiter) RevisionFetcher {
+	if limiter == nil {
+		return inner
+	}
+
+	return rateLimitedRevisionFetch{
+		inner:   inner,
+		limiter: limiter,
+	}
+}
+
+func (r rateLimitedRevisionFetch) FetchBetween(wiki string, title string, startID int, endID int) ([]Revision, error) {
+	r.limiter.Wait()
+	return r.inner.FetchBetween(wiki, title, startID, endID)
+}
+
+func (r rateLimitedRevisionFetch) FetchContent(wiki string, revID int) (string, error) {
+	r.limiter.Wait()
+	return r.inner.FetchContent(wiki, revID)
+}
@@ -16,6 +16,5 @@ func NewSSEClient() SSEClient {
 
 func (s *sseClient) Subscribe(url string, handler func(msg *sse.Event)) error {
 	client := sse.NewClient(url)
-	client.Subscribe("messages", handler)
-	return nil
+	return client.Subscribe("messages", handler)
 }
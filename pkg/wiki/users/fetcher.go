@@ -0,0 +1,217 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/batchcache"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/sirupsen/logrus"
+)
+
+// batchSize is the most users list=users looks up in one request
+const batchSize = 50
+
+// botGroup is the group of accounts approved to run bots
+const botGroup = "bot"
+
+// User is an account as returned by list=users
+type User struct {
+	ID        int    `json:"userid"`
+	Name      string `json:"name"`
+	EditCount int    `json:"editcount"`
+
+	// Registration is empty for accounts registered before 2005, when
+	// registrations started being recorded
+	Registration string   `json:"registration"`
+	Groups       []string `json:"groups"`
+
+	// Missing is set for names which are not accounts, such as IP addresses
+	// and accounts which were never registered
+	Missing bool `json:"missing"`
+	Invalid bool `json:"invalid"`
+}
+
+// IsBot reports whether the account is in the bot group
+func (u User) IsBot() bool {
+	for _, group := range u.Groups {
+		if group == botGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// Age returns how long ago the account registered, or zero if the
+// registration was not recorded
+func (u User) Age(now time.Time) time.Duration {
+	registered, err := time.Parse(time.RFC3339, u.Registration)
+	if err != nil {
+		return 0
+	}
+	return now.Sub(registered)
+}
+
+type usersResult struct {
+	Error *struct {
+		Code string `json:"code"`
+		Info string `json:"info"`
+	} `json:"error"`
+	Query struct {
+		Users []User `json:"users"`
+	} `json:"query"`
+}
+
+// UserFetcher looks up accounts
+type UserFetcher interface {
+	// Fetch looks up the accounts of a wiki by name. Names which are not
+	// accounts are returned as Missing or Invalid.
+	Fetch(wiki string, names []string) (map[string]User, error)
+}
+
+type userFetch struct {
+	client http.Client
+	logger *logrus.Logger
+}
+
+// NewUserFetcher creates a UserFetcher using the Action API
+func NewUserFetcher(logger *logrus.Logger, client http.Client) UserFetcher {
+	return userFetch{
+		logger: logger,
+		client: client,
+	}
+}
+
+func (uf userFetch) Fetch(wikiName string, names []string) (map[string]User, error) {
+	if !wiki.ValidWiki(wikiName) {
+		return nil, fmt.Errorf("Invalid wiki %q", wikiName)
+	}
+
+	users := make(map[string]User, len(names))
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		names = names[len(batch):]
+
+		err := uf.fetch(wikiName, batch, users)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (uf userFetch) fetch(wikiName string, names []string, users map[string]User) error {
+	query := url.Values{}
+	query.Set("action", "query")
+	query.Set("format", "json")
+	query.Set("formatversion", "2")
+	query.Set("list", "users")
+	query.Set("ususers", strings.Join(names, "|"))
+	query.Set("usprop", "editcount|registration|groups")
+
+	url := wiki.APIURL(wikiName) + "?" + query.Encode()
+	uf.logger.WithFields(logrus.Fields{
+		"url": url,
+	}).Info("Fetching users")
+
+	start := time.Now()
+	resp, err := uf.client.Get(url)
+	if err != nil {
+		uf.logger.WithError(err).Error("Error querying")
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		uf.logger.WithError(err).Error("Error reading body")
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s fetching users from %s", resp.Status, wikiName)
+	}
+
+	result := usersResult{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return fmt.Errorf("There was an error decoding: %s", string(body))
+	}
+
+	if result.Error != nil {
+		return fmt.Errorf("API error %s: %s", result.Error.Code, result.Error.Info)
+	}
+
+	for _, user := range result.Query.Users {
+		users[user.Name] = user
+	}
+
+	uf.logger.WithFields(logrus.Fields{
+		"time":  time.Now().Sub(start).String(),
+		"bytes": len(body),
+	}).Info("Users fetched")
+	return nil
+}
+
+// CachedUserFetcher is a UserFetcher remembering the accounts found by an
+// inner UserFetcher. Edit counts and groups change, so accounts should be
+// kept for a short TTL.
+type CachedUserFetcher struct {
+	inner UserFetcher
+	cache *batchcache.Cache
+}
+
+// NewCachedUserFetcher creates a UserFetcher caching up to size accounts
+// found by inner, each for ttl
+func NewCachedUserFetcher(inner UserFetcher, size int, ttl time.Duration) *CachedUserFetcher {
+	return &CachedUserFetcher{
+		inner: inner,
+		cache: batchcache.New(size, ttl),
+	}
+}
+
+// Fetch returns the cached accounts, looking up the rest with the inner
+// UserFetcher
+func (c *CachedUserFetcher) Fetch(wikiName string, names []string) (map[string]User, error) {
+	// Accounts are cached by wiki and name
+	prefix := wikiName + ":"
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = prefix + name
+	}
+
+	values, err := c.cache.Lookup(keys, func(missing []string) (map[string]interface{}, error) {
+		names := make([]string, len(missing))
+		for i, key := range missing {
+			names[i] = strings.TrimPrefix(key, prefix)
+		}
+
+		found, err := c.inner.Fetch(wikiName, names)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]interface{}, len(found))
+		for name, user := range found {
+			values[prefix+name] = user
+		}
+		return values, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]User, len(values))
+	for key, user := range values {
+		users[strings.TrimPrefix(key, prefix)] = user.(User)
+	}
+	return users, nil
+}
@@ -0,0 +1,160 @@
+package users_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/users"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/wikitest"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+var registered = time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+
+var testDataset = wikitest.APIDataset{
+	"en": {
+		SiteName: "Wikipedia",
+		Lang:     "en",
+		Users: []wikitest.APIUser{
+			{ID: 1, Name: "Alice", EditCount: 5000},
+			{ID: 2, Name: "Bob", EditCount: 3, Registration: registered},
+			{ID: 3, Name: "ExampleBot", EditCount: 100000, Registration: registered, Groups: []string{"bot"}},
+		},
+	},
+}
+
+func TestUserFetcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		wiki     string
+		names    []string
+		want     map[string]users.User
+		requests int
+		err      string
+	}{
+		{
+			name:  "users",
+			wiki:  "en",
+			names: []string{"Alice", "Bob", "ExampleBot", "Nobody"},
+			want: map[string]users.User{
+				"Alice":      {ID: 1, Name: "Alice", EditCount: 5000, Groups: []string{"*", "user"}},
+				"Bob":        {ID: 2, Name: "Bob", EditCount: 3, Registration: "2019-07-01T00:00:00Z", Groups: []string{"*", "user"}},
+				"ExampleBot": {ID: 3, Name: "ExampleBot", EditCount: 100000, Registration: "2019-07-01T00:00:00Z", Groups: []string{"*", "user", "bot"}},
+				"Nobody":     {Name: "Nobody", Missing: true},
+			},
+			requests: 1,
+		},
+		{
+			name:  "invalid wiki",
+			wiki:  "attacker.example/x#",
+			names: []string{"Alice"},
+			err:   "Invalid wiki",
+		},
+		{
+			name:     "unknown wiki",
+			wiki:     "xx",
+			names:    []string{"Alice"},
+			requests: 1,
+			err:      "Unexpected status",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := test.NewNullLogger()
+			api := wikitest.NewAPIServer(testDataset, wikitest.DefaultAPIOptions)
+			fetcher := users.NewUserFetcher(logger, api.Client())
+
+			got, err := fetcher.Fetch(tt.wiki, tt.names)
+			if tt.err == "" && err != nil {
+				t.Errorf("got error %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if tt.err == "" && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if requests := len(api.Requests()); requests != tt.requests {
+				t.Errorf("got %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestUserFetcherBatches(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	api := wikitest.NewAPIServer(testDataset, wikitest.DefaultAPIOptions)
+	fetcher := users.NewUserFetcher(logger, api.Client())
+
+	names := []string{}
+	for i := 0; i < 120; i++ {
+		names = append(names, fmt.Sprintf("User %d", i))
+	}
+	got, err := fetcher.Fetch("en", names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(names) {
+		t.Errorf("got %d users, want %d", len(got), len(names))
+	}
+	if requests := len(api.Requests()); requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+}
+
+func TestCachedUserFetcher(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	api := wikitest.NewAPIServer(testDataset, wikitest.DefaultAPIOptions)
+	fetcher := users.NewCachedUserFetcher(users.NewUserFetcher(logger, api.Client()), 10, time.Hour)
+
+	for _, names := range [][]string{
+		{"Alice", "Nobody", "Alice"},
+		{"Alice", "Nobody"},
+		{"Nobody", "Bob"},
+	} {
+		got, err := fetcher.Fetch("en", names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if got[name].Name != name {
+				t.Errorf("got %+v for %s", got[name], name)
+			}
+		}
+	}
+
+	// Only Bob was looked up after the first fetch
+	requests := api.Requests()
+	if len(requests) != 2 || !strings.HasSuffix(requests[1], "&ususers=Bob") {
+		t.Errorf("got requests %v", requests)
+	}
+}
+
+func TestUser(t *testing.T) {
+	now := registered.Add(24 * time.Hour)
+	tests := []struct {
+		name string
+		user users.User
+		bot  bool
+		age  time.Duration
+	}{
+		{"user", users.User{Registration: "2019-07-01T00:00:00Z", Groups: []string{"*", "user"}}, false, 24 * time.Hour},
+		{"bot", users.User{Registration: "2019-07-01T00:00:00Z", Groups: []string{"*", "user", "bot"}}, true, 24 * time.Hour},
+		{"unrecorded registration", users.User{}, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bot := tt.user.IsBot(); bot != tt.bot {
+				t.Errorf("got bot %t, want %t", bot, tt.bot)
+			}
+			if age := tt.user.Age(now); age != tt.age {
+				t.Errorf("got age %s, want %s", age, tt.age)
+			}
+		})
+	}
+}
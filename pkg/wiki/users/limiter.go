@@ -0,0 +1,30 @@
+package users
+
+import (
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+)
+
+// rateLimitedUserFetch is a UserFetcher which spaces requests by an inner
+// UserFetcher with a RateLimiter
+type rateLimitedUserFetch struct {
+	inner   UserFetcher
+	limiter *wiki.RateLimiter
+}
+
+// NewRateLimitedUserFetcher creates a UserFetcher making requests with inner
+// as limiter allows. Requests are not limited when limiter is nil.
+func NewRateLimitedUserFetcher(inner UserFetcher, limiter *wiki.RateLimiter) UserFetcher {
+	if limiter == nil {
+		return inner
+	}
+
+	return rateLimitedUserFetch{
+		inner:   inner,
+		limiter: limiter,
+	}
+}
+
+func (r rateLimitedUserFetch) Fetch(wiki string, names []string) (map[string]User, error) {
+	r.limiter.Wait()
+	return r.inner.Fetch(wiki, names)
+}
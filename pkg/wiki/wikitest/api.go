@@ -0,0 +1,411 @@
+package wikitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+)
+
+// APIDataset is the content served by an APIServer, keyed by normalized wiki
+// name, such as "en" for the English Wikipedia
+type APIDataset map[string]*APIWiki
+
+// APIWiki is the content of a wiki
+type APIWiki struct {
+	SiteName string `json:"sitename"`
+	Lang     string `json:"lang"`
+
+	// DBName is the database name, which defaults to the wiki name followed
+	// by "wiki", such as "enwiki"
+	DBName string `json:"dbname,omitempty"`
+
+	Pages []APIPage `json:"pages"`
+	Users []APIUser `json:"users"`
+}
+
+// APIPage is a page and its history
+type APIPage struct {
+	ID    int    `json:"id"`
+	NS    int    `json:"ns"`
+	Title string `json:"title"`
+
+	// Revisions are the revisions of the page, oldest first. Each revision's
+	// parent is the revision before it.
+	Revisions []APIRevision `json:"revisions"`
+}
+
+// APIRevision is a revision of a page
+type APIRevision struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	User      string    `json:"user"`
+	UserID    int       `json:"userid"`
+	Comment   string    `json:"comment"`
+	Minor     bool      `json:"minor,omitempty"`
+	Bot       bool      `json:"bot,omitempty"`
+	Text      string    `json:"text"`
+
+	// TextHidden, UserHidden and CommentHidden are set for revisions deleted
+	// with revision deletion, and Suppressed when hidden from admins too
+	TextHidden    bool `json:"texthidden,omitempty"`
+	UserHidden    bool `json:"userhidden,omitempty"`
+	CommentHidden bool `json:"commenthidden,omitempty"`
+	Suppressed    bool `json:"suppressed,omitempty"`
+}
+
+// APIUser is a registered user
+type APIUser struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	EditCount    int       `json:"editcount"`
+	Registration time.Time `json:"registration"`
+	Groups       []string  `json:"groups"`
+}
+
+// LoadAPIDataset reads a dataset from a JSON file, such as a fixture in
+// testdata
+func LoadAPIDataset(path string) (APIDataset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dataset := APIDataset{}
+	err = json.Unmarshal(data, &dataset)
+	if err != nil {
+		return nil, fmt.Errorf("There was an error decoding %s: %s", path, err)
+	}
+	return dataset, nil
+}
+
+// APIOptions configures an APIServer
+type APIOptions struct {
+	// Latency delays every response
+	Latency time.Duration
+
+	// RateLimit is how many requests each wiki serves a second before
+	// failing with HTTP 429. Zero is unlimited.
+	RateLimit int
+
+	// Limit is the most results a list or prop returns before continuing,
+	// which "max" requests
+	Limit int
+}
+
+// DefaultAPIOptions serves as fast as possible, with the limits of a user
+// without the apihighlimits right
+var DefaultAPIOptions = APIOptions{
+	Limit: 500,
+}
+
+// APIFault is an error injected into responses
+type APIFault struct {
+	// Wiki and Action restrict the fault to requests to a wiki or for an
+	// action. Empty matches every request.
+	Wiki   string
+	Action string
+
+	// Status is the HTTP status of the response, which is 200 when zero
+	Status int
+
+	// Code and Info are the API error returned. A response with a Status and
+	// no Code has an HTML body, as when a server is down.
+	Code string
+	Info string
+
+	// Times is how many requests fail, or every request when zero
+	Times int
+}
+
+// APIServer is a fake of the MediaWiki Action API of many wikis, serving
+// action=compare, and action=query with prop=revisions, list=recentchanges,
+// list=users and meta=siteinfo, in JSON with formatversion=2. Requests are
+// routed to wikis by host, as given by wiki.APIURL, so it is used through
+// the client returned by Client.
+type APIServer struct {
+	dataset APIDataset
+	options APIOptions
+
+	mux      sync.Mutex
+	lag      map[string]int
+	faults   []*APIFault
+	requests []string
+	served   map[string][]time.Time
+}
+
+// NewAPIServer creates an APIServer serving a dataset
+func NewAPIServer(dataset APIDataset, o APIOptions) *APIServer {
+	if o.Limit <= 0 {
+		o.Limit = DefaultAPIOptions.Limit
+	}
+
+	return &APIServer{
+		dataset: dataset,
+		options: o,
+		lag:     make(map[string]int),
+		served:  make(map[string][]time.Time),
+	}
+}
+
+// Client returns an HTTP client which sends requests for the Action API of
+// any wiki to the server, without a network
+func (s *APIServer) Client() http.Client {
+	return http.Client{Transport: apiTransport{server: s}}
+}
+
+// SetLag sets the replication lag of a wiki in seconds, which fails requests
+// with a lower maxlag parameter
+func (s *APIServer) SetLag(wiki string, seconds int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lag[wiki] = seconds
+}
+
+// Fail injects a fault into the responses to matching requests. Faults are
+// matched in the order they were added.
+func (s *APIServer) Fail(f APIFault) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Requests returns the URL of every request received so far, in order
+func (s *APIServer) Requests() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	s.mux.Lock()
+	s.requests = append(s.requests, "https://"+host+r.URL.RequestURI())
+	s.mux.Unlock()
+
+	name := wiki.HostWiki(host)
+	site, ok := s.dataset[name]
+	if !ok || r.URL.Path != "/w/api.php" {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	action := query.Get("action")
+
+	s.mux.Lock()
+	limited := s.rateLimited(name)
+	fault := s.fault(name, action)
+	lag := s.lag[name]
+	s.mux.Unlock()
+
+	if s.options.Latency > 0 {
+		select {
+		case <-time.After(s.options.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if limited {
+		w.Header().Set("Retry-After", "1")
+		writeAPIError(w, http.StatusTooManyRequests, "ratelimited", "You've exceeded your rate limit. Please wait some time and try again.")
+		return
+	}
+
+	if fault != nil {
+		status := fault.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if fault.Code == "" {
+			http.Error(w, "<!DOCTYPE html><title>Wikimedia Error</title>", status)
+			return
+		}
+		writeAPIError(w, status, fault.Code, fault.Info)
+		return
+	}
+
+	if maxlag, err := strconv.Atoi(query.Get("maxlag")); err == nil && lag > maxlag {
+		w.Header().Set("Retry-After", "5")
+		w.Header().Set("X-Database-Lag", strconv.Itoa(lag))
+		writeAPIError(w, http.StatusOK, "maxlag", fmt.Sprintf("Waiting for a database server: %d seconds lagged.", lag))
+		return
+	}
+
+	var result map[string]interface{}
+	var err *apiError
+	switch action {
+	case "compare":
+		result, err = compare(site, query)
+	case "query":
+		result, err = s.query(name, site, query)
+	default:
+		err = &apiError{"badvalue", fmt.Sprintf("Unrecognized value for parameter \"action\": %s.", action)}
+	}
+
+	if err != nil {
+		writeAPIError(w, http.StatusOK, err.code, err.info)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// rateLimited records a request to a wiki, reporting whether it is over the
+// rate limit
+func (s *APIServer) rateLimited(wiki string) bool {
+	if s.options.RateLimit <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	served := []time.Time{}
+	for _, t := range s.served[wiki] {
+		if now.Sub(t) < time.Second {
+			served = append(served, t)
+		}
+	}
+
+	if len(served) >= s.options.RateLimit {
+		s.served[wiki] = served
+		return true
+	}
+	s.served[wiki] = append(served, now)
+	return false
+}
+
+// fault returns the first fault matching a request, counting it against the
+// fault's Times
+func (s *APIServer) fault(wiki string, action string) *APIFault {
+	for i, f := range s.faults {
+		if (f.Wiki != "" && f.Wiki != wiki) || (f.Action != "" && f.Action != action) {
+			continue
+		}
+
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// apiError is an error returned by the API
+type apiError struct {
+	code string
+	info string
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, info string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]string{
+			"code": code,
+			"info": info,
+		},
+		"servedby": "wikitest",
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// apiTransport serves requests with an APIServer in process
+type apiTransport struct {
+	server *APIServer
+}
+
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.server.ServeHTTP(w, req)
+
+	// The server gives up on requests cancelled while waiting out latency
+	err := req.Context().Err()
+	if err != nil {
+		return nil, err
+	}
+	return w.Result(), nil
+}
+
+// revisionRef is a revision of a page of a wiki
+type revisionRef struct {
+	page  *APIPage
+	index int
+}
+
+func (r revisionRef) revision() *APIRevision {
+	return &r.page.Revisions[r.index]
+}
+
+// parent returns the revision before r, reporting whether there is one
+func (r revisionRef) parent() (revisionRef, bool) {
+	return revisionRef{r.page, r.index - 1}, r.index > 0
+}
+
+// child returns the revision after r, reporting whether there is one
+func (r revisionRef) child() (revisionRef, bool) {
+	return revisionRef{r.page, r.index + 1}, r.index+1 < len(r.page.Revisions)
+}
+
+// findRevision finds a revision of a wiki by ID
+func (w *APIWiki) findRevision(id int) (revisionRef, bool) {
+	for i := range w.Pages {
+		page := &w.Pages[i]
+		for j := range page.Revisions {
+			if page.Revisions[j].ID == id {
+				return revisionRef{page, j}, true
+			}
+		}
+	}
+	return revisionRef{}, false
+}
+
+// findPage finds a page of a wiki by title
+func (w *APIWiki) findPage(title string) (*APIPage, bool) {
+	for i := range w.Pages {
+		if w.Pages[i].Title == title {
+			return &w.Pages[i], true
+		}
+	}
+	return nil, false
+}
+
+// changes returns every revision of a wiki, oldest first
+func (w *APIWiki) changes() []revisionRef {
+	changes := []revisionRef{}
+	for i := range w.Pages {
+		for j := range w.Pages[i].Revisions {
+			changes = append(changes, revisionRef{&w.Pages[i], j})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		a, b := changes[i].revision(), changes[j].revision()
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return a.ID < b.ID
+	})
+	return changes
+}
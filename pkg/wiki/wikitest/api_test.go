@@ -0,0 +1,158 @@
+package wikitest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func at(minutes int) time.Time {
+	return time.Date(2019, 7, 1, 0, minutes, 0, 0, time.UTC)
+}
+
+var testDataset = APIDataset{
+	"en": {
+		SiteName: "Wikipedia",
+		Lang:     "en",
+		Pages: []APIPage{
+			{ID: 1, Title: "Main Page", Revisions: []APIRevision{
+				{ID: 100, Timestamp: at(0), User: "Alice", UserID: 1, Comment: "a", Text: "a"},
+				{ID: 102, Timestamp: at(2), User: "ExampleBot", UserID: 2, Comment: "b", Text: "b", Bot: true},
+			}},
+			{ID: 2, Title: "Talk:Main Page", NS: 1, Revisions: []APIRevision{
+				{ID: 101, Timestamp: at(1), User: "Alice", UserID: 1, Comment: "c", Text: "c"},
+				{ID: 103, Timestamp: at(3), User: "Alice", UserID: 1, Comment: "d", Text: "d", UserHidden: true},
+			}},
+		},
+		Users: []APIUser{
+			{ID: 1, Name: "Alice", EditCount: 3, Registration: at(0), Groups: []string{"sysop"}},
+		},
+	},
+	"wikidata": {SiteName: "Wikidata", Lang: "en"},
+}
+
+// get requests a URL from the server, decoding the JSON response
+func get(t *testing.T, s *APIServer, url string) (int, map[string]interface{}) {
+	t.Helper()
+	client := s.Client()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]interface{}{}
+	json.Unmarshal(body, &result)
+	return resp.StatusCode, result
+}
+
+// errorCode returns the code of the API error in a response
+func errorCode(result map[string]interface{}) string {
+	e, _ := result["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+func TestAPIServerRecentChanges(t *testing.T) {
+	s := NewAPIServer(testDataset, DefaultAPIOptions)
+
+	revids := []float64{}
+	url := "https://en.wikipedia.org/w/api.php?action=query&format=json&formatversion=2&list=recentchanges&rcshow=!bot&rclimit=2"
+	for requests := 0; requests < 5; requests++ {
+		_, result := get(t, s, url)
+		query := result["query"].(map[string]interface{})
+		for _, change := range query["recentchanges"].([]interface{}) {
+			revids = append(revids, change.(map[string]interface{})["revid"].(float64))
+		}
+
+		cont, ok := result["continue"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		url = "https://en.wikipedia.org/w/api.php?action=query&format=json&formatversion=2&list=recentchanges&rcshow=!bot&rclimit=2&rccontinue=" + cont["rccontinue"].(string)
+	}
+
+	want := []float64{103, 101, 100}
+	if !reflect.DeepEqual(revids, want) {
+		t.Errorf("got revisions %v, want %v", revids, want)
+	}
+}
+
+func TestAPIServerQuery(t *testing.T) {
+	s := NewAPIServer(testDataset, DefaultAPIOptions)
+
+	_, result := get(t, s, "https://www.wikidata.org/w/api.php?action=query&format=json&formatversion=2&meta=siteinfo")
+	general := result["query"].(map[string]interface{})["general"].(map[string]interface{})
+	if general["dbname"] != "wikidatawiki" || general["servername"] != "www.wikidata.org" {
+		t.Errorf("got siteinfo %v", general)
+	}
+
+	_, result = get(t, s, "https://en.wikipedia.org/w/api.php?action=query&format=json&formatversion=2&list=users&ususers=Alice|Nobody&usprop=editcount|groups")
+	users := result["query"].(map[string]interface{})["users"].([]interface{})
+	want := []interface{}{
+		map[string]interface{}{"userid": 1.0, "name": "Alice", "editcount": 3.0, "groups": []interface{}{"*", "user", "sysop"}},
+		map[string]interface{}{"name": "Nobody", "missing": true},
+	}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("got users %v, want %v", users, want)
+	}
+
+	_, result = get(t, s, "https://en.wikipedia.org/w/api.php?action=query&format=json&formatversion=2&prop=revisions&titles=Main+Page|Talk:Main+Page&rvlimit=1")
+	if code := errorCode(result); code != "invalidparammix" {
+		t.Errorf("got error %q, want %q", code, "invalidparammix")
+	}
+
+	_, result = get(t, s, "https://en.wikipedia.org/w/api.php?action=edit")
+	if code := errorCode(result); code != "badvalue" {
+		t.Errorf("got error %q, want %q", code, "badvalue")
+	}
+
+	status, _ := get(t, s, "https://fr.wikipedia.org/w/api.php?action=query")
+	if status != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown wiki, want %d", status, http.StatusNotFound)
+	}
+
+	if requests := len(s.Requests()); requests != 5 {
+		t.Errorf("got %d requests, want 5", requests)
+	}
+}
+
+func TestAPIServerInjection(t *testing.T) {
+	s := NewAPIServer(testDataset, DefaultAPIOptions)
+	compare := "https://en.wikipedia.org/w/api.php?action=compare&format=json&formatversion=2&fromrev=102&torelative=prev"
+
+	s.SetLag("en", 10)
+	_, result := get(t, s, compare+"&maxlag=5")
+	if code := errorCode(result); code != "maxlag" {
+		t.Errorf("got error %q, want %q", code, "maxlag")
+	}
+	_, result = get(t, s, compare+"&maxlag=15")
+	if code := errorCode(result); code != "" {
+		t.Errorf("got error %q below the maxlag", code)
+	}
+
+	s.Fail(APIFault{Action: "compare", Status: http.StatusBadGateway, Times: 2})
+	for i := 0; i < 2; i++ {
+		status, _ := get(t, s, compare)
+		if status != http.StatusBadGateway {
+			t.Errorf("got status %d, want %d", status, http.StatusBadGateway)
+		}
+	}
+	status, result := get(t, s, compare)
+	if status != http.StatusOK || errorCode(result) != "" {
+		t.Errorf("got status %d and error %q once the fault passed", status, errorCode(result))
+	}
+
+	compared := result["compare"].(map[string]interface{})
+	if compared["fromrevid"] != 100.0 || compared["torevid"] != 102.0 || compared["prev"] != 100.0 {
+		t.Errorf("got comparison %v", compared)
+	}
+}
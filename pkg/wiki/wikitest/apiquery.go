@@ -0,0 +1,585 @@
+package wikitest
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs"
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/diffs/engine"
+)
+
+// continueTimestamp is the format of timestamps in continuation values
+const continueTimestamp = "20060102150405"
+
+// defaultLimit is the number of results returned when no limit is given
+const defaultLimit = 10
+
+// compare handles action=compare, diffing fromrev or torev against torev or
+// torelative
+func compare(site *APIWiki, query url.Values) (map[string]interface{}, *apiError) {
+	var from, to revisionRef
+	hasFrom, hasTo := false, false
+
+	if query.Get("fromrev") != "" {
+		id, _ := strconv.Atoi(query.Get("fromrev"))
+		ref, ok := site.findRevision(id)
+		if !ok {
+			return nil, noSuchRevision(query.Get("fromrev"))
+		}
+		from, hasFrom = ref, true
+	}
+
+	switch {
+	case query.Get("torev") != "":
+		id, _ := strconv.Atoi(query.Get("torev"))
+		ref, ok := site.findRevision(id)
+		if !ok {
+			return nil, noSuchRevision(query.Get("torev"))
+		}
+		to, hasTo = ref, true
+	case hasFrom && query.Get("torelative") == "prev":
+		to, hasTo = from, true
+		from, hasFrom = from.parent()
+	case hasFrom && query.Get("torelative") == "next":
+		to, hasTo = from.child()
+		if !hasTo {
+			return nil, &apiError{"nosuchrevid", fmt.Sprintf("There is no revision after %d.", from.revision().ID)}
+		}
+	case hasFrom && query.Get("torelative") == "cur":
+		to, hasTo = revisionRef{from.page, len(from.page.Revisions) - 1}, true
+	}
+
+	if !hasTo {
+		return nil, &apiError{"missingparam", "One of the parameters \"torev\" or \"torelative\" is required."}
+	}
+
+	compare := map[string]interface{}{}
+	fromText := ""
+	if hasFrom {
+		compareFields(compare, "from", from)
+		fromText = from.revision().Text
+	}
+	compareFields(compare, "to", to)
+
+	if parent, ok := to.parent(); ok {
+		compare["prev"] = parent.revision().ID
+	}
+	if child, ok := to.child(); ok {
+		compare["next"] = child.revision().ID
+	}
+
+	// Hidden text cannot be diffed
+	if !(hasFrom && from.revision().TextHidden) && !to.revision().TextHidden {
+		body := engine.Render(engine.Diff(fromText, to.revision().Text, engine.DefaultOptions))
+		compare["diffsize"] = len(body)
+		compare["bodies"] = map[string]string{diffs.MainSlot: body}
+	}
+
+	return map[string]interface{}{"compare": compare}, nil
+}
+
+// compareFields adds the fields describing one side of a comparison
+func compareFields(compare map[string]interface{}, side string, ref revisionRef) {
+	rev := ref.revision()
+	compare[side+"id"] = ref.page.ID
+	compare[side+"revid"] = rev.ID
+	compare[side+"ns"] = ref.page.NS
+	compare[side+"title"] = ref.page.Title
+	compare[side+"size"] = len(rev.Text)
+	compare[side+"timestamp"] = formatTimestamp(rev.Timestamp)
+
+	if rev.UserHidden {
+		compare[side+"userhidden"] = true
+	} else {
+		compare[side+"user"] = rev.User
+		compare[side+"userid"] = rev.UserID
+	}
+
+	if rev.CommentHidden {
+		compare[side+"commenthidden"] = true
+	} else {
+		compare[side+"comment"] = rev.Comment
+		compare[side+"parsedcomment"] = html.EscapeString(rev.Comment)
+	}
+
+	if rev.TextHidden {
+		compare[side+"texthidden"] = true
+	}
+	if rev.Suppressed {
+		compare[side+"suppressed"] = true
+	}
+}
+
+// query handles action=query with the supported meta, list and prop modules
+func (s *APIServer) query(name string, site *APIWiki, query url.Values) (map[string]interface{}, *apiError) {
+	results := map[string]interface{}{}
+	continues := map[string]string{}
+
+	for _, meta := range splitParam(query.Get("meta")) {
+		switch meta {
+		case "siteinfo":
+			results["general"] = siteInfo(name, site)
+		default:
+			return nil, unrecognized("meta", meta)
+		}
+	}
+
+	for _, list := range splitParam(query.Get("list")) {
+		switch list {
+		case "recentchanges":
+			changes, rccontinue, err := s.recentChanges(site, query)
+			if err != nil {
+				return nil, err
+			}
+			results["recentchanges"] = changes
+			if rccontinue != "" {
+				continues["rccontinue"] = rccontinue
+				continues["continue"] = "-||"
+			}
+		case "users":
+			results["users"] = users(site, query)
+		default:
+			return nil, unrecognized("list", list)
+		}
+	}
+
+	for _, prop := range splitParam(query.Get("prop")) {
+		switch prop {
+		case "revisions":
+			err := s.revisions(site, query, results, continues)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, unrecognized("prop", prop)
+		}
+	}
+
+	result := map[string]interface{}{"query": results}
+	if len(continues) > 0 {
+		result["continue"] = continues
+	} else {
+		result["batchcomplete"] = true
+	}
+	return result, nil
+}
+
+// siteInfo returns the general site information of a wiki
+func siteInfo(name string, site *APIWiki) map[string]interface{} {
+	dbname := site.DBName
+	if dbname == "" {
+		dbname = name + "wiki"
+	}
+
+	server := strings.TrimSuffix(strings.TrimPrefix(wiki.APIURL(name), "https:"), "/w/api.php")
+	return map[string]interface{}{
+		"mainpage":    "Main Page",
+		"base":        "https:" + server + "/wiki/Main_Page",
+		"sitename":    site.SiteName,
+		"lang":        site.Lang,
+		"generator":   "MediaWiki 1.34.0-wmf.11",
+		"dbname":      dbname,
+		"wikiid":      dbname,
+		"server":      server,
+		"servername":  strings.TrimPrefix(server, "//"),
+		"articlepath": "/wiki/$1",
+		"scriptpath":  "/w",
+		"time":        formatTimestamp(time.Now()),
+	}
+}
+
+// recentChanges lists the revisions of a wiki as recent changes, returning
+// the continuation value when there are more
+func (s *APIServer) recentChanges(site *APIWiki, query url.Values) ([]map[string]interface{}, string, *apiError) {
+	limit, err := s.limit(query.Get("rclimit"), defaultLimit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	changes := site.changes()
+	ids := make(map[revisionRef]int, len(changes))
+	for i, ref := range changes {
+		ids[ref] = i + 1
+	}
+
+	if query.Get("rcdir") != "newer" {
+		for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+			changes[i], changes[j] = changes[j], changes[i]
+		}
+	}
+
+	show := map[string]bool{}
+	for _, value := range splitParam(query.Get("rcshow")) {
+		show[value] = true
+	}
+	types := map[string]bool{}
+	for _, value := range splitParam(query.Get("rctype")) {
+		types[value] = true
+	}
+
+	rcid := 0
+	if rccontinue := query.Get("rccontinue"); rccontinue != "" {
+		parts := strings.Split(rccontinue, "|")
+		rcid, _ = strconv.Atoi(parts[len(parts)-1])
+	}
+
+	results := []map[string]interface{}{}
+	for _, ref := range changes {
+		if rcid != 0 && ids[ref] != rcid {
+			continue
+		}
+		rcid = 0
+
+		rev := ref.revision()
+		rcType := "edit"
+		if ref.index == 0 {
+			rcType = "new"
+		}
+		if (show["bot"] && !rev.Bot) || (show["!bot"] && rev.Bot) ||
+			(show["minor"] && !rev.Minor) || (show["!minor"] && rev.Minor) ||
+			(len(types) > 0 && !types[rcType]) {
+			continue
+		}
+
+		if len(results) == limit {
+			return results, rev.Timestamp.UTC().Format(continueTimestamp) + "|" + strconv.Itoa(ids[ref]), nil
+		}
+
+		change := map[string]interface{}{
+			"type":      rcType,
+			"ns":        ref.page.NS,
+			"title":     ref.page.Title,
+			"pageid":    ref.page.ID,
+			"revid":     rev.ID,
+			"old_revid": 0,
+			"rcid":      ids[ref],
+			"bot":       rev.Bot,
+			"minor":     rev.Minor,
+			"new":       rcType == "new",
+			"oldlen":    0,
+			"newlen":    len(rev.Text),
+			"timestamp": formatTimestamp(rev.Timestamp),
+		}
+		if parent, ok := ref.parent(); ok {
+			change["old_revid"] = parent.revision().ID
+			change["oldlen"] = len(parent.revision().Text)
+		}
+		if rev.UserHidden {
+			change["userhidden"] = true
+		} else {
+			change["user"] = rev.User
+			change["userid"] = rev.UserID
+		}
+		if rev.CommentHidden {
+			change["commenthidden"] = true
+		} else {
+			change["comment"] = rev.Comment
+		}
+		results = append(results, change)
+	}
+	return results, "", nil
+}
+
+// users returns the users named by ususers, with the properties in usprop
+func users(site *APIWiki, query url.Values) []map[string]interface{} {
+	props := map[string]bool{}
+	for _, prop := range splitParam(query.Get("usprop")) {
+		props[prop] = true
+	}
+
+	results := []map[string]interface{}{}
+	for _, name := range splitParam(query.Get("ususers")) {
+		var found *APIUser
+		for i := range site.Users {
+			if site.Users[i].Name == name {
+				found = &site.Users[i]
+			}
+		}
+
+		if found == nil {
+			results = append(results, map[string]interface{}{"name": name, "missing": true})
+			continue
+		}
+
+		user := map[string]interface{}{"userid": found.ID, "name": found.Name}
+		if props["editcount"] {
+			user["editcount"] = found.EditCount
+		}
+		if props["registration"] {
+			// Registrations before 2005 were not recorded
+			user["registration"] = nil
+			if !found.Registration.IsZero() {
+				user["registration"] = formatTimestamp(found.Registration)
+			}
+		}
+		if props["groups"] {
+			user["groups"] = append([]string{"*", "user"}, found.Groups...)
+		}
+		results = append(results, user)
+	}
+	return results
+}
+
+// revisions handles prop=revisions for the pages given by titles, pageids or
+// revids. Pages given by title or ID have their latest revision, or their
+// revisions from rvstartid to rvendid when enumerating a single page.
+func (s *APIServer) revisions(site *APIWiki, query url.Values, results map[string]interface{}, continues map[string]string) *apiError {
+	props := map[string]bool{}
+	for _, prop := range splitParam(query.Get("rvprop")) {
+		props[prop] = true
+	}
+	if query.Get("rvprop") == "" {
+		props = map[string]bool{"ids": true, "timestamp": true, "flags": true, "comment": true, "user": true}
+	}
+	slots := query.Get("rvslots") != ""
+
+	pages := []map[string]interface{}{}
+	if query.Get("revids") != "" {
+		byPage := map[*APIPage]map[string]interface{}{}
+		badrevids := map[string]interface{}{}
+		for _, value := range splitParam(query.Get("revids")) {
+			id, _ := strconv.Atoi(value)
+			ref, ok := site.findRevision(id)
+			if !ok {
+				badrevids[value] = map[string]interface{}{"revid": id, "missing": true}
+				continue
+			}
+
+			page, ok := byPage[ref.page]
+			if !ok {
+				page = pageFields(ref.page)
+				page["revisions"] = []map[string]interface{}{}
+				byPage[ref.page] = page
+				pages = append(pages, page)
+			}
+			page["revisions"] = append(page["revisions"].([]map[string]interface{}), revisionFields(ref, props, slots))
+		}
+		if len(badrevids) > 0 {
+			results["badrevids"] = badrevids
+		}
+		results["pages"] = pages
+		return nil
+	}
+
+	found := []*APIPage{}
+	for _, title := range splitParam(query.Get("titles")) {
+		page, ok := site.findPage(title)
+		if !ok {
+			pages = append(pages, map[string]interface{}{"ns": 0, "title": title, "missing": true})
+			continue
+		}
+		found = append(found, page)
+	}
+	for _, value := range splitParam(query.Get("pageids")) {
+		id, _ := strconv.Atoi(value)
+		var page *APIPage
+		for i := range site.Pages {
+			if site.Pages[i].ID == id {
+				page = &site.Pages[i]
+			}
+		}
+		if page == nil {
+			pages = append(pages, map[string]interface{}{"pageid": id, "missing": true})
+			continue
+		}
+		found = append(found, page)
+	}
+
+	enumerate := false
+	for _, param := range []string{"rvlimit", "rvstartid", "rvendid", "rvdir", "rvcontinue"} {
+		if query.Get(param) != "" {
+			enumerate = true
+		}
+	}
+	if enumerate && len(found) > 1 {
+		return &apiError{"invalidparammix", "titles, pageids or a generator was used to supply multiple pages, but the rvlimit, rvstartid, rvendid, rvdir and rvcontinue parameters may only be used on a single page."}
+	}
+
+	for _, page := range found {
+		fields := pageFields(page)
+		revisions := []map[string]interface{}{}
+		if len(page.Revisions) > 0 && !enumerate {
+			revisions = append(revisions, revisionFields(revisionRef{page, len(page.Revisions) - 1}, props, slots))
+		}
+
+		if enumerate {
+			limit, err := s.limit(query.Get("rvlimit"), defaultLimit)
+			if err != nil {
+				return err
+			}
+
+			refs := pageRevisions(page, query)
+			for i, ref := range refs {
+				if i == limit {
+					rev := ref.revision()
+					continues["rvcontinue"] = rev.Timestamp.UTC().Format(continueTimestamp) + "|" + strconv.Itoa(rev.ID)
+					continues["continue"] = "||"
+					break
+				}
+				revisions = append(revisions, revisionFields(ref, props, slots))
+			}
+		}
+
+		fields["revisions"] = revisions
+		pages = append(pages, fields)
+	}
+
+	results["pages"] = pages
+	return nil
+}
+
+// pageRevisions returns the revisions of a page enumerated by rvdir,
+// rvstartid, rvendid and rvcontinue, in order
+func pageRevisions(page *APIPage, query url.Values) []revisionRef {
+	newer := query.Get("rvdir") == "newer"
+	startID, _ := strconv.Atoi(query.Get("rvstartid"))
+	endID, _ := strconv.Atoi(query.Get("rvendid"))
+	continueID := 0
+	if rvcontinue := query.Get("rvcontinue"); rvcontinue != "" {
+		parts := strings.Split(rvcontinue, "|")
+		continueID, _ = strconv.Atoi(parts[len(parts)-1])
+	}
+
+	// before reports whether revision a comes before b in the enumeration
+	before := func(a, b int) bool {
+		if newer {
+			return a < b
+		}
+		return a > b
+	}
+
+	refs := []revisionRef{}
+	for i := range page.Revisions {
+		ref := revisionRef{page, i}
+		if !newer {
+			ref.index = len(page.Revisions) - 1 - i
+		}
+
+		id := ref.revision().ID
+		if (startID != 0 && before(id, startID)) || (endID != 0 && before(endID, id)) {
+			continue
+		}
+		if continueID != 0 && before(id, continueID) {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+func pageFields(page *APIPage) map[string]interface{} {
+	return map[string]interface{}{
+		"pageid": page.ID,
+		"ns":     page.NS,
+		"title":  page.Title,
+	}
+}
+
+// revisionFields returns the properties of a revision in rvprop
+func revisionFields(ref revisionRef, props map[string]bool, slots bool) map[string]interface{} {
+	rev := ref.revision()
+	fields := map[string]interface{}{}
+
+	if props["ids"] {
+		fields["revid"] = rev.ID
+		fields["parentid"] = 0
+		if parent, ok := ref.parent(); ok {
+			fields["parentid"] = parent.revision().ID
+		}
+	}
+	if props["timestamp"] {
+		fields["timestamp"] = formatTimestamp(rev.Timestamp)
+	}
+	if props["flags"] {
+		fields["minor"] = rev.Minor
+	}
+	if props["size"] {
+		fields["size"] = len(rev.Text)
+	}
+	if props["user"] || props["userid"] {
+		if rev.UserHidden {
+			fields["userhidden"] = true
+		} else {
+			if props["user"] {
+				fields["user"] = rev.User
+			}
+			if props["userid"] {
+				fields["userid"] = rev.UserID
+			}
+		}
+	}
+	if props["comment"] {
+		if rev.CommentHidden {
+			fields["commenthidden"] = true
+		} else {
+			fields["comment"] = rev.Comment
+		}
+	}
+	if rev.Suppressed {
+		fields["suppressed"] = true
+	}
+
+	if props["content"] {
+		content := map[string]interface{}{
+			"contentmodel":  "wikitext",
+			"contentformat": "text/x-wiki",
+			"content":       rev.Text,
+		}
+		if rev.TextHidden {
+			content = map[string]interface{}{"texthidden": true}
+		}
+
+		if slots {
+			fields["slots"] = map[string]interface{}{diffs.MainSlot: content}
+		} else {
+			for key, value := range content {
+				fields[key] = value
+			}
+		}
+	}
+	return fields
+}
+
+// limit parses a limit parameter, which is capped at the server's limit
+func (s *APIServer) limit(value string, def int) (int, *apiError) {
+	switch value {
+	case "":
+		return def, nil
+	case "max":
+		return s.options.Limit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, &apiError{"badinteger", fmt.Sprintf("Invalid value \"%s\" for integer parameter.", value)}
+	}
+	if limit > s.options.Limit {
+		return s.options.Limit, nil
+	}
+	return limit, nil
+}
+
+func noSuchRevision(id string) *apiError {
+	return &apiError{"nosuchrevid", fmt.Sprintf("There is no revision with ID %s.", id)}
+}
+
+func unrecognized(param string, value string) *apiError {
+	return &apiError{"badvalue", fmt.Sprintf("Unrecognized value for parameter \"%s\": %s.", param, value)}
+}
+
+// splitParam splits a multi-value parameter, such as "ids|timestamp"
+func splitParam(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, "|")
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,54 @@
+package wikitest
+
+import (
+	"io"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcrecording"
+)
+
+// ReadRecording reads every record of a recording made with rcrecord, such as
+// a fixture in testdata
+func ReadRecording(path string) ([]rcrecording.Record, error) {
+	r, err := rcrecording.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	records := []rcrecording.Record{}
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// SendRecords sends the EventStreams events of a recording, skipping records
+// from other sources
+func (s *StreamServer) SendRecords(records []rcrecording.Record) {
+	for _, record := range records {
+		if record.Source == rcrecording.SourceSSE {
+			s.Send(StreamEvent{ID: record.ID, Data: record.Data})
+		}
+	}
+}
+
+// SendRecords sends the IRC lines of a recording, skipping records from other
+// sources
+func (s *IRCServer) SendRecords(records []rcrecording.Record) error {
+	for _, record := range records {
+		if record.Source != rcrecording.SourceIRC {
+			continue
+		}
+		err := s.Send(record.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package wikitest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// ServerName is the name the IRCServer gives itself
+const ServerName = "irc.wikimedia.org"
+
+// IRCServer emulates irc.wikimedia.org, which welcomes every client, lets
+// them join any channel, and sends each channel the lines it is given.
+// Clients may log in with SASL PLAIN once accounts are added.
+type IRCServer struct {
+	listener net.Listener
+
+	mux      sync.Mutex
+	clients  map[*ircClient]struct{}
+	accounts map[string]string
+	joined   chan struct{}
+}
+
+// ircClient is a connection to an IRCServer
+type ircClient struct {
+	conn     net.Conn
+	mux      sync.Mutex
+	nick     string
+	user     string
+	welcomed bool
+	channels map[string]bool
+
+	// negotiating holds registration until CAP END
+	negotiating bool
+	account     string
+}
+
+// NewIRCServer starts an IRCServer listening on addr, such as
+// "127.0.0.1:0" for any free port
+func NewIRCServer(addr string) (*IRCServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &IRCServer{
+		listener: listener,
+		clients:  make(map[*ircClient]struct{}),
+		accounts: make(map[string]string),
+		joined:   make(chan struct{}, 1),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// AddAccount adds an account clients can log in to with SASL. The server
+// only offers the sasl capability once it has accounts.
+func (s *IRCServer) AddAccount(user string, pass string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.accounts[user] = pass
+}
+
+// Addr returns the address the server listens on
+func (s *IRCServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, disconnecting every client
+func (s *IRCServer) Close() error {
+	err := s.listener.Close()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for client := range s.clients {
+		client.conn.Close()
+	}
+	return err
+}
+
+// Disconnect drops the clients in a channel, or every client when channel is
+// empty, as when a connection is lost
+func (s *IRCServer) Disconnect(channel string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for client := range s.clients {
+		client.mux.Lock()
+		joined := channel == "" || client.channels[channel]
+		client.mux.Unlock()
+		if joined {
+			client.conn.Close()
+		}
+	}
+}
+
+func (s *IRCServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		client := &ircClient{conn: conn, channels: make(map[string]bool)}
+		s.mux.Lock()
+		s.clients[client] = struct{}{}
+		s.mux.Unlock()
+		go s.serve(client)
+	}
+}
+
+func (s *IRCServer) serve(c *ircClient) {
+	defer func() {
+		s.mux.Lock()
+		delete(s.clients, c)
+		s.mux.Unlock()
+		c.conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		m, err := irc.ParseMessage(scanner.Text())
+		if err != nil {
+			continue
+		}
+		if !s.handle(c, m) {
+			return
+		}
+	}
+}
+
+// handle handles a message from a client, reporting whether to stay
+// connected
+func (s *IRCServer) handle(c *ircClient, m *irc.Message) bool {
+	switch m.Command {
+	case "NICK":
+		c.nick = m.Trailing()
+		s.welcome(c)
+	case "USER":
+		if len(m.Params) > 0 {
+			c.user = m.Params[0]
+		}
+		s.welcome(c)
+	case "CAP":
+		s.handleCap(c, m)
+	case "AUTHENTICATE":
+		s.authenticate(c, m)
+	case "PING":
+		c.write(":" + ServerName + " PONG " + ServerName + " :" + m.Trailing())
+	case "JOIN":
+		if len(m.Params) == 0 {
+			return true
+		}
+		for _, channel := range strings.Split(m.Params[0], ",") {
+			c.mux.Lock()
+			c.channels[channel] = true
+			c.mux.Unlock()
+			c.write(":" + c.nick + "!~" + c.user + "@localhost JOIN " + channel)
+		}
+		select {
+		case s.joined <- struct{}{}:
+		default:
+		}
+	case "QUIT":
+		return false
+	}
+	return true
+}
+
+// handleCap negotiates capabilities, of which only sasl is supported
+func (s *IRCServer) handleCap(c *ircClient, m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+
+	offered := ""
+	if s.hasAccounts() {
+		offered = "sasl"
+	}
+
+	switch m.Params[0] {
+	case "LS":
+		c.negotiating = true
+		c.write(":" + ServerName + " CAP " + c.target() + " LS :" + offered)
+	case "REQ":
+		c.negotiating = true
+		requested := m.Trailing()
+		if offered != "" && requested == offered {
+			c.write(":" + ServerName + " CAP " + c.target() + " ACK :" + requested)
+		} else {
+			c.write(":" + ServerName + " CAP " + c.target() + " NAK :" + requested)
+		}
+	case "END":
+		c.negotiating = false
+		s.welcome(c)
+	}
+}
+
+// authenticate performs SASL PLAIN authentication
+func (s *IRCServer) authenticate(c *ircClient, m *irc.Message) {
+	if len(m.Params) == 0 {
+		return
+	}
+
+	if m.Params[0] == "PLAIN" {
+		c.write("AUTHENTICATE +")
+		return
+	}
+
+	if m.Params[0] == "*" {
+		c.write(":" + ServerName + " 906 " + c.target() + " :SASL authentication aborted")
+		return
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(m.Params[0])
+	parts := strings.Split(string(payload), "\x00")
+	if err != nil || len(parts) != 3 || !s.checkAccount(parts[1], parts[2]) {
+		c.write(":" + ServerName + " 904 " + c.target() + " :SASL authentication failed")
+		return
+	}
+
+	c.mux.Lock()
+	c.account = parts[1]
+	c.mux.Unlock()
+	c.write(":" + ServerName + " 900 " + c.target() + " " + c.target() + "!~" + c.user + "@localhost " + parts[1] + " :You are now logged in as " + parts[1])
+	c.write(":" + ServerName + " 903 " + c.target() + " :SASL authentication successful")
+}
+
+func (s *IRCServer) hasAccounts() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.accounts) > 0
+}
+
+func (s *IRCServer) checkAccount(user string, pass string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	want, ok := s.accounts[user]
+	return ok && want == pass
+}
+
+// LoggedIn returns the number of clients logged in with SASL
+func (s *IRCServer) LoggedIn() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	loggedIn := 0
+	for client := range s.clients {
+		client.mux.Lock()
+		if client.account != "" {
+			loggedIn++
+		}
+		client.mux.Unlock()
+	}
+	return loggedIn
+}
+
+// Clients returns the number of connected clients
+func (s *IRCServer) Clients() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.clients)
+}
+
+// welcome welcomes a client once it has registered
+func (s *IRCServer) welcome(c *ircClient) {
+	if c.welcomed || c.negotiating || c.nick == "" || c.user == "" {
+		return
+	}
+	c.welcomed = true
+	c.write(":" + ServerName + " 001 " + c.nick + " :Welcome to the Wikimedia IRC network " + c.nick)
+}
+
+// target is how the server addresses the client, which is "*" until it has
+// a nick
+func (c *ircClient) target() string {
+	if c.nick == "" {
+		return "*"
+	}
+	return c.nick
+}
+
+func (c *ircClient) write(line string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Send sends a line, such as one recorded from irc.wikimedia.org, to every
+// client in the channel it is addressed to
+func (s *IRCServer) Send(line string) error {
+	m, err := irc.ParseMessage(line)
+	if err != nil {
+		return err
+	}
+	if len(m.Params) == 0 {
+		return nil
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for client := range s.clients {
+		client.mux.Lock()
+		joined := client.channels[m.Params[0]]
+		client.mux.Unlock()
+		if joined {
+			client.write(line)
+		}
+	}
+	return nil
+}
+
+// Joined returns the number of clients in a channel, or in any channel when
+// channel is empty
+func (s *IRCServer) Joined(channel string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	joined := 0
+	for client := range s.clients {
+		client.mux.Lock()
+		if client.channels[channel] || (channel == "" && len(client.channels) > 0) {
+			joined++
+		}
+		client.mux.Unlock()
+	}
+	return joined
+}
+
+// WaitForJoin waits until at least n clients have joined a channel,
+// reporting whether they joined before the timeout
+func (s *IRCServer) WaitForJoin(channel string, n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for s.Joined(channel) < n {
+		select {
+		case <-s.joined:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
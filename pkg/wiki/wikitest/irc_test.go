@@ -0,0 +1,137 @@
+package wikitest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIRCServer(t *testing.T) {
+	s, err := NewIRCServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(conn)
+
+	expect := func(prefix string) {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("got %v, want %q", lines.Err(), prefix)
+		}
+		if !strings.HasPrefix(lines.Text(), prefix) {
+			t.Fatalf("got %q, want %q", lines.Text(), prefix)
+		}
+	}
+
+	conn.Write([]byte("NICK tester\r\nUSER tester 0 * :Tester\r\n"))
+	expect(":irc.wikimedia.org 001 tester ")
+
+	conn.Write([]byte("JOIN #en.wikipedia\r\n"))
+	expect(":tester!~tester@localhost JOIN #en.wikipedia")
+	if !s.WaitForJoin("#en.wikipedia", 1, 5*time.Second) {
+		t.Fatal("client did not join")
+	}
+
+	s.Send(":rc-pmtpa!~rc-pmtpa@localhost PRIVMSG #de.wikipedia :ignored")
+	s.Send(":rc-pmtpa!~rc-pmtpa@localhost PRIVMSG #en.wikipedia :change")
+	expect(":rc-pmtpa!~rc-pmtpa@localhost PRIVMSG #en.wikipedia :change")
+
+	conn.Write([]byte("PING :123\r\n"))
+	expect(":irc.wikimedia.org PONG irc.wikimedia.org :123")
+}
+
+func TestIRCServerSASL(t *testing.T) {
+	tests := []struct {
+		name   string
+		pass   string
+		want   string
+		logged int
+	}{
+		{name: "success", pass: "secret", want: ":irc.wikimedia.org 903 tester ", logged: 1},
+		{name: "failure", pass: "wrong", want: ":irc.wikimedia.org 904 tester ", logged: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewIRCServer("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			s.AddAccount("tester", "secret")
+
+			conn, err := net.Dial("tcp", s.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			lines := bufio.NewScanner(conn)
+
+			expect := func(prefix string) {
+				t.Helper()
+				if !lines.Scan() {
+					t.Fatalf("got %v, want %q", lines.Err(), prefix)
+				}
+				if !strings.HasPrefix(lines.Text(), prefix) {
+					t.Fatalf("got %q, want %q", lines.Text(), prefix)
+				}
+			}
+
+			conn.Write([]byte("CAP REQ :sasl\r\nNICK tester\r\nUSER tester 0 * :Tester\r\n"))
+			expect(":irc.wikimedia.org CAP * ACK :sasl")
+
+			conn.Write([]byte("AUTHENTICATE PLAIN\r\n"))
+			expect("AUTHENTICATE +")
+
+			payload := base64.StdEncoding.EncodeToString([]byte("tester\x00tester\x00" + tt.pass))
+			conn.Write([]byte("AUTHENTICATE " + payload + "\r\n"))
+			if tt.logged > 0 {
+				expect(":irc.wikimedia.org 900 tester ")
+			}
+			expect(tt.want)
+
+			conn.Write([]byte("CAP END\r\n"))
+			expect(":irc.wikimedia.org 001 tester ")
+
+			if got := s.LoggedIn(); got != tt.logged {
+				t.Errorf("got %d clients logged in, want %d", got, tt.logged)
+			}
+		})
+	}
+}
+
+func TestIRCServerNoSASL(t *testing.T) {
+	s, err := NewIRCServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(conn)
+
+	conn.Write([]byte("CAP REQ :sasl\r\nNICK tester\r\nUSER tester 0 * :Tester\r\n"))
+	if !lines.Scan() {
+		t.Fatal(lines.Err())
+	}
+	if want := ":irc.wikimedia.org CAP * NAK :sasl"; lines.Text() != want {
+		t.Errorf("got %q, want %q", lines.Text(), want)
+	}
+}
@@ -0,0 +1,272 @@
+// Package wikitest provides in-process fakes of Wikimedia services, for
+// testing listeners and replaying recordings without network access
+package wikitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/wiki"
+	wikisse "github.com/leebradley/wikiedit-monitor-fast/pkg/wiki/recentchanges/sse"
+	"github.com/r3labs/sse"
+)
+
+// StreamEvent is an event sent by a StreamServer
+type StreamEvent struct {
+	ID   string
+	Data string
+}
+
+// StreamServer is an EventStreams compatible server, sending the events it is
+// given to every connected client. Every event is kept, so clients sending
+// Last-Event-ID resume after the event they last received.
+type StreamServer struct {
+	mux     sync.Mutex
+	clients map[*streamClient]struct{}
+	history []StreamEvent
+	resumed []string
+	joined  chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// streamClient is a connection to a StreamServer
+type streamClient struct {
+	events chan StreamEvent
+	drop   chan struct{}
+}
+
+// NewStreamServer creates a StreamServer, which is served with net/http or
+// httptest
+func NewStreamServer() *StreamServer {
+	return &StreamServer{
+		clients: make(map[*streamClient]struct{}),
+		joined:  make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close ends every stream, so the server serving them can shut down
+func (s *StreamServer) Close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
+
+// Send sends an event to every connected client without waiting for them.
+// Clients too far behind to take the event are dropped, as EventStreams drops
+// slow clients, so they reconnect and resume after the last event they
+// received.
+func (s *StreamServer) Send(e StreamEvent) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.history = append(s.history, e)
+	for client := range s.clients {
+		select {
+		case client.events <- e:
+		default:
+			delete(s.clients, client)
+			close(client.drop)
+		}
+	}
+}
+
+// SendCanary sends a canary event, which EventStreams sends to check the
+// stream is flowing. It looks like a change to enwiki except for its domain.
+func (s *StreamServer) SendCanary(id string) {
+	s.Send(CanaryEvent(id, time.Now()))
+}
+
+// CanaryEvent creates a canary recentchange event
+func CanaryEvent(id string, dt time.Time) StreamEvent {
+	data, _ := json.Marshal(map[string]interface{}{
+		"$schema": "/mediawiki/recentchange/1.0.0",
+		"meta": map[string]string{
+			"domain": wikisse.CanaryDomain,
+			"stream": "mediawiki.recentchange",
+			"id":     id,
+			"dt":     dt.UTC().Format(time.RFC3339),
+		},
+		"type":      "edit",
+		"title":     "Canary",
+		"timestamp": dt.Unix(),
+		"user":      "Canary",
+		"wiki":      "enwiki",
+	})
+	return StreamEvent{ID: id, Data: string(data)}
+}
+
+// Disconnect drops every connection without ending its stream, as when
+// EventStreams restarts, so clients reconnect sending Last-Event-ID
+func (s *StreamServer) Disconnect() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client.drop)
+	}
+}
+
+// Clients returns the number of connected clients
+func (s *StreamServer) Clients() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.clients)
+}
+
+// LastEventIDs returns the Last-Event-ID sent by every connection so far, in
+// order, which is empty for connections that did not send one
+func (s *StreamServer) LastEventIDs() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string(nil), s.resumed...)
+}
+
+// WaitForClients waits until at least n clients are connected, reporting
+// whether they connected before the timeout
+func (s *StreamServer) WaitForClients(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for s.Clients() < n {
+		select {
+		case <-s.joined:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := &streamClient{
+		events: make(chan StreamEvent, 1024),
+		drop:   make(chan struct{}),
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	s.mux.Lock()
+	backlog := s.after(lastID)
+	s.clients[client] = struct{}{}
+	s.resumed = append(s.resumed, lastID)
+	s.mux.Unlock()
+	select {
+	case s.joined <- struct{}{}:
+	default:
+	}
+
+	defer func() {
+		s.mux.Lock()
+		delete(s.clients, client)
+		s.mux.Unlock()
+	}()
+
+	for _, e := range backlog {
+		_, err := w.Write(formatEvent(e))
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-client.events:
+			_, err := w.Write(formatEvent(e))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-client.drop:
+			abort(w)
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// after returns the events sent after the event with the given ID, which is
+// none when the ID is empty or unknown
+func (s *StreamServer) after(id string) []StreamEvent {
+	if id == "" {
+		return nil
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].ID == id {
+			return append([]StreamEvent(nil), s.history[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// abort closes the connection mid stream. Ending the response instead would
+// end it cleanly, which clients take to mean the stream is over.
+func abort(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// formatEvent formats an event as EventStreams sends it
+func formatEvent(e StreamEvent) []byte {
+	var b strings.Builder
+	b.WriteString("event: message\n")
+	if e.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", e.ID)
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// sseClient subscribes to a StreamServer in place of the URL it is given
+type sseClient struct {
+	server *url.URL
+}
+
+// NewSSEClient creates a wiki.SSEClient which connects to the server at
+// serverURL, such as an httptest.Server serving a StreamServer, keeping the
+// path and query of the URLs it subscribes to
+func NewSSEClient(serverURL string) (wiki.SSEClient, error) {
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return &sseClient{server: server}, nil
+}
+
+func (c *sseClient) Subscribe(rawurl string, handler func(msg *sse.Event)) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	u.Scheme = c.server.Scheme
+	u.Host = c.server.Host
+
+	client := sse.NewClient(u.String())
+	return client.Subscribe("messages", handler)
+}
@@ -0,0 +1,159 @@
+package wikitest
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leebradley/wikiedit-monitor-fast/pkg/rcrecording"
+	"github.com/r3labs/sse"
+)
+
+func TestStreamServer(t *testing.T) {
+	s := NewStreamServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer s.Close()
+
+	events := make(chan *sse.Event, 10)
+	client := sse.NewClient(server.URL)
+	go client.Subscribe("messages", func(msg *sse.Event) {
+		events <- msg
+	})
+
+	if !s.WaitForClients(1, 5*time.Second) {
+		t.Fatal("client did not connect")
+	}
+	s.Send(StreamEvent{ID: "1", Data: `{"title":"A"}`})
+
+	select {
+	case e := <-events:
+		if string(e.ID) != "1" || string(e.Data) != `{"title":"A"}` {
+			t.Errorf("got event %q %q", e.ID, e.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestStreamServerSlowClient(t *testing.T) {
+	s := NewStreamServer()
+	defer s.Close()
+
+	// A client whose buffer is full, which is never drained
+	slow := &streamClient{events: make(chan StreamEvent), drop: make(chan struct{})}
+	s.mux.Lock()
+	s.clients[slow] = struct{}{}
+	s.mux.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		s.Send(StreamEvent{ID: "1", Data: "dropped"})
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked on a slow client")
+	}
+	select {
+	case <-slow.drop:
+	default:
+		t.Error("slow client was not dropped")
+	}
+	if s.Clients() != 0 {
+		t.Errorf("got %d clients, want 0", s.Clients())
+	}
+}
+
+func TestStreamServerResume(t *testing.T) {
+	s := NewStreamServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer s.Close()
+
+	client, err := NewSSEClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Send(StreamEvent{ID: "1", Data: "before"})
+
+	events := make(chan *sse.Event, 10)
+	go client.Subscribe("https://stream.wikimedia.org/v2/stream/recentchange", func(msg *sse.Event) {
+		// The client sends an empty event when the connection drops
+		if len(msg.Data) > 0 {
+			events <- msg
+		}
+	})
+
+	expect := func(id string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if string(e.ID) != id {
+				t.Fatalf("got event %q, want %q", e.ID, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %q", id)
+		}
+	}
+
+	if !s.WaitForClients(1, 5*time.Second) {
+		t.Fatal("client did not connect")
+	}
+	s.Send(StreamEvent{ID: "2", Data: "live"})
+	expect("2")
+
+	s.Disconnect()
+	s.Send(StreamEvent{ID: "3", Data: "missed"})
+	expect("3")
+
+	if !s.WaitForClients(1, 5*time.Second) {
+		t.Fatal("client did not reconnect")
+	}
+	s.Send(StreamEvent{ID: "4", Data: "live"})
+	expect("4")
+
+	want := []string{"", "2"}
+	if got := s.LastEventIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got Last-Event-IDs %q, want %q", got, want)
+	}
+}
+
+func TestSendRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	w, err := rcrecording.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []rcrecording.Record{
+		{Source: rcrecording.SourceSSE, ID: "1", Data: `{"title":"A"}`},
+		{Source: rcrecording.SourceIRC, Subject: "#en.wikipedia", Data: ":rc!~rc@localhost PRIVMSG #en.wikipedia :B"},
+		{Source: rcrecording.SourceSSE, ID: "2", Data: `{"title":"C"}`},
+	}
+	for _, record := range records {
+		w.Write(record)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d records, want %d", len(got), len(records))
+	}
+
+	s := NewStreamServer()
+	s.SendRecords(got)
+	want := []StreamEvent{{ID: "1", Data: `{"title":"A"}`}, {ID: "2", Data: `{"title":"C"}`}}
+	if !reflect.DeepEqual(s.history, want) {
+		t.Errorf("got events %+v, want %+v", s.history, want)
+	}
+}